@@ -1,18 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql-redis/river"
-	"gopkg.in/birkirb/loggers.v1/log"
+	log "github.com/sirupsen/logrus"
 )
 
 var configFile = flag.String("config", "/Users/jianghaiping/godev/src/github.com/siddontang/go-mysql-redis/etc/river.toml", "go-mysql-redis config file")
+var configFormat = flag.String("config_format", "", "config format: toml, yaml or json, default by the file extension")
 var my_addr = flag.String("my_addr", "", "MySQL addr")
 var my_user = flag.String("my_user", "", "MySQL user")
 var my_pass = flag.String("my_pass", "", "MySQL password")
@@ -21,25 +26,32 @@ var data_dir = flag.String("data_dir", "", "path for go-mysql-redis to save data
 var server_id = flag.Int("server_id", 0, "MySQL server id, as a pseudo slave")
 var flavor = flag.String("flavor", "", "flavor: mysql or mariadb")
 var execution = flag.String("exec", "", "mysqldump execution path")
-var logLevel = flag.String("log_level", "info", "log level")
+var logLevel = flag.String("log_level", "", "log level")
+var replayDeadLetters = flag.Bool("replay_dead_letters", false, "apply the events in the dead-letter queue again, then exit")
+var checkConfig = flag.Bool("check_config", false, "check the config and the MySQL settings, then exit")
+var checkRedis = flag.Bool("check", false, "compare the rows in MySQL with the keys in Redis, print the mismatches, then exit")
+var repair = flag.Bool("repair", false, "with -check, rewrite the mismatched keys and delete the extra ones")
+var exportSnapshot = flag.String("export_snapshot", "", "write the keys of the rule -snapshot_rule with their fields to the file, then exit")
+var snapshotRule = flag.String("snapshot_rule", "", "the rule of -export_snapshot, schema.table")
+var diffSnapshot = flag.String("diff_snapshot", "", "diff the snapshot file with the one after a comma, or with the keys in Redis, then exit")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 
-	level := log.ParseLevel(*logLevel)
-	log.SetLevel(level)
-
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
 		os.Kill,
 		os.Interrupt,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	cfg, err := river.NewConfigWithFile(*configFile)
+	// SIGHUP reads the rotated passwords again
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	cfg, err := river.NewConfigWithFileFormat(*configFile, *configFormat)
 	if err != nil {
 		println(errors.ErrorStack(err))
 		return
@@ -77,25 +89,146 @@ func main() {
 		cfg.DumpExec = *execution
 	}
 
-	r, err := river.NewRiver(cfg)
+	if len(*logLevel) > 0 {
+		cfg.LogLevel = *logLevel
+	}
+
+	if err = river.SetupLog(cfg); err != nil {
+		println(errors.ErrorStack(err))
+		return
+	}
+
+	if *checkConfig {
+		os.Exit(check(cfg))
+	}
+
+	if files := strings.Split(*diffSnapshot, ","); len(files) == 2 {
+		diff, err := river.DiffSnapshotFiles(files[0], files[1])
+		os.Exit(printDiff(diff, err))
+	}
+
+	r, err := river.New(cfg)
 	if err != nil {
 		println(errors.ErrorStack(err))
 		return
 	}
 
+	if *replayDeadLetters {
+		n, err := r.ReplayDeadLetters(context.Background())
+		r.Close()
+		println(fmt.Sprintf("replayed %d dead letters", n))
+		if err != nil {
+			println(errors.ErrorStack(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(*exportSnapshot) > 0 {
+		n, err := r.ExportSnapshot(context.Background(), *snapshotRule, *exportSnapshot)
+		r.Close()
+		if err != nil {
+			println(errors.ErrorStack(err))
+			os.Exit(1)
+		}
+		println(fmt.Sprintf("exported %d keys", n))
+		return
+	}
+
+	if len(*diffSnapshot) > 0 {
+		diff, err := r.DiffLiveSnapshot(context.Background(), *diffSnapshot)
+		r.Close()
+		os.Exit(printDiff(diff, err))
+	}
+
+	if *checkRedis {
+		report, err := r.Check(context.Background(), *repair)
+		r.Close()
+		if report != nil {
+			var buf bytes.Buffer
+			report.WriteTo(&buf)
+			print(buf.String())
+		}
+		if err != nil {
+			println(errors.ErrorStack(err))
+			os.Exit(1)
+		}
+		if !report.Ok() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	done := make(chan struct{}, 1)
 	go func() {
-		r.Run()
+		r.Run(context.Background())
 		done <- struct{}{}
 	}()
 
-	select {
-	case n := <-sc:
-		log.Infof("receive signal %v, closing", n)
-	case <-r.Ctx().Done():
-		log.Infof("context is done with %v, closing", r.Ctx().Err())
+loop:
+	for {
+		select {
+		case <-hup:
+			details := map[string]interface{}{"signal": "SIGHUP"}
+			if err := r.ReloadSecrets(); err != nil {
+				log.Errorf("reload secrets err %v", err)
+				details["err"] = err.Error()
+			}
+			r.Audit("reload_secrets", river.AuditSourceSignal, details)
+		case n := <-sc:
+			log.Infof("receive signal %v, closing", n)
+			break loop
+		case <-r.Ctx().Done():
+			log.Infof("context is done with %v, closing", r.Ctx().Err())
+			break loop
+		}
 	}
 
 	r.Close()
 	<-done
 }
+
+// check prints all the problems of the config and the MySQL settings,
+// it returns the exit code.
+func check(cfg *river.Config) int {
+	code := 0
+	if err := cfg.ResolveSecrets(); err != nil {
+		println(err.Error())
+		return 1
+	}
+	for _, err := range []error{cfg.Validate(), river.CheckMaster(context.Background(), cfg)} {
+		if err == nil {
+			continue
+		}
+
+		code = 1
+		if errs, ok := errors.Cause(err).(river.ConfigErrors); ok {
+			for _, err := range errs {
+				println(err.Error())
+			}
+		} else {
+			println(err.Error())
+		}
+	}
+
+	if code == 0 {
+		println("config is ok")
+	}
+	return code
+}
+
+// printDiff prints the differences of the snapshots, it returns the exit code.
+func printDiff(diff []river.Mismatch, err error) int {
+	if err != nil {
+		println(errors.ErrorStack(err))
+		return 1
+	}
+	for _, m := range diff {
+		println(m.String())
+	}
+	println(fmt.Sprintf("%d keys differ", len(diff)))
+	if len(diff) > 0 {
+		return 1
+	}
+	return 0
+}
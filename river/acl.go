@@ -0,0 +1,294 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// How the Redis ACL is checked on startup, like check_master.
+const (
+	CheckRedisACLOff   = "off"
+	CheckRedisACLWarn  = "warn"
+	CheckRedisACLError = "error"
+)
+
+// redisACL is the minimal Redis ACL of the river: the commands, with
+// sample arguments for ACL DRYRUN, and the key patterns.
+type redisACL struct {
+	cmds []redisCmd
+	keys []string
+	// complete is false if a transform script or a RowMapper may run
+	// other commands
+	complete bool
+}
+
+// requiredRedisACL returns the commands and keys the config and the
+// prepared rules require.
+func (r *River) requiredRedisACL() *redisACL {
+	acl := &redisACL{complete: r.mapper == nil}
+	cmds := make(map[string]redisCmd)
+	keys := make(map[string]bool)
+	add := func(name string, args ...interface{}) {
+		cmds[name] = newRedisCmd(name, args...)
+	}
+
+	add("PING")
+	add("INFO", "memory")
+	add("MULTI")
+	add("EXEC")
+	add("DISCARD")
+
+	for _, rule := range r.rules {
+		for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+			key := rule.keyPrefix + ":1"
+			if rule.script != nil {
+				acl.complete = false
+			}
+			if rule.hasHashOutput() {
+				keys[rule.keyPrefix+":*"] = true
+				for _, c := range rule.Conditions {
+					if len(c.keyPrefix) > 0 {
+						keys[c.keyPrefix+":*"] = true
+					}
+				}
+				add("HMSET", key, "field", "value")
+				add("HDEL", key, "field")
+				add("DEL", key)
+			}
+			if rule.hasTTL() {
+				add("EXPIRE", key, 60)
+				add("PERSIST", key)
+			}
+			if rule.SetFormat == SetFormatRedisSet || rule.ListFormat == ListFormatRedisSet && len(rule.ListColumns) > 0 {
+				keys[rule.keyPrefix+":*"] = true
+				add("DEL", key)
+				add("SADD", key+":tags", "a")
+			}
+			if len(rule.IndexColumns) > 0 {
+				keys[rule.indexPrefix+":*"] = true
+				add("SADD", rule.indexPrefix+":a:b", "1")
+				add("SREM", rule.indexPrefix+":a:b", "1")
+			}
+			if len(rule.RangeIndexColumns) > 0 {
+				keys[rule.indexPrefix+":*"] = true
+				add("ZADD", rule.indexPrefix+":a", 0, "1")
+				add("ZREM", rule.indexPrefix+":a", "1")
+			}
+			if len(rule.UniqueColumns) > 0 {
+				keys[rule.lookupPrefix+":*"] = true
+				add("SET", rule.lookupPrefix+":a:b", "1", "PX", 60000)
+				add("EVAL", lookupDeleteScript, 1, rule.lookupPrefix+":a:b", "1")
+			}
+			for _, inv := range rule.Invalidations {
+				if len(inv.Key) > 0 {
+					keys[columnKeyPattern(inv.Key)] = true
+					add("DEL", "key")
+					if isKeyPattern(inv.Key) {
+						add("SCAN", 0, "MATCH", "*", "COUNT", 1000)
+					}
+				}
+				if len(inv.Set) > 0 {
+					keys[columnKeyPattern(inv.Set)] = true
+					keys[inv.SetKeyPrefix+":*"] = true
+					add("SMEMBERS", "set")
+					add("DEL", "key")
+				}
+			}
+			for _, ro := range rule.Rollups {
+				pattern := columnKeyPattern(strings.Replace(ro.Key, "{bucket}", "*", -1))
+				keys[pattern] = true
+				add("HINCRBY", pattern, "count", 1)
+				add("HINCRBYFLOAT", pattern, "sum", "1.5")
+				add("EXPIRE", pattern, 60)
+			}
+			if rule.TrackRows {
+				all, count := trackKeys(rule)
+				keys[all] = true
+				keys[count] = true
+				add("EVAL", trackAddScript, 2, all, count, "1")
+			}
+			if rule.OversizePolicy == OversizePolicyChunk {
+				keys[rule.keyPrefix+":*"] = true
+				keys["{"+rule.keyPrefix+":*"] = true
+				add("DEL", chunkKey(key, "body"))
+				add("RPUSH", chunkKey(key, "body"), "a")
+			}
+			if rule.WritePolicy == WritePolicySkip || r.c.RedisCluster {
+				add("EXISTS", key)
+			}
+			for _, o := range rule.Outputs {
+				switch o.Type {
+				case OutputSet:
+					keys[o.Key] = true
+					add("SADD", o.Key, key)
+					add("SREM", o.Key, key)
+				case OutputStream:
+					keys[o.Key] = true
+					add("XADD", o.Key, "*", "_key", key)
+				case OutputGeo:
+					keys[o.Key] = true
+					add("GEOADD", o.Key, 0, 0, key)
+					add("ZREM", o.Key, key)
+				case OutputJoin:
+					pattern := columnKeyPattern(o.Key)
+					keys[pattern] = true
+					add("SADD", pattern, "a")
+					add("SREM", pattern, "a")
+				case OutputTop:
+					pattern := columnKeyPattern(o.Key)
+					keys[pattern] = true
+					add("ZADD", pattern, 0, key)
+					add("ZREM", pattern, key)
+					add("ZREMRANGEBYRANK", pattern, 0, -o.MaxLen-1)
+				case OutputNested:
+					pattern := columnKeyPattern(o.Key)
+					keys[pattern] = true
+					add("EVAL", nestedScript, 1, pattern, o.Field, key, "")
+				}
+			}
+		}
+	}
+
+	if key := r.c.DeadLetterKey; len(key) > 0 {
+		keys[key] = true
+		if r.c.DeadLetterType == DeadLetterTypeStream {
+			add("XADD", key, "*", "event", "{}")
+			add("XRANGE", key, "-", "+", "COUNT", 1)
+			add("XDEL", key, "0-1")
+		} else {
+			add("RPUSH", key, "{}")
+			add("LINDEX", key, 0)
+			add("LPOP", key)
+		}
+	}
+
+	if r.c.ReplayGuard {
+		keys[r.c.ReplayGuardKey] = true
+		add("HGETALL", r.c.ReplayGuardKey)
+		add("HMSET", r.c.ReplayGuardKey, "name", "mysql-bin.000001", "pos", 4)
+	}
+
+	if r.c.RedisOOMPolicy == RedisOOMPolicyTTL {
+		add("SCAN", 0, "MATCH", "*", "COUNT", 1000)
+		add("TTL", "key")
+		add("EXPIRE", "key", 60)
+	}
+
+	if r.c.VerifySample > 0 {
+		add("HGETALL", "key")
+	}
+
+	if r.c.ReapInterval.Duration > 0 {
+		add("SCAN", 0, "MATCH", "*", "COUNT", 1000)
+		add("WATCH", "key")
+		add("UNWATCH")
+		add("TYPE", "key")
+	}
+
+	if r.c.KeyspaceInterval.Duration > 0 {
+		add("SCAN", 0, "MATCH", "*", "COUNT", 1000)
+		add("MEMORY", "USAGE", "key")
+	}
+
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		acl.cmds = append(acl.cmds, cmds[name])
+	}
+
+	for key := range keys {
+		acl.keys = append(acl.keys, key)
+	}
+	sort.Strings(acl.keys)
+	return acl
+}
+
+// String returns the rules of ACL SETUSER for the river user, like
+// "~test:t1:* +del +exec +hmset".
+func (a *redisACL) String() string {
+	rules := make([]string, 0, len(a.keys)+len(a.cmds))
+	for _, key := range a.keys {
+		rules = append(rules, "~"+key)
+	}
+	for _, cmd := range a.cmds {
+		rules = append(rules, "+"+strings.ToLower(cmd.Name))
+	}
+	return strings.Join(rules, " ")
+}
+
+// checkRedisACL checks the Redis user may run the commands the rules
+// require with ACL DRYRUN by check_redis_acl, it only logs the problems
+// for warn. Redis before 7.0, or a user not allowed to run ACL, can not
+// be checked.
+func (r *River) checkRedisACL() error {
+	switch r.c.CheckRedisACL {
+	case "", CheckRedisACLOff:
+		return nil
+	}
+
+	acl := r.requiredRedisACL()
+	log.Infof("minimal Redis ACL: %s", acl)
+	if !acl.complete {
+		log.Warnf("the transform scripts or the RowMapper may run other Redis commands, not checked")
+	}
+
+	user, err := redis.String(r.doRedis("ACL", "WHOAMI"))
+	if err != nil {
+		log.Warnf("can not check the Redis ACL, ACL WHOAMI err %v", err)
+		return nil
+	}
+
+	var errs ConfigErrors
+	for _, cmd := range acl.cmds {
+		reply, err := redis.String(r.doRedis("ACL", append([]interface{}{"DRYRUN", user, cmd.Name}, cmd.Args...)...))
+		if err != nil && strings.Contains(err.Error(), "unknown subcommand") {
+			log.Warnf("can not check the Redis ACL, ACL DRYRUN is not supported: %v", err)
+			return nil
+		}
+		if err == nil && reply == "OK" {
+			continue
+		}
+		if err != nil {
+			reply = err.Error()
+		}
+		errs = append(errs, errors.Errorf("Redis user %s can not run %s: %s", user, cmd.Name, reply))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	if r.c.CheckRedisACL == CheckRedisACLWarn {
+		for _, err := range errs {
+			log.Warnf("check Redis ACL: %v", err)
+		}
+		return nil
+	}
+	return errs
+}
+
+// redisACLHandler serves the minimal Redis ACL for the river user.
+type redisACLHandler struct {
+	r *River
+}
+
+func (h redisACLHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+
+	acl := h.r.requiredRedisACL()
+	buf.WriteString(fmt.Sprintf("ACL SETUSER <user> on ><password> resetkeys -@all %s\n", acl))
+	if !acl.complete {
+		buf.WriteString("# the transform scripts or the RowMapper may run other commands\n")
+	}
+
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,78 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// alerter posts Slack-compatible messages to the configured webhooks.
+// All methods are no-ops on a nil alerter.
+type alerter struct {
+	urls   []string
+	name   string
+	client *http.Client
+
+	wg sync.WaitGroup
+}
+
+func newAlerter(urls []string, name string) *alerter {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	return &alerter{
+		urls:   urls,
+		name:   name,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Alertf sends the message to all webhooks in the background.
+func (a *alerter) Alertf(format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+
+	text := fmt.Sprintf(format, args...)
+	if len(a.name) > 0 {
+		text = fmt.Sprintf("[%s] %s", a.name, text)
+	}
+
+	body, _ := json.Marshal(map[string]string{"text": text})
+
+	for _, url := range a.urls {
+		a.wg.Add(1)
+		go func(url string) {
+			defer a.wg.Done()
+			a.post(url, body)
+		}(url)
+	}
+}
+
+func (a *alerter) post(url string, body []byte) {
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("post alert to webhook %s err %v", url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Errorf("post alert to webhook %s err status %d", url, resp.StatusCode)
+	}
+}
+
+// Close waits for the pending alerts to be sent.
+func (a *alerter) Close() {
+	if a == nil {
+		return
+	}
+
+	a.wg.Wait()
+}
@@ -0,0 +1,94 @@
+package river
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// The sources of the audited operations besides the http clients.
+const (
+	AuditSourceAPI    = "api"
+	AuditSourceSignal = "signal"
+	AuditSourceRiver  = "river"
+)
+
+// auditLog records the operations changing what the river writes or from
+// where, as JSON lines in audit_log, or in the log with audit=true.
+type auditLog struct {
+	l *log.Logger
+	// the audit_log file, nil if it is the log
+	closer io.Closer
+}
+
+func newAuditLog(c *Config) *auditLog {
+	if len(c.AuditLog) == 0 {
+		return &auditLog{l: log.StandardLogger()}
+	}
+
+	f := &lumberjack.Logger{
+		Filename:   c.AuditLog,
+		MaxSize:    c.LogMaxSize,
+		MaxBackups: c.LogMaxBackups,
+		MaxAge:     c.LogMaxAge,
+	}
+	l := log.New()
+	l.Out = f
+	l.Formatter = &log.JSONFormatter{}
+	l.Level = log.InfoLevel
+	return &auditLog{l: l, closer: f}
+}
+
+// Record writes the operation op triggered by source with its details.
+func (a *auditLog) Record(op string, source string, details map[string]interface{}) {
+	if a == nil {
+		return
+	}
+
+	fields := log.Fields{"audit": true, "op": op, "source": source}
+	for k, v := range details {
+		fields[k] = v
+	}
+	a.l.WithFields(fields).Infof("audit %s by %s", op, source)
+}
+
+func (a *auditLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// Audit records an operation on the river, like pause or a rule change by
+// an admin endpoint of the application, with the source triggering it,
+// like AuditSourceAPI or HTTPAuditSource of the request.
+func (r *River) Audit(op string, source string, details map[string]interface{}) {
+	r.audit.Record(op, source, details)
+}
+
+// HTTPAuditSource returns the source of an http request for the audit
+// log, the client IP and the SHA-256 prefix of the bearer token, which
+// identifies the token without logging it.
+func HTTPAuditSource(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	source := "http " + ip
+
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(auth[len("Bearer "):]))
+		source += " token:" + hex.EncodeToString(sum[:4])
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		source += " cert:" + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return source
+}
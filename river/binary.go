@@ -0,0 +1,61 @@
+package river
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// The encodings of the BINARY, VARBINARY and BLOB columns.
+const (
+	// BinaryEncodingRaw writes the bytes as they are, the default.
+	BinaryEncodingRaw = "raw"
+	// BinaryEncodingBase64 writes the standard base64 of the bytes.
+	BinaryEncodingBase64 = "base64"
+	// BinaryEncodingHex writes the lowercase hex of the bytes.
+	BinaryEncodingHex = "hex"
+)
+
+// isBinaryColumn returns true for the BINARY, VARBINARY and BLOB columns,
+// which go-mysql reads as strings.
+func isBinaryColumn(col *schema.TableColumn) bool {
+	if col.Type != schema.TYPE_STRING {
+		return false
+	}
+	t := strings.ToLower(col.RawType)
+	return strings.HasPrefix(t, "binary") || strings.HasPrefix(t, "varbinary") || strings.Contains(t, "blob")
+}
+
+// binaryBytes returns the bytes of the binary column value, never decoded
+// by the charset.
+func binaryBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return []byte(transformString(value))
+}
+
+// binaryValue applies the rule max_binary_bytes to the bytes of the field,
+// then encodes them by binary_encoding. It returns false if the field is
+// not to be written.
+func (r *River) binaryValue(rule *Rule, field string, value []byte) (interface{}, bool, error) {
+	if rule.MaxBinaryBytes > 0 && len(value) > rule.MaxBinaryBytes {
+		if ok, err := r.oversize(rule, field, len(value), rule.MaxBinaryBytes, "max_binary_bytes"); !ok {
+			return nil, false, err
+		}
+		value = value[:rule.MaxBinaryBytes]
+	}
+
+	switch rule.BinaryEncoding {
+	case BinaryEncodingBase64:
+		return base64.StdEncoding.EncodeToString(value), true, nil
+	case BinaryEncodingHex:
+		return hex.EncodeToString(value), true, nil
+	}
+	return value, true, nil
+}
@@ -0,0 +1,111 @@
+package river
+
+import (
+	"github.com/juju/errors"
+)
+
+// ConfigBuilder builds a Config in Go for the programs embedding the River,
+// like
+//
+//	c, err := river.NewConfigBuilder().
+//		MySQL("127.0.0.1:3306", "root", "").
+//		Redis("127.0.0.1:6379").
+//		ServerID(1001).
+//		AddSource("test", "test_river").
+//		AddRule(&river.Rule{Schema: "test", Table: "test_river", NullPolicy: river.NullPolicyEmpty}).
+//		Build()
+type ConfigBuilder struct {
+	c Config
+}
+
+// NewConfigBuilder creates a ConfigBuilder with the same defaults as an empty TOML config.
+func NewConfigBuilder() *ConfigBuilder {
+	return new(ConfigBuilder)
+}
+
+// MySQL sets the MySQL address, user and password.
+func (b *ConfigBuilder) MySQL(addr string, user string, password string) *ConfigBuilder {
+	b.c.MyAddr = addr
+	b.c.MyUser = user
+	b.c.MyPassword = password
+	return b
+}
+
+// Redis sets the Redis address.
+func (b *ConfigBuilder) Redis(addr string) *ConfigBuilder {
+	b.c.RedisAddr = addr
+	return b
+}
+
+// ServerID sets the server ID of the River as a MySQL replica.
+func (b *ConfigBuilder) ServerID(id uint32) *ConfigBuilder {
+	b.c.ServerID = id
+	return b
+}
+
+// Flavor sets the MySQL flavor, mysql or mariadb.
+func (b *ConfigBuilder) Flavor(flavor string) *ConfigBuilder {
+	b.c.Flavor = flavor
+	return b
+}
+
+// DataDir sets the directory to save the binlog position.
+func (b *ConfigBuilder) DataDir(dir string) *ConfigBuilder {
+	b.c.DataDir = dir
+	return b
+}
+
+// Dump sets the mysqldump path for the initial dump, empty to skip it.
+func (b *ConfigBuilder) Dump(exec string) *ConfigBuilder {
+	b.c.DumpExec = exec
+	return b
+}
+
+// AddSource adds the tables of the schema to sync.
+func (b *ConfigBuilder) AddSource(schema string, tables ...string) *ConfigBuilder {
+	b.c.Sources = append(b.c.Sources, SourceConfig{Schema: schema, Tables: tables})
+	return b
+}
+
+// RuleDefaults sets the options copied to the rules added by AddTable.
+func (b *ConfigBuilder) RuleDefaults(rule *Rule) *ConfigBuilder {
+	b.c.RuleDefaults = rule
+	return b
+}
+
+// AddRule adds the rule as it is.
+func (b *ConfigBuilder) AddRule(rule *Rule) *ConfigBuilder {
+	b.c.Rules = append(b.c.Rules, rule)
+	return b
+}
+
+// AddTable adds a rule for the table with a copy of the rule defaults,
+// changed by the options.
+func (b *ConfigBuilder) AddTable(schema string, table string, options ...func(*Rule)) *ConfigBuilder {
+	rule := newDefaultRule(schema, table)
+	if b.c.RuleDefaults != nil {
+		rule = b.c.RuleDefaults.clone()
+		rule.Schema = schema
+		rule.Table = table
+	}
+
+	for _, option := range options {
+		option(rule)
+	}
+	return b.AddRule(rule)
+}
+
+// Set changes the other options of the config.
+func (b *ConfigBuilder) Set(option func(*Config)) *ConfigBuilder {
+	option(&b.c)
+	return b
+}
+
+// Build checks and returns the config.
+func (b *ConfigBuilder) Build() (*Config, error) {
+	c := b.c
+	if err := c.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &c, nil
+}
@@ -0,0 +1,129 @@
+package river
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// charsetEncodings are the MySQL charsets which are not UTF-8 compatible.
+var charsetEncodings = map[string]encoding.Encoding{
+	// MySQL latin1 is cp1252 actually
+	"latin1":  charmap.Windows1252,
+	"latin2":  charmap.ISO8859_2,
+	"cp1250":  charmap.Windows1250,
+	"cp1251":  charmap.Windows1251,
+	"cp1256":  charmap.Windows1256,
+	"cp1257":  charmap.Windows1257,
+	"koi8r":   charmap.KOI8R,
+	"koi8u":   charmap.KOI8U,
+	"greek":   charmap.ISO8859_7,
+	"hebrew":  charmap.ISO8859_8,
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	"big5":    traditionalchinese.Big5,
+	"sjis":    japanese.ShiftJIS,
+	"cp932":   japanese.ShiftJIS,
+	"ujis":    japanese.EUCJP,
+	"eucjpms": japanese.EUCJP,
+	"euckr":   korean.EUCKR,
+}
+
+// defaultMyCharset is the charset of the replication and dump connections
+// without my_charset, which keeps the 4-byte characters like emoji.
+const defaultMyCharset = "utf8mb4"
+
+// myCharset returns the charset of the MySQL connections.
+func (c *Config) myCharset() string {
+	if len(c.MyCharset) > 0 {
+		return c.MyCharset
+	}
+	return defaultMyCharset
+}
+
+// isUTF8Charset returns whether the charset is a MySQL UTF-8 charset, utf8
+// and utf8mb3 without the 4-byte characters.
+func isUTF8Charset(charset string) bool {
+	switch charset {
+	case "utf8", "utf8mb3", "utf8mb4":
+		return true
+	}
+	return false
+}
+
+// isValidCharset returns whether the charset can be used for the charset rule option.
+func isValidCharset(charset string) bool {
+	switch charset {
+	case "utf8", "utf8mb3", "utf8mb4", "ascii", "binary":
+		return true
+	}
+	_, ok := charsetEncodings[charset]
+	return ok
+}
+
+// columnCharset returns the rule charset, or the charset of the column collation,
+// like latin1 for latin1_swedish_ci.
+func columnCharset(rule *Rule, col *schema.TableColumn) string {
+	if len(rule.Charset) > 0 {
+		return rule.Charset
+	}
+
+	if i := strings.Index(col.Collation, "_"); i > 0 {
+		return col.Collation[:i]
+	}
+	return col.Collation
+}
+
+// decodeString converts the string column value in the column charset to UTF-8.
+func decodeString(rule *Rule, col *schema.TableColumn, value []byte) string {
+	enc, ok := charsetEncodings[columnCharset(rule, col)]
+	if !ok {
+		return string(value)
+	}
+
+	data, err := enc.NewDecoder().Bytes(value)
+	if err != nil {
+		log.Warnf("decode %s.%s column %s in %s err %v, keep it raw", rule.Schema, rule.Table, col.Name, columnCharset(rule, col), err)
+		return string(value)
+	}
+	return string(data)
+}
+
+// checkCharset returns the problems of the string columns of the rule
+// with the connection charset: 4-byte characters of utf8mb4 columns the
+// dump replaces by ?, columns in another charset than the rule charset,
+// and charsets which can not be converted to UTF-8.
+func checkCharset(rule *Rule, myCharset string) []string {
+	var warnings []string
+	for i, c := range rule.TableInfo.Columns {
+		if c.Type != schema.TYPE_STRING || isBinaryColumn(&rule.TableInfo.Columns[i]) || len(c.Collation) == 0 {
+			continue
+		}
+
+		charset := c.Collation
+		if j := strings.Index(charset, "_"); j > 0 {
+			charset = charset[:j]
+		}
+
+		if charset == "utf8mb4" && myCharset != "utf8mb4" {
+			warnings = append(warnings, fmt.Sprintf("%s.%s column %s is utf8mb4, but my_charset is %s, the dump replaces 4-byte characters like emoji by ?, set my_charset = \"utf8mb4\"",
+				rule.Schema, rule.Table, c.Name, myCharset))
+		}
+		if len(rule.Charset) > 0 && rule.Charset != charset && !(isUTF8Charset(rule.Charset) && isUTF8Charset(charset)) {
+			warnings = append(warnings, fmt.Sprintf("%s.%s column %s is %s, but the rule charset is %s", rule.Schema, rule.Table, c.Name, charset, rule.Charset))
+		}
+		if len(rule.Charset) == 0 && !isValidCharset(charset) {
+			warnings = append(warnings, fmt.Sprintf("%s.%s column %s in %s can not be converted to UTF-8, it is written raw, set the rule charset", rule.Schema, rule.Table, c.Name, charset))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,694 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultCheckChunkSize is the number of rows read from MySQL at a time by
+// Check without check_chunk_size.
+const defaultCheckChunkSize = 1000
+
+// defaultCheckMaxMismatches is the number of mismatches kept in the check
+// report without check_max_mismatches, the others are only counted.
+const defaultCheckMaxMismatches = 1000
+
+// checkRecheckDelay is the time before the mismatched keys are compared
+// again, so the rows changed by the sync meanwhile are not reported.
+const checkRecheckDelay = time.Second
+
+const (
+	// MismatchMissing is a row without its key in Redis.
+	MismatchMissing = "missing"
+	// MismatchExtra is a key without its row in MySQL.
+	MismatchExtra = "extra"
+	// MismatchFields is a key with fields differing from its row.
+	MismatchFields = "fields"
+)
+
+// Mismatch is a key of a rule differing between MySQL and Redis.
+type Mismatch struct {
+	Rule string
+	Key  string
+	Kind string
+	// Fields are the differing fields of a MismatchFields.
+	Fields []string
+	// Repaired is true once the key is repaired by Check with repair.
+	Repaired bool
+}
+
+func (m Mismatch) String() string {
+	s := fmt.Sprintf("%s %s %s", m.Rule, m.Kind, m.Key)
+	if len(m.Fields) > 0 {
+		s = fmt.Sprintf("%s %s", s, strings.Join(m.Fields, ","))
+	}
+	if m.Repaired {
+		s += " repaired"
+	}
+	return s
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Rows    int64
+	Missing int64
+	Extra   int64
+	Differ  int64
+	// Repaired is the number of keys repaired, DryRun is true if the
+	// repairs were only counted by dry_run.
+	Repaired int64
+	DryRun   bool
+	// Unchanged is the number of rows skipped by check_checksum as their
+	// chunk did not change since it was verified.
+	Unchanged int64
+	// Skipped are the rules not checked with the reason.
+	Skipped []string
+	// Mismatches are the first check_max_mismatches mismatches.
+	Mismatches []Mismatch
+
+	max    int
+	repair *repairer
+	sums   *checkInfo
+	// my and conn are the connections of Check, not the ones of the sync
+	my   mysqlExecutor
+	conn redis.Conn
+}
+
+// Ok returns true if no mismatch was found.
+func (c *CheckReport) Ok() bool {
+	return c.Missing == 0 && c.Extra == 0 && c.Differ == 0
+}
+
+func (c *CheckReport) add(m Mismatch) {
+	switch m.Kind {
+	case MismatchMissing:
+		c.Missing++
+	case MismatchExtra:
+		c.Extra++
+	default:
+		c.Differ++
+	}
+	if m.Repaired {
+		c.Repaired++
+	}
+	if len(c.Mismatches) < c.max {
+		c.Mismatches = append(c.Mismatches, m)
+	}
+}
+
+// WriteTo writes the report, one mismatch per line.
+func (c *CheckReport) WriteTo(buf *bytes.Buffer) error {
+	for _, m := range c.Mismatches {
+		buf.WriteString(m.String())
+		buf.WriteString("\n")
+	}
+	if n := c.Missing + c.Extra + c.Differ; n > int64(len(c.Mismatches)) {
+		buf.WriteString(fmt.Sprintf("... %d more mismatches\n", n-int64(len(c.Mismatches))))
+	}
+	for _, s := range c.Skipped {
+		buf.WriteString(fmt.Sprintf("skipped %s\n", s))
+	}
+	buf.WriteString(fmt.Sprintf("rows:%d missing:%d extra:%d differ:%d\n", c.Rows, c.Missing, c.Extra, c.Differ))
+	if c.sums != nil {
+		buf.WriteString(fmt.Sprintf("unchanged:%d\n", c.Unchanged))
+	}
+	if c.repair != nil {
+		if c.DryRun {
+			buf.WriteString(fmt.Sprintf("repaired:%d (dry run, nothing written)\n", c.Repaired))
+		} else {
+			buf.WriteString(fmt.Sprintf("repaired:%d\n", c.Repaired))
+		}
+	}
+	return nil
+}
+
+// Check compares the rows of the rules in MySQL with their hash keys in
+// Redis chunk by chunk in primary key order, and reports the missing keys,
+// the extra keys and the keys with differing fields. It reads with MySQL and
+// Redis connections of its own, so it may run along the sync, the
+// mismatched keys are compared again after checkRecheckDelay so the rows
+// changed meanwhile are not reported.
+//
+// Only the hash keys are compared. The rows mapped by a RowMapper or a
+// transform_script are verified by the RowVerifier or the script verify
+// function, the rules without one or of a table without a primary key are
+// skipped, and their extra keys are not looked for. The
+// rows of a rule with a ttl are not reported missing, the fields encrypted
+// or chunked and the version_field are not compared, and the extra keys are
+// only looked for under the rule key_prefix.
+//
+// With repair, the mismatched keys are rewritten from their rows and the
+// extra keys are deleted, at most check_repair_rate keys per second. With
+// dry_run the repairs are only reported.
+func (r *River) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	report := &CheckReport{max: r.c.CheckMaxMismatches, DryRun: r.c.DryRun}
+	if report.max <= 0 {
+		report.max = defaultCheckMaxMismatches
+	}
+
+	addr, err := r.resolveRedisMaster()
+	if err != nil {
+		return nil, errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+	my, err := r.dialMySQL()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer my.Close()
+	conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+	if err != nil {
+		return nil, errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+	defer conn.Close()
+	report.my, report.conn = my, conn
+
+	if repair {
+		report.repair = r.newRepairer(conn)
+	}
+	if r.c.CheckChecksum {
+		sums, err := loadCheckInfo(r.c.DataDir)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		report.sums = sums
+		defer func() {
+			if err := sums.save(); err != nil {
+				log.Errorf("save check.info err %v", err)
+			}
+		}()
+	}
+
+	names := make([]string, 0, len(r.rules))
+	for name := range r.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, rule := range append([]*Rule{r.rules[name]}, r.rules[name].overlaps...) {
+			if reason := r.checkSkipReason(rule); len(reason) > 0 {
+				report.Skipped = append(report.Skipped, fmt.Sprintf("%s.%s: %s", rule.Schema, rule.Table, reason))
+				continue
+			}
+			if err := r.checkRule(ctx, rule, report); err != nil {
+				return report, errors.Annotatef(err, "check %s.%s", rule.Schema, rule.Table)
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkSkipReason returns why the rule can not be checked, empty if it can.
+func (r *River) checkSkipReason(rule *Rule) string {
+	switch {
+	case r.isCustomRule(rule) && !r.canVerifyCustom(rule):
+		return "custom mapping without verifier"
+	case !r.isCustomRule(rule) && !rule.hasHashOutput():
+		return "no hash output"
+	case len(rule.TableInfo.PKColumns) == 0:
+		return "no primary key"
+	}
+	return ""
+}
+
+func (r *River) checkRule(ctx context.Context, rule *Rule, report *CheckReport) error {
+	size := r.c.CheckChunkSize
+	if size <= 0 {
+		size = defaultCheckChunkSize
+	}
+
+	// the keys of the rows, to find the extra keys at the end
+	seen := make(map[string]bool)
+	var last []interface{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+
+		var (
+			n   int
+			err error
+		)
+		if report.sums != nil && rule.hasPKKeys() && !r.isCustomRule(rule) {
+			last, n, err = r.checksumChunk(ctx, rule, last, size, seen, report)
+		} else {
+			last, n, err = r.checkChunk(ctx, rule, last, size, seen, report)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n < size {
+			break
+		}
+	}
+
+	if r.isCustomRule(rule) {
+		// the keys of a custom mapping are unknown
+		return nil
+	}
+	return errors.Trace(r.checkExtraKeys(ctx, rule, seen, report))
+}
+
+// checkChunk compares the next size rows after the primary key values last
+// with their keys, it returns the primary key values of the last row and
+// the number of rows.
+func (r *River) checkChunk(ctx context.Context, rule *Rule, last []interface{}, size int, seen map[string]bool, report *CheckReport) ([]interface{}, int, error) {
+	rows, err := checkChunkRows(report.my, rule, last, size)
+	if err != nil || len(rows) == 0 {
+		return last, 0, errors.Trace(err)
+	}
+	report.Rows += int64(len(rows))
+
+	var mismatched [][]interface{}
+	for _, row := range rows {
+		key, err := r.getPKValue(rule, row)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		seen[key] = true
+
+		m, err := r.checkKey(report.conn, rule, key, row)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		} else if m != nil {
+			mismatched = append(mismatched, row)
+		}
+	}
+
+	if err := r.recheckRows(ctx, rule, mismatched, report); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	last, err = rule.TableInfo.GetPKValues(rows[len(rows)-1])
+	return last, len(rows), errors.Trace(err)
+}
+
+// recheckRows compares the mismatched rows again after checkRecheckDelay,
+// read again from MySQL, and reports the mismatches left.
+func (r *River) recheckRows(ctx context.Context, rule *Rule, rows [][]interface{}, report *CheckReport) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(checkRecheckDelay):
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+
+	for _, row := range rows {
+		key, err := r.getPKValue(rule, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		pks, err := rule.TableInfo.GetPKValues(row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if row, err = selectRow(report.my, rule, pks); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := r.reportKey(ctx, rule, key, row, report); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// checkExtraKeys reports the keys under the rule key prefix not seen for a
+// row, once they are compared again with their row read by the key.
+func (r *River) checkExtraKeys(ctx context.Context, rule *Rule, seen map[string]bool, report *CheckReport) error {
+	var extra []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(report.conn.Do("SCAN", cursor, "MATCH", rule.keyPrefix+":*", "COUNT", 1000))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if !seen[key] && !isChunkKey(key, seen) && isRowKey(rule, key) {
+				extra = append(extra, key)
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(checkRecheckDelay):
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+
+	for _, key := range extra {
+		// the row may have been inserted after its chunk was read
+		var row []interface{}
+		if pks, ok := keyPKValues(rule, key); ok {
+			var err error
+			if row, err = selectRow(report.my, rule, pks); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := r.reportKey(ctx, rule, key, row, report); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// reportKey compares the row with its key again and reports the mismatch
+// left, repaired first with repair.
+func (r *River) reportKey(ctx context.Context, rule *Rule, key string, row []interface{}, report *CheckReport) error {
+	m, err := r.checkKey(report.conn, rule, key, row)
+	if err != nil || m == nil {
+		return errors.Trace(err)
+	}
+
+	if report.repair != nil {
+		if err := report.repair.repair(ctx, rule, m, row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	report.add(*m)
+	return nil
+}
+
+// isChunkKey returns true if the key is a chunk list of a seen key, see chunkKey.
+func isChunkKey(key string, seen map[string]bool) bool {
+	if !strings.HasSuffix(key, ":chunks") {
+		return false
+	}
+	key = strings.TrimSuffix(key, ":chunks")
+	i := strings.LastIndex(key, ":")
+	if i <= 0 {
+		return false
+	}
+	key = key[:i]
+	return seen[key] || strings.HasPrefix(key, "{") && strings.HasSuffix(key, "}") && seen[key[1:len(key)-1]]
+}
+
+// keyPKValues returns the primary key values of the row key of the rule,
+// split by ":" after the rule key prefix, false if the key is not one.
+func keyPKValues(rule *Rule, key string) ([]interface{}, bool) {
+	if len(rule.KeyColumns) > 0 || !strings.HasPrefix(key, rule.keyPrefix+":") {
+		return nil, false
+	}
+
+	n := len(rule.TableInfo.PKColumns)
+	parts := strings.SplitN(strings.TrimPrefix(key, rule.keyPrefix+":"), ":", n)
+	if len(parts) != n {
+		return nil, false
+	}
+
+	pks := make([]interface{}, n)
+	for i, part := range parts {
+		pks[i] = part
+	}
+	return pks, true
+}
+
+// checkKey compares the row, nil if it is gone, with its key read by conn,
+// and returns the mismatch, nil if none.
+func (r *River) checkKey(conn redis.Conn, rule *Rule, key string, row []interface{}) (*Mismatch, error) {
+	return r.compareKey(readOnlyRedis(conn.Do), rule, key, row)
+}
+
+// compareKey compares the row with its key read by rd, by the verifier of
+// a custom mapping, or with its hash.
+func (r *River) compareKey(rd RedisReader, rule *Rule, key string, row []interface{}) (*Mismatch, error) {
+	if r.isCustomRule(rule) {
+		m, err := r.verifyCustom(rd, rule, key, row)
+		if errors.Cause(err) != ErrDefaultMapping {
+			return m, errors.Trace(err)
+		}
+	}
+
+	hash, err := redis.StringMap(rd.Do("HGETALL", key))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Trace(err)
+	}
+	return r.checkHash(rule, key, row, hash)
+}
+
+// checkHash compares the row, nil if it is gone, with the hash of its key,
+// and returns the mismatch, nil if none.
+func (r *River) checkHash(rule *Rule, key string, row []interface{}, hash map[string]string) (*Mismatch, error) {
+	name := fmt.Sprintf("%s.%s", rule.Schema, rule.Table)
+	fields := checkFields(rule)
+
+	written := false
+	for field := range hash {
+		if fields[field] || rule.WritePolicy == WritePolicyOverwrite {
+			written = true
+			break
+		}
+	}
+
+	if row == nil || !rule.MatchRow(row) {
+		if written {
+			return &Mismatch{Rule: name, Key: key, Kind: MismatchExtra}, nil
+		}
+		return nil, nil
+	}
+	if !written {
+		if rule.hasTTL() {
+			// the key may have expired
+			return nil, nil
+		}
+		return &Mismatch{Rule: name, Key: key, Kind: MismatchMissing}, nil
+	}
+
+	// the version field is skipped, see checkSkipFields
+	values, nulls, err := r.makeRowFields(rule, nil, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	skip := checkSkipFields(rule)
+	var diff []string
+	for field, value := range values {
+		if _, ok := value.(chunkedValue); ok || skip[field] {
+			continue
+		}
+		if v, ok := hash[field]; !ok || v != redisString(value) {
+			diff = append(diff, field)
+		}
+	}
+	for _, field := range nulls {
+		if _, ok := hash[field]; ok {
+			diff = append(diff, field)
+		}
+	}
+	if rule.WritePolicy == WritePolicyOverwrite {
+		for field := range hash {
+			if _, ok := values[field]; !ok && !skip[field] && !isNullField(nulls, field) {
+				diff = append(diff, field)
+			}
+		}
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+
+	sort.Strings(diff)
+	return &Mismatch{Rule: name, Key: key, Kind: MismatchFields, Fields: diff}, nil
+}
+
+// checkFields returns the fields the rule may write to a row key.
+func checkFields(rule *Rule) map[string]bool {
+	fields := make(map[string]bool)
+	for _, c := range rule.TableInfo.Columns {
+		fields[rule.FieldName(c.Name)] = true
+	}
+	for field := range rule.Computed {
+		fields[field] = true
+	}
+	if len(rule.VersionField) > 0 {
+		fields[rule.VersionField] = true
+	}
+	if rule.StrictTypes {
+		fields[rule.TypesField] = true
+	}
+	return fields
+}
+
+// checkSkipFields returns the fields whose values can not be compared.
+func checkSkipFields(rule *Rule) map[string]bool {
+	skip := make(map[string]bool)
+	if len(rule.VersionField) > 0 {
+		skip[rule.VersionField] = true
+	}
+	for column, t := range rule.Transforms {
+		for _, name := range strings.Split(t, "|") {
+			if strings.TrimSpace(name) == "encrypt" {
+				skip[rule.FieldName(column)] = true
+			}
+		}
+	}
+	return skip
+}
+
+func isNullField(nulls []string, field string) bool {
+	for _, f := range nulls {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// redisString returns the value as redigo writes it: float64 in the
+// shortest 'g' form, like 1e+06, and the other numbers by fmt. The values
+// of strict_types and DECIMAL columns are already strings in the 'f' form.
+func redisString(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return transformString(value)
+}
+
+// checkChunkRows returns the next size rows of the rule table after the
+// primary key values last, nil for the first chunk, in primary key order.
+func checkChunkRows(my mysqlExecutor, rule *Rule, last []interface{}, size int) ([][]interface{}, error) {
+	pks := pkColumns(rule)
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", selectColumns(rule), quoteName(rule.Schema), quoteName(rule.Table))
+	if last != nil {
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", pks, placeholders(len(last)))
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", pks, size)
+
+	return selectRows(my, rule, query, last...)
+}
+
+// mysqlExecutor runs the queries reading the rows, on a connection of
+// their own, as the canal is replaced on restart.
+type mysqlExecutor interface {
+	Execute(command string, args ...interface{}) (*mysql.Result, error)
+}
+
+// dialMySQL returns a new MySQL connection for a background task.
+func (r *River) dialMySQL() (*client.Conn, error) {
+	conn, err := client.Connect(r.c.MyAddr, r.c.MyUser, r.mysqlPassword(), "")
+	if err != nil {
+		return nil, errors.Trace(wrapError(err, ErrMySQLUnavailable))
+	}
+	if err = conn.SetCharset(r.c.myCharset()); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+// selectRow returns the row of the rule table with the primary key values,
+// nil if there is none.
+func selectRow(my mysqlExecutor, rule *Rule, pks []interface{}) ([]interface{}, error) {
+	conds := make([]string, 0, len(rule.TableInfo.PKColumns))
+	for _, i := range rule.TableInfo.PKColumns {
+		conds = append(conds, quoteName(rule.TableInfo.Columns[i].Name)+" = ?")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s", selectColumns(rule), quoteName(rule.Schema), quoteName(rule.Table), strings.Join(conds, " AND "))
+	rows, err := selectRows(my, rule, query, pks...)
+	if err != nil || len(rows) == 0 {
+		return nil, errors.Trace(err)
+	}
+	return rows[0], nil
+}
+
+func selectRows(my mysqlExecutor, rule *Rule, query string, args ...interface{}) ([][]interface{}, error) {
+	res, err := my.Execute(query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows := res.Resultset.Values
+	for _, row := range rows {
+		textRowValues(rule, row)
+	}
+	return rows, errors.Trace(checkRowColumns(rule, rows))
+}
+
+// textRowValues converts the values of a row read by a query to the types
+// of the binlog rows, strings for []byte but binary columns, and DECIMAL
+// strings like the binlog decimal.Decimal.
+func textRowValues(rule *Rule, row []interface{}) {
+	for i, value := range row {
+		b, ok := value.([]byte)
+		if !ok || i >= len(rule.TableInfo.Columns) {
+			continue
+		}
+
+		col := &rule.TableInfo.Columns[i]
+		switch {
+		case col.Type == schema.TYPE_DECIMAL:
+			row[i] = decimalText(string(b))
+		case isBinaryColumn(col):
+		default:
+			row[i] = string(b)
+		}
+	}
+}
+
+// decimalText returns the exact DECIMAL text as decimal.Decimal.String()
+// does, without the trailing zeros of the scale, "1.500" as "1.5".
+func decimalText(s string) string {
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" || len(s) == 0 {
+		return "0"
+	}
+	return s
+}
+
+// selectColumns returns the quoted columns of the rule table, in the order
+// of TableInfo, as SELECT * leaves the invisible ones out.
+func selectColumns(rule *Rule) string {
+	columns := make([]string, 0, len(rule.TableInfo.Columns))
+	for _, c := range rule.TableInfo.Columns {
+		columns = append(columns, quoteName(c.Name))
+	}
+	return strings.Join(columns, ", ")
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,251 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/ioutil2"
+)
+
+// checkChunkSum is the checksums of a chunk of rows verified by Check, from
+// the primary key values after its start up to Upper.
+type checkChunkSum struct {
+	Upper string `toml:"upper"`
+	MySQL uint64 `toml:"mysql"`
+	Redis uint64 `toml:"redis"`
+}
+
+// checkInfo keeps the checksums of the chunks verified by Check with
+// check_checksum, saved in check.info of the data dir, so the next Check
+// only compares the chunks changed since in MySQL or in Redis.
+type checkInfo struct {
+	// Chunks are by the rule and the start of the chunk, see chunkName.
+	Chunks map[string]checkChunkSum `toml:"chunks"`
+
+	// verified are the chunks verified by this Check, the ones saved
+	verified map[string]checkChunkSum
+	filePath string
+}
+
+func loadCheckInfo(dataDir string) (*checkInfo, error) {
+	c := &checkInfo{verified: make(map[string]checkChunkSum)}
+
+	if len(dataDir) == 0 {
+		return c, nil
+	}
+	c.filePath = path.Join(dataDir, "check.info")
+
+	f, err := os.Open(c.filePath)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	_, err = toml.DecodeReader(f, c)
+	return c, errors.Trace(err)
+}
+
+// unchanged returns true if the chunk was verified with the same checksums.
+func (c *checkInfo) unchanged(name string, sum checkChunkSum) bool {
+	old, ok := c.Chunks[name]
+	return ok && old == sum
+}
+
+// verify keeps the checksums of the verified chunk to save.
+func (c *checkInfo) verify(name string, sum checkChunkSum) {
+	c.verified[name] = sum
+}
+
+// save saves the verified chunks, forgetting the others.
+func (c *checkInfo) save() error {
+	if len(c.filePath) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(&checkInfo{Chunks: c.verified}); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(c.filePath, buf.Bytes(), 0644))
+}
+
+// chunkName returns the name of the chunk of the rule after the primary key
+// values last, nil for the first one.
+func chunkName(rule *Rule, last []interface{}) string {
+	return fmt.Sprintf("%s.%s %v", rule.Schema, rule.Table, last)
+}
+
+// hasPKKeys returns true if the row keys are made of the rule key prefix
+// and the primary key values only, so the keys of a chunk are known from
+// its primary keys.
+func (r *Rule) hasPKKeys() bool {
+	if len(r.KeyColumns) > 0 {
+		return false
+	}
+	for _, c := range r.Conditions {
+		if len(c.keyPrefix) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pkKey returns the row key of the primary key values, see getPKValue.
+func pkKey(rule *Rule, pks []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteString(rule.keyPrefix)
+	for _, value := range pks {
+		buf.WriteString(fmt.Sprintf(":%v", value))
+	}
+	return buf.String()
+}
+
+// checksumChunk checksums the next size rows after the primary key values
+// last in MySQL and their keys in Redis, and only compares the rows with
+// their keys if the checksums changed since the chunk was last verified. It
+// returns the primary key values of the last row and the number of rows.
+func (r *River) checksumChunk(ctx context.Context, rule *Rule, last []interface{}, size int, seen map[string]bool, report *CheckReport) ([]interface{}, int, error) {
+	pks, err := chunkPKValues(report.my, rule, last, size)
+	if err != nil || len(pks) == 0 {
+		return last, 0, errors.Trace(err)
+	}
+	upper := pks[len(pks)-1]
+
+	sum := checkChunkSum{Upper: fmt.Sprint(upper)}
+	if sum.MySQL, err = mysqlChecksum(report.my, rule, last, upper); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	keys := make([]string, 0, len(pks))
+	for _, values := range pks {
+		keys = append(keys, pkKey(rule, values))
+	}
+	if sum.Redis, err = redisChecksum(report.conn, keys); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	name := chunkName(rule, last)
+	if report.sums.unchanged(name, sum) {
+		for _, key := range keys {
+			seen[key] = true
+		}
+		report.Rows += int64(len(pks))
+		report.Unchanged += int64(len(pks))
+		report.sums.verify(name, sum)
+		return upper, len(pks), nil
+	}
+
+	before := report.Missing + report.Extra + report.Differ
+	next, n, err := r.checkChunk(ctx, rule, last, size, seen, report)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	// a chunk with mismatches, even repaired, is compared again next time
+	if report.Missing+report.Extra+report.Differ == before && fmt.Sprint(next) == sum.Upper {
+		report.sums.verify(name, sum)
+	}
+	return next, n, nil
+}
+
+// chunkPKValues returns the primary key values of the next size rows after
+// the primary key values last, in primary key order.
+func chunkPKValues(my mysqlExecutor, rule *Rule, last []interface{}, size int) ([][]interface{}, error) {
+	pks := pkColumns(rule)
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", pks, quoteName(rule.Schema), quoteName(rule.Table))
+	if last != nil {
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", pks, placeholders(len(last)))
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", pks, size)
+
+	res, err := my.Execute(query, last...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows := res.Resultset.Values
+	for _, row := range rows {
+		for i, value := range row {
+			if b, ok := value.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// mysqlChecksum returns the BIT_XOR of the CRC32 of the rows after the
+// primary key values last up to upper, computed by MySQL like
+// pt-table-checksum, with the NULL columns told apart from empty ones.
+func mysqlChecksum(my mysqlExecutor, rule *Rule, last []interface{}, upper []interface{}) (uint64, error) {
+	columns := make([]string, 0, len(rule.TableInfo.Columns))
+	nulls := make([]string, 0, len(rule.TableInfo.Columns))
+	for _, c := range rule.TableInfo.Columns {
+		columns = append(columns, quoteName(c.Name))
+		nulls = append(nulls, fmt.Sprintf("ISNULL(%s)", quoteName(c.Name)))
+	}
+
+	pks := pkColumns(rule)
+	query := fmt.Sprintf("SELECT COALESCE(BIT_XOR(CRC32(CONCAT_WS('#', %s, CONCAT(%s)))), 0) FROM %s.%s WHERE (%s) <= (%s)",
+		strings.Join(columns, ", "), strings.Join(nulls, ", "), quoteName(rule.Schema), quoteName(rule.Table), pks, placeholders(len(upper)))
+	args := upper
+	if last != nil {
+		query += fmt.Sprintf(" AND (%s) > (%s)", pks, placeholders(len(last)))
+		args = append(append([]interface{}{}, upper...), last...)
+	}
+
+	res, err := my.Execute(query, args...)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	sum, err := res.GetUint(0, 0)
+	return sum, errors.Trace(err)
+}
+
+// redisChecksum returns the XOR of the CRC32 of the keys with their sorted
+// hash fields.
+func redisChecksum(conn redis.Conn, keys []string) (uint64, error) {
+	var sum uint64
+	for _, key := range keys {
+		hash, err := redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil && err != redis.ErrNil {
+			return 0, errors.Trace(err)
+		}
+		sum ^= uint64(hashChecksum(key, hash))
+	}
+	return sum, nil
+}
+
+// hashChecksum returns the CRC32 of the key and its hash sorted by field.
+func hashChecksum(key string, hash map[string]string) uint32 {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	h := crc32.NewIEEE()
+	fmt.Fprintf(h, "%s\x00", key)
+	for _, field := range fields {
+		fmt.Fprintf(h, "%s\x00%s\x00", field, hash[field])
+	}
+	return h.Sum32()
+}
+
+// pkColumns returns the quoted primary key columns of the rule table.
+func pkColumns(rule *Rule) string {
+	pks := make([]string, 0, len(rule.TableInfo.PKColumns))
+	for _, i := range rule.TableInfo.PKColumns {
+		pks = append(pks, quoteName(rule.TableInfo.Columns[i].Name))
+	}
+	return strings.Join(pks, ", ")
+}
@@ -0,0 +1,105 @@
+package river
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// defaultChunkBytes is the chunk size of the oversize_policy chunk without
+// chunk_bytes.
+const defaultChunkBytes = 1 << 20
+
+// chunkedValue is a value larger than max_field_bytes to be written in
+// chunks by the oversize_policy chunk.
+type chunkedValue string
+
+// chunkManifest replaces the chunked value in the hash field, the value is
+// the concatenation of LRANGE <key> 0 -1.
+type chunkManifest struct {
+	Key    string `json:"key"`
+	Chunks int    `json:"chunks"`
+	Bytes  int    `json:"bytes"`
+}
+
+// chunkKey returns the list of the chunks of the field of the row key, in
+// the cluster slot of the row key, which is the hash tag if it has none.
+func chunkKey(key string, field string) string {
+	if !hasHashTag(key) {
+		key = "{" + key + "}"
+	}
+	return key + ":" + field + ":chunks"
+}
+
+// chunkFields returns the string, JSON and computed fields, which may hold
+// a chunked value.
+func chunkFields(rule *Rule) []string {
+	var fields []string
+	for _, c := range rule.TableInfo.Columns {
+		if c.Type == schema.TYPE_STRING || c.Type == schema.TYPE_JSON {
+			fields = append(fields, rule.FieldName(c.Name))
+		}
+	}
+	for field := range rule.Computed {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// chunkDeleteCmds returns the command to delete the chunk lists of the
+// fields of the row key with the oversize_policy chunk.
+func chunkDeleteCmds(rule *Rule, key string, fields []string) []redisCmd {
+	if rule.OversizePolicy != OversizePolicyChunk || len(fields) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, chunkKey(key, field))
+	}
+	return []redisCmd{newRedisCmd("DEL", redis.Args{}.AddFlat(keys)...)}
+}
+
+// unchunkValues truncates the chunked values to max_field_bytes for the
+// outputs other than the hash, which have no lists to chunk them to.
+func unchunkValues(rule *Rule, values map[string]interface{}) {
+	for field, value := range values {
+		if v, ok := value.(chunkedValue); ok {
+			values[field] = truncateValue(string(v), rule.MaxFieldBytes)
+		}
+	}
+}
+
+// chunkCmds returns the commands to write the chunked values of the row
+// to their lists in chunks of chunk_bytes, one command each, replacing the
+// old lists and the values by their manifests. The list of a field written
+// unchunked is left until the row is deleted or the field chunked again.
+func chunkCmds(rule *Rule, key string, values map[string]interface{}, ttl time.Duration) []redisCmd {
+	var cmds []redisCmd
+	for field, value := range values {
+		v, ok := value.(chunkedValue)
+		if !ok {
+			continue
+		}
+
+		k := chunkKey(key, field)
+		cmds = append(cmds, newRedisCmd("DEL", k))
+		n := 0
+		for i := 0; i < len(v); i += rule.ChunkBytes {
+			end := i + rule.ChunkBytes
+			if end > len(v) {
+				end = len(v)
+			}
+			cmds = append(cmds, newRedisCmd("RPUSH", k, string(v[i:end])))
+			n++
+		}
+		if ttl > 0 {
+			cmds = append(cmds, newRedisCmd("EXPIRE", k, int64(ttl/time.Second)))
+		}
+
+		data, _ := json.Marshal(chunkManifest{Key: k, Chunks: n, Bytes: len(v)})
+		values[field] = string(data)
+	}
+	return cmds
+}
@@ -0,0 +1,63 @@
+package river
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRedisCircuitProbeInterval = 5 * time.Second
+
+// waitRedis opens the circuit after Redis is unavailable even after the
+// retries: it pauses the sync by blocking the canal, so the binlog is
+// not read any further, and probes Redis until it is back. It returns
+// true to apply the failed rows event again, false if the river is closed
+// or Redis is not back within redis_circuit_max_open.
+func (r *River) waitRedis(err error) bool {
+	interval := r.c.RedisCircuitProbeInterval.Duration
+	if interval <= 0 {
+		interval = defaultRedisCircuitProbeInterval
+	}
+
+	pos := r.syncedPosition()
+	log.Errorf("Redis is unavailable err %v, open circuit and pause sync after binlog %s", err, pos)
+	r.alert.Alertf("Redis is unavailable, sync paused after binlog %s: %v", pos, err)
+	r.st.RedisCircuitOpen.Set(1)
+	r.st.RedisCircuitOpenNum.Add(1)
+	defer r.st.RedisCircuitOpen.Set(0)
+
+	r.redisState.down(err)
+	start := time.Now()
+	defer r.waitedTxn(start)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return false
+		}
+
+		if err = r.probeRedis(); err == nil {
+			log.Infof("Redis is back after %s, close circuit and resume sync from binlog %s", time.Since(start), pos)
+			r.alert.Alertf("Redis is back after %s, sync resumed", time.Since(start))
+			return true
+		}
+
+		if max := r.c.RedisCircuitMaxOpen.Duration; max > 0 && time.Since(start) >= max {
+			log.Errorf("Redis is still unavailable after %s err %v", max, err)
+			return false
+		}
+		log.Debugf("Redis is still unavailable err %v", err)
+	}
+}
+
+// probeRedis dials Redis again and pings it.
+func (r *River) probeRedis() error {
+	if err := r.dialRedis(); err != nil {
+		return err
+	}
+	_, err := r.doRedisOnce("PING")
+	return err
+}
@@ -0,0 +1,101 @@
+package river
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	clusterSlots = 16384
+
+	// moveDeleteRetries is the number of tries to delete the old key of a moved row.
+	moveDeleteRetries = 3
+)
+
+// crc16 is the CRC16-CCITT (XMODEM) used by Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// hasHashTag returns true if the slot of the key is the one of its {hash tag}.
+func hasHashTag(key string) bool {
+	i := strings.Index(key, "{")
+	return i >= 0 && strings.Index(key[i+1:], "}") > 0
+}
+
+// keySlot returns the Redis Cluster hash slot of the key, honoring {hash tags}.
+func keySlot(key string) uint16 {
+	if i := strings.Index(key, "{"); i >= 0 {
+		if j := strings.Index(key[i+1:], "}"); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return crc16([]byte(key)) % clusterSlots
+}
+
+// moveRowOrdered moves the row across cluster slots, where MULTI is not possible.
+// It writes the new key, verifies it, then deletes the old key, so a failure
+// leaves the old key rather than no key. A failed write is rolled back by
+// deleting the new key, a failed delete leaves the old key orphaned.
+func (r *River) moveRowOrdered(rule *Rule, oldKey string, newKey string, deleteCmds []redisCmd, writeCmds []redisCmd) error {
+	if len(writeCmds) > 0 {
+		if err := r.doRedisCmds(writeCmds); err != nil {
+			r.rollbackMovedRow(newKey)
+			return errors.Trace(err)
+		}
+	}
+
+	// only the hash output writes the new key itself
+	if len(writeCmds) > 0 && rule.hasHashOutput() && !r.c.DryRun {
+		exists, err := redis.Bool(r.doRedis("EXISTS", newKey))
+		if err != nil {
+			return errors.Trace(err)
+		} else if !exists {
+			return errors.Errorf("moved row key %s not found after write", newKey)
+		}
+	}
+
+	var err error
+retry:
+	for i := 0; i < moveDeleteRetries; i++ {
+		if err = r.doRedisCmds(deleteCmds); err == nil {
+			return nil
+		}
+		if i == moveDeleteRetries-1 {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(i+1) * 100 * time.Millisecond):
+		case <-r.ctx.Done():
+			// closing, don't hold the sync
+			break retry
+		}
+	}
+
+	r.st.OrphanNum.Add(1)
+	log.Errorf("delete old key %s of moved row %s err %v, the key is orphaned", oldKey, newKey, err)
+	return errors.Trace(err)
+}
+
+func (r *River) rollbackMovedRow(newKey string) {
+	if _, err := r.doRedis("DEL", newKey); err != nil {
+		log.Errorf("roll back moved row key %s err %v", newKey, err)
+		return
+	}
+	r.st.OrphanCleanupNum.Add(1)
+}
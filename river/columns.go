@@ -0,0 +1,52 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// loadSkipColumns finds the generated and invisible columns of the rule table
+// to skip. go-mysql keeps them in TableInfo, as they are in the binlog row
+// image too, so the column indices still line up with the row values.
+func (r *River) loadSkipColumns(rule *Rule) error {
+	rule.skipColumns = nil
+	if !rule.SkipGeneratedColumns && !rule.SkipInvisibleColumns {
+		return nil
+	}
+
+	res, err := r.canal.Execute(`SELECT COLUMN_NAME, EXTRA FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?`, rule.Schema, rule.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	skip := make(map[string]bool)
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		name, _ := res.GetString(i, 0)
+		extra, _ := res.GetString(i, 1)
+		extra = strings.ToUpper(extra)
+
+		if rule.SkipGeneratedColumns && strings.Contains(extra, "GENERATED") {
+			skip[name] = true
+		}
+		if rule.SkipInvisibleColumns && strings.Contains(extra, "INVISIBLE") {
+			skip[name] = true
+		}
+	}
+
+	rule.skipColumns = skip
+	return nil
+}
+
+// checkRowColumns makes sure the row values line up with the table columns,
+// so values are never written under the wrong field names.
+func checkRowColumns(rule *Rule, rows [][]interface{}) error {
+	for _, row := range rows {
+		if len(row) != len(rule.TableInfo.Columns) {
+			return wrapError(errors.Errorf("%s.%s row has %d values but table has %d columns, the table schema may be out of date",
+				rule.Schema, rule.Table, len(row), len(rule.TableInfo.Columns)), ErrSchemaMismatch)
+		}
+	}
+	return nil
+}
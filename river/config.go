@@ -1,13 +1,26 @@
 package river
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/juju/errors"
 )
 
+// How the rules matching one table are applied.
+const (
+	// RuleOverlapPriority applies the rule with the highest priority, the default.
+	RuleOverlapPriority = "priority"
+	// RuleOverlapAll applies all the matching rules in priority order.
+	RuleOverlapAll = "all"
+)
+
 // SourceConfig is the configs for source
 type SourceConfig struct {
 	Schema string   `toml:"schema"`
@@ -19,49 +32,442 @@ type Config struct {
 	MyAddr     string `toml:"my_addr"`
 	MyUser     string `toml:"my_user"`
 	MyPassword string `toml:"my_pass"`
-	MyCharset  string `toml:"my_charset"`
+	// MyCharset is the charset of the replication and dump connections,
+	// default utf8mb4.
+	MyCharset string `toml:"my_charset"`
+
+	// The passwords read from a file, an environment variable or a Vault
+	// secret by ResolveSecrets instead of my_pass and redis_pass.
+	MyPasswordFile     string `toml:"my_password_file"`
+	MyPasswordEnv      string `toml:"my_password_env"`
+	MyPasswordVault    string `toml:"my_password_vault"`
+	RedisPasswordFile  string `toml:"redis_password_file"`
+	RedisPasswordEnv   string `toml:"redis_password_env"`
+	RedisPasswordVault string `toml:"redis_password_vault"`
+
+	VaultAddr  string `toml:"vault_addr"`
+	VaultToken string `toml:"vault_token"`
+
+	RedisAddr     string `toml:"redis_addr"`
+	RedisPassword string `toml:"redis_pass"`
+
+	RedisCluster bool `toml:"redis_cluster"`
+
+	// RedisSentinelMaster is the master name to ask RedisSentinelAddrs for
+	// the Redis address, instead of redis_addr.
+	RedisSentinelAddrs  []string `toml:"redis_sentinel_addrs"`
+	RedisSentinelMaster string   `toml:"redis_sentinel_master"`
 
+	// RedisMaxRetries is how many times a command failed with a transient
+	// error is retried, default 3, -1 for never.
+	RedisMaxRetries      int          `toml:"redis_max_retries"`
+	RedisRetryBackoff    TomlDuration `toml:"redis_retry_backoff"`
+	RedisRetryMaxBackoff TomlDuration `toml:"redis_retry_max_backoff"`
 
-	RedisAddr  string `toml:"redis_addr"`
+	// RedisCircuitBreaker pauses the sync while Redis is unavailable after
+	// the retries, instead of applying the error policy.
+	RedisCircuitBreaker       bool         `toml:"redis_circuit_breaker"`
+	RedisCircuitProbeInterval TomlDuration `toml:"redis_circuit_probe_interval"`
+	RedisCircuitMaxOpen       TomlDuration `toml:"redis_circuit_max_open"`
 
-	StatAddr   string `toml:"stat_addr"`
+	// RedisOOMPolicy is what to do when Redis refuses writes for maxmemory,
+	// fail, pause, drop or ttl.
+	RedisOOMPolicy      string       `toml:"redis_oom_policy"`
+	RedisOOMMinPriority int          `toml:"redis_oom_min_priority"`
+	RedisOOMTTL         TomlDuration `toml:"redis_oom_ttl"`
 
-	ServerID uint32 `toml:"server_id"`
-	Flavor   string `toml:"flavor"`
-	DataDir  string `toml:"data_dir"`
+	// KeyspaceInterval counts the keys of each rule by SCAN and estimates
+	// their memory by MEMORY USAGE of KeyspaceSample keys, default off.
+	KeyspaceInterval TomlDuration `toml:"keyspace_interval"`
+	KeyspaceSample   int          `toml:"keyspace_sample"`
+
+	StatAddr string `toml:"stat_addr"`
+
+	// StatTLSCert and StatTLSKey serve stat_addr over HTTPS, the clients
+	// must have a certificate signed by StatTLSClientCA if it is set.
+	StatTLSCert     string `toml:"stat_tls_cert"`
+	StatTLSKey      string `toml:"stat_tls_key"`
+	StatTLSClientCA string `toml:"stat_tls_client_ca"`
+
+	// StatToken is required as "Authorization: Bearer <token>" by the
+	// status endpoints, or read from StatTokenFile, StatTokenEnv or StatTokenVault.
+	StatToken      string `toml:"stat_token"`
+	StatTokenFile  string `toml:"stat_token_file"`
+	StatTokenEnv   string `toml:"stat_token_env"`
+	StatTokenVault string `toml:"stat_token_vault"`
+
+	StatSampleSize int `toml:"stat_sample_size"`
+
+	StatsdAddr    string   `toml:"statsd_addr"`
+	StatsdPrefix  string   `toml:"statsd_prefix"`
+	StatsdTags    []string `toml:"statsd_tags"`
+	StatsdDatadog bool     `toml:"statsd_datadog"`
+
+	// ServerID is selected within ServerIDMin and ServerIDMax if not set.
+	ServerID    uint32 `toml:"server_id"`
+	ServerIDMin uint32 `toml:"server_id_min"`
+	ServerIDMax uint32 `toml:"server_id_max"`
+	Flavor      string `toml:"flavor"`
+	DataDir     string `toml:"data_dir"`
 
 	DumpExec       string `toml:"mysqldump"`
 	SkipMasterData bool   `toml:"skip_master_data"`
 
+	// DumpSSLMode and the certificates are passed to mysqldump, which
+	// connects through the SSH bastion DumpSSHAddr if it is set.
+	DumpSSLMode       string `toml:"dump_ssl_mode"`
+	DumpSSLCA         string `toml:"dump_ssl_ca"`
+	DumpSSLCert       string `toml:"dump_ssl_cert"`
+	DumpSSLKey        string `toml:"dump_ssl_key"`
+	DumpSSHAddr       string `toml:"dump_ssh_addr"`
+	DumpSSHUser       string `toml:"dump_ssh_user"`
+	DumpSSHKeyFile    string `toml:"dump_ssh_key_file"`
+	DumpSSHKnownHosts string `toml:"dump_ssh_known_hosts"`
+
+	// BinlogPurgedPolicy is what to do when the saved binlog position is
+	// not on MySQL any more, fail or redump.
+	BinlogPurgedPolicy string `toml:"binlog_purged_policy"`
+
+	// StartupWait is how long to wait for MySQL and Redis to be reachable
+	// on startup, default not at all.
+	StartupWait TomlDuration `toml:"startup_wait"`
+
+	// CheckMaster checks the MySQL settings on startup with CheckMaster,
+	// off, warn or error to refuse to start.
+	CheckMaster string `toml:"check_master"`
+
+	// CheckRedisACL checks the Redis user may run the commands the rules
+	// require on startup, off, warn or error to refuse to start.
+	CheckRedisACL string `toml:"check_redis_acl"`
+
 	Sources []SourceConfig `toml:"source"`
 
 	Rules []*Rule `toml:"rule"`
 
+	// RuleOverlap is how the rules matching one table are applied, priority or all.
+	// The precedence is the higher rule priority, then the exact table rule
+	// before the wildcard ones, then the config order.
+	RuleOverlap string `toml:"rule_overlap"`
+
+	// Include are the paths or glob patterns of the TOML files with more
+	// sources and rules, relative to the config file.
+	Include []string `toml:"include"`
+
+	// RuleDefaults are the options inherited by all rules, a rule overrides
+	// the options it sets.
+	RuleDefaults *Rule `toml:"rule_defaults"`
+
+	// the keys not known, reported by Validate
+	undecoded []string
+
+	BulkSize      int          `toml:"bulk_size"`
 	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
 
 	SkipNoPkTable bool `toml:"skip_no_pk_table"`
+
+	TimeZone string `toml:"time_zone"`
+
+	ReplayGuard    bool   `toml:"replay_guard"`
+	ReplayGuardKey string `toml:"replay_guard_key"`
+
+	// DryRun syncs the binlog and applies the rules, but counts the Redis
+	// writes in the stats instead of running them, and never saves the
+	// binlog position.
+	DryRun bool `toml:"dry_run"`
+
+	// CheckChunkSize is the number of rows read at a time by Check,
+	// CheckMaxMismatches the number of mismatches kept in its report and
+	// CheckRepairRate the number of keys repaired per second.
+	CheckChunkSize     int `toml:"check_chunk_size"`
+	CheckMaxMismatches int `toml:"check_max_mismatches"`
+	CheckRepairRate    int `toml:"check_repair_rate"`
+
+	// CheckChecksum checksums the chunks in MySQL and in Redis, and only
+	// compares the chunks changed since they were last verified.
+	CheckChecksum bool `toml:"check_checksum"`
+
+	// VerifySample is the number of keys synced in the last minute that
+	// are compared with their rows every minute, default 0 for none.
+	VerifySample int `toml:"verify_sample"`
+
+	// ReapInterval deletes the row keys whose rows are gone for longer
+	// than ReapWindow, default off.
+	ReapInterval TomlDuration `toml:"reap_interval"`
+	ReapWindow   TomlDuration `toml:"reap_window"`
+
+	// ProbeTable is the schema.table the server_id row is written to every
+	// ProbeInterval, to measure the end to end latency until it is synced.
+	ProbeTable    string       `toml:"probe_table"`
+	ProbeInterval TomlDuration `toml:"probe_interval"`
+
+	// MaxRestarts is how many times the canal and the sync loop stopped
+	// on an error or a panic are restarted from the saved position.
+	MaxRestarts int `toml:"max_restarts"`
+
+	// PoisonThreshold is how many times a rows event may stop the sync,
+	// across restarts, before it is quarantined to the dead-letter queue.
+	PoisonThreshold int `toml:"poison_threshold"`
+
+	ErrorPolicy         string `toml:"error_policy"`
+	ErrorMaxConsecutive int    `toml:"error_max_consecutive"`
+	DeadLetterFile      string `toml:"dead_letter_file"`
+	DeadLetterKey       string `toml:"dead_letter_key"`
+	DeadLetterType      string `toml:"dead_letter_type"`
+
+	// TxnTimeout is the time the river may spend applying a binlog
+	// transaction before the error policy applies to the rest of it.
+	TxnTimeout TomlDuration `toml:"txn_timeout"`
+
+	LagAlertThreshold TomlDuration `toml:"lag_alert_threshold"`
+
+	AlertWebhooks []string `toml:"alert_webhooks"`
+	AlertName     string   `toml:"alert_name"`
+
+	LogLevel      string `toml:"log_level"`
+	LogFormat     string `toml:"log_format"`
+	LogFile       string `toml:"log_file"`
+	LogMaxSize    int    `toml:"log_max_size"`
+	LogMaxBackups int    `toml:"log_max_backups"`
+	LogMaxAge     int    `toml:"log_max_age"`
+
+	// AuditLog is the file of the audit trail, JSON lines rotated like
+	// log_file, default in the log.
+	AuditLog string `toml:"audit_log"`
 }
 
-// NewConfigWithFile creates a Config from file.
+// NewConfigWithFile creates a Config from file, in YAML or JSON for
+// the .yaml, .yml or .json extension, else TOML.
 func NewConfigWithFile(name string) (*Config, error) {
-	data, err := ioutil.ReadFile(name)
+	return NewConfigWithFileFormat(name, "")
+}
+
+// NewConfig creates a Config from data, the included files are relative
+// to the working directory.
+func NewConfig(data string) (*Config, error) {
+	return newConfig(data, "")
+}
+
+func newConfig(data string, dir string) (*Config, error) {
+	var c Config
+
+	data, err := expandEnv(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	md, err := toml.Decode(data, &c)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	for _, key := range md.Undecoded() {
+		c.undecoded = append(c.undecoded, key.String())
+	}
+
+	if c.RuleDefaults != nil {
+		if c.Rules, err = c.decodeRules(data); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if err = c.includeFiles(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	return NewConfig(string(data))
+	return &c, nil
 }
 
-// NewConfig creates a Config from data.
-func NewConfig(data string) (*Config, error) {
-	var c Config
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${NAME} in the config with the environment variable,
+// ${NAME:-default} with default if it is not set, and $$ with $.
+// The values are escaped for the TOML string they are in, and can not
+// have a quote or a new line in a literal string. The comment lines are
+// kept.
+func expandEnv(data string) (string, error) {
+	var err error
+	expand := func(s string, quote byte) string {
+		if s == "$$" {
+			return "$"
+		}
+
+		m := envPattern.FindStringSubmatch(s)
+		v, ok := os.LookupEnv(m[1])
+		if !ok && len(m[2]) > 0 {
+			v, ok = m[3], true
+		}
+		if !ok {
+			if err == nil {
+				err = errors.Errorf("environment variable %s in config is not set", m[1])
+			}
+			return s
+		}
+
+		switch quote {
+		case '"':
+			return tomlEscaper.Replace(v)
+		case '\'':
+			if strings.ContainsAny(v, "'\r\n") && err == nil {
+				err = errors.Errorf("environment variable %s in a config literal string has a quote or a new line", m[1])
+			}
+		}
+		return v
+	}
+
+	lines := strings.Split(data, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
 
-	_, err := toml.Decode(data, &c)
+		var b strings.Builder
+		last := 0
+		for _, loc := range envPattern.FindAllStringIndex(line, -1) {
+			b.WriteString(line[last:loc[0]])
+			b.WriteString(expand(line[loc[0]:loc[1]], tomlQuote(line[:loc[0]])))
+			last = loc[1]
+		}
+		b.WriteString(line[last:])
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, "\n"), err
+}
+
+// tomlEscaper escapes a value for a TOML basic string.
+var tomlEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// tomlQuote returns the quote of the TOML string open at the end of the
+// line prefix, 0 if none.
+func tomlQuote(prefix string) byte {
+	var quote byte
+	for i := 0; i < len(prefix); i++ {
+		switch c := prefix[i]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			// the escaped character
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return quote
+}
+
+// decodeRules decodes the rules again on top of a copy of the rule
+// defaults, so only the options set in a rule override the defaults.
+func (c *Config) decodeRules(data string) ([]*Rule, error) {
+	var raw struct {
+		Rules []toml.Primitive `toml:"rule"`
+	}
+
+	md, err := toml.Decode(data, &raw)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	return &c, nil
+	rules := make([]*Rule, 0, len(raw.Rules))
+	for _, prim := range raw.Rules {
+		rule := c.RuleDefaults.clone()
+		if err = md.PrimitiveDecode(prim, rule); err != nil {
+			return nil, errors.Trace(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// includeFiles merges the sources and rules of the included TOML files,
+// a table in more than one file is an error.
+func (c *Config) includeFiles(dir string) error {
+	// the file of each source table and rule
+	files := make(map[string]string)
+	check := func(kind string, key string, name string) error {
+		if other, ok := files[kind+key]; ok && other != name {
+			return errors.Errorf("duplicate %s %s in %s and %s", kind, key, other, name)
+		}
+		files[kind+key] = name
+		return nil
+	}
+
+	for _, s := range c.Sources {
+		for _, table := range s.Tables {
+			check("source", s.Schema+"."+table, "config")
+		}
+	}
+	for _, rule := range c.Rules {
+		check("rule", rule.Schema+"."+rule.Table, "config")
+	}
+
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Annotatef(err, "include %s", pattern)
+		}
+
+		for _, name := range names {
+			inc, err := c.decodeInclude(name)
+			if err != nil {
+				return errors.Annotatef(err, "include %s", name)
+			}
+
+			for _, s := range inc.Sources {
+				for _, table := range s.Tables {
+					if err = check("source", s.Schema+"."+table, name); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+			for _, rule := range inc.Rules {
+				if err = check("rule", rule.Schema+"."+rule.Table, name); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			c.Sources = append(c.Sources, inc.Sources...)
+			c.Rules = append(c.Rules, inc.Rules...)
+		}
+	}
+
+	return nil
+}
+
+type includeConfig struct {
+	Sources []SourceConfig `toml:"source"`
+	Rules   []*Rule        `toml:"rule"`
+}
+
+func (c *Config) decodeInclude(name string) (*includeConfig, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := expandEnv(string(b))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var inc includeConfig
+	md, err := toml.Decode(data, &inc)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, key := range md.Undecoded() {
+		c.undecoded = append(c.undecoded, fmt.Sprintf("%s in %s", key, name))
+	}
+
+	if c.RuleDefaults != nil {
+		if inc.Rules, err = c.decodeRules(data); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return &inc, nil
 }
 
 // TomlDuration supports time codec for TOML format.
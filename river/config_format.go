@@ -0,0 +1,129 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config formats.
+const (
+	ConfigFormatTOML = "toml"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatJSON = "json"
+)
+
+// NewConfigWithFileFormat creates a Config from file in the format,
+// detected by the file extension if it is empty, default TOML.
+func NewConfigWithFileFormat(name string, format string) (*Config, error) {
+	if len(format) == 0 {
+		format = configFormat(name)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newConfigWithFormat(string(data), format, filepath.Dir(name))
+}
+
+// NewConfigWithFormat creates a Config from data in TOML, YAML or JSON,
+// with the same keys in all formats.
+func NewConfigWithFormat(data string, format string) (*Config, error) {
+	return newConfigWithFormat(data, format, "")
+}
+
+func newConfigWithFormat(data string, format string, dir string) (*Config, error) {
+	var (
+		v   interface{}
+		err error
+	)
+
+	switch format {
+	case "", ConfigFormatTOML:
+		return newConfig(data, dir)
+	case ConfigFormatYAML:
+		err = yaml.Unmarshal([]byte(data), &v)
+	case ConfigFormatJSON:
+		d := json.NewDecoder(strings.NewReader(data))
+		// keep the integers for TOML
+		d.UseNumber()
+		err = d.Decode(&v)
+	default:
+		return nil, errors.Errorf("invalid config format %s", format)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse %s config", format)
+	}
+
+	m, ok := normalizeConfigValue(v).(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("%s config must be an object", format)
+	}
+
+	// decode as TOML, so all formats share the decoding and validation
+	var buf bytes.Buffer
+	if err = toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, errors.Annotatef(err, "convert %s config", format)
+	}
+
+	return newConfig(buf.String(), dir)
+}
+
+func configFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".json":
+		return ConfigFormatJSON
+	}
+	return ConfigFormatTOML
+}
+
+// normalizeConfigValue converts the YAML and JSON values to the types
+// the TOML encoder supports, with the lists of objects as arrays of tables.
+func normalizeConfigValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[fmt.Sprint(k)] = normalizeConfigValue(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[k] = normalizeConfigValue(value)
+		}
+		return m
+	case []interface{}:
+		tables := make([]map[string]interface{}, 0, len(v))
+		list := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			value = normalizeConfigValue(value)
+			if m, ok := value.(map[string]interface{}); ok {
+				tables = append(tables, m)
+			}
+			list = append(list, value)
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+		return list
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
@@ -0,0 +1,391 @@
+package river
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// The Redis types of the dead-letter queue.
+const (
+	DeadLetterTypeList   = "list"
+	DeadLetterTypeStream = "stream"
+)
+
+// deadLetter is one failed rows event, written as a JSON line.
+type deadLetter struct {
+	Time   time.Time `json:"time"`
+	Schema string    `json:"schema"`
+	Table  string    `json:"table"`
+	Action string    `json:"action"`
+	// Rule is the key_prefix of the rule failed on, the only one of the
+	// table replaying the event with rule_overlap all
+	Rule string `json:"rule,omitempty"`
+	// RuleName is the schema.table of the rule failed on, its table in
+	// the rules, the table of the event for the dead letters without one
+	RuleName string          `json:"rule_name,omitempty"`
+	Keys     []string        `json:"keys,omitempty"`
+	Rows     [][]interface{} `json:"rows"`
+	// Redacted are the sensitive columns replaced in the rows, not
+	// written on replay
+	Redacted []string       `json:"redacted,omitempty"`
+	Pos      mysql.Position `json:"pos"`
+	Err      string         `json:"err"`
+}
+
+// deadLetterQueue keeps the failed rows events in a file and/or a Redis
+// list or stream.
+type deadLetterQueue struct {
+	sync.Mutex
+
+	r *River
+
+	path string
+	f    *os.File
+	key  string
+	// DeadLetterTypeList or DeadLetterTypeStream
+	typ string
+}
+
+func newDeadLetterQueue(r *River, path string, key string) (*deadLetterQueue, error) {
+	q := &deadLetterQueue{r: r, path: path, key: key, typ: r.c.DeadLetterType}
+	if len(q.typ) == 0 {
+		q.typ = DeadLetterTypeList
+	}
+
+	if len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		q.f = f
+	}
+
+	return q, nil
+}
+
+// Put writes the rows event failed with the rule to the queue.
+func (q *deadLetterQueue) Put(rule *Rule, e *canal.RowsEvent, err error) error {
+	rows, redacted := redactRows(rule, e.Rows)
+	l := deadLetter{
+		Time:     time.Now(),
+		Schema:   e.Table.Schema,
+		Table:    e.Table.Name,
+		Action:   e.Action,
+		Rule:     rule.keyPrefix,
+		RuleName: rule.Schema + "." + rule.Table,
+		Keys:     q.r.rowsKeys(rule, e.Action, e.Rows),
+		Rows:     encodeDeadLetterRows(rows),
+		Redacted: redacted,
+		Pos:      q.r.syncedPosition(),
+		Err:      err.Error(),
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.f != nil {
+		if _, err = q.f.Write(append(data, '\n')); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(q.key) > 0 {
+		if q.typ == DeadLetterTypeStream {
+			_, err = q.r.doRedis("XADD", q.key, "*", "event", data)
+		} else {
+			_, err = q.r.doRedis("RPUSH", q.key, data)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// rowsKeys returns the Redis keys of the rows, the keys failed to build are omitted.
+func (r *River) rowsKeys(rule *Rule, action string, rows [][]interface{}) []string {
+	var keys []string
+	for i, row := range rows {
+		// the update rows are pairs of before and after
+		if action == canal.UpdateAction && i%2 == 0 {
+			continue
+		}
+		if key, err := r.getPKValue(rule, row); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ReplayDeadLetters applies the rows events in the dead-letter queue
+// again in order, once the problem they failed on is fixed, removing the
+// applied ones from dead_letter_key and dead_letter_file. It stops at the
+// first event failing again, and returns the number of events applied.
+// It must not be called while the River runs.
+func (r *River) ReplayDeadLetters(ctx context.Context) (int, error) {
+	q := r.deadLetters
+	q.Lock()
+	defer q.Unlock()
+
+	n, err := q.replayKey(ctx)
+	if err == nil {
+		var m int
+		m, err = q.replayFile(ctx)
+		n += m
+	}
+
+	details := map[string]interface{}{"replayed": n}
+	if err != nil {
+		details["err"] = err.Error()
+	}
+	r.audit.Record("replay_dead_letters", AuditSourceAPI, details)
+	return n, errors.Trace(err)
+}
+
+func (q *deadLetterQueue) replayKey(ctx context.Context) (int, error) {
+	if len(q.key) == 0 {
+		return 0, nil
+	}
+
+	n := 0
+	for ctx.Err() == nil {
+		var (
+			data []byte
+			id   string
+			err  error
+		)
+		if q.typ == DeadLetterTypeStream {
+			data, id, err = q.firstStreamEntry()
+		} else {
+			data, err = redis.Bytes(q.r.doRedis("LINDEX", q.key, 0))
+		}
+		if err == redis.ErrNil || (err == nil && data == nil) {
+			return n, nil
+		} else if err != nil {
+			return n, errors.Trace(err)
+		}
+
+		if err = q.r.replayDeadLetter(data); err != nil {
+			return n, errors.Trace(err)
+		}
+
+		if q.typ == DeadLetterTypeStream {
+			_, err = q.r.doRedis("XDEL", q.key, id)
+		} else {
+			_, err = q.r.doRedis("LPOP", q.key)
+		}
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		n++
+	}
+	return n, errors.Trace(ctx.Err())
+}
+
+// firstStreamEntry returns the event and ID of the first entry of the stream.
+func (q *deadLetterQueue) firstStreamEntry() ([]byte, string, error) {
+	entries, err := redis.Values(q.r.doRedis("XRANGE", q.key, "-", "+", "COUNT", 1))
+	if err != nil || len(entries) == 0 {
+		return nil, "", err
+	}
+
+	// [id, [field, value, ...]]
+	entry, err := redis.Values(entries[0], nil)
+	if err != nil || len(entry) != 2 {
+		return nil, "", errors.Errorf("invalid stream entry %v", entries[0])
+	}
+	id, _ := redis.String(entry[0], nil)
+	fields, err := redis.ByteSlices(entry[1], nil)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == "event" {
+			return fields[i+1], id, nil
+		}
+	}
+	return nil, "", errors.Errorf("no event in stream entry %s", id)
+}
+
+// replayFile replays the lines of the file, keeping the ones not applied.
+func (q *deadLetterQueue) replayFile(ctx context.Context) (int, error) {
+	if q.f == nil {
+		return 0, nil
+	}
+
+	data, err := ioutil.ReadFile(q.path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var rest bytes.Buffer
+	n := 0
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 64*1024*1024)
+	for s.Scan() {
+		line := s.Bytes()
+		if rest.Len() == 0 && ctx.Err() == nil && len(line) > 0 {
+			if err = q.r.replayDeadLetter(line); err == nil {
+				n++
+				continue
+			}
+		}
+		rest.Write(line)
+		rest.WriteByte('\n')
+	}
+	if serr := s.Err(); serr != nil && err == nil {
+		err = serr
+	}
+
+	// the file is opened to append, so truncating it keeps appending right
+	if terr := q.f.Truncate(0); terr != nil {
+		return n, errors.Trace(terr)
+	}
+	if _, werr := q.f.Write(rest.Bytes()); werr != nil {
+		return n, errors.Trace(werr)
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	return n, errors.Trace(err)
+}
+
+// encodeDeadLetterRows tags the []byte values of TEXT, BLOB and BINARY
+// columns as {"bytes": base64}, so they are not replayed as base64 strings.
+func encodeDeadLetterRows(rows [][]interface{}) [][]interface{} {
+	encoded := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		values := make([]interface{}, len(row))
+		for i, value := range row {
+			if v, ok := value.([]byte); ok {
+				values[i] = map[string][]byte{"bytes": v}
+			} else {
+				values[i] = value
+			}
+		}
+		encoded = append(encoded, values)
+	}
+	return encoded
+}
+
+// decodeDeadLetterRows returns the rows of encodeDeadLetterRows decoded
+// with json.Number, the numbers as integers or exact strings.
+func decodeDeadLetterRows(rows [][]interface{}) error {
+	for _, row := range rows {
+		for i, value := range row {
+			switch v := value.(type) {
+			case json.Number:
+				if n, err := v.Int64(); err == nil {
+					row[i] = n
+				} else {
+					row[i] = v.String()
+				}
+			case map[string]interface{}:
+				s, ok := v["bytes"].(string)
+				if !ok || len(v) != 1 {
+					return errors.Errorf("invalid dead letter value %v", v)
+				}
+				data, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return errors.Annotatef(err, "invalid dead letter bytes")
+				}
+				row[i] = data
+			}
+		}
+	}
+	return nil
+}
+
+// ruleOfDeadLetter returns the rule the dead letter failed on, by its
+// schema.table and key_prefix.
+func (r *River) ruleOfDeadLetter(l *deadLetter) (*Rule, error) {
+	rule, ok := r.rules[ruleKey(l.Schema, l.Table)]
+	if len(l.RuleName) > 0 {
+		var err error
+		if rule, err = r.ruleByName(l.RuleName); err != nil {
+			return nil, errors.Annotatef(ErrRuleNotExist, "dead letter %s.%s rule %s", l.Schema, l.Table, l.RuleName)
+		}
+		ok = true
+	}
+	if ok {
+		rule, ok = deadLetterRule(rule, l)
+	}
+	if !ok {
+		return nil, errors.Annotatef(ErrRuleNotExist, "dead letter %s.%s rule %s", l.Schema, l.Table, l.Rule)
+	}
+	return rule, nil
+}
+
+// deadLetterRule returns the rule of the dead letter among the overlapping
+// rules of its table, the first one for the dead letters without a rule.
+func deadLetterRule(rule *Rule, l *deadLetter) (*Rule, bool) {
+	if len(l.Rule) == 0 {
+		return rule, true
+	}
+	for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+		if rule.keyPrefix == l.Rule {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// replayDeadLetter applies the rows event of the JSON dead letter with the
+// rule it failed on, not the other rules of its table which applied it.
+func (r *River) replayDeadLetter(data []byte) error {
+	var l deadLetter
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&l); err != nil {
+		return errors.Annotatef(err, "decode dead letter")
+	}
+	if err := decodeDeadLetterRows(l.Rows); err != nil {
+		return errors.Trace(err)
+	}
+
+	rule, err := r.ruleOfDeadLetter(&l)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(l.Redacted) > 0 {
+		rule = rule.withoutColumns(l.Redacted)
+	}
+
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: l.Action, Rows: l.Rows}
+	h := &eventHandler{r}
+	if err := h.applyRuleRows(rule, e); err != nil {
+		return errors.Annotatef(err, "replay %s %s.%s from binlog %s", l.Action, l.Schema, l.Table, l.Pos)
+	}
+
+	log.Infof("replayed dead letter %s %s.%s from binlog %s", l.Action, l.Schema, l.Table, l.Pos)
+	return nil
+}
+
+// Close closes the dead-letter file.
+func (q *deadLetterQueue) Close() error {
+	if q == nil || q.f == nil {
+		return nil
+	}
+
+	return q.f.Close()
+}
@@ -0,0 +1,21 @@
+// Package river syncs MySQL tables to Redis by the binlog, it is the
+// engine of the go-mysql-redis binary and can be embedded in other Go
+// services instead of running the binary:
+//
+//	c, err := river.NewConfigWithFile("river.toml")
+//	...
+//	r, err := river.New(c)
+//	...
+//	go r.Run(ctx)
+//	err = r.Pause(ctx, river.HTTPAuditSource(req))
+//	err = r.Resume(ctx, river.HTTPAuditSource(req))
+//	st := r.Status()
+//	r.Close()
+//
+// Only the River lifecycle follows semantic versioning, it is changed
+// incompatibly in a new major version only: New, NewConfig and
+// NewConfigWithFile, the River methods Run, Close, Pause, Resume, Paused
+// and Status, and the Status and RuleStatus types. The other exported
+// identifiers, like Rule, RowMapper and RowVerifier exposing the go-mysql
+// schema types, and the /stat text format, may change in a minor version.
+package river
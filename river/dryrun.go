@@ -0,0 +1,59 @@
+package river
+
+import (
+	"strings"
+	"time"
+)
+
+// readOnlyRedisCommands are the commands run in dry run, all the other
+// commands are writes, which are counted instead.
+var readOnlyRedisCommands = map[string]bool{
+	"PING":     true,
+	"ACL":      true,
+	"INFO":     true,
+	"EXISTS":   true,
+	"TYPE":     true,
+	"TTL":      true,
+	"PTTL":     true,
+	"GET":      true,
+	"HGET":     true,
+	"HGETALL":  true,
+	"HKEYS":    true,
+	"LINDEX":   true,
+	"LRANGE":   true,
+	"SCAN":     true,
+	"SMEMBERS": true,
+	"XRANGE":   true,
+}
+
+// dryRun records the command instead of running it if dry_run is set and
+// it is a write, it returns true if so.
+func (r *River) dryRun(cmd string, args []interface{}) bool {
+	cmd = strings.ToUpper(cmd)
+	if !r.c.DryRun || readOnlyRedisCommands[cmd] {
+		return false
+	}
+
+	var key string
+	if len(args) > 0 {
+		key = transformString(args[0])
+	}
+	r.st.DryRunCmd(cmd)
+	r.st.dryRunCmds.Add(sample{
+		Time:   time.Now(),
+		Action: cmd,
+		Key:    key,
+	})
+	return true
+}
+
+// DryRunCmd counts a write command not run in dry run.
+func (s *stat) DryRunCmd(cmd string) {
+	s.dryRunLock.Lock()
+	defer s.dryRunLock.Unlock()
+
+	if s.dryRun == nil {
+		s.dryRun = make(map[string]int64)
+	}
+	s.dryRun[cmd]++
+}
@@ -0,0 +1,197 @@
+package river
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The dump_ssl_mode values, as the mysqldump --ssl-mode option.
+const (
+	DumpSSLModeDisabled       = "DISABLED"
+	DumpSSLModePreferred      = "PREFERRED"
+	DumpSSLModeRequired       = "REQUIRED"
+	DumpSSLModeVerifyCA       = "VERIFY_CA"
+	DumpSSLModeVerifyIdentity = "VERIFY_IDENTITY"
+)
+
+// dumpSSLOptions returns the mysqldump options of dump_ssl_mode and the
+// certificates. MariaDB mysqldump has no --ssl-mode, so it gets --ssl and
+// --ssl-verify-server-cert instead.
+func (c *Config) dumpSSLOptions() []string {
+	var opts []string
+	mode := strings.ToUpper(c.DumpSSLMode)
+	if len(mode) > 0 {
+		if c.Flavor != "mariadb" {
+			opts = append(opts, "--ssl-mode="+mode)
+		} else if mode == DumpSSLModeDisabled {
+			opts = append(opts, "--skip-ssl")
+		} else {
+			opts = append(opts, "--ssl")
+			if mode == DumpSSLModeVerifyCA || mode == DumpSSLModeVerifyIdentity {
+				opts = append(opts, "--ssl-verify-server-cert")
+			}
+		}
+	}
+
+	for _, opt := range []struct{ name, value string }{
+		{"--ssl-ca", c.DumpSSLCA},
+		{"--ssl-cert", c.DumpSSLCert},
+		{"--ssl-key", c.DumpSSLKey},
+	} {
+		if len(opt.value) > 0 {
+			opts = append(opts, opt.name+"="+opt.value)
+		}
+	}
+	return opts
+}
+
+// sshTunnel forwards the local connections of mysqldump to MySQL through
+// an SSH bastion, for a dump crossing a network boundary.
+type sshTunnel struct {
+	sync.Mutex
+
+	addr   string
+	config *ssh.ClientConfig
+	client *ssh.Client
+	l      net.Listener
+	target string
+}
+
+// newSSHTunnel connects the bastion dump_ssh_addr and listens on a local
+// port for mysqldump. The host key of the bastion must be in
+// dump_ssh_known_hosts, default ~/.ssh/known_hosts.
+func newSSHTunnel(c *Config) (*sshTunnel, error) {
+	key, err := ioutil.ReadFile(c.DumpSSHKeyFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read dump_ssh_key_file")
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parse dump_ssh_key_file %s", c.DumpSSHKeyFile)
+	}
+
+	knownHosts := c.DumpSSHKnownHosts
+	if len(knownHosts) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKey, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read dump_ssh_known_hosts %s", knownHosts)
+	}
+
+	t := &sshTunnel{
+		addr: c.DumpSSHAddr,
+		config: &ssh.ClientConfig{
+			User:            c.DumpSSHUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         10 * time.Second,
+		},
+		target: c.MyAddr,
+	}
+	if t.client, err = ssh.Dial("tcp", t.addr, t.config); err != nil {
+		return nil, errors.Annotatef(err, "connect SSH bastion %s", t.addr)
+	}
+
+	if t.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.client.Close()
+		return nil, errors.Trace(err)
+	}
+
+	log.Infof("dump MySQL %s through SSH bastion %s", c.MyAddr, c.DumpSSHAddr)
+	go t.serve()
+	return t, nil
+}
+
+// Options returns the mysqldump options to connect through the tunnel,
+// they come after and override the host and port of my_addr.
+func (t *sshTunnel) Options() []string {
+	host, port, _ := net.SplitHostPort(t.l.Addr().String())
+	return []string{"--protocol=TCP", "--host=" + host, "--port=" + port}
+}
+
+func (t *sshTunnel) serve() {
+	for {
+		conn, err := t.l.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(conn)
+	}
+}
+
+func (t *sshTunnel) forward(conn net.Conn) {
+	defer conn.Close()
+
+	remote, err := t.dial()
+	if err != nil {
+		log.Errorf("dial MySQL %s through SSH err %v", t.target, err)
+		return
+	}
+	defer remote.Close()
+
+	// either side closing ends the forward
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dial connects the target through the bastion, connecting the bastion
+// again if the connection was lost, like between the dumps.
+func (t *sshTunnel) dial() (net.Conn, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.client != nil {
+		conn, err := t.client.Dial("tcp", t.target)
+		if err == nil {
+			return conn, nil
+		}
+		t.client.Close()
+		t.client = nil
+	}
+
+	client, err := ssh.Dial("tcp", t.addr, t.config)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect SSH bastion %s", t.addr)
+	}
+	t.client = client
+	conn, err := client.Dial("tcp", t.target)
+	return conn, errors.Trace(err)
+}
+
+// Close stops the tunnel, all methods are no-ops on a nil tunnel.
+func (t *sshTunnel) Close() {
+	if t == nil {
+		return
+	}
+	t.l.Close()
+
+	t.Lock()
+	defer t.Unlock()
+	if t.client != nil {
+		t.client.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package river
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// newEncrypter returns the AES-GCM cipher of the base64 key, 16, 24 or 32
+// bytes for AES-128, AES-192 or AES-256.
+func newEncrypter(key string) (cipher.AEAD, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid base64 encrypt_key")
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid encrypt_key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// hasEncryptKey returns true if the rule has the key of the encrypt
+// transform, or reads it from a file, an environment variable or Vault.
+func (r *Rule) hasEncryptKey() bool {
+	return r.encrypter != nil || len(r.EncryptKeyFile) > 0 || len(r.EncryptKeyEnv) > 0 || len(r.EncryptKeyVault) > 0
+}
+
+// encryptValue seals the value with a random nonce, and returns the
+// base64 of the nonce followed by the ciphertext.
+func encryptValue(aead cipher.AEAD, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Trace(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// DecryptValue decrypts a field written by the encrypt transform with
+// the base64 encrypt_key of the rule, for the services reading Redis.
+func DecryptValue(key string, value string) (string, error) {
+	aead, err := newEncrypter(key)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", errors.Annotatef(err, "invalid encrypted value")
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value, too short")
+	}
+
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Annotatef(err, "decrypt value")
+	}
+	return string(plain), nil
+}
+
+func encryptTransform(rule *Rule) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		if rule.encrypter == nil {
+			return nil, errors.Errorf("%s.%s encrypt_key is not set", rule.Schema, rule.Table)
+		}
+		return encryptValue(rule.encrypter, transformString(value))
+	}
+}
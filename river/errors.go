@@ -0,0 +1,87 @@
+package river
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// Error is a failure cause of the river. The errors returned by the river
+// keep it as the cause, so it is checked like
+//
+//	if errors.Cause(err) == river.ErrRedisUnavailable {
+//
+// or with ErrorCode(err), or the standard errors.Is.
+type Error struct {
+	// Code is a stable name of the cause, like "redis_unavailable".
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// The failure causes of the river.
+var (
+	// ErrRuleNotExist is the error if rule is not defined.
+	ErrRuleNotExist = &Error{Code: "rule_not_exist", Message: "rule is not exist"}
+	// ErrInvalidConfig is the error if the config is invalid.
+	ErrInvalidConfig = &Error{Code: "invalid_config", Message: "invalid config"}
+	// ErrMySQLUnavailable is the error if MySQL can not be connected.
+	ErrMySQLUnavailable = &Error{Code: "mysql_unavailable", Message: "MySQL is unavailable"}
+	// ErrRedisUnavailable is the error if Redis can not be connected or the connection fails.
+	ErrRedisUnavailable = &Error{Code: "redis_unavailable", Message: "Redis is unavailable"}
+	// ErrRedisCommand is the error if Redis replies an error to a command.
+	ErrRedisCommand = &Error{Code: "redis_command", Message: "Redis command failed"}
+	// ErrPKMissing is the error if the key of a row can not be built.
+	ErrPKMissing = &Error{Code: "pk_missing", Message: "primary key is missing"}
+	// ErrBinlogPurged is the error if the saved binlog position is not on MySQL any more.
+	ErrBinlogPurged = &Error{Code: "binlog_purged", Message: "binlog position is purged"}
+	// ErrSchemaMismatch is the error if the rows do not match the table schema.
+	ErrSchemaMismatch = &Error{Code: "schema_mismatch", Message: "rows do not match the table schema"}
+)
+
+// causeError is an error with an Error as its cause.
+type causeError struct {
+	cause *Error
+	err   error
+}
+
+// wrapError returns err with the cause, keeping the message of err.
+func wrapError(err error, cause *Error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := errors.Cause(err).(*Error); ok {
+		return err
+	}
+	return &causeError{cause: cause, err: err}
+}
+
+func (e *causeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.cause.Message, e.err)
+}
+
+// Cause returns the cause for juju errors.Cause.
+func (e *causeError) Cause() error {
+	return e.cause
+}
+
+// Unwrap returns the wrapped error for the standard errors.As.
+func (e *causeError) Unwrap() error {
+	return e.err
+}
+
+// Is reports the cause for the standard errors.Is.
+func (e *causeError) Is(target error) bool {
+	return target == e.cause
+}
+
+// ErrorCode returns the Code of the cause of err, or "" if the cause is not an Error.
+func ErrorCode(err error) string {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
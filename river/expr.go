@@ -0,0 +1,328 @@
+package river
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/juju/errors"
+)
+
+// expr is a parsed row filter expression, like
+//
+//	status == "active" && deleted_at == nil
+//
+// It supports column names, string, number, true, false and nil literals,
+// the comparisons == != < <= > >=, and && || ! with parentheses.
+type expr interface {
+	eval(row map[string]interface{}) interface{}
+}
+
+type (
+	literalExpr struct{ value interface{} }
+	columnExpr  struct{ name string }
+	notExpr     struct{ x expr }
+	binaryExpr  struct {
+		op   string
+		x, y expr
+	}
+)
+
+func (e literalExpr) eval(row map[string]interface{}) interface{} { return e.value }
+func (e columnExpr) eval(row map[string]interface{}) interface{} {
+	return normalizeExprValue(row[e.name])
+}
+func (e notExpr) eval(row map[string]interface{}) interface{} { return !isTrue(e.x.eval(row)) }
+
+func (e binaryExpr) eval(row map[string]interface{}) interface{} {
+	switch e.op {
+	case "&&":
+		return isTrue(e.x.eval(row)) && isTrue(e.y.eval(row))
+	case "||":
+		return isTrue(e.x.eval(row)) || isTrue(e.y.eval(row))
+	}
+
+	x, y := e.x.eval(row), e.y.eval(row)
+	if x == nil || y == nil {
+		switch e.op {
+		case "==":
+			return x == nil && y == nil
+		case "!=":
+			return !(x == nil && y == nil)
+		}
+		return false
+	}
+
+	c := compareExprValues(x, y)
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// isTrue returns true for true and any nonzero number, like a TINYINT(1)
+// column of 1, as MySQL.
+func isTrue(v interface{}) bool {
+	switch v := normalizeExprValue(v).(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+// normalizeExprValue converts the column value to nil, bool, float64 or string.
+func normalizeExprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, float64, string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	if f, err := strconv.ParseFloat(fmt.Sprintf("%v", v), 64); err == nil {
+		return f
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// compareExprValues compares as numbers if both are numbers, else as strings.
+func compareExprValues(x, y interface{}) int {
+	xf, xok := toFloat(x)
+	yf, yok := toFloat(y)
+	if xok && yok {
+		switch {
+		case xf < yf:
+			return -1
+		case xf > yf:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", x), fmt.Sprintf("%v", y))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseExpr parses the filter expression.
+func parseExpr(s string) (expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errors.Errorf("unexpected %s in expression %s", p.tokens[p.pos].text, s)
+	}
+	return e, nil
+}
+
+type exprToken struct {
+	// kind is ident, string, number or op
+	kind string
+	text string
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			var buf strings.Builder
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				buf.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, errors.Errorf("unterminated string in expression %s", s)
+			}
+			tokens = append(tokens, exprToken{"string", buf.String()})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{"number", s[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, exprToken{"ident", s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, errors.Errorf("invalid character %q in expression %s", c, s)
+			}
+			tokens = append(tokens, exprToken{"op", op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != "op" {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("||"); !ok {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"||", x, y}
+	}
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	x, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&&"); !ok {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"&&", x, y}
+	}
+}
+
+func (p *exprParser) parseCompare() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOp("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return x, nil
+	}
+	p.pos++
+	y, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryExpr{op, x, y}, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case "string":
+		return literalExpr{t.text}, nil
+	case "number":
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %s", t.text)
+		}
+		return literalExpr{f}, nil
+	case "ident":
+		switch t.text {
+		case "nil", "null", "NULL":
+			return literalExpr{nil}, nil
+		case "true":
+			return literalExpr{true}, nil
+		case "false":
+			return literalExpr{false}, nil
+		}
+		return columnExpr{t.text}, nil
+	}
+
+	switch t.text {
+	case "!":
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	case "(":
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, errors.New("missing ) in expression")
+		}
+		p.pos++
+		return x, nil
+	}
+
+	return nil, errors.Errorf("unexpected %s in expression", t.text)
+}
@@ -0,0 +1,91 @@
+package river
+
+import (
+	stderrors "errors"
+	"net"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// redirectRedis handles the error replies telling the river to write to
+// another Redis: READONLY after a failover promoted another node, the
+// address is resolved again, and MOVED after a cluster reshard, the node
+// in the reply is connected. It returns true if the connection changed.
+func (r *River) redirectRedis(err error) bool {
+	var reply redis.Error
+	if !stderrors.As(err, &reply) {
+		return false
+	}
+
+	msg := string(reply)
+	switch {
+	case strings.HasPrefix(msg, "READONLY"):
+		log.Warnf("Redis %s is read only, resolve the master again", r.redisAddr)
+		r.redisAddr = ""
+	case strings.HasPrefix(msg, "MOVED "):
+		// MOVED <slot> <host:port>
+		seps := strings.Fields(msg)
+		if len(seps) != 3 {
+			return false
+		}
+		log.Warnf("Redis slot %s moved to %s", seps[1], seps[2])
+		r.redisAddr = seps[2]
+	default:
+		return false
+	}
+
+	r.redisState.down(err)
+	if err := r.dialRedis(); err != nil {
+		log.Errorf("dial Redis err %v", err)
+		return false
+	}
+	return true
+}
+
+// resolveRedis returns the address of the Redis master: the node of the
+// last MOVED reply, else the one of resolveRedisMaster.
+func (r *River) resolveRedis() (string, error) {
+	if len(r.redisAddr) > 0 {
+		return r.redisAddr, nil
+	}
+	return r.resolveRedisMaster()
+}
+
+// resolveRedisMaster returns the master known by the Sentinels if
+// redis_sentinel_master is set, else redis_addr.
+func (r *River) resolveRedisMaster() (string, error) {
+	if len(r.c.RedisSentinelMaster) == 0 {
+		return r.c.RedisAddr, nil
+	}
+
+	var lastErr error
+	for _, addr := range r.c.RedisSentinelAddrs {
+		master, err := querySentinel(addr, r.c.RedisSentinelMaster)
+		if err == nil {
+			return master, nil
+		}
+		log.Warnf("query Redis Sentinel %s err %v", addr, err)
+		lastErr = err
+	}
+	return "", errors.Annotatef(lastErr, "no Redis Sentinel knows master %s", r.c.RedisSentinelMaster)
+}
+
+func querySentinel(addr string, name string) (string, error) {
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer conn.Close()
+
+	hostPort, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", name))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(hostPort) != 2 {
+		return "", errors.Errorf("invalid master address %v", hostPort)
+	}
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
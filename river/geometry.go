@@ -0,0 +1,321 @@
+package river
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// The formats of the GEOMETRY columns.
+const (
+	// GeometryFormatWKT writes the well-known text like POINT(1 2), the default.
+	GeometryFormatWKT = "wkt"
+	// GeometryFormatGeoJSON writes the GeoJSON geometry object.
+	GeometryFormatGeoJSON = "geojson"
+)
+
+// The WKB geometry types.
+const (
+	wkbPoint              = 1
+	wkbLineString         = 2
+	wkbPolygon            = 3
+	wkbMultiPoint         = 4
+	wkbMultiLineString    = 5
+	wkbMultiPolygon       = 6
+	wkbGeometryCollection = 7
+)
+
+var geometryTypeNames = map[uint32]string{
+	wkbPoint:              "Point",
+	wkbLineString:         "LineString",
+	wkbPolygon:            "Polygon",
+	wkbMultiPoint:         "MultiPoint",
+	wkbMultiLineString:    "MultiLineString",
+	wkbMultiPolygon:       "MultiPolygon",
+	wkbGeometryCollection: "GeometryCollection",
+}
+
+// geometry is a decoded MySQL geometry value. MySQL stores the coordinates
+// of a geographic SRS like 4326 in longitude-latitude order too, so X is
+// the longitude.
+type geometry struct {
+	SRID uint32
+	Type uint32
+	// coords is [2]float64 for a point, [][2]float64 for a linestring, and
+	// []interface{} of the coords of the rings or parts for the others
+	coords interface{}
+	// geometries are the parts of a collection
+	geometries []*geometry
+}
+
+// isGeometryColumn returns true for the spatial columns.
+func isGeometryColumn(col *schema.TableColumn) bool {
+	t := strings.ToLower(col.RawType)
+	if i := strings.IndexAny(t, " ("); i >= 0 {
+		t = t[:i]
+	}
+	switch t {
+	case "geometry", "point", "linestring", "polygon", "multipoint", "multilinestring",
+		"multipolygon", "geometrycollection", "geomcollection":
+		return true
+	}
+	return false
+}
+
+// parseGeometry decodes the MySQL internal geometry format, the SRID as a
+// little-endian uint32 followed by the WKB.
+func parseGeometry(data []byte) (*geometry, error) {
+	if len(data) < 4 {
+		return nil, errors.Errorf("invalid geometry, %d bytes", len(data))
+	}
+
+	r := &wkbReader{data: data[4:]}
+	g, err := r.geometry()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	g.SRID = binary.LittleEndian.Uint32(data)
+	return g, nil
+}
+
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errors.New("invalid geometry, too short")
+	}
+	v := r.order.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *wkbReader) point() ([2]float64, error) {
+	var p [2]float64
+	if r.pos+16 > len(r.data) {
+		return p, errors.New("invalid geometry, too short")
+	}
+	p[0] = math.Float64frombits(r.order.Uint64(r.data[r.pos:]))
+	p[1] = math.Float64frombits(r.order.Uint64(r.data[r.pos+8:]))
+	r.pos += 16
+	return p, nil
+}
+
+func (r *wkbReader) points() ([][2]float64, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	// a point is 16 bytes, so n is not trusted to allocate
+	if int(n) > (len(r.data)-r.pos)/16 {
+		return nil, errors.Errorf("invalid geometry, %d points", n)
+	}
+	points := make([][2]float64, 0, n)
+	for i := uint32(0); i < n; i++ {
+		p, err := r.point()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func (r *wkbReader) geometry() (*geometry, error) {
+	if r.pos >= len(r.data) {
+		return nil, errors.New("invalid geometry, too short")
+	}
+	switch r.data[r.pos] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return nil, errors.Errorf("invalid geometry byte order %d", r.data[r.pos])
+	}
+	r.pos++
+
+	typ, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	g := &geometry{Type: typ}
+
+	switch typ {
+	case wkbPoint:
+		g.coords, err = r.point()
+	case wkbLineString:
+		g.coords, err = r.points()
+	case wkbPolygon:
+		var n uint32
+		if n, err = r.uint32(); err != nil {
+			return nil, err
+		}
+		rings := make([]interface{}, 0)
+		for i := uint32(0); i < n && err == nil; i++ {
+			var ring [][2]float64
+			if ring, err = r.points(); err == nil {
+				rings = append(rings, ring)
+			}
+		}
+		g.coords = rings
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection:
+		var n uint32
+		if n, err = r.uint32(); err != nil {
+			return nil, err
+		}
+		parts := make([]interface{}, 0)
+		for i := uint32(0); i < n && err == nil; i++ {
+			var part *geometry
+			if part, err = r.geometry(); err == nil {
+				g.geometries = append(g.geometries, part)
+				parts = append(parts, part.coords)
+			}
+		}
+		if typ != wkbGeometryCollection {
+			g.coords = parts
+		}
+	default:
+		return nil, errors.Errorf("invalid geometry type %d", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// WKT returns the well-known text of the geometry, like MySQL ST_AsText.
+func (g *geometry) WKT() string {
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToUpper(geometryTypeNames[g.Type]))
+	switch g.Type {
+	case wkbGeometryCollection:
+		buf.WriteByte('(')
+		for i, part := range g.geometries {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(part.WKT())
+		}
+		buf.WriteByte(')')
+	case wkbPoint:
+		buf.WriteByte('(')
+		writeWKTCoords(&buf, g.coords)
+		buf.WriteByte(')')
+	default:
+		writeWKTCoords(&buf, g.coords)
+	}
+	return buf.String()
+}
+
+// writeWKTCoords writes a point as "x y", and the others as the
+// parenthesized list of their parts.
+func writeWKTCoords(buf *bytes.Buffer, coords interface{}) {
+	var parts []interface{}
+	switch c := coords.(type) {
+	case [2]float64:
+		buf.WriteString(strconv.FormatFloat(c[0], 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(c[1], 'f', -1, 64))
+		return
+	case [][2]float64:
+		for _, p := range c {
+			parts = append(parts, p)
+		}
+	case []interface{}:
+		parts = c
+	}
+
+	// the points of a multipoint are parenthesized like MySQL 8
+	_, multiPoint := coords.([]interface{})
+	buf.WriteByte('(')
+	for i, part := range parts {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if _, ok := part.([2]float64); ok && multiPoint {
+			buf.WriteByte('(')
+			writeWKTCoords(buf, part)
+			buf.WriteByte(')')
+			continue
+		}
+		writeWKTCoords(buf, part)
+	}
+	buf.WriteByte(')')
+}
+
+// GeoJSON returns the GeoJSON geometry object.
+func (g *geometry) GeoJSON() string {
+	data, _ := json.Marshal(g.geoJSON())
+	return string(data)
+}
+
+func (g *geometry) geoJSON() map[string]interface{} {
+	if g.Type == wkbGeometryCollection {
+		geometries := make([]interface{}, 0, len(g.geometries))
+		for _, part := range g.geometries {
+			geometries = append(geometries, part.geoJSON())
+		}
+		return map[string]interface{}{"type": geometryTypeNames[g.Type], "geometries": geometries}
+	}
+	return map[string]interface{}{"type": geometryTypeNames[g.Type], "coordinates": g.coords}
+}
+
+// geometryValue decodes the geometry column value by the rule
+// geometry_format, an invalid one is kept raw.
+func geometryValue(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	g, err := parseGeometry(binaryBytes(value))
+	if err != nil {
+		log.Warnf("decode %s.%s geometry column %s err %v, keep it raw", rule.Schema, rule.Table, col.Name, err)
+		return value
+	}
+
+	if rule.GeometryFormat == GeometryFormatGeoJSON {
+		return g.GeoJSON()
+	}
+	return g.WKT()
+}
+
+// The coordinates GEOADD accepts, the latitudes of the Web Mercator.
+const (
+	geoMaxLongitude = 180
+	geoMaxLatitude  = 85.05112878
+)
+
+// geoPoint returns the longitude and latitude of the POINT column of the
+// row, false if the row is nil, or the column is NULL, another geometry or
+// a point out of the GEOADD range.
+func geoPoint(rule *Rule, column string, row []interface{}) ([2]float64, bool, error) {
+	var p [2]float64
+	i := rule.TableInfo.FindColumn(column)
+	if i < 0 {
+		return p, false, errors.Errorf("%s.%s geo output column %s is not exist", rule.Schema, rule.Table, column)
+	}
+	if i >= len(row) || row[i] == nil {
+		return p, false, nil
+	}
+
+	g, err := parseGeometry(binaryBytes(row[i]))
+	if err != nil {
+		return p, false, errors.Annotatef(err, "%s.%s geo output column %s", rule.Schema, rule.Table, column)
+	}
+	if g.Type != wkbPoint {
+		return p, false, nil
+	}
+	p = g.coords.([2]float64)
+	if math.Abs(p[0]) > geoMaxLongitude || math.Abs(p[1]) > geoMaxLatitude {
+		log.Warnf("%s.%s geo output column %s point %v %v out of range, removed", rule.Schema, rule.Table, column, rule.logValue(column, p[0]), rule.logValue(column, p[1]))
+		return p, false, nil
+	}
+	return p, true, nil
+}
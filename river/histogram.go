@@ -0,0 +1,69 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+var (
+	// latencyBuckets are the upper bounds in milliseconds for Redis command latency.
+	latencyBuckets = []float64{0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+	// batchSizeBuckets are the upper bounds for the number of rows in one rows event.
+	batchSizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+)
+
+// histogram counts observations in fixed buckets.
+type histogram struct {
+	sync.Mutex
+
+	bounds []float64
+	// counts[i] is the number of observations <= bounds[i],
+	// the last one is for observations above all bounds.
+	counts []int64
+
+	count int64
+	sum   float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	i := 0
+	for ; i < len(h.bounds); i++ {
+		if v <= h.bounds[i] {
+			break
+		}
+	}
+
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// WriteTo writes the histogram with cumulative bucket counts in the status format.
+func (h *histogram) WriteTo(buf *bytes.Buffer, name string) {
+	h.Lock()
+	defer h.Unlock()
+
+	buf.WriteString(fmt.Sprintf("\n[%s]\n", name))
+	buf.WriteString(fmt.Sprintf("count:%d\n", h.count))
+	buf.WriteString(fmt.Sprintf("sum:%g\n", h.sum))
+
+	var n int64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		buf.WriteString(fmt.Sprintf("le_%g:%d\n", bound, n))
+	}
+	buf.WriteString(fmt.Sprintf("le_inf:%d\n", h.count))
+}
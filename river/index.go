@@ -0,0 +1,258 @@
+package river
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// Scripts of track_rows, adding or removing the PK ARGV[1] in the set
+// KEYS[1] of the rows and counting the rows in KEYS[2], so the counter is
+// only changed by a new or deleted row.
+const (
+	trackAddScript = `if redis.call('SADD', KEYS[1], ARGV[1]) == 1 then
+	redis.call('INCR', KEYS[2])
+end
+return 0
+`
+	trackRemoveScript = `if redis.call('SREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('DECR', KEYS[2])
+end
+return 0
+`
+)
+
+// rowIndexCmds returns the commands to maintain the index sets, the range
+// indexes, the unique lookups, the tracked rows and the top and join
+// outputs of the row with the key, in the transaction of the row. The
+// rollups are not idempotent, so they are added by the callers applying
+// an event only, see rollupCmds.
+func (r *River) rowIndexCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) []redisCmd {
+	cmds := r.indexCmds(rule, action, key, before, row)
+	cmds = append(cmds, r.joinCmds(rule, action, before, row)...)
+	cmds = append(cmds, r.topCmds(rule, action, key, before, row)...)
+	cmds = append(cmds, r.rangeIndexCmds(rule, action, key, row)...)
+	cmds = append(cmds, r.lookupCmds(rule, action, key, before, row)...)
+	return append(cmds, trackCmds(rule, action, key, row)...)
+}
+
+// trackKeys returns the set of the PKs of the rows and their counter.
+func trackKeys(rule *Rule) (string, string) {
+	return rule.keyPrefix + ":__all", rule.keyPrefix + ":__count"
+}
+
+// trackCmds returns the command to add the PK of the row with the key to
+// the rows of the table and count it with track_rows, or remove it for
+// delete.
+func trackCmds(rule *Rule, action string, key string, row []interface{}) []redisCmd {
+	if !rule.TrackRows {
+		return nil
+	}
+
+	all, count := trackKeys(rule)
+	script := trackAddScript
+	if action == canal.DeleteAction {
+		script = trackRemoveScript
+	}
+	return []redisCmd{newRedisCmd("EVAL", script, 2, all, count, indexMember(rule, key, row))}
+}
+
+// indexMember returns the PK of the row key, the member of the index
+// sets, like 1 for test:test_river:1.
+func indexMember(rule *Rule, key string, row []interface{}) string {
+	return strings.TrimPrefix(key, rule.rowKeyPrefix(row)+":")
+}
+
+// indexValue returns the value of the index column in the row as the
+// index key suffix, false for a NULL or unknown column.
+func (r *River) indexValue(rule *Rule, column string, row []interface{}) (string, bool) {
+	i := rule.TableInfo.FindColumn(column)
+	if i < 0 || i >= len(row) || row[i] == nil {
+		return "", false
+	}
+	return transformString(r.makeReqColumnData(rule, &rule.TableInfo.Columns[i], row[i])), true
+}
+
+// indexKey returns the set of the rows with the value of the index column,
+// like idx:test_river:status:active.
+func indexKey(rule *Rule, column string, value string) string {
+	return rule.indexPrefix + ":" + column + ":" + value
+}
+
+// indexCmds returns the commands to keep the PK of the row with the key in
+// the sets of its index_columns values, before is the row before an update,
+// nil if unknown, and row is the deleted row for delete. The PK is moved
+// from the set of the old value only when before is known.
+func (r *River) indexCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	member := indexMember(rule, key, row)
+	for _, column := range rule.IndexColumns {
+		value, ok := r.indexValue(rule, column, row)
+		if action == canal.DeleteAction {
+			if ok {
+				cmds = append(cmds, newRedisCmd("SREM", indexKey(rule, column, value), member))
+			}
+			continue
+		}
+
+		if before != nil {
+			if old, oldOK := r.indexValue(rule, column, before); oldOK && (!ok || old != value) {
+				cmds = append(cmds, newRedisCmd("SREM", indexKey(rule, column, old), member))
+			}
+		}
+		if ok {
+			cmds = append(cmds, newRedisCmd("SADD", indexKey(rule, column, value), member))
+		}
+	}
+	return cmds
+}
+
+// rangeIndexKey returns the sorted set of the range index column, like
+// idx:test_river:created_at.
+func rangeIndexKey(rule *Rule, column string) string {
+	return rule.indexPrefix + ":" + column
+}
+
+// columnTime returns the time of the DATETIME, TIMESTAMP or DATE value in
+// the rule time zone, or of the unix timestamp of an epoch column, false
+// for NULL, another type or an invalid date.
+func columnTime(rule *Rule, col *schema.TableColumn, value interface{}) (time.Time, bool) {
+	if value == nil {
+		return time.Time{}, false
+	}
+
+	if rule.isEpochColumn(col) {
+		if col.IsUnsigned {
+			value = unsignedValue(col, value)
+		}
+		n, err := strconv.ParseInt(transformString(value), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if rule.EpochUnit == EpochUnitMilli {
+			return time.Unix(n/1000, n%1000*int64(time.Millisecond)).In(rule.location), true
+		}
+		return time.Unix(n, 0).In(rule.location), true
+	}
+
+	layout := mysql.TimeFormat
+	switch col.Type {
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+	case schema.TYPE_DATE:
+		layout = "2006-01-02"
+	default:
+		return time.Time{}, false
+	}
+	// the fractional seconds are parsed without them in the layout
+	t, err := time.ParseInLocation(layout, transformString(value), rule.location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// rangeScore returns the score of the value of the range index column, the
+// number, or the unix seconds of a date in the rule time zone, false for
+// NULL or a value which is not a number or a valid date.
+func (r *River) rangeScore(rule *Rule, col *schema.TableColumn, value interface{}) (float64, bool) {
+	if value == nil {
+		return 0, false
+	}
+
+	switch col.Type {
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		t, ok := columnTime(rule, col, value)
+		if !ok {
+			return 0, false
+		}
+		return float64(t.UnixNano()) / float64(time.Second), true
+	}
+
+	if rule.isEpochColumn(col) {
+		if col.IsUnsigned {
+			value = unsignedValue(col, value)
+		}
+	} else {
+		value = r.makeReqColumnData(rule, col, value)
+	}
+	f, err := strconv.ParseFloat(transformString(value), 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// rangeIndexCmds returns the commands to keep the PK of the row with the
+// key in the sorted sets of its range_index_columns, scored by the column
+// values, row is the deleted row for delete. A NULL value removes it.
+func (r *River) rangeIndexCmds(rule *Rule, action string, key string, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	member := indexMember(rule, key, row)
+	for _, column := range rule.RangeIndexColumns {
+		k := rangeIndexKey(rule, column)
+		i := rule.TableInfo.FindColumn(column)
+		if i < 0 || i >= len(row) {
+			continue
+		}
+
+		score, ok := r.rangeScore(rule, &rule.TableInfo.Columns[i], row[i])
+		if action == canal.DeleteAction || !ok {
+			cmds = append(cmds, newRedisCmd("ZREM", k, member))
+			continue
+		}
+		cmds = append(cmds, newRedisCmd("ZADD", k, score, member))
+	}
+	return cmds
+}
+
+// lookupDeleteScript deletes the lookup key KEYS[1] only if it is still the
+// PK ARGV[1], not taken by another row since.
+const lookupDeleteScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// lookupKey returns the key of the PK of the row with the value of the
+// unique column, like lookup:user:email:a@b.com.
+func lookupKey(rule *Rule, column string, value string) string {
+	return rule.lookupPrefix + ":" + column + ":" + value
+}
+
+// lookupCmds returns the commands to keep the keys of the unique_columns
+// values to the PK of the row with the key, with the TTL of the row,
+// before is the row before an update, nil if unknown, and row is the
+// deleted row for delete. The old keys are deleted only if they are still
+// the PK of the row.
+func (r *River) lookupCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	member := indexMember(rule, key, row)
+	for _, column := range rule.UniqueColumns {
+		value, ok := r.indexValue(rule, column, row)
+		if action == canal.DeleteAction {
+			if ok {
+				cmds = append(cmds, newRedisCmd("EVAL", lookupDeleteScript, 1, lookupKey(rule, column, value), member))
+			}
+			continue
+		}
+
+		if before != nil {
+			if old, oldOK := r.indexValue(rule, column, before); oldOK && (!ok || old != value) {
+				cmds = append(cmds, newRedisCmd("EVAL", lookupDeleteScript, 1, lookupKey(rule, column, old), member))
+			}
+		}
+		if !ok {
+			continue
+		}
+		if ttl := rule.rowTTL(row); ttl > 0 {
+			cmds = append(cmds, newRedisCmd("SET", lookupKey(rule, column, value), member, "PX", int64(ttl/time.Millisecond)))
+		} else {
+			cmds = append(cmds, newRedisCmd("SET", lookupKey(rule, column, value), member))
+		}
+	}
+	return cmds
+}
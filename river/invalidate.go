@@ -0,0 +1,178 @@
+package river
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	log "github.com/sirupsen/logrus"
+)
+
+// Invalidation deletes the keys derived from the rows of another table,
+// like the cached sessions of a user, when a row of the rule changes.
+type Invalidation struct {
+	// Key is the key to delete, with {column} replaced by the values of
+	// the changed row, like session:{user_id}, or a pattern like
+	// session:{user_id}:* whose keys are found by SCAN.
+	Key string `toml:"key"`
+
+	// Set is an index set of the PKs of the derived rows, like the
+	// index_columns set idx:session:user_id:{id}, whose rows
+	// <set_key_prefix>:<pk> are deleted.
+	Set          string `toml:"set"`
+	SetKeyPrefix string `toml:"set_key_prefix"`
+
+	// Columns limits the invalidation to the updates changing the columns,
+	// default any update.
+	Columns []string `toml:"columns"`
+}
+
+func (inv *Invalidation) prepare(r *Rule) error {
+	if len(inv.Key) == 0 && len(inv.Set) == 0 {
+		return errors.Errorf("%s.%s key or set must be set for invalidate", r.Schema, r.Table)
+	}
+	if len(inv.Set) > 0 && len(inv.SetKeyPrefix) == 0 {
+		return errors.Errorf("%s.%s set_key_prefix must be set for invalidate set %s", r.Schema, r.Table, inv.Set)
+	}
+	inv.Key = r.replaceKey(inv.Key)
+	inv.Set = r.replaceKey(inv.Set)
+	return nil
+}
+
+// changed returns whether the update from before to row changes the
+// invalidation columns, always true for insert and delete.
+func (inv *Invalidation) changed(rule *Rule, before []interface{}, row []interface{}) bool {
+	if before == nil || len(inv.Columns) == 0 {
+		return true
+	}
+	for _, column := range inv.Columns {
+		i := rule.TableInfo.FindColumn(column)
+		if i >= 0 && i < len(row) && i < len(before) && !reflect.DeepEqual(before[i], row[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isKeyPattern returns whether the key is a SCAN pattern.
+func isKeyPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[")
+}
+
+// invalidationKeys returns the keys, patterns and sets to invalidate for
+// the change of the row, by the row and the row before an update, as the
+// derived keys of both change.
+func invalidationKeys(rule *Rule, action string, before []interface{}, row []interface{}) (keys []string, sets []Invalidation) {
+	seen := make(map[string]bool)
+	for _, inv := range rule.Invalidations {
+		if action == canal.UpdateAction && !inv.changed(rule, before, row) {
+			continue
+		}
+
+		for _, values := range [][]interface{}{before, row} {
+			if values == nil {
+				continue
+			}
+			if len(inv.Key) > 0 {
+				if k := columnKey(rule, inv.Key, values); len(k) > 0 && !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+			if len(inv.Set) > 0 {
+				if k := columnKey(rule, inv.Set, values); len(k) > 0 && !seen["set "+k] {
+					seen["set "+k] = true
+					sets = append(sets, Invalidation{Set: k, SetKeyPrefix: inv.SetKeyPrefix})
+				}
+			}
+		}
+	}
+	return keys, sets
+}
+
+// invalidate deletes the derived keys of the invalidate rules after the
+// row is written, outside its transaction as the patterns need SCAN, before
+// is the row before an update, and row is the deleted row for delete.
+func (r *River) invalidate(rule *Rule, action string, before []interface{}, row []interface{}) error {
+	if len(rule.Invalidations) == 0 {
+		return nil
+	}
+
+	keys, sets := invalidationKeys(rule, action, before, row)
+	n := 0
+	for _, key := range keys {
+		var m int
+		var err error
+		if isKeyPattern(key) {
+			m, err = r.deleteKeys(key)
+		} else {
+			m, err = r.delKey(key)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalidate %s", rule.Schema, rule.Table, key)
+		}
+		n += m
+	}
+
+	for _, set := range sets {
+		members, err := redis.Strings(r.doRedis("SMEMBERS", set.Set))
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalidate set %s", rule.Schema, rule.Table, set.Set)
+		}
+		for _, member := range members {
+			m, err := r.delKey(set.SetKeyPrefix + ":" + member)
+			if err != nil {
+				return errors.Annotatef(err, "%s.%s invalidate set %s", rule.Schema, rule.Table, set.Set)
+			}
+			n += m
+		}
+	}
+
+	if n > 0 {
+		r.st.InvalidatedNum.Add(int64(n))
+		r.st.Rule(rule).InvalidatedNum.Add(int64(n))
+		log.Debugf("%s.%s %s invalidated %d keys", rule.Schema, rule.Table, action, n)
+	}
+	return nil
+}
+
+// deleteKeys deletes the keys matching the pattern.
+func (r *River) deleteKeys(pattern string) (int, error) {
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(r.doRedis("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return n, errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			m, err := r.delKey(key)
+			if err != nil {
+				return n, errors.Trace(err)
+			}
+			n += m
+		}
+
+		if cursor == "0" || r.ctx.Err() != nil {
+			return n, nil
+		}
+	}
+}
+
+// delKey deletes the key, it returns 1 if it existed, 0 in dry run.
+func (r *River) delKey(key string) (int, error) {
+	reply, err := r.doRedis("DEL", key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n, _ := redis.Int(reply, nil)
+	return n, nil
+}
@@ -0,0 +1,40 @@
+package river
+
+import (
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// joinCmds returns the commands to keep the member column value of the row
+// in the set of the key by the join outputs, before is the row before an
+// update, nil if unknown, and row is the deleted row for delete. With one
+// join output for each direction, the rows of a join table keep both
+// post:1:tags and tag:go:posts.
+func (r *River) joinCmds(rule *Rule, action string, before []interface{}, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	for _, o := range rule.Outputs {
+		if o.Type != OutputJoin {
+			continue
+		}
+
+		key := columnKey(rule, o.Key, row)
+		member, ok := r.indexValue(rule, o.Column, row)
+		if action == canal.DeleteAction {
+			if len(key) > 0 && ok {
+				cmds = append(cmds, newRedisCmd("SREM", key, member))
+			}
+			continue
+		}
+
+		if before != nil {
+			oldKey := columnKey(rule, o.Key, before)
+			oldMember, oldOK := r.indexValue(rule, o.Column, before)
+			if len(oldKey) > 0 && oldOK && (oldKey != key || oldMember != member || !ok) {
+				cmds = append(cmds, newRedisCmd("SREM", oldKey, oldMember))
+			}
+		}
+		if len(key) > 0 && ok {
+			cmds = append(cmds, newRedisCmd("SADD", key, member))
+		}
+	}
+	return cmds
+}
@@ -0,0 +1,120 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// Formats of the JSON columns.
+const (
+	// JSONFormatDecode decodes the JSON for the transforms and strict_types,
+	// the default.
+	JSONFormatDecode = "decode"
+	// JSONFormatRaw writes the JSON text from MySQL verbatim.
+	JSONFormatRaw = "raw"
+	// JSONFormatNormalize writes the compact JSON with sorted keys.
+	JSONFormatNormalize = "normalize"
+	// JSONFormatFlatten writes the leaves to the fields <field>.<path>,
+	// like addr.city or tags.0.
+	JSONFormatFlatten = "flatten"
+)
+
+// jsonValue returns the JSON column value by the rule json_format, the
+// flattened one is decoded for flattenJSON.
+func jsonValue(rule *Rule, value interface{}) interface{} {
+	var data []byte
+	switch v := value.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return value
+	}
+
+	if rule.JSONFormat == JSONFormatRaw {
+		return string(data)
+	}
+
+	var f interface{}
+	if err := unmarshalJSON(data, &f); err != nil || f == nil {
+		return value
+	}
+	if rule.JSONFormat == JSONFormatNormalize {
+		if s, err := normalizeJSON(f); err == nil {
+			return s
+		}
+		return value
+	}
+	return f
+}
+
+// normalizeJSON encodes the decoded JSON compactly, with sorted keys and
+// without escaping HTML.
+func normalizeJSON(f interface{}) (string, error) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(f); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(buf.Bytes(), "\n")), nil
+}
+
+// isFlattenJSON returns true for a JSON column written as flattened fields.
+func (r *Rule) isFlattenJSON(col *schema.TableColumn) bool {
+	return r.JSONFormat == JSONFormatFlatten && col.Type == schema.TYPE_JSON
+}
+
+// flattenJSON returns the leaves of the decoded JSON by their field paths
+// under the prefix, the nulls and empty objects and arrays are omitted.
+func flattenJSON(prefix string, f interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				walk(path+"."+k, item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(path+"."+strconv.Itoa(i), item)
+			}
+		case nil:
+		case json.Number:
+			fields[path] = v.String()
+		case string:
+			fields[path] = v
+		default:
+			fields[path] = fmt.Sprint(v)
+		}
+	}
+	walk(prefix, f)
+	return fields
+}
+
+// flattenJSONValues returns the flattened fields of the JSON column i of
+// the row, and the fields of before not in the row any more.
+func (r *River) flattenJSONValues(rule *Rule, col *schema.TableColumn, field string, before []interface{}, row []interface{}, i int) (map[string]interface{}, []string) {
+	values := make(map[string]interface{})
+	if row[i] != nil {
+		values = flattenJSON(field, r.makeReqColumnData(rule, col, row[i]))
+	}
+
+	var nulls []string
+	if before != nil && before[i] != nil {
+		for k := range flattenJSON(field, r.makeReqColumnData(rule, col, before[i])) {
+			if _, ok := values[k]; !ok {
+				nulls = append(nulls, k)
+			}
+		}
+	}
+	sort.Strings(nulls)
+	return values, nulls
+}
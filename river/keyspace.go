@@ -0,0 +1,123 @@
+package river
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultKeyspaceSample is the number of keys of each rule measured by
+// MEMORY USAGE without keyspace_sample.
+const defaultKeyspaceSample = 100
+
+// cmdsSize returns the approximate bytes of the arguments of the commands.
+func cmdsSize(cmds []redisCmd) int64 {
+	var n int64
+	for _, cmd := range cmds {
+		for _, arg := range cmd.Args {
+			n += int64(len(transformString(arg)))
+		}
+	}
+	return n
+}
+
+// accountWrite counts the bytes of the commands written for the rule.
+func (r *River) accountWrite(rule *Rule, cmds []redisCmd) {
+	n := cmdsSize(cmds)
+	r.st.WrittenBytes.Add(n)
+	r.st.Rule(rule).WrittenBytes.Add(n)
+}
+
+// keyspaceLoop updates the live keys and the estimated memory of the rules
+// in the statistics every keyspace_interval, with its own connection.
+func (r *River) keyspaceLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.c.KeyspaceInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		addr, err := r.resolveRedisMaster()
+		if err != nil {
+			continue
+		}
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+		if err != nil {
+			continue
+		}
+
+		// rules with rule_overlap all may share the key prefix
+		seen := make(map[string]bool)
+		for _, rule := range r.rules {
+			if seen[rule.keyPrefix] {
+				continue
+			}
+			seen[rule.keyPrefix] = true
+
+			keys, bytes, err := r.measureKeyspace(conn, rule.keyPrefix+":*")
+			if err != nil {
+				log.Warnf("measure keyspace of %s.%s err %v", rule.Schema, rule.Table, err)
+				break
+			}
+			r.st.Rule(rule).LiveKeys.Set(keys)
+			r.st.Rule(rule).MemoryBytes.Set(bytes)
+		}
+		conn.Close()
+	}
+}
+
+// measureKeyspace returns the number of keys matching the pattern by SCAN,
+// and their memory estimated by MEMORY USAGE of keyspace_sample of them.
+func (r *River) measureKeyspace(conn redis.Conn, pattern string) (int64, int64, error) {
+	sample := r.c.KeyspaceSample
+	if sample <= 0 {
+		sample = defaultKeyspaceSample
+	}
+
+	var keys, sampled, sampledBytes int64
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return 0, 0, errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		batch, _ := redis.Strings(reply[1], nil)
+		for _, key := range batch {
+			keys++
+			if sampled >= int64(sample) {
+				continue
+			}
+			n, err := redis.Int64(conn.Do("MEMORY", "USAGE", key))
+			if err == redis.ErrNil {
+				// expired since SCAN
+				continue
+			} else if err != nil {
+				return 0, 0, errors.Trace(err)
+			}
+			sampled++
+			sampledBytes += n
+		}
+
+		if cursor == "0" || r.ctx.Err() != nil {
+			break
+		}
+	}
+
+	if sampled == 0 {
+		return keys, 0, nil
+	}
+	return keys, sampledBytes * keys / sampled, nil
+}
@@ -0,0 +1,43 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// SetupLog configures the global logger with the level, format and
+// output file in the config.
+func SetupLog(c *Config) error {
+	level := c.LogLevel
+	if len(level) == 0 {
+		level = "info"
+	}
+
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.SetLevel(l)
+
+	switch c.LogFormat {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.Errorf("invalid log format %s, must be text or json", c.LogFormat)
+	}
+
+	if len(c.LogFile) > 0 {
+		// lumberjack rotates the file once it reaches log_max_size megabytes
+		log.SetOutput(&lumberjack.Logger{
+			Filename:   c.LogFile,
+			MaxSize:    c.LogMaxSize,
+			MaxBackups: c.LogMaxBackups,
+			MaxAge:     c.LogMaxAge,
+		})
+	}
+
+	return nil
+}
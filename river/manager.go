@@ -0,0 +1,265 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Manager runs several rivers with their own configs in one process,
+// serving the statistics of all of them on one address.
+type Manager struct {
+	lock   sync.Mutex
+	rivers map[string]*River
+	// the rivers started by Run, the rivers added later are started by Add
+	running bool
+	ctx     context.Context
+
+	wg   sync.WaitGroup
+	errs map[string]error
+
+	l net.Listener
+}
+
+// NewManager creates a Manager without rivers.
+func NewManager() *Manager {
+	m := new(Manager)
+	m.rivers = make(map[string]*River)
+	m.errs = make(map[string]error)
+	return m
+}
+
+// Add creates the river with the name. The stat_addr of the config is
+// ignored, the statistics are served by the Manager.
+func (m *Manager) Add(name string, c *Config) error {
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return errors.Errorf("invalid river name %q", name)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.rivers[name]; ok {
+		return errors.Errorf("duplicate river %s", name)
+	}
+
+	cc := *c
+	cc.StatAddr = ""
+	r, err := NewRiver(&cc)
+	if err != nil {
+		return errors.Annotatef(err, "river %s", name)
+	}
+
+	m.rivers[name] = r
+	r.audit.Record("add_river", AuditSourceAPI, map[string]interface{}{"river": name, "rules": len(cc.Rules)})
+	if m.running {
+		m.run(name, r)
+	}
+	return nil
+}
+
+// River returns the river with the name.
+func (m *Manager) River(name string) (*River, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	r, ok := m.rivers[name]
+	return r, ok
+}
+
+// Names returns the names of the rivers in order.
+func (m *Manager) Names() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.names()
+}
+
+func (m *Manager) names() []string {
+	names := make([]string, 0, len(m.rivers))
+	for name := range m.rivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove closes the river with the name and removes it.
+func (m *Manager) Remove(name string) error {
+	m.lock.Lock()
+	r, ok := m.rivers[name]
+	delete(m.rivers, name)
+	m.lock.Unlock()
+
+	if !ok {
+		return errors.Errorf("river %s is not exist", name)
+	}
+
+	r.audit.Record("remove_river", AuditSourceAPI, map[string]interface{}{"river": name})
+	r.Close()
+	return nil
+}
+
+// Run runs all the rivers and waits for them to stop, a river stopping
+// on an error does not stop the others, ctx being done closes all of them.
+// It returns the errors by river name.
+func (m *Manager) Run(ctx context.Context) map[string]error {
+	m.lock.Lock()
+	m.running = true
+	m.ctx = ctx
+	for name, r := range m.rivers {
+		m.run(name, r)
+	}
+	m.lock.Unlock()
+
+	m.wg.Wait()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	errs := make(map[string]error, len(m.errs))
+	for name, err := range m.errs {
+		errs[name] = err
+	}
+	return errs
+}
+
+func (m *Manager) run(name string, r *River) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		if err := r.Run(m.ctx); err != nil {
+			log.Errorf("river %s stopped err %v", name, err)
+
+			m.lock.Lock()
+			m.errs[name] = err
+			m.lock.Unlock()
+		}
+	}()
+}
+
+// Close closes all the rivers and the status http server.
+func (m *Manager) Close() {
+	m.lock.Lock()
+	rivers := make([]*River, 0, len(m.rivers))
+	for _, r := range m.rivers {
+		rivers = append(rivers, r)
+	}
+	m.rivers = make(map[string]*River)
+	l := m.l
+	m.lock.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+
+	for _, r := range rivers {
+		r.Close()
+	}
+}
+
+// ServeHTTP serves /stat with the statistics of all the rivers, each
+// following a "[[name]]" line, and /river/<name>/stat, /river/<name>/stat/events
+// and /river/<name>/stat/errors of one river.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/stat" {
+		m.serveStat(w)
+		return
+	}
+
+	seps := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/river/"), "/", 2)
+	if len(seps) != 2 || !strings.HasPrefix(req.URL.Path, "/river/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	r, ok := m.River(seps[0])
+	if !ok || r.st == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch seps[1] {
+	case "stat":
+		r.st.ServeHTTP(w, req)
+	case "stat/events":
+		r.st.events.ServeHTTP(w, req)
+	case "stat/errors":
+		r.st.errors.ServeHTTP(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (m *Manager) serveStat(w http.ResponseWriter) {
+	m.lock.Lock()
+	names := m.names()
+	rivers := make([]*River, 0, len(names))
+	for _, name := range names {
+		rivers = append(rivers, m.rivers[name])
+	}
+	m.lock.Unlock()
+
+	var buf bytes.Buffer
+	var insertNum, updateNum, deleteNum, skipNum int64
+	for _, r := range rivers {
+		insertNum += r.st.InsertNum.Get()
+		updateNum += r.st.UpdateNum.Get()
+		deleteNum += r.st.DeleteNum.Get()
+		skipNum += r.st.SkipNum.Get()
+	}
+	buf.WriteString(fmt.Sprintf("river_num:%d\n", len(rivers)))
+	buf.WriteString(fmt.Sprintf("insert_num:%d\n", insertNum))
+	buf.WriteString(fmt.Sprintf("update_num:%d\n", updateNum))
+	buf.WriteString(fmt.Sprintf("delete_num:%d\n", deleteNum))
+	buf.WriteString(fmt.Sprintf("skip_num:%d\n", skipNum))
+
+	for i, r := range rivers {
+		buf.WriteString(fmt.Sprintf("\n[[%s]]\n", names[i]))
+		if err := r.st.WriteTo(&buf); err != nil {
+			buf.WriteString(fmt.Sprintf("error:%v\n", err))
+		}
+	}
+
+	w.Write(buf.Bytes())
+}
+
+// RunStat runs the status http server of all the rivers, it blocks
+// until the Manager is closed.
+func (m *Manager) RunStat(addr string) error {
+	return m.RunStatConfig(&Config{StatAddr: addr})
+}
+
+// RunStatConfig runs the status http server of all the rivers on the
+// stat_addr of c, with its stat_tls and stat_token options, it blocks
+// until the Manager is closed.
+func (m *Manager) RunStatConfig(c *Config) error {
+	log.Infof("run manager status http server %s", c.StatAddr)
+
+	l, err := c.listenStat(c.StatAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m.lock.Lock()
+	m.l = l
+	m.lock.Unlock()
+
+	mux := http.NewServeMux()
+	mux.Handle("/stat", m)
+	mux.Handle("/river/", m)
+	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+
+	token := c.StatToken
+	srv := http.Server{Handler: statAuth{h: mux, token: func() string { return token }}}
+	srv.Serve(l)
+	return nil
+}
@@ -0,0 +1,230 @@
+package river
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// ErrDefaultMapping is returned by a RowMapper to apply the row with the rule
+// mapping, also wrapped like by errors.Trace.
+var ErrDefaultMapping = errors.New("use the default mapping")
+
+// RedisOp is one Redis command of a mapped row.
+type RedisOp struct {
+	Name string
+	Args []interface{}
+}
+
+// RowMapper maps the rows to Redis commands for the programs embedding the River.
+// before is nil for insert and after is nil for delete, the values are in the
+// order of rule.TableInfo.Columns. The commands are applied in a transaction,
+// none are applied if it returns no commands.
+type RowMapper interface {
+	Map(action string, rule *Rule, before, after []interface{}) ([]RedisOp, error)
+}
+
+// SetRowMapper sets the RowMapper used for all the rules, it must be called before Run.
+func (r *River) SetRowMapper(m RowMapper) {
+	r.mapper = m
+}
+
+// RedisReader runs the read-only Redis commands of a RowVerifier.
+type RedisReader interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+}
+
+// RowVerifier verifies the Redis commands mapped by the RowMapper for Check
+// and verify_sample, the rules are skipped without it. row is in the order
+// of rule.TableInfo.Columns, nil if the row is gone, and key is the key of
+// the row built by the rule. It returns the differences found, empty if
+// none, or ErrDefaultMapping to verify the row mapped by the rule.
+type RowVerifier interface {
+	Verify(rule *Rule, key string, row []interface{}, redis RedisReader) ([]string, error)
+}
+
+// SetRowVerifier sets the RowVerifier of the RowMapper, it must be called before Run.
+func (r *River) SetRowVerifier(v RowVerifier) {
+	r.verifier = v
+}
+
+// verifyRedisCommands are the commands reading the keys allowed to verify.
+var verifyRedisCommands = map[string]bool{
+	"PING":      true,
+	"INFO":      true,
+	"EXISTS":    true,
+	"TYPE":      true,
+	"TTL":       true,
+	"PTTL":      true,
+	"GET":       true,
+	"HGET":      true,
+	"HMGET":     true,
+	"HGETALL":   true,
+	"HKEYS":     true,
+	"LINDEX":    true,
+	"LRANGE":    true,
+	"LLEN":      true,
+	"SCAN":      true,
+	"SMEMBERS":  true,
+	"SISMEMBER": true,
+	"ZSCORE":    true,
+	"ZRANGE":    true,
+	"XRANGE":    true,
+	"XLEN":      true,
+}
+
+// readOnlyRedis runs only the read-only commands for a verifier.
+type readOnlyRedis func(cmd string, args ...interface{}) (interface{}, error)
+
+func (f readOnlyRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	cmd = strings.ToUpper(cmd)
+	if !verifyRedisCommands[cmd] {
+		return nil, errors.Errorf("%s is not read-only, not allowed to verify", cmd)
+	}
+	return f(cmd, args...)
+}
+
+// isCustomRule returns true if the rows of the rule are mapped by the
+// RowMapper or the transform script.
+func (r *River) isCustomRule(rule *Rule) bool {
+	return r.mapper != nil || rule.script != nil
+}
+
+// canVerifyCustom returns true if the custom mapping of the rule has a
+// RowVerifier or a script verify function.
+func (r *River) canVerifyCustom(rule *Rule) bool {
+	if r.mapper != nil {
+		return r.verifier != nil
+	}
+	return rule.script != nil && rule.script.canVerify()
+}
+
+// verifyCustom verifies the row mapped by the RowMapper or the transform
+// script, it returns ErrDefaultMapping for a row mapped by the rule.
+func (r *River) verifyCustom(rd RedisReader, rule *Rule, key string, row []interface{}) (*Mismatch, error) {
+	if row != nil && !rule.MatchRow(row) {
+		// never mapped
+		row = nil
+	}
+
+	var (
+		diffs []string
+		err   error
+	)
+	if r.mapper != nil {
+		diffs, err = r.verifier.Verify(rule, key, row, rd)
+	} else {
+		diffs, err = rule.script.verify(rule.Schema, rule.Table, r.makeScriptRow(rule, row), key, rd)
+	}
+	if errors.Cause(err) == ErrDefaultMapping {
+		return nil, ErrDefaultMapping
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+
+	kind := MismatchFields
+	if row == nil {
+		kind = MismatchExtra
+	}
+	sort.Strings(diffs)
+	return &Mismatch{Rule: rule.Schema + "." + rule.Table, Key: key, Kind: kind, Fields: diffs}, nil
+}
+
+// mapRows applies the rows with the RowMapper or the rule transform script.
+func (r *River) mapRows(rule *Rule, action string, rows [][]interface{}) error {
+	step := 1
+	if action == canal.UpdateAction {
+		if len(rows)%2 != 0 {
+			return errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+		}
+		step = 2
+	}
+
+	for i := 0; i < len(rows); i += step {
+		var before, after []interface{}
+		switch action {
+		case canal.InsertAction:
+			after = rows[i]
+		case canal.DeleteAction:
+			before = rows[i]
+		case canal.UpdateAction:
+			before, after = rows[i], rows[i+1]
+		default:
+			return errors.Errorf("invalid rows action %s", action)
+		}
+
+		if (before == nil || !rule.MatchRow(before)) && (after == nil || !rule.MatchRow(after)) {
+			r.st.FilteredNum.Add(1)
+			continue
+		}
+
+		row := after
+		if row == nil {
+			row = before
+		}
+		key, err := r.getPKValue(rule, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		cmds, err := r.mapRow(rule, action, before, after, key)
+		if errors.Cause(err) == ErrDefaultMapping {
+			if err = r.applyRow(rule, action, before, after); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(cmds) > 0 {
+			if err = r.writeRow(cmds); err != nil {
+				return errors.Trace(err)
+			}
+			r.accountWrite(rule, cmds)
+		}
+
+		r.rowApplied(rule, action, key)
+		r.recordVerify(rule, key, row)
+	}
+
+	return nil
+}
+
+func (r *River) mapRow(rule *Rule, action string, before, after []interface{}, key string) ([]redisCmd, error) {
+	if r.mapper != nil {
+		ops, err := r.mapper.Map(action, rule, before, after)
+		if err != nil {
+			return nil, err
+		}
+
+		cmds := make([]redisCmd, 0, len(ops))
+		for _, op := range ops {
+			cmds = append(cmds, newRedisCmd(op.Name, op.Args...))
+		}
+		return cmds, nil
+	}
+
+	if rule.script != nil {
+		return rule.script.call(action, rule.Schema, rule.Table, r.makeScriptRow(rule, before), r.makeScriptRow(rule, after), key)
+	}
+
+	return nil, ErrDefaultMapping
+}
+
+// applyRow applies the row with the rule mapping.
+func (r *River) applyRow(rule *Rule, action string, before, after []interface{}) error {
+	switch action {
+	case canal.InsertAction:
+		return r.insertRow(rule, after)
+	case canal.DeleteAction:
+		return r.deleteRow(rule, before)
+	default:
+		return r.updateRows(rule, [][]interface{}{before, after})
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go/ioutil2"
-	"gopkg.in/birkirb/loggers.v1/log"
+	log "github.com/sirupsen/logrus"
 )
 
 type masterInfo struct {
@@ -51,7 +51,7 @@ func loadMasterInfo(dataDir string) (*masterInfo, error) {
 }
 
 func (m *masterInfo) Save(pos mysql.Position) error {
-	log.Infof("save position %s", pos)
+	log.Debugf("save position %s", pos)
 
 	m.Lock()
 	defer m.Unlock()
@@ -82,6 +82,27 @@ func (m *masterInfo) Save(pos mysql.Position) error {
 	return errors.Trace(err)
 }
 
+// Reset forgets the position and saves it at once, so the canal starts
+// with a dump.
+func (m *masterInfo) Reset() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Name = ""
+	m.Pos = 0
+
+	if len(m.filePath) == 0 {
+		return nil
+	}
+
+	m.lastSaveTime = time.Now()
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(m.filePath, buf.Bytes(), 0644))
+}
+
 func (m *masterInfo) Position() mysql.Position {
 	m.RLock()
 	defer m.RUnlock()
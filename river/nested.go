@@ -0,0 +1,153 @@
+package river
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// nestedScript replaces the child with the key ARGV[2] in the JSON array
+// in the field ARGV[1] of the parent hash KEYS[1] by the JSON ARGV[3], or
+// removes it if ARGV[3] is empty, keeping the order of the others. The
+// field is deleted once the array is empty. The items are split from the
+// array and joined back as they are, as a cjson round trip would change
+// the numbers of the other children, only their _key is decoded.
+const nestedScript = `local function split(doc)
+	local items = {}
+	local depth, from, i = 0, 0, 1
+	while i <= #doc do
+		local c = doc:sub(i, i)
+		if c == '"' then
+			i = i + 1
+			while i <= #doc and doc:sub(i, i) ~= '"' do
+				if doc:sub(i, i) == '\\' then
+					i = i + 1
+				end
+				i = i + 1
+			end
+		elseif c == '[' or c == '{' then
+			depth = depth + 1
+			if depth == 1 then
+				from = i
+			end
+		elseif c == ']' or c == '}' then
+			if depth == 1 then
+				local item = doc:sub(from + 1, i - 1):match('^%s*(.-)%s*$')
+				if item ~= '' then
+					table.insert(items, item)
+				end
+			end
+			depth = depth - 1
+		elseif c == ',' and depth == 1 then
+			table.insert(items, doc:sub(from + 1, i - 1):match('^%s*(.-)%s*$'))
+			from = i
+		end
+		i = i + 1
+	end
+	return items
+end
+local items = {}
+local doc = redis.call('HGET', KEYS[1], ARGV[1])
+if doc then
+	items = split(doc)
+end
+local out = {}
+local found = false
+for _, item in ipairs(items) do
+	if cjson.decode(item)['_key'] == ARGV[2] then
+		found = true
+		if ARGV[3] ~= '' then
+			table.insert(out, ARGV[3])
+		end
+	else
+		table.insert(out, item)
+	end
+end
+if not found and ARGV[3] ~= '' then
+	table.insert(out, ARGV[3])
+end
+if #out == 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], '[' .. table.concat(out, ',') .. ']')
+end
+return #out
+`
+
+// columnKeyRegexp matches the {column} placeholders of a key.
+var columnKeyRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// columnKey returns the key with the {column} placeholders replaced by the
+// row values, like the parent key of a nested child row, empty if one is
+// NULL or not a column.
+func columnKey(rule *Rule, key string, row []interface{}) string {
+	ok := true
+	key = columnKeyRegexp.ReplaceAllStringFunc(key, func(s string) string {
+		i := rule.TableInfo.FindColumn(s[1 : len(s)-1])
+		if i < 0 || i >= len(row) || row[i] == nil {
+			ok = false
+			return s
+		}
+		return transformString(row[i])
+	})
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+// columnKeyPattern returns the pattern of the column keys for the ACL.
+func columnKeyPattern(key string) string {
+	return columnKeyRegexp.ReplaceAllString(key, "*")
+}
+
+// nestedCmds returns the commands to write the child row with the key into
+// the arrays of its parents by the nested outputs, before is the row
+// before an update, nil if unknown, and row is the deleted row for delete.
+// A child moved to another parent is removed from the old one.
+func (r *River) nestedCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) ([]redisCmd, error) {
+	var cmds []redisCmd
+	for _, o := range rule.Outputs {
+		if o.Type != OutputNested {
+			continue
+		}
+
+		parent := columnKey(rule, o.Key, row)
+		if action == canal.DeleteAction {
+			if len(parent) > 0 {
+				cmds = append(cmds, nestedCmd(parent, o.Field, key, ""))
+			}
+			continue
+		}
+
+		if before != nil {
+			if old := columnKey(rule, o.Key, before); len(old) > 0 && old != parent {
+				cmds = append(cmds, nestedCmd(old, o.Field, key, ""))
+			}
+		}
+		if len(parent) == 0 {
+			continue
+		}
+
+		values, _, err := r.makeRowValues(rule, nil, row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		unchunkValues(rule, values)
+		values["_key"] = key
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cmds = append(cmds, nestedCmd(parent, o.Field, key, string(data)))
+	}
+	return cmds, nil
+}
+
+// nestedCmd returns the EVAL of nestedScript, run in the row transaction
+// like the other commands, doc is empty to remove the child.
+func nestedCmd(parent string, field string, key string, doc string) redisCmd {
+	return newRedisCmd("EVAL", nestedScript, 1, parent, field, key, doc)
+}
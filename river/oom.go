@@ -0,0 +1,241 @@
+package river
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do when Redis refuses writes as it reached maxmemory.
+const (
+	// RedisOOMPolicyFail applies the error policy, the default.
+	RedisOOMPolicyFail = "fail"
+	// RedisOOMPolicyPause pauses the sync until Redis has memory again.
+	RedisOOMPolicyPause = "pause"
+	// RedisOOMPolicyDrop skips the rows of the rules with a priority lower
+	// than redis_oom_min_priority, and pauses for the others.
+	RedisOOMPolicyDrop = "drop"
+	// RedisOOMPolicyTTL expires the keys of the rules with a priority lower
+	// than redis_oom_min_priority after redis_oom_ttl, and pauses.
+	RedisOOMPolicyTTL = "ttl"
+)
+
+const (
+	// redisMemoryLowWater is the part of maxmemory Redis must use less of
+	// to resume after an OOM.
+	redisMemoryLowWater = 0.95
+
+	redisInfoInterval = 10 * time.Second
+)
+
+// handleOOM applies the redis_oom_policy after Redis refused to write the
+// rows of the rule for maxmemory. It returns whether to skip the rows, or
+// to apply them again, neither only if the river is closed meanwhile.
+func (r *River) handleOOM(rule *Rule, err error) (skip bool, retry bool) {
+	r.st.RedisOOMNum.Add(1)
+	if !r.oom {
+		r.oom = true
+		log.Errorf("Redis is out of memory err %v, %s", err, r.c.RedisOOMPolicy)
+		r.alert.Alertf("Redis is out of memory, %s: %v", r.c.RedisOOMPolicy, err)
+	}
+
+	if r.skipOOM(rule) {
+		return true, false
+	}
+
+	if r.c.RedisOOMPolicy == RedisOOMPolicyTTL {
+		if err := r.tightenTTL(); err != nil {
+			log.Errorf("expire low priority keys err %v", err)
+		}
+	}
+
+	return false, r.waitRedisMemory()
+}
+
+// skipOOM returns true to skip the rows of the low priority rule while
+// Redis is out of memory with the drop policy.
+func (r *River) skipOOM(rule *Rule) bool {
+	if !r.oom || r.c.RedisOOMPolicy != RedisOOMPolicyDrop || rule.Priority >= r.c.RedisOOMMinPriority {
+		return false
+	}
+
+	// check the memory again now and then, as only skipped rows may come
+	if time.Since(r.oomCheckTime) >= r.redisOOMProbeInterval() {
+		r.oomCheckTime = time.Now()
+		if ok, err := r.redisMemoryOK(); err == nil && ok {
+			r.resumeOOM()
+			return false
+		}
+	}
+
+	r.st.RedisOOMDroppedNum.Add(1)
+	return true
+}
+
+func (r *River) redisOOMProbeInterval() time.Duration {
+	if d := r.c.RedisCircuitProbeInterval.Duration; d > 0 {
+		return d
+	}
+	return defaultRedisCircuitProbeInterval
+}
+
+// waitRedisMemory pauses the sync until Redis uses less than the low
+// water of maxmemory, it returns false if the river is closed.
+func (r *River) waitRedisMemory() bool {
+	defer r.waitedTxn(time.Now())
+
+	ticker := time.NewTicker(r.redisOOMProbeInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return false
+		}
+
+		ok, err := r.redisMemoryOK()
+		if err != nil {
+			log.Errorf("get Redis memory err %v", err)
+			continue
+		}
+		if ok {
+			r.resumeOOM()
+			return true
+		}
+	}
+}
+
+func (r *River) resumeOOM() {
+	r.oom = false
+	log.Infof("Redis has memory again, resume sync")
+	r.alert.Alertf("Redis has memory again, sync resumed")
+}
+
+// redisMemoryOK returns true if Redis uses less than the low water of maxmemory.
+func (r *River) redisMemoryOK() (bool, error) {
+	info, err := redis.String(r.doRedisOnce("INFO", "memory"))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	used, max := parseRedisMemory(info)
+	r.st.RedisUsedMemory.Set(used)
+	r.st.RedisMaxMemory.Set(max)
+	return max == 0 || float64(used) < float64(max)*redisMemoryLowWater, nil
+}
+
+// parseRedisMemory returns used_memory and maxmemory of INFO memory.
+func parseRedisMemory(info string) (used int64, max int64) {
+	s := bufio.NewScanner(strings.NewReader(info))
+	for s.Scan() {
+		seps := strings.SplitN(strings.TrimSpace(s.Text()), ":", 2)
+		if len(seps) != 2 {
+			continue
+		}
+		switch seps[0] {
+		case "used_memory":
+			used, _ = strconv.ParseInt(seps[1], 10, 64)
+		case "maxmemory":
+			max, _ = strconv.ParseInt(seps[1], 10, 64)
+		}
+	}
+	return used, max
+}
+
+// tightenTTL expires the keys without a TTL of the rules with a priority
+// lower than redis_oom_min_priority after redis_oom_ttl.
+func (r *River) tightenTTL() error {
+	ttl := int64(r.c.RedisOOMTTL.Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+
+	for _, rule := range r.rules {
+		for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+			if rule.Priority >= r.c.RedisOOMMinPriority {
+				continue
+			}
+
+			n, err := r.expireKeys(rule.keyPrefix+":*", ttl)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			log.Warnf("expire %d keys of %s.%s in %ds for Redis out of memory", n, rule.Schema, rule.Table, ttl)
+		}
+	}
+	return nil
+}
+
+// expireKeys expires the keys matching the pattern without a TTL.
+func (r *River) expireKeys(pattern string, ttl int64) (int, error) {
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(r.doRedis("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return n, errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if left, err := redis.Int64(r.doRedis("TTL", key)); err != nil {
+				return n, errors.Trace(err)
+			} else if left != -1 {
+				continue
+			}
+			if _, err = r.doRedis("EXPIRE", key, ttl); err != nil {
+				return n, errors.Trace(err)
+			}
+			n++
+		}
+
+		if cursor == "0" || r.ctx.Err() != nil {
+			return n, nil
+		}
+	}
+}
+
+// redisInfoLoop updates the Redis memory in the statistics, with its own
+// connection as the river connection is used by the canal.
+func (r *River) redisInfoLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(redisInfoInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		addr, err := r.resolveRedisMaster()
+		if err != nil {
+			continue
+		}
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+		if err != nil {
+			continue
+		}
+		info, err := redis.String(conn.Do("INFO", "memory"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		used, max := parseRedisMemory(info)
+		r.st.RedisUsedMemory.Set(used)
+		r.st.RedisMaxMemory.Set(max)
+	}
+}
@@ -0,0 +1,142 @@
+package river
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// Output types of a rule.
+const (
+	// OutputHash writes the row to the hash of the row key, the default.
+	OutputHash = "hash"
+	// OutputSet adds the row key to the set, and removes it on delete.
+	OutputSet = "set"
+	// OutputStream appends the action as _action, the row key as _key and
+	// the row to the stream.
+	OutputStream = "stream"
+	// OutputGeo adds the row key to the geo set at the POINT of the column,
+	// and removes it on delete or for a NULL or other geometry.
+	OutputGeo = "geo"
+	// OutputNested writes the row as an object with _key to the JSON array
+	// in the field of the parent hash, and removes it on delete.
+	OutputNested = "nested"
+	// OutputTop keeps the row keys of each group in the sorted set of the
+	// group scored by the column, trimmed to the max_len highest scores.
+	OutputTop = "top"
+	// OutputJoin adds the value of the column to the set of the key with
+	// {column} replaced by the row, and removes it on delete, like the tags
+	// of a post from the rows of a join table.
+	OutputJoin = "join"
+)
+
+// Output is one Redis data structure a rule writes the rows to. All the
+// outputs of a row are written in one transaction, so in Redis Cluster
+// their keys must be in one slot, like with a {hash tag}.
+type Output struct {
+	Type string `toml:"type"`
+
+	// Key is the set or stream key, {schema} and {table} are replaced like key_prefix.
+	// For the nested output it is the parent key, with {column} replaced by
+	// the column values of the row, like "test:order:{order_id}".
+	Key string `toml:"key"`
+
+	// MaxLen trims the stream to about the length, 0 for no limit, or the
+	// top output to the length.
+	MaxLen int `toml:"max_len"`
+
+	// Column is the POINT column of the geo output, the number or date
+	// column scoring the top output, or the member column of the join output.
+	Column string `toml:"column"`
+
+	// Field is the parent hash field of the nested output.
+	Field string `toml:"field"`
+}
+
+func (o *Output) prepare(r *Rule) error {
+	switch o.Type {
+	case "":
+		o.Type = OutputHash
+	case OutputHash:
+	case OutputSet, OutputStream, OutputGeo, OutputNested, OutputTop, OutputJoin:
+		if len(o.Key) == 0 {
+			return errors.Errorf("%s.%s key must be set for %s output", r.Schema, r.Table, o.Type)
+		}
+		if o.Type == OutputGeo && len(o.Column) == 0 {
+			return errors.Errorf("%s.%s column must be set for geo output", r.Schema, r.Table)
+		}
+		if o.Type == OutputNested && len(o.Field) == 0 {
+			return errors.Errorf("%s.%s field must be set for nested output", r.Schema, r.Table)
+		}
+		if o.Type == OutputJoin && len(o.Column) == 0 {
+			return errors.Errorf("%s.%s column must be set for join output", r.Schema, r.Table)
+		}
+		if o.Type == OutputTop && (len(o.Column) == 0 || o.MaxLen <= 0) {
+			return errors.Errorf("%s.%s column and max_len must be set for top output", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("%s.%s invalid output type %s", r.Schema, r.Table, o.Type)
+	}
+
+	o.Key = r.replaceKey(o.Key)
+	return nil
+}
+
+// hasHashOutput checks whether the rows are written to hashes,
+// which they are without outputs.
+func (r *Rule) hasHashOutput() bool {
+	if len(r.Outputs) == 0 {
+		return true
+	}
+
+	for _, o := range r.Outputs {
+		if o.Type == OutputHash {
+			return true
+		}
+	}
+	return false
+}
+
+// outputCmds returns the commands to write the row with the key to the
+// outputs other than hash and to the Redis sets of the SET columns, row is
+// nil for delete.
+func (r *River) outputCmds(rule *Rule, action string, key string, row []interface{}) ([]redisCmd, error) {
+	cmds := r.redisSetCmds(rule, key, row)
+	for _, o := range rule.Outputs {
+		switch o.Type {
+		case OutputSet:
+			if action == canal.DeleteAction {
+				cmds = append(cmds, newRedisCmd("SREM", o.Key, key))
+			} else {
+				cmds = append(cmds, newRedisCmd("SADD", o.Key, key))
+			}
+		case OutputStream:
+			args := redis.Args{}.Add(o.Key)
+			if o.MaxLen > 0 {
+				args = args.Add("MAXLEN", "~", o.MaxLen)
+			}
+			args = args.Add("*", "_action", action, "_key", key)
+
+			if row != nil {
+				values, _, err := r.makeRowValues(rule, nil, row)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				unchunkValues(rule, values)
+				args = args.AddFlat(values)
+			}
+			cmds = append(cmds, newRedisCmd("XADD", args...))
+		case OutputGeo:
+			p, ok, err := geoPoint(rule, o.Column, row)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if ok {
+				cmds = append(cmds, newRedisCmd("GEOADD", o.Key, p[0], p[1], key))
+			} else {
+				cmds = append(cmds, newRedisCmd("ZREM", o.Key, key))
+			}
+		}
+	}
+	return cmds, nil
+}
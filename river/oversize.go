@@ -0,0 +1,86 @@
+package river
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errDropRow is returned for a row not to be written by the oversize_policy drop_row.
+var errDropRow = errors.New("drop oversize row")
+
+// oversizeError is returned for a value larger than max_field_bytes or
+// max_binary_bytes with the oversize_policy dead_letter.
+type oversizeError struct {
+	Field  string
+	Size   int
+	Max    int
+	Option string
+}
+
+func (e *oversizeError) Error() string {
+	return fmt.Sprintf("field %s size %d exceeds %s %d", e.Field, e.Size, e.Option, e.Max)
+}
+
+// limitValue applies the rule max_field_bytes to the value of the field,
+// it returns false if the field is not to be written.
+func (r *River) limitValue(rule *Rule, field string, value interface{}) (interface{}, bool, error) {
+	if rule.MaxFieldBytes <= 0 {
+		return value, true, nil
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		// numbers are always small
+		return value, true, nil
+	}
+	if len(s) <= rule.MaxFieldBytes {
+		return value, true, nil
+	}
+
+	if ok, err := r.oversize(rule, field, len(s), rule.MaxFieldBytes, "max_field_bytes"); !ok {
+		return nil, false, err
+	}
+	if rule.OversizePolicy == OversizePolicyChunk {
+		return chunkedValue(s), true, nil
+	}
+
+	return truncateValue(s, rule.MaxFieldBytes), true, nil
+}
+
+// truncateValue returns s cut to n bytes at a rune boundary, for valid UTF-8.
+func truncateValue(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// oversize counts and logs the field larger than the max of the option,
+// it returns false if the field is not to be written by the oversize_policy,
+// or true to truncate or chunk it.
+func (r *River) oversize(rule *Rule, field string, size int, max int, option string) (bool, error) {
+	r.st.OversizeNum.Add(1)
+	r.st.Rule(rule).OversizeNum.Add(1)
+	log.Warnf("%s.%s field %s size %d exceeds %s %d, %s", rule.Schema, rule.Table, field, size, option, max, rule.OversizePolicy)
+
+	switch rule.OversizePolicy {
+	case OversizePolicyDropField:
+		return false, nil
+	case OversizePolicyDropRow:
+		return false, errDropRow
+	case OversizePolicyDeadLetter:
+		return false, &oversizeError{Field: field, Size: size, Max: max, Option: option}
+	}
+	return true, nil
+}
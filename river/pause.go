@@ -0,0 +1,82 @@
+package river
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pause stops applying the rows events until Resume, like the circuit
+// breaker: the canal is blocked, so the binlog is not read any further and
+// the position is not saved past the paused event. The background tasks
+// like verify_sample go on. It has no effect if already paused, else it is
+// recorded in the audit log with the source triggering it, like
+// AuditSourceAPI or HTTPAuditSource of the request. It returns the ctx
+// error without pausing if ctx is done.
+func (r *River) Pause(ctx context.Context, source string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.pauseLock.Lock()
+	defer r.pauseLock.Unlock()
+
+	if r.pauseCh != nil {
+		return nil
+	}
+	r.pauseCh = make(chan struct{})
+	r.st.Paused.Set(1)
+	log.Infof("pause sync by %s", source)
+	r.audit.Record("pause", source, map[string]interface{}{"pos": r.syncedPosition().String()})
+	return nil
+}
+
+// Resume applies the rows events again after Pause, it has no effect if
+// not paused, else it is recorded in the audit log with the source like
+// Pause. It returns the ctx error without resuming if ctx is done.
+func (r *River) Resume(ctx context.Context, source string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.pauseLock.Lock()
+	defer r.pauseLock.Unlock()
+
+	if r.pauseCh == nil {
+		return nil
+	}
+	close(r.pauseCh)
+	r.pauseCh = nil
+	r.st.Paused.Set(0)
+	log.Infof("resume sync by %s", source)
+	r.audit.Record("resume", source, map[string]interface{}{"pos": r.syncedPosition().String()})
+	return nil
+}
+
+// Paused returns true between Pause and Resume.
+func (r *River) Paused() bool {
+	r.pauseLock.Lock()
+	defer r.pauseLock.Unlock()
+
+	return r.pauseCh != nil
+}
+
+// waitResume blocks the canal while paused, it returns false if the river
+// is closed meanwhile.
+func (r *River) waitResume() bool {
+	r.pauseLock.Lock()
+	ch := r.pauseCh
+	r.pauseLock.Unlock()
+
+	if ch == nil {
+		return true
+	}
+	defer r.waitedTxn(time.Now())
+	select {
+	case <-ch:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,110 @@
+package river
+
+import (
+	"bytes"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go/ioutil2"
+	log "github.com/sirupsen/logrus"
+)
+
+// poisonInfo counts the failures of the rows event at the binlog position
+// across restarts, saved in poison.info of the data dir.
+type poisonInfo struct {
+	Name     string `toml:"bin_name"`
+	Pos      uint32 `toml:"bin_pos"`
+	Failures int    `toml:"failures"`
+
+	filePath string
+}
+
+func loadPoisonInfo(dataDir string) (*poisonInfo, error) {
+	var p poisonInfo
+
+	if len(dataDir) == 0 {
+		return &p, nil
+	}
+	p.filePath = path.Join(dataDir, "poison.info")
+
+	f, err := os.Open(p.filePath)
+	if os.IsNotExist(err) {
+		return &p, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	_, err = toml.DecodeReader(f, &p)
+	return &p, errors.Trace(err)
+}
+
+// Failed counts a failure of the rows event at pos, it returns the failures so far.
+func (p *poisonInfo) Failed(pos mysql.Position) (int, error) {
+	if p.Name != pos.Name || p.Pos != pos.Pos {
+		p.Name, p.Pos, p.Failures = pos.Name, pos.Pos, 0
+	}
+	p.Failures++
+	return p.Failures, errors.Trace(p.save())
+}
+
+// Reset forgets the failures.
+func (p *poisonInfo) Reset() error {
+	p.Name, p.Pos, p.Failures = "", 0, 0
+	return errors.Trace(p.save())
+}
+
+func (p *poisonInfo) save() error {
+	if len(p.filePath) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(p); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(p.filePath, buf.Bytes(), 0644))
+}
+
+// quarantine counts the failure of the rows event that stops the sync,
+// and once it failed poison_threshold times, even across restarts, writes
+// it to the dead-letter queue to skip it. It returns true if quarantined.
+func (r *River) quarantine(rule *Rule, e *canal.RowsEvent, err error) bool {
+	if r.c.PoisonThreshold <= 0 {
+		return false
+	}
+
+	// the rows of mysqldump have no position
+	pos, ok := r.eventPosition(e)
+	if !ok {
+		return false
+	}
+
+	failures, serr := r.poison.Failed(pos)
+	if serr != nil {
+		log.Errorf("save poison info err %v", serr)
+	}
+	if failures < r.c.PoisonThreshold {
+		log.Errorf("%s %s.%s at binlog %s failed %d/%d times err %v", e.Action, rule.Schema, rule.Table, pos, failures, r.c.PoisonThreshold, err)
+		return false
+	}
+
+	if derr := r.deadLetters.Put(rule, e, err); derr != nil {
+		log.Errorf("quarantine %s %s.%s at binlog %s err %v", e.Action, rule.Schema, rule.Table, pos, derr)
+		return false
+	}
+
+	log.Errorf("QUARANTINED poison %s %s.%s at binlog %s to the dead-letter queue after %d failures, err %v",
+		e.Action, rule.Schema, rule.Table, pos, failures, err)
+	r.alert.Alertf("quarantined %s %s.%s at binlog %s after %d failures: %v", e.Action, rule.Schema, rule.Table, pos, failures, err)
+	r.st.QuarantinedNum.Add(1)
+
+	if serr = r.poison.Reset(); serr != nil {
+		log.Errorf("save poison info err %v", serr)
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package river
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultProbeInterval is the interval the probe row is written at without
+// probe_interval.
+const defaultProbeInterval = 10 * time.Second
+
+// probeLatencyBuckets are the upper bounds in milliseconds for the end to
+// end latency of the probe rows.
+var probeLatencyBuckets = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// prepareProbe finds the rule of probe_table, which must be synced like the
+// other tables.
+func (r *River) prepareProbe() error {
+	if len(r.c.ProbeTable) == 0 {
+		return nil
+	}
+
+	rule, err := r.ruleByName(r.c.ProbeTable)
+	if err != nil {
+		return errors.Annotatef(err, "probe_table must be in a source")
+	}
+	for _, name := range []string{"id", "ts"} {
+		if rule.TableInfo.FindColumn(name) < 0 {
+			return errors.Errorf("probe_table %s must have the column %s", r.c.ProbeTable, name)
+		}
+	}
+	r.probeRule = rule
+	return nil
+}
+
+// probeLoop writes the row of the server_id to probe_table with the time
+// in unix nanoseconds every probe_interval, see observeProbe, with its own
+// MySQL connection.
+func (r *River) probeLoop() {
+	defer r.wg.Done()
+
+	interval := r.c.ProbeInterval.Duration
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	query := fmt.Sprintf("REPLACE INTO %s.%s (`id`, `ts`) VALUES (?, ?)",
+		quoteName(r.probeRule.Schema), quoteName(r.probeRule.Table))
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		if err := r.writeProbe(query); err != nil {
+			log.Warnf("write probe row err %v", err)
+		}
+	}
+}
+
+func (r *River) writeProbe(query string) error {
+	my, err := r.dialMySQL()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer my.Close()
+
+	_, err = my.Execute(query, r.c.ServerID, time.Now().UnixNano())
+	return errors.Trace(err)
+}
+
+// observeProbe records the time from the probe row written by probeLoop
+// to its key written in Redis, the end to end latency of the sync. The
+// rows of the other rivers sharing probe_table are ignored.
+func (r *River) observeProbe(rule *Rule, row []interface{}) {
+	if rule != r.probeRule {
+		return
+	}
+
+	id := row[rule.TableInfo.FindColumn("id")]
+	if transformString(id) != strconv.FormatUint(uint64(r.c.ServerID), 10) {
+		return
+	}
+	ts, err := strconv.ParseInt(transformString(row[rule.TableInfo.FindColumn("ts")]), 10, 64)
+	if err != nil {
+		return
+	}
+
+	d := time.Since(time.Unix(0, ts))
+	r.st.ProbeLatency.Set(int64(d / time.Millisecond))
+	if r.st.probeLatency != nil {
+		r.st.probeLatency.Observe(float64(d) / float64(time.Millisecond))
+	}
+	r.st.statsd.Timing("probe.latency", d)
+}
@@ -0,0 +1,69 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// How the river recovers when the saved binlog position is not on the
+// master any more, like after PURGE BINARY LOGS.
+const (
+	// BinlogPurgedPolicyFail stops the sync with the steps to recover, the default.
+	BinlogPurgedPolicyFail = "fail"
+	// BinlogPurgedPolicyRedump dumps the data again with mysqldump and
+	// continues from the binlog position of the dump.
+	BinlogPurgedPolicyRedump = "redump"
+)
+
+// isBinlogPurged returns true if the master can not send the binlog from
+// the saved position, as the file is purged or the position is past its end.
+func isBinlogPurged(err error) bool {
+	if err == nil {
+		return false
+	}
+	if myErr, ok := errors.Cause(err).(*mysql.MyError); ok && myErr.Code != mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Could not find first log file name in binary log index file") ||
+		strings.Contains(msg, "requested master to start replication from position > file size") ||
+		strings.Contains(msg, "the master has purged binary logs")
+}
+
+// handleBinlogPurged reports the saved binlog position is purged, and by
+// binlog_purged_policy, resets it to dump the data again. It returns true
+// to restart the canal with the dump.
+func (r *River) handleBinlogPurged(err error) bool {
+	pos := r.master.Position()
+	r.st.BinlogPurgedNum.Add(1)
+
+	if r.c.BinlogPurgedPolicy != BinlogPurgedPolicyRedump {
+		log.Errorf("binlog %s is not on MySQL any more, likely purged: %v. To recover, stop the river, "+
+			"delete master.info in %s and the keys in Redis, then start it to dump the data again, "+
+			"or set binlog_purged_policy = \"redump\"", pos, err, r.c.DataDir)
+		r.alert.Alertf("binlog %s is not on MySQL any more, the data must be dumped again", pos)
+		return false
+	}
+
+	if rerr := r.master.Reset(); rerr != nil {
+		log.Errorf("reset binlog position %s err %v", pos, rerr)
+		return false
+	}
+	if rerr := r.poison.Reset(); rerr != nil {
+		log.Errorf("save poison info err %v", rerr)
+	}
+	// the position of the watermark is gone too
+	r.watermark = mysql.Position{}
+
+	log.Warnf("binlog %s is not on MySQL any more, likely purged: %v, dump the data again", pos, err)
+	r.audit.Record("reset_position", AuditSourceRiver, map[string]interface{}{
+		"pos":    pos.String(),
+		"reason": "binlog_purged_policy redump",
+	})
+	r.alert.Alertf("binlog %s is not on MySQL any more, dumping the data again", pos)
+	r.st.RedumpNum.Add(1)
+	return true
+}
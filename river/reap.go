@@ -0,0 +1,175 @@
+package river
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultReapWindow is how long a key must be without its row before it is
+// deleted without reap_window.
+const defaultReapWindow = time.Hour
+
+// isRowKey returns true if the key under the rule key prefix may be a row
+// key, not a track_rows key or a chunk list.
+func isRowKey(rule *Rule, key string) bool {
+	all, count := trackKeys(rule)
+	if key == all || key == count {
+		return false
+	}
+	return rule.OversizePolicy != OversizePolicyChunk || !strings.HasSuffix(key, ":chunks")
+}
+
+// reapLoop deletes the row keys whose rows are gone from MySQL for longer
+// than reap_window every reap_interval, like the deletes missed while the
+// binlog was purged, with its own MySQL and Redis connections. The keys found without
+// rows are only kept in memory, so the window starts over after a restart.
+func (r *River) reapLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.c.ReapInterval.Duration)
+	defer ticker.Stop()
+
+	// the keys found without rows and since when
+	orphans := make(map[string]time.Time)
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		addr, err := r.resolveRedisMaster()
+		if err != nil {
+			continue
+		}
+		my, err := r.dialMySQL()
+		if err != nil {
+			log.Warnf("reap keys err %v", err)
+			continue
+		}
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+		if err != nil {
+			my.Close()
+			continue
+		}
+
+		found := make(map[string]time.Time)
+		seen := make(map[string]bool)
+		for _, rule := range r.rules {
+			// the keys of a rule with rule_overlap all are reaped once
+			if seen[rule.keyPrefix] || len(r.checkSkipReason(rule)) > 0 || r.isCustomRule(rule) || !rule.hasPKKeys() {
+				continue
+			}
+			seen[rule.keyPrefix] = true
+
+			if err := r.reapRule(my, conn, rule, orphans, found); err != nil {
+				log.Warnf("reap keys of %s.%s err %v", rule.Schema, rule.Table, err)
+				break
+			}
+		}
+		orphans = found
+		conn.Close()
+		my.Close()
+	}
+}
+
+// reapRule looks for the keys of the rule without rows by SCAN, adding
+// them to found, and deletes the ones in orphans for longer than
+// reap_window.
+func (r *River) reapRule(my mysqlExecutor, conn redis.Conn, rule *Rule, orphans map[string]time.Time, found map[string]time.Time) error {
+	window := r.c.ReapWindow.Duration
+	if window <= 0 {
+		window = defaultReapWindow
+	}
+
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", rule.keyPrefix+":*", "COUNT", 1000))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			pks, ok := keyPKValues(rule, key)
+			if !ok || !isRowKey(rule, key) {
+				continue
+			}
+			row, err := selectRow(my, rule, pks)
+			if err != nil {
+				return errors.Trace(err)
+			} else if row != nil {
+				continue
+			}
+
+			now := time.Now()
+			since, ok := orphans[key]
+			if !ok {
+				since = now
+			}
+			found[key] = since
+			if now.Sub(since) < window {
+				continue
+			}
+
+			deleted, err := r.reapKey(my, conn, rule, key, pks)
+			if err != nil {
+				return errors.Trace(err)
+			} else if deleted {
+				delete(found, key)
+				r.st.ReapedNum.Add(1)
+				r.st.Rule(rule).ReapedNum.Add(1)
+				log.WithField("key", key).Infof("reap key without row since %s", since.Format(time.RFC3339))
+			}
+		}
+
+		if cursor == "0" || r.ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// reapKey deletes the hash key if its row is still missing, it returns
+// true if deleted. The key is watched, so it is kept if the sync writes the
+// row meanwhile. The key has no row to clean its indexes and other
+// outputs, only the hash key and its chunks are deleted.
+func (r *River) reapKey(my mysqlExecutor, conn redis.Conn, rule *Rule, key string, pks []interface{}) (bool, error) {
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	typ, err := redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, errors.Trace(err)
+	}
+	row, err := selectRow(my, rule, pks)
+	if err != nil || row != nil || typ != "hash" {
+		conn.Do("UNWATCH")
+		return false, errors.Trace(err)
+	}
+	if r.c.DryRun {
+		conn.Do("UNWATCH")
+		log.WithField("key", key).Infof("dry run, not reaping key without row")
+		return false, nil
+	}
+
+	conn.Send("MULTI")
+	for _, cmd := range deleteRowCmds(rule, key) {
+		conn.Send(cmd.Name, cmd.Args...)
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	// a nil reply is the key written meanwhile
+	return reply != nil, nil
+}
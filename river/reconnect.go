@@ -0,0 +1,63 @@
+package river
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// connState tracks a connection from its first failure to the reconnect,
+// so the reconnect is reported with its cause and downtime.
+type connState struct {
+	name string
+
+	// the time and error of the first failure, zero while connected
+	since time.Time
+	cause error
+	// the number of failures since
+	failures int
+}
+
+// down records a failure of the connection.
+func (s *connState) down(err error) {
+	if s.since.IsZero() {
+		s.since = time.Now()
+		s.cause = err
+	}
+	s.failures++
+}
+
+// reconnected reports the connection is back, with the metric, a
+// structured log, a sample in /stat/reconnects and an alert.
+func (r *River) reconnected(s *connState) {
+	var downtime time.Duration
+	if !s.since.IsZero() {
+		downtime = time.Since(s.since)
+	}
+
+	switch s.name {
+	case "mysql":
+		r.st.MySQLReconnectNum.Add(1)
+	case "redis":
+		r.st.RedisReconnectNum.Add(1)
+	}
+	r.st.statsd.Count("reconnects", 1, "target:"+s.name)
+	r.st.statsd.Timing("reconnect.downtime", downtime, "target:"+s.name)
+	r.st.reconnects.Add(sample{
+		Time:     time.Now(),
+		Action:   "reconnect",
+		Key:      s.name,
+		Err:      s.cause,
+		Duration: downtime,
+	})
+
+	log.WithFields(log.Fields{
+		"target":   s.name,
+		"cause":    s.cause,
+		"downtime": downtime,
+		"failures": s.failures,
+	}).Warnf("reconnected %s after %s", s.name, downtime)
+	r.alert.Alertf("reconnected %s after %s, %d failures since %v", s.name, downtime, s.failures, s.cause)
+
+	s.since, s.cause, s.failures = time.Time{}, nil, 0
+}
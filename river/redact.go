@@ -0,0 +1,135 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// redactedValue replaces the values of the sensitive columns in the logs,
+// the errors and the dead letters.
+const redactedValue = "[REDACTED]"
+
+// maskTransforms are the transforms making a column sensitive.
+var maskTransforms = map[string]bool{
+	"hash":    true,
+	"redact":  true,
+	"drop":    true,
+	"encrypt": true,
+}
+
+// prepareSensitive sets the sensitive columns: sensitive_columns, and the
+// columns with a hash, redact, drop or encrypt transform.
+func (r *Rule) prepareSensitive() {
+	r.sensitive = make(map[string]bool, len(r.SensitiveColumns))
+	for _, column := range r.SensitiveColumns {
+		r.sensitive[column] = true
+	}
+	for column := range r.Transforms {
+		if r.isMasked(column) {
+			r.sensitive[column] = true
+		}
+	}
+}
+
+// isMasked returns true if the column has a hash, redact, drop or encrypt
+// transform, so its plain value must not be written to Redis.
+func (r *Rule) isMasked(column string) bool {
+	s, ok := r.Transforms[column]
+	if !ok || isTemplateTransform(s) {
+		return false
+	}
+	for _, name := range strings.Split(s, "|") {
+		name = strings.TrimSpace(name)
+		if i := strings.Index(name, ":"); i >= 0 {
+			name = name[:i]
+		}
+		if maskTransforms[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// isSensitive returns true if the values of the column must not be logged.
+func (r *Rule) isSensitive(column string) bool {
+	return r.sensitive[column]
+}
+
+// logValue returns the value of the column to log.
+func (r *Rule) logValue(column string, value interface{}) interface{} {
+	if r.isSensitive(column) {
+		return redactedValue
+	}
+	return value
+}
+
+// redactError hides the error of a sensitive column, which may contain
+// its value. An empty column is a computed field, which may use any
+// column, so its error is hidden if the rule has any sensitive column.
+func (r *Rule) redactError(column string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if len(column) > 0 && !r.isSensitive(column) || len(column) == 0 && len(r.sensitive) == 0 {
+		return err
+	}
+	return errors.Errorf("invalid value %s", redactedValue)
+}
+
+// redactRows returns a copy of the rows with the values of the sensitive
+// columns replaced, and the replaced columns. The key columns are kept,
+// they are in the row keys already.
+func redactRows(rule *Rule, rows [][]interface{}) ([][]interface{}, []string) {
+	if len(rule.sensitive) == 0 || rule.TableInfo == nil {
+		return rows, nil
+	}
+
+	keys := make(map[string]bool)
+	for _, name := range rule.KeyColumns {
+		keys[name] = true
+	}
+	if len(rule.KeyColumns) == 0 {
+		for _, i := range rule.TableInfo.PKColumns {
+			keys[rule.TableInfo.Columns[i].Name] = true
+		}
+	}
+
+	var columns []int
+	var names []string
+	for i, c := range rule.TableInfo.Columns {
+		if rule.isSensitive(c.Name) && !keys[c.Name] {
+			columns = append(columns, i)
+			names = append(names, c.Name)
+		}
+	}
+	if len(columns) == 0 {
+		return rows, nil
+	}
+
+	redacted := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		row = append([]interface{}(nil), row...)
+		for _, i := range columns {
+			if i < len(row) && row[i] != nil {
+				row[i] = redactedValue
+			}
+		}
+		redacted = append(redacted, row)
+	}
+	return redacted, names
+}
+
+// withoutColumns returns a copy of the rule not writing the columns, to
+// replay the dead letters with redacted columns.
+func (r *Rule) withoutColumns(columns []string) *Rule {
+	c := *r
+	c.skipColumns = make(map[string]bool, len(r.skipColumns)+len(columns))
+	for column := range r.skipColumns {
+		c.skipColumns[column] = true
+	}
+	for _, column := range columns {
+		c.skipColumns[column] = true
+	}
+	return &c
+}
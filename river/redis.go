@@ -0,0 +1,340 @@
+package river
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The defaults of retrying the transient Redis errors.
+const (
+	defaultRedisMaxRetries      = 3
+	defaultRedisRetryBackoff    = 100 * time.Millisecond
+	defaultRedisRetryMaxBackoff = 5 * time.Second
+
+	// maxRedisRedirects is the number of MOVED replies followed for one command.
+	maxRedisRedirects = 5
+)
+
+// redisCmd is one Redis command to be sent.
+type redisCmd struct {
+	Name string
+	Args []interface{}
+}
+
+func newRedisCmd(name string, args ...interface{}) redisCmd {
+	return redisCmd{Name: name, Args: args}
+}
+
+// nonIdempotentRedisCommands are the commands applied once more by a retry,
+// like XADD adding another stream entry.
+var nonIdempotentRedisCommands = map[string]bool{
+	"XADD":         true,
+	"INCR":         true,
+	"INCRBY":       true,
+	"INCRBYFLOAT":  true,
+	"DECR":         true,
+	"DECRBY":       true,
+	"HINCRBY":      true,
+	"HINCRBYFLOAT": true,
+	"ZINCRBY":      true,
+	"LPUSH":        true,
+	"RPUSH":        true,
+	"APPEND":       true,
+	"PUBLISH":      true,
+}
+
+// isIdempotentCmds returns true if the commands can be applied again, a
+// push to a list deleted first, like the chunks, is.
+func isIdempotentCmds(cmds []redisCmd) bool {
+	deleted := make(map[string]bool)
+	for _, cmd := range cmds {
+		name := strings.ToUpper(cmd.Name)
+		if name == "DEL" {
+			for _, key := range cmd.Args {
+				deleted[fmt.Sprint(key)] = true
+			}
+			continue
+		}
+		if (name == "LPUSH" || name == "RPUSH") && len(cmd.Args) > 0 && deleted[fmt.Sprint(cmd.Args[0])] {
+			continue
+		}
+		if nonIdempotentRedisCommands[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// unknownResultError is a connection failure once the commands not
+// idempotent were sent, they may be applied so they are not retried.
+type unknownResultError struct {
+	err error
+}
+
+func (e *unknownResultError) Error() string {
+	return fmt.Sprintf("%v, not retried as it may be applied", e.err)
+}
+
+// Cause returns the cause for juju errors.Cause.
+func (e *unknownResultError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// Unwrap returns the wrapped error for the standard errors.As.
+func (e *unknownResultError) Unwrap() error {
+	return e.err
+}
+
+// unknownResult returns the connection failure err as an
+// unknownResultError, an error reply is returned as is.
+func unknownResult(err error) error {
+	var reply redis.Error
+	if err == nil || stderrors.As(err, &reply) {
+		return err
+	}
+	return &unknownResultError{err: err}
+}
+
+// doRedis runs the Redis command and records its latency, retrying the
+// transient errors.
+func (r *River) doRedis(cmd string, args ...interface{}) (interface{}, error) {
+	if r.dryRun(cmd, args) {
+		return nil, nil
+	}
+
+	var reply interface{}
+	err := r.retryRedis(cmd, func() error {
+		var err error
+		reply, err = r.doRedisOnce(cmd, args...)
+		if nonIdempotentRedisCommands[strings.ToUpper(cmd)] {
+			return unknownResult(err)
+		}
+		return err
+	})
+	return reply, err
+}
+
+func (r *River) doRedisOnce(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := r.redisConn.Do(cmd, args...)
+	r.st.ObserveLatency(cmd, time.Since(start))
+	return reply, redisError(err)
+}
+
+// redisError returns err with ErrRedisCommand as the cause for an error
+// reply, else ErrRedisUnavailable as the connection failed.
+func redisError(err error) error {
+	if _, ok := err.(redis.Error); ok {
+		return wrapError(err, ErrRedisCommand)
+	}
+	return wrapError(err, ErrRedisUnavailable)
+}
+
+// doRedisCmds runs the commands one by one, stopping at the first error.
+func (r *River) doRedisCmds(cmds []redisCmd) error {
+	for _, cmd := range cmds {
+		if _, err := r.doRedis(cmd.Name, cmd.Args...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// doRedisMulti runs the commands in one MULTI/EXEC transaction,
+// so either all of them or none of them are applied. The whole
+// transaction is retried on the transient errors, but not after a
+// connection failure on EXEC if the commands are not idempotent.
+func (r *River) doRedisMulti(cmds []redisCmd) error {
+	if r.c.DryRun {
+		for _, cmd := range cmds {
+			r.dryRun(cmd.Name, cmd.Args)
+		}
+		return nil
+	}
+
+	idempotent := isIdempotentCmds(cmds)
+	return r.retryRedis("MULTI", func() error {
+		return r.doRedisMultiOnce(cmds, idempotent)
+	})
+}
+
+func (r *River) doRedisMultiOnce(cmds []redisCmd, idempotent bool) error {
+	if err := r.redisConn.Send("MULTI"); err != nil {
+		return errors.Trace(redisError(err))
+	}
+
+	for _, cmd := range cmds {
+		if err := r.redisConn.Send(cmd.Name, cmd.Args...); err != nil {
+			r.redisConn.Do("DISCARD")
+			return errors.Trace(redisError(err))
+		}
+	}
+
+	replies, err := redis.Values(r.doRedisOnce("EXEC"))
+	if err != nil && !idempotent {
+		// EXEC may be applied before the connection failed
+		return unknownResult(err)
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	// EXEC does not roll back, but a failed command must fail the sync
+	for i, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return wrapError(errors.Errorf("%s in MULTI err %v", cmds[i].Name, err), ErrRedisCommand)
+		}
+	}
+
+	return nil
+}
+
+// retryRedis runs fn, retrying it with exponential backoff and jitter while
+// it fails with a transient error, up to redis_max_retries times. The
+// connection is dialed again if it failed, and reported as a reconnect
+// once a command succeeds on it.
+func (r *River) retryRedis(name string, fn func() error) error {
+	maxRetries := r.c.RedisMaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultRedisMaxRetries
+	}
+	backoff := r.c.RedisRetryBackoff.Duration
+	if backoff <= 0 {
+		backoff = defaultRedisRetryBackoff
+	}
+	maxBackoff := r.c.RedisRetryMaxBackoff.Duration
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRedisRetryMaxBackoff
+	}
+
+	redirects := 0
+	for i := 0; ; {
+		err := fn()
+		if err == nil {
+			if !r.redisState.since.IsZero() {
+				r.reconnected(&r.redisState)
+			}
+			return nil
+		}
+
+		// a MOVED slot is written to the new node at once
+		if isRedisReply(err, "MOVED") && redirects < maxRedisRedirects && r.redirectRedis(err) {
+			redirects++
+			continue
+		}
+
+		if i >= maxRetries || !isRetryableRedisError(err) {
+			return err
+		}
+		i++
+
+		// full backoff for the attempt, half of it randomized
+		wait := backoff << uint(i-1)
+		if wait > maxBackoff || wait <= 0 {
+			wait = maxBackoff
+		}
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+		log.Warnf("Redis %s err %v, retry %d/%d in %s", name, err, i, maxRetries, wait)
+		r.st.RedisRetryNum.Add(1)
+
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return err
+		}
+
+		var reply redis.Error
+		if !stderrors.As(err, &reply) {
+			// the node of a MOVED may be gone, resolve it again
+			r.redisState.down(err)
+			r.redisAddr = ""
+			if err := r.dialRedis(); err != nil {
+				log.Errorf("dial Redis err %v", err)
+			}
+		} else {
+			r.redirectRedis(err)
+		}
+	}
+}
+
+// dialRedis connects Redis, closing the old connection. A reconnect reads
+// the password again, as it may be rotated.
+func (r *River) dialRedis() error {
+	if r.redisConn != nil {
+		r.reloadSecrets()
+	}
+
+	addr, err := r.resolveRedis()
+	if err != nil {
+		return errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+
+	conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+	if err != nil {
+		return errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+
+	if r.redisConn != nil {
+		r.redisConn.Close()
+	}
+	r.redisConn = conn
+	r.redisAddr = addr
+	return nil
+}
+
+// isRedisReply returns true if err is the error reply with the prefix.
+func isRedisReply(err error, prefix string) bool {
+	var reply redis.Error
+	if !stderrors.As(err, &reply) {
+		return false
+	}
+	return strings.HasPrefix(string(reply), prefix+" ") || string(reply) == prefix
+}
+
+// The error replies of a Redis busy loading, failing over or resharding,
+// an ASK slot is retried until its migration is done and it is MOVED.
+var retryableRedisReplies = []string{"LOADING", "READONLY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN", "BUSY", "ASK"}
+
+// isRetryableRedisError returns true for the transient Redis errors: the
+// connection timeouts, resets and closes, and the error replies of a Redis
+// not ready to write yet. A failure with an unknown result is not.
+func isRetryableRedisError(err error) bool {
+	var unknown *unknownResultError
+	if stderrors.As(err, &unknown) {
+		return false
+	}
+
+	var reply redis.Error
+	if stderrors.As(err, &reply) {
+		for _, prefix := range retryableRedisReplies {
+			if isRedisReply(err, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if stderrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	for _, target := range []error{io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE} {
+		if stderrors.Is(err, target) {
+			return true
+		}
+	}
+
+	// redigo closes the connection after an I/O error
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,124 @@
+package river
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultCheckRepairRate is the number of keys repaired per second without
+// check_repair_rate.
+const defaultCheckRepairRate = 100
+
+// repairer rewrites the mismatched keys found by Check, at most rate per
+// second, on the Redis connection of Check.
+type repairer struct {
+	r    *River
+	conn redis.Conn
+	rate int
+	next time.Time
+}
+
+func (r *River) newRepairer(conn redis.Conn) *repairer {
+	rate := r.c.CheckRepairRate
+	if rate <= 0 {
+		rate = defaultCheckRepairRate
+	}
+	return &repairer{r: r, conn: conn, rate: rate}
+}
+
+// wait blocks until the next repair is allowed by the rate.
+func (p *repairer) wait(ctx context.Context) error {
+	now := time.Now()
+	if p.next.After(now) {
+		select {
+		case <-time.After(p.next.Sub(now)):
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+		now = p.next
+	}
+	p.next = now.Add(time.Second / time.Duration(p.rate))
+	return nil
+}
+
+// repair rewrites the key of the rule with the row for a missing key or
+// differing fields, or deletes the rule fields of an extra key. The extra
+// key has no row to clean its indexes and other outputs, only the hash key
+// and its chunks are deleted, and the one of a custom mapping is left.
+func (p *repairer) repair(ctx context.Context, rule *Rule, m *Mismatch, row []interface{}) error {
+	if err := p.wait(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	var (
+		cmds []redisCmd
+		err  error
+	)
+	if m.Kind == MismatchExtra {
+		if p.r.isCustomRule(rule) {
+			// no row to map the delete with
+			return nil
+		}
+		cmds = deleteRowCmds(rule, m.Key)
+	} else {
+		if p.r.isCustomRule(rule) {
+			cmds, err = p.r.mapRow(rule, canal.InsertAction, nil, row, m.Key)
+		}
+		if !p.r.isCustomRule(rule) || errors.Cause(err) == ErrDefaultMapping {
+			// the full row, also with the skip write_policy
+			cmds, err = p.r.upsertRowAllCmds(rule, canal.InsertAction, m.Key, nil, row)
+		}
+		if errors.Cause(err) == errDropRow {
+			log.WithField("key", m.Key).Warnf("drop oversize repaired row")
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := p.write(cmds); err != nil {
+		return errors.Trace(err)
+	}
+	p.r.accountWrite(rule, cmds)
+
+	m.Repaired = true
+	log.WithField("key", m.Key).Infof("repair %s key of %s", m.Kind, m.Rule)
+	return nil
+}
+
+// write runs the commands in one MULTI/EXEC transaction like writeRow, but
+// on the connection of the repairer, they are only counted with dry_run.
+func (p *repairer) write(cmds []redisCmd) error {
+	if p.r.c.DryRun {
+		for _, cmd := range cmds {
+			p.r.dryRun(cmd.Name, cmd.Args)
+		}
+		return nil
+	}
+
+	if err := p.conn.Send("MULTI"); err != nil {
+		return errors.Trace(redisError(err))
+	}
+	for _, cmd := range cmds {
+		if err := p.conn.Send(cmd.Name, cmd.Args...); err != nil {
+			p.conn.Do("DISCARD")
+			return errors.Trace(redisError(err))
+		}
+	}
+
+	replies, err := redis.Values(p.conn.Do("EXEC"))
+	if err != nil {
+		return errors.Trace(redisError(err))
+	}
+	for i, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return wrapError(errors.Errorf("%s in MULTI err %v", cmds[i].Name, err), ErrRedisCommand)
+		}
+	}
+	return nil
+}
@@ -4,18 +4,18 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/gomodule/redigo/redis"
 	"github.com/siddontang/go-mysql/canal"
-	"gopkg.in/birkirb/loggers.v1/log"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
 )
 
-// ErrRuleNotExist is the error if rule is not defined.
-var ErrRuleNotExist = errors.New("rule is not exist")
-
 // River is a pluggable service within Elasticsearch pulling data then indexing it into Elasticsearch.
 // We use this definition here too, although it may not run within Elasticsearch.
 // Maybe later I can implement a acutal river in Elasticsearch, but I must learn java. :-)
@@ -23,6 +23,9 @@ type River struct {
 	c *Config
 
 	canal *canal.Canal
+	// canalLock guards canal, which restartCanal replaces, for the goroutines
+	// other than the one running it
+	canalLock sync.RWMutex
 
 	rules map[string]*Rule
 
@@ -32,28 +35,132 @@ type River struct {
 	wg sync.WaitGroup
 
 	redisConn redis.Conn // FIXME
+	// the address of redisConn, empty to resolve it again
+	redisAddr string
 
 	st *stat
 
 	master *masterInfo
 
+	// the failures of the last failed rows event, only used in the canal goroutine
+	poison *poisonInfo
+
 	syncCh chan interface{}
+
+	alert *alerter
+
+	audit *auditLog
+
+	deadLetters *deadLetterQueue
+	// number of rows events failed in a row, only used in the canal goroutine
+	consecutiveErrors int
+
+	// rows events at or before it are replayed after restart, only used in the canal goroutine
+	watermark mysql.Position
+
+	// the version of the rows event being applied, written to the version_field
+	// of the rows, only used in the canal goroutine
+	version int64
+
+	// Redis is out of memory and the last time it was checked, only used in the canal goroutine
+	oom          bool
+	oomCheckTime time.Time
+
+	// when the current transaction started applying, the time it waited
+	// since and whether it exceeded txn_timeout, only used in the canal
+	// goroutine
+	txnStart    time.Time
+	txnWaited   time.Duration
+	txnTimedOut bool
+
+	// server_id was selected automatically
+	autoServerID bool
+
+	// secretsLock guards the passwords in c, which are rotated by ReloadSecrets
+	secretsLock sync.Mutex
+
+	// the SSH tunnel of mysqldump, nil if dump_ssh_addr is not set
+	dumpTunnel *sshTunnel
+
+	// the failures of the MySQL and Redis connections until the reconnect
+	mysqlState connState
+	redisState connState
+
+	mapper   RowMapper
+	verifier RowVerifier
+
+	// the keys recently synced for verify_sample, nil if not set
+	verifyKeys *verifyRing
+
+	// the rule of probe_table, nil if not set
+	probeRule *Rule
+
+	// pauseLock guards pauseCh, which is closed by Resume, nil if not paused
+	pauseLock sync.Mutex
+	pauseCh   chan struct{}
+
+	closeOnce sync.Once
+}
+
+// New creates the River from config, it is stopped until Run.
+func New(c *Config) (*River, error) {
+	return NewRiver(c)
 }
 
-// NewRiver creates the River from config
+// NewRiver creates the River from config, it is the same as New.
 func NewRiver(c *Config) (*River, error) {
+	if err := c.validate(false); err != nil {
+		return nil, errors.Trace(wrapError(err, ErrInvalidConfig))
+	}
+	if err := c.ResolveSecrets(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	r := new(River)
 
 	r.c = c
 	r.rules = make(map[string]*Rule)
 	r.syncCh = make(chan interface{}, 4096)
 	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.alert = newAlerter(c.AlertWebhooks, c.AlertName)
+	r.audit = newAuditLog(c)
+	r.mysqlState.name = "mysql"
+	r.redisState.name = "redis"
+	if c.VerifySample > 0 {
+		r.verifyKeys = newVerifyRing(c.VerifySample * verifyRecentFactor)
+	}
+
+	if err := r.waitDependencies(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.autoServerID = c.ServerID == 0
+	c.selectServerID()
+	if err := c.checkMaster(r.ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	var err error
 	if r.master, err = loadMasterInfo(c.DataDir); err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	if r.poison, err = loadPoisonInfo(c.DataDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if c.DryRun {
+		// start from the saved position, but never move it
+		log.Warnf("dry run, the Redis writes are only counted in the stats")
+		r.master.filePath = ""
+		r.poison.filePath = ""
+	}
+
+	if len(c.DumpSSHAddr) > 0 && len(c.DumpExec) > 0 {
+		if r.dumpTunnel, err = newSSHTunnel(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	if err = r.newCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -62,6 +169,10 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
+	if err = r.prepareProbe(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	if err = r.prepareCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -71,12 +182,29 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
-	r.redisConn, err = redis.Dial("tcp", r.c.RedisAddr) // FIXME
-	if err != nil {
+	if err = r.dialRedis(); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	r.st = &stat{r: r}
+	r.st = newStat(r)
+
+	if err = r.loadWatermark(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = r.checkRedisACL(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if r.deadLetters, err = newDeadLetterQueue(r, r.c.DeadLetterFile, r.c.DeadLetterKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(r.c.StatsdAddr) > 0 {
+		if r.st.statsd, err = newStatsdClient(r.c.StatsdAddr, r.c.StatsdPrefix, r.c.StatsdTags, r.c.StatsdDatadog); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 	go r.st.Run(r.c.StatAddr)
 
 	return r, nil
@@ -86,14 +214,21 @@ func (r *River) newCanal() error {
 	cfg := canal.NewDefaultConfig()
 	cfg.Addr = r.c.MyAddr
 	cfg.User = r.c.MyUser
-	cfg.Password = r.c.MyPassword
-	cfg.Charset = r.c.MyCharset
+	cfg.Password = r.mysqlPassword()
+	cfg.Charset = r.c.myCharset()
 	cfg.Flavor = r.c.Flavor
 
 	cfg.ServerID = r.c.ServerID
 	cfg.Dump.ExecutionPath = r.c.DumpExec
 	cfg.Dump.DiscardErr = false
 	cfg.Dump.SkipMasterData = r.c.SkipMasterData
+	cfg.Dump.ExtraOptions = append(r.c.dumpSSLOptions(), "--default-character-set="+r.c.myCharset())
+	if r.dumpTunnel != nil {
+		cfg.Dump.ExtraOptions = append(cfg.Dump.ExtraOptions, r.dumpTunnel.Options()...)
+	}
+
+	// decode DECIMAL as exact decimals instead of float64
+	cfg.UseDecimal = true
 
 	for _, s := range r.c.Sources {
 		for _, t := range s.Tables {
@@ -101,9 +236,15 @@ func (r *River) newCanal() error {
 		}
 	}
 
-	var err error
-	r.canal, err = canal.NewCanal(cfg)
-	return errors.Trace(err)
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return errors.Trace(wrapError(err, ErrMySQLUnavailable))
+	}
+
+	r.canalLock.Lock()
+	r.canal = c
+	r.canalLock.Unlock()
+	return nil
 }
 
 func (r *River) prepareCanal() error {
@@ -142,7 +283,7 @@ func (r *River) newRule(schema, table string) error {
 		return errors.Errorf("duplicate source %s, %s defined in config", schema, table)
 	}
 
-	log.Errorf("new rule %s", key)
+	log.Infof("new rule %s", key)
 	r.rules[key] = newDefaultRule(schema, table)
 	return nil
 }
@@ -158,7 +299,13 @@ func (r *River) updateRule(schema, table string) error {
 		return errors.Trace(err)
 	}
 
-	rule.TableInfo = tableInfo
+	for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+		rule.TableInfo = tableInfo
+
+		if err = r.loadSkipColumns(rule); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	return nil
 }
@@ -220,11 +367,21 @@ func (r *River) parseSource() (map[string][]string, error) {
 }
 
 func (r *River) prepareRule() error {
-	_, err := r.parseSource()
+	wildTables, err := r.parseSource()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	switch r.c.RuleOverlap {
+	case "":
+		r.c.RuleOverlap = RuleOverlapPriority
+	case RuleOverlapPriority, RuleOverlapAll:
+	default:
+		return errors.Errorf("invalid rule_overlap %s", r.c.RuleOverlap)
+	}
+
+	// the custom mapping rules matching each table
+	matched := make(map[string][]*Rule)
 	if r.c.Rules != nil {
 		// then, set custom mapping rule
 		for _, rule := range r.c.Rules {
@@ -234,57 +391,292 @@ func (r *River) prepareRule() error {
 
 			if regexp.QuoteMeta(rule.Table) != rule.Table {
 				//wildcard table
+				tables, ok := wildTables[ruleKey(rule.Schema, rule.Table)]
+				if !ok {
+					return errors.Errorf("wildcard table rule %s.%s not defined in source", rule.Schema, rule.Table)
+				}
 
+				re, err := regexp.Compile(buildTable(rule.Table))
+				if err != nil {
+					return errors.Annotatef(err, "wildcard table rule %s.%s", rule.Schema, rule.Table)
+				}
+
+				for _, table := range tables {
+					tableRule := rule.clone()
+					tableRule.Table = table
+					tableRule.wildcard = rule.Table
+					if m := re.FindStringSubmatch(table); len(m) > 0 {
+						tableRule.tableGroups = m[1:]
+					}
+
+					key := ruleKey(rule.Schema, table)
+					matched[key] = append(matched[key], tableRule)
+				}
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
 				if _, ok := r.rules[key]; !ok {
 					return errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				log.Errorf("add rule %s", key)
-				r.rules[key] = rule
+				matched[key] = append(matched[key], rule)
 			}
 		}
 	}
 
+	for key, rules := range matched {
+		sortRules(rules)
+
+		log.Infof("add rule %s", key)
+		r.rules[key] = rules[0]
+		if len(rules) == 1 {
+			continue
+		}
+
+		if r.c.RuleOverlap == RuleOverlapAll {
+			log.Infof("apply %d more overlapping rules for %s", len(rules)-1, key)
+			rules[0].overlaps = rules[1:]
+		} else {
+			log.Warnf("ignore %d overlapping rules for %s with lower priority", len(rules)-1, key)
+		}
+	}
+
 	rules := make(map[string]*Rule)
 	for key, rule := range r.rules {
-		if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
-			log.Errorf("get table %s.%s failed", rule.Schema, rule.Table)
+		ok, err := r.prepareTableRule(rule)
+		if err != nil {
 			return errors.Trace(err)
+		} else if !ok {
+			continue
 		}
 
-		if len(rule.TableInfo.PKColumns) == 0 {
-			if !r.c.SkipNoPkTable {
-				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
+		overlaps := rule.overlaps[:0]
+		for _, overlap := range rule.overlaps {
+			if ok, err = r.prepareTableRule(overlap); err != nil {
+				return errors.Trace(err)
+			} else if ok {
+				overlaps = append(overlaps, overlap)
 			}
-
-			log.Errorf("ignored table without a primary key: %s\n", rule.TableInfo.Name)
-		} else {
-			rules[key] = rule
 		}
+		rule.overlaps = overlaps
+
+		rules[key] = rule
 	}
 	r.rules = rules
 
 	return nil
 }
 
+// sortRules sorts the rules of one table by precedence: the higher
+// priority first, then the exact table rule before the wildcard ones,
+// then the config order.
+func sortRules(rules []*Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return len(rules[i].wildcard) == 0 && len(rules[j].wildcard) > 0
+	})
+}
+
+// prepareTableRule prepares the rule for its table, it returns false
+// for a table to be ignored.
+func (r *River) prepareTableRule(rule *Rule) (bool, error) {
+	var err error
+	if err = rule.prepare(r.c); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+		log.Errorf("get table %s.%s failed", rule.Schema, rule.Table)
+		return false, errors.Trace(err)
+	}
+
+	if err = r.loadSkipColumns(rule); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	for _, warning := range checkCharset(rule, r.c.myCharset()) {
+		log.Warn(warning)
+	}
+
+	for _, name := range rule.KeyColumns {
+		if rule.TableInfo.FindColumn(name) == -1 {
+			return false, errors.Errorf("%s.%s key column %s not found", rule.Schema, rule.Table, name)
+		}
+	}
+
+	for _, ro := range rule.Rollups {
+		columns := []string{ro.Column}
+		for _, column := range ro.Sum {
+			columns = append(columns, column)
+		}
+		for _, name := range columns {
+			if rule.TableInfo.FindColumn(name) == -1 {
+				return false, errors.Errorf("%s.%s rollup column %s not found", rule.Schema, rule.Table, name)
+			}
+		}
+	}
+
+	for _, columns := range [][]string{rule.IndexColumns, rule.RangeIndexColumns, rule.UniqueColumns} {
+		for _, name := range columns {
+			if rule.TableInfo.FindColumn(name) == -1 {
+				return false, errors.Errorf("%s.%s index column %s not found", rule.Schema, rule.Table, name)
+			}
+		}
+	}
+
+	if err = rule.checkEpochColumns(); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if err = rule.checkListColumns(); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if len(rule.SoftDeleteColumn) > 0 && rule.TableInfo.FindColumn(rule.SoftDeleteColumn) == -1 {
+		return false, errors.Errorf("%s.%s soft delete column %s not found", rule.Schema, rule.Table, rule.SoftDeleteColumn)
+	}
+
+	if len(rule.KeyColumns) == 0 && len(rule.TableInfo.PKColumns) == 0 {
+		switch rule.NoPKStrategy {
+		case NoPKStrategySkip:
+			log.Warnf("ignored table without a primary key: %s", rule.TableInfo.Name)
+			return false, nil
+		case NoPKStrategyHash:
+			log.Warnf("table without a primary key %s is keyed by the hash of all columns", rule.TableInfo.Name)
+		default:
+			return false, errors.Errorf("%s.%s must have a PK for a column, or set key_columns or no_pk_strategy", rule.Schema, rule.Table)
+		}
+	}
+
+	return true, nil
+}
+
 func ruleKey(schema string, table string) string {
 	return strings.ToLower(fmt.Sprintf("%s:%s", schema, table))
 }
 
-// Run syncs the data from MySQL and inserts to Redis.
-func (r *River) Run() error {
+// Run syncs the data from MySQL and inserts to Redis until the River is
+// closed, ctx being done closes the River.
+func (r *River) Run(ctx context.Context) error {
 	log.Infof("starting to sync data from MySQL and insert to Redis")
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-r.ctx.Done():
+		}
+	}()
+
 	r.wg.Add(1)
 	go r.syncLoop()
 
+	r.wg.Add(1)
+	go r.redisInfoLoop()
+
+	r.wg.Add(1)
+	go r.lagLoop()
+
+	if r.c.KeyspaceInterval.Duration > 0 {
+		r.wg.Add(1)
+		go r.keyspaceLoop()
+	}
+
+	if r.verifyKeys != nil {
+		r.wg.Add(1)
+		go r.verifyLoop()
+	}
+
+	if r.c.ReapInterval.Duration > 0 {
+		r.wg.Add(1)
+		go r.reapLoop()
+	}
+
+	if r.probeRule != nil {
+		r.wg.Add(1)
+		go r.probeLoop()
+	}
+
 	pos := r.master.Position()
-	if err := r.canal.RunFrom(pos); err != nil {
-		log.Errorf("start canal err %v", err)
-		return errors.Trace(err)
+	if len(pos.Name) == 0 && len(r.c.DumpExec) > 0 {
+		r.wg.Add(1)
+		go r.waitDumpDone()
 	}
 
-	return nil
+	// the canal stopped on an error is restarted from the saved position
+	for restarts, selects, redumps := 0, 0, 0; ; restarts++ {
+		err := r.canal.RunFrom(pos)
+		if err == nil {
+			return nil
+		}
+
+		purged := isBinlogPurged(err)
+		if purged {
+			err = wrapError(err, ErrBinlogPurged)
+		}
+
+		if isDuplicateServerID(err) && r.handleDuplicateServerID(err, selects) {
+			// the restart with another server_id does not count
+			selects++
+			restarts--
+		} else if purged && redumps == 0 && r.handleBinlogPurged(err) {
+			// the restart with a dump does not count, but it is done once
+			redumps++
+			restarts--
+		} else if purged || !r.restart("canal", restarts, err) {
+			log.Errorf("start canal err %v", err)
+			r.alert.Alertf("sync stopped, start canal err %v", err)
+			r.cancel()
+			return errors.Trace(err)
+		}
+
+		r.mysqlState.down(err)
+		if err = r.restartCanal(); err != nil {
+			log.Errorf("restart canal err %v", err)
+			r.alert.Alertf("sync stopped, restart canal err %v", err)
+			r.cancel()
+			return errors.Trace(err)
+		}
+		r.reconnected(&r.mysqlState)
+		pos = r.master.Position()
+		if len(pos.Name) == 0 && len(r.c.DumpExec) > 0 {
+			r.wg.Add(1)
+			go r.waitDumpDone()
+		}
+	}
+}
+
+func (r *River) waitDumpDone() {
+	defer r.wg.Done()
+
+	select {
+	case <-r.canal.WaitDumpDone():
+		r.alert.Alertf("initial dump is done, syncing binlog from %s", r.syncedPosition())
+	case <-r.ctx.Done():
+	}
+}
+
+// syncedPosition returns the binlog position read up to, zero without the
+// canal. It is safe to call from any goroutine.
+func (r *River) syncedPosition() mysql.Position {
+	r.canalLock.RLock()
+	defer r.canalLock.RUnlock()
+
+	if r.canal == nil {
+		return mysql.Position{}
+	}
+	return r.canal.SyncedPosition()
+}
+
+// executeCanal runs the query on the canal connection, it is safe to call
+// from any goroutine.
+func (r *River) executeCanal(query string, args ...interface{}) (*mysql.Result, error) {
+	r.canalLock.RLock()
+	defer r.canalLock.RUnlock()
+
+	if r.canal == nil {
+		return nil, errors.New("no canal")
+	}
+	return r.canal.Execute(query, args...)
 }
 
 // Ctx returns the internal context for outside use.
@@ -292,19 +684,41 @@ func (r *River) Ctx() context.Context {
 	return r.ctx
 }
 
-// Close closes the River
+// Close closes the River, only the first call has effect.
 func (r *River) Close() {
+	r.closeOnce.Do(r.close)
+}
+
+func (r *River) close() {
 	log.Infof("closing river")
 
 	r.cancel()
 
 	r.canal.Close()
 
+	r.dumpTunnel.Close()
+
 	r.master.Close()
 
 	r.redisConn.Close()
 
+	r.st.Close()
+
+	r.deadLetters.Close()
+
 	r.wg.Wait()
+
+	for _, rule := range r.rules {
+		for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+			if rule.script != nil {
+				rule.script.Close()
+			}
+		}
+	}
+
+	r.alert.Close()
+
+	r.audit.Close()
 }
 
 func isValidTables(tables []string) bool {
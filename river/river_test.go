@@ -1,15 +1,40 @@
 package river
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/client"
 	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/siddontang/go/sync2"
+	log "github.com/sirupsen/logrus"
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -103,7 +128,7 @@ func (s *riverTestSuite) SetUpSuite(c *C) {
 
 	s.testRedisClear(c)
 	s.testPrepareData(c)
-	go func() { s.r.Run() }()
+	go func() { s.r.Run(context.Background()) }()
 
 	testWaitSyncDone(c, s.r)
 	fmt.Printf("init env succ\n")
@@ -395,3 +420,3948 @@ func TestBuildTable(t *testing.T) {
 		}
 	}
 }
+
+func TestRuleStat(t *testing.T) {
+	st := &stat{}
+
+	rule := newDefaultRule("test", "test_river")
+	st.Rule(rule).InsertNum.Add(1)
+	st.Rule(newDefaultRule("test", "test_river")).InsertNum.Add(1)
+	st.Rule(newDefaultRule("test", "test_river_filter")).DeleteNum.Add(1)
+
+	if n := st.Rule(rule).InsertNum.Get(); n != 2 {
+		t.Errorf("Rule: test.test_river, Expected: insert_num is 2, but: was %d", n)
+	}
+
+	if len(st.rules) != 2 {
+		t.Errorf("Expected: 2 rule stats, but: was %d", len(st.rules))
+	}
+}
+
+func TestSampleRing(t *testing.T) {
+	r := newSampleRing(3)
+
+	for i := 0; i < 5; i++ {
+		r.Add(sample{Key: fmt.Sprintf("%d", i)})
+	}
+
+	samples := r.Samples()
+	if len(samples) != 3 {
+		t.Fatalf("Expected: 3 samples, but: was %d", len(samples))
+	}
+
+	for i, s := range samples {
+		if s.Key != fmt.Sprintf("%d", i+2) {
+			t.Errorf("Sample: %d, Expected: key is \"%d\", but: was \"%s\"", i, i+2, s.Key)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+
+	for _, v := range []float64{0.5, 1, 5, 20} {
+		h.Observe(v)
+	}
+
+	expects := []int64{2, 1, 1}
+	for i, n := range expects {
+		if h.counts[i] != n {
+			t.Errorf("Bucket: %d, Expected: count is %d, but: was %d", i, n, h.counts[i])
+		}
+	}
+
+	if h.count != 4 || h.sum != 26.5 {
+		t.Errorf("Expected: count 4 sum 26.5, but: was count %d sum %g", h.count, h.sum)
+	}
+}
+
+func TestMakeRowValuesNullPolicy(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{
+		Schema: "test",
+		Name:   "test_river",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "title", Type: schema.TYPE_STRING},
+		},
+		PKColumns: []int{0},
+	}
+
+	tests := []struct {
+		Policy string
+		Values map[string]interface{}
+		Nulls  []string
+	}{
+		{NullPolicyDelete, map[string]interface{}{"id": 1}, []string{"title"}},
+		{NullPolicyEmpty, map[string]interface{}{"id": 1, "title": ""}, nil},
+		{NullPolicySentinel, map[string]interface{}{"id": 1, "title": "NULL"}, nil},
+	}
+
+	for _, test := range tests {
+		rule.NullPolicy = test.Policy
+		rule.NullSentinel = "NULL"
+
+		values, nulls, _ := r.makeRowValues(rule, nil, []interface{}{1, nil})
+		if !reflect.DeepEqual(values, test.Values) || !reflect.DeepEqual(nulls, test.Nulls) {
+			t.Errorf("Policy: %s, Expected: %v %v, but: was %v %v", test.Policy, test.Values, test.Nulls, values, nulls)
+		}
+	}
+
+	// unchanged NULL columns are skipped for update
+	rule.NullPolicy = NullPolicyDelete
+	values, nulls, _ := r.makeRowValues(rule, []interface{}{1, nil}, []interface{}{1, nil})
+	if len(values) != 0 || len(nulls) != 0 {
+		t.Errorf("Expected: nothing changed, but: was %v %v", values, nulls)
+	}
+}
+
+func TestMoveRowCmds(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "title"}},
+	}
+
+	cmds := deleteRowCmds(rule, "test:test_river:1")
+	cmds = append(cmds, writeRowCmds("test:test_river:2", map[string]interface{}{"id": 2}, []string{"title"})...)
+
+	expects := []redisCmd{
+		newRedisCmd("HDEL", "test:test_river:1", "id", "title"),
+		newRedisCmd("HMSET", "test:test_river:2", "id", 2),
+		newRedisCmd("HDEL", "test:test_river:2", "title"),
+	}
+
+	if !reflect.DeepEqual(cmds, expects) {
+		t.Errorf("Expected: %v, but: was %v", expects, cmds)
+	}
+}
+
+func TestUpsertRowCmdsOverwrite(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.WritePolicy = WritePolicyOverwrite
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "title"}},
+	}
+
+	cmds, _ := r.upsertRowCmds(rule, "test:test_river:1", []interface{}{1, "a"}, []interface{}{1, nil})
+	expects := []redisCmd{
+		newRedisCmd("DEL", "test:test_river:1"),
+		newRedisCmd("HMSET", "test:test_river:1", "id", 1),
+	}
+
+	if !reflect.DeepEqual(cmds, expects) {
+		t.Errorf("Expected: %v, but: was %v", expects, cmds)
+	}
+}
+
+func TestUpsertRowCmdsPurgeStaleFields(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.PurgeStaleFields = true
+	rule.Filter = []string{"id"}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "title"}},
+	}
+
+	// insert purges
+	cmds, _ := r.upsertRowCmds(rule, "test:test_river:1", nil, []interface{}{1, "a"})
+	expects := []redisCmd{
+		newRedisCmd("DEL", "test:test_river:1"),
+		newRedisCmd("HMSET", "test:test_river:1", "id", 1),
+	}
+	if !reflect.DeepEqual(cmds, expects) {
+		t.Errorf("Expected: %v, but: was %v", expects, cmds)
+	}
+
+	// update merges
+	cmds, _ = r.upsertRowCmds(rule, "test:test_river:1", []interface{}{2, "a"}, []interface{}{1, "b"})
+	expects = []redisCmd{
+		newRedisCmd("HMSET", "test:test_river:1", "id", 1),
+	}
+	if !reflect.DeepEqual(cmds, expects) {
+		t.Errorf("Expected: %v, but: was %v", expects, cmds)
+	}
+}
+
+func TestStrictValue(t *testing.T) {
+	tests := []struct {
+		Value  interface{}
+		Expect interface{}
+	}{
+		{float64(1e21), "1000000000000000000000"},
+		{float64(0.1), "0.1"},
+		{float32(1.5), "1.5"},
+		{int64(-1), int64(-1)},
+		{map[string]interface{}{"a": float64(1)}, `{"a":1}`},
+		{"abc", "abc"},
+	}
+
+	for _, test := range tests {
+		if v := strictValue(test.Value); !reflect.DeepEqual(v, test.Expect) {
+			t.Errorf("Value: %v, Expected: is %#v, but: was %#v", test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		Format string
+		Expect interface{}
+	}{
+		{TimeFormatRFC3339, "2016-03-16T12:24:54Z"},
+		{TimeFormatUnix, int64(1458131094)},
+		{TimeFormatUnixMilli, int64(1458131094000)},
+		{TimeFormatRaw, "2016-03-16 12:24:54"},
+	}
+
+	for _, test := range tests {
+		rule := newDefaultRule("test", "test_river")
+		rule.TimeZone = "UTC"
+		rule.TimeFormat = test.Format
+		if err := rule.prepare(new(Config)); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := formatTime(rule, "t", "2016-03-16 12:24:54", 0); v != test.Expect {
+			t.Errorf("Format: %s, Expected: is %v, but: was %v", test.Format, test.Expect, v)
+		}
+	}
+}
+
+func TestUnsignedValue(t *testing.T) {
+	tests := []struct {
+		RawType string
+		Value   interface{}
+		Expect  interface{}
+	}{
+		{"tinyint(3) unsigned", int8(-1), uint8(255)},
+		{"smallint(5) unsigned", int16(-1), uint16(65535)},
+		{"mediumint(8) unsigned", int32(-1), uint32(16777215)},
+		{"int(10) unsigned", int32(-1), uint32(4294967295)},
+		{"bigint(20) unsigned", int64(-1), uint64(18446744073709551615)},
+		{"int(10) unsigned", int32(1), uint32(1)},
+	}
+
+	for _, test := range tests {
+		col := &schema.TableColumn{Type: schema.TYPE_NUMBER, RawType: test.RawType, IsUnsigned: true}
+		if v := unsignedValue(col, test.Value); v != test.Expect {
+			t.Errorf("Type: %s, Expected: is %v, but: was %v", test.RawType, test.Expect, v)
+		}
+	}
+}
+
+type testDecimal string
+
+func (d testDecimal) String() string {
+	return string(d)
+}
+
+func TestDecimalValue(t *testing.T) {
+	tests := []struct {
+		Value  interface{}
+		Expect interface{}
+	}{
+		{testDecimal("12345678901234567890.12"), "12345678901234567890.12"},
+		{[]byte("0.10"), "0.10"},
+		{"0.10", "0.10"},
+		{float64(1e21), "1000000000000000000000"},
+	}
+
+	for _, test := range tests {
+		if v := decimalValue(test.Value); v != test.Expect {
+			t.Errorf("Value: %v, Expected: is %v, but: was %v", test.Value, test.Expect, v)
+		}
+	}
+
+	var f interface{}
+	if err := unmarshalJSON([]byte(`{"price":12345678901234567890.12}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	if v := strictValue(f); v != `{"price":12345678901234567890.12}` {
+		t.Errorf("Expected: JSON number kept, but: was %v", v)
+	}
+}
+
+func TestTextRowDecimal(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "price", Type: schema.TYPE_DECIMAL}},
+	}
+
+	tests := []struct {
+		Value  string
+		Expect string
+	}{
+		{"12345678901234567890.12", "12345678901234567890.12"},
+		{"1.500", "1.5"},
+		{"10.000", "10"},
+		{"100", "100"},
+		{"-0.00", "0"},
+		{"-0.010", "-0.01"},
+	}
+
+	for _, test := range tests {
+		row := []interface{}{[]byte("1"), []byte(test.Value)}
+		textRowValues(rule, row)
+		if v := decimalValue(row[1]); v != test.Expect {
+			t.Errorf("Value: %s, Expected: is %s, but: was %v", test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestGetPKValueWithoutPK(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.NoPKStrategy = NoPKStrategyHash
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "title"}},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	k1, err := r.getPKValue(rule, []interface{}{1, "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := r.getPKValue(rule, []interface{}{1, "a"})
+	k3, _ := r.getPKValue(rule, []interface{}{1, "b"})
+
+	if k1 != k2 || k1 == k3 {
+		t.Errorf("Expected: equal rows share one key, but: was %s %s %s", k1, k2, k3)
+	}
+	if k1 != "test:test_river:"+hashRow([]interface{}{1, "a"}) {
+		t.Errorf("Expected: key with row hash, but: was %s", k1)
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+
+	tests := []struct {
+		Collation string
+		Value     []byte
+		Expect    string
+	}{
+		{"latin1_swedish_ci", []byte{'c', 'a', 'f', 0xe9}, "café"},
+		{"gbk_chinese_ci", []byte{0xc4, 0xe3, 0xba, 0xc3}, "你好"},
+		{"utf8mb4_general_ci", []byte("你好"), "你好"},
+	}
+
+	for _, test := range tests {
+		col := &schema.TableColumn{Name: "title", Type: schema.TYPE_STRING, Collation: test.Collation}
+		if v := decodeString(rule, col, test.Value); v != test.Expect {
+			t.Errorf("Collation: %s, Expected: is %s, but: was %s", test.Collation, test.Expect, v)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		Key    string
+		Expect uint16
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"{user1000}.following", keySlot("user1000")},
+		{"foo{}{bar}", keySlot("foo{}{bar}")},
+	}
+
+	for _, test := range tests {
+		if v := keySlot(test.Key); v != test.Expect {
+			t.Errorf("Key: %s, Expected: is %d, but: was %d", test.Key, test.Expect, v)
+		}
+	}
+}
+
+func TestMoveRowOrderedClosed(t *testing.T) {
+	// a Redis failing any command
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte("-ERR failed\r\n"))
+		}
+	}()
+
+	r := new(River)
+	r.c = &Config{RedisMaxRetries: -1}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+	if r.redisConn, err = redis.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.redisConn.Close()
+
+	r.cancel()
+	start := time.Now()
+	rule := newDefaultRule("test", "t1")
+	err = r.moveRowOrdered(rule, "test:t1:1", "test:t1:2", []redisCmd{newRedisCmd("DEL", "test:t1:1")}, nil)
+	if err == nil || r.st.OrphanNum.Get() != 1 {
+		t.Errorf("Expected: the old key orphaned, but: was %d %v", r.st.OrphanNum.Get(), err)
+	}
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Errorf("Expected: no retry wait once closed, but: was %s", d)
+	}
+}
+
+func TestIsInvalidEnumSet(t *testing.T) {
+	enum := &schema.TableColumn{Type: schema.TYPE_ENUM, EnumValues: []string{"e1", "e2", "e3"}}
+	set := &schema.TableColumn{Type: schema.TYPE_SET, SetValues: []string{"a", "b", "c"}}
+
+	tests := []struct {
+		Col    *schema.TableColumn
+		Value  interface{}
+		Expect bool
+	}{
+		{enum, int64(1), false},
+		{enum, int64(3), false},
+		{enum, int64(0), true},
+		{enum, int64(5), true},
+		{enum, "e5", false},
+		{set, int64(7), false},
+		{set, int64(8), true},
+	}
+
+	for _, test := range tests {
+		if v := isInvalidEnumSet(test.Col, test.Value); v != test.Expect {
+			t.Errorf("Value: %v, Expected: is %t, but: was %t", test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestRowFilter(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.RowFilter = `status == "active" && (deleted_at == nil || id > 10) && !(title == 'x')`
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "status"}, {Name: "deleted_at"}, {Name: "title"}},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Row    []interface{}
+		Expect bool
+	}{
+		{[]interface{}{int32(1), "active", nil, "a"}, true},
+		{[]interface{}{int32(1), []byte("active"), nil, "a"}, true},
+		{[]interface{}{int32(1), "inactive", nil, "a"}, false},
+		{[]interface{}{int32(1), "active", "2018-01-01", "a"}, false},
+		{[]interface{}{int64(11), "active", "2018-01-01", "a"}, true},
+		{[]interface{}{int32(1), "active", nil, "x"}, false},
+	}
+
+	for _, test := range tests {
+		if v := rule.MatchRow(test.Row); v != test.Expect {
+			t.Errorf("Row: %v, Expected: is %t, but: was %t", test.Row, test.Expect, v)
+		}
+	}
+
+	// a TINYINT(1) column is a boolean
+	rule.RowFilter = `active && !deleted`
+	rule.TableInfo.Columns = []schema.TableColumn{{Name: "id"}, {Name: "active"}, {Name: "deleted"}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Row    []interface{}
+		Expect bool
+	}{
+		{[]interface{}{int32(1), int8(1), int8(0)}, true},
+		{[]interface{}{int32(1), int8(2), nil}, true},
+		{[]interface{}{int32(1), int8(0), int8(0)}, false},
+		{[]interface{}{int32(1), int8(1), int8(1)}, false},
+	} {
+		if v := rule.MatchRow(test.Row); v != test.Expect {
+			t.Errorf("Row: %v, Expected: is %t, but: was %t", test.Row, test.Expect, v)
+		}
+	}
+
+	for _, s := range []string{`id ==`, `(id == 1`, `id # 1`, `"abc`} {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("Expression: %s, Expected: error, but: was nil", s)
+		}
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.FieldMapping = map[string]string{"title": "redis_title"}
+	rule.TableInfo = &schema.Table{
+		Schema: "test",
+		Name:   "test_river",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "title", Type: schema.TYPE_STRING},
+		},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	values, nulls, _ := r.makeRowValues(rule, nil, []interface{}{1, nil})
+	if !reflect.DeepEqual(values, map[string]interface{}{"id": 1}) || !reflect.DeepEqual(nulls, []string{"redis_title"}) {
+		t.Errorf("Expected: map[id:1] [redis_title], but: was %v %v", values, nulls)
+	}
+
+	cmds := deleteRowCmds(rule, "test_river:1")
+	if args := fmt.Sprint(cmds[0].Args); args != "[test_river:1 id redis_title]" {
+		t.Errorf("Expected: [test_river:1 id redis_title], but: was %s", args)
+	}
+
+	rule.FieldMapping = map[string]string{"id": "title", "title": "title"}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: duplicated field error, but: was nil")
+	}
+}
+
+func TestCheckFilterExclude(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.Exclude = []string{"password_hash"}
+
+	tests := []struct {
+		Filter []string
+		Field  string
+		Expect bool
+	}{
+		{nil, "id", true},
+		{nil, "password_hash", false},
+		{[]string{"id", "password_hash"}, "id", true},
+		{[]string{"id", "password_hash"}, "password_hash", false},
+		{[]string{"id"}, "name", false},
+	}
+
+	for _, test := range tests {
+		rule.Filter = test.Filter
+		if v := rule.CheckFilter(test.Field); v != test.Expect {
+			t.Errorf("Filter: %v, Field: %s, Expected: is %t, but: was %t", test.Filter, test.Field, test.Expect, v)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.TimeZone = "UTC"
+	rule.Transforms = map[string]string{
+		"name":    " trim | upper ",
+		"tags":    "split",
+		"created": "rfc3339",
+		"title":   "template:{{ .id }} - {{ .name }}",
+	}
+	rule.TableInfo = &schema.Table{
+		Schema: "test",
+		Name:   "test_river",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "name", Type: schema.TYPE_STRING},
+			{Name: "tags", Type: schema.TYPE_STRING},
+			{Name: "created", Type: schema.TYPE_NUMBER},
+			{Name: "title", Type: schema.TYPE_STRING},
+		},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	values, _, err := r.makeRowValues(rule, nil, []interface{}{int64(1), " a ", "x,y", int64(0), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"id":      int64(1),
+		"name":    "A",
+		"tags":    `["x","y"]`,
+		"created": "1970-01-01T00:00:00Z",
+		"title":   "1 -  a ",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, values)
+	}
+
+	// the template is rendered again when only other columns change
+	values, _, _ = r.makeRowValues(rule, []interface{}{int64(1), "a", "", int64(0), nil}, []interface{}{int64(1), "b", "", int64(0), nil})
+	if values["title"] != "1 - b" {
+		t.Errorf("Expected: 1 - b, but: was %v", values["title"])
+	}
+
+	rule.Transforms = map[string]string{"name": "reverse"}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: unknown transform error, but: was nil")
+	}
+}
+
+func TestScript(t *testing.T) {
+	f, err := ioutil.TempFile("", "transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`
+function transform(action, schema, table, before, after, key)
+	if after == nil then
+		return {{"DEL", "user:" .. before.id}}
+	end
+	return {{"SET", "user:" .. after.id, string.upper(after.name)}, {"SADD", table, after.id}}
+end
+`)
+	f.Close()
+
+	s, err := newScript(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cmds, err := s.call("insert", "test", "test_river", nil, map[string]interface{}{"id": int64(9007199254740993), "name": "a"}, "9007199254740993")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fmt.Sprint(cmds); v != "[{SET [user:9007199254740993 A]} {SADD [test_river 9007199254740993]}]" {
+		t.Errorf("Expected: insert commands, but: was %s", v)
+	}
+
+	cmds, err = s.call("delete", "test", "test_river", map[string]interface{}{"id": int64(1), "name": nil}, nil, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fmt.Sprint(cmds); v != "[{DEL [user:1]}]" {
+		t.Errorf("Expected: [{DEL [user:1]}], but: was %s", v)
+	}
+}
+
+func TestSetupLog(t *testing.T) {
+	level, formatter := log.GetLevel(), log.StandardLogger().Formatter
+	defer func() {
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+		log.SetOutput(os.Stderr)
+	}()
+
+	if err := SetupLog(&Config{LogLevel: "verbose"}); err == nil {
+		t.Errorf("Expected: an error for an unknown level, but: was nil")
+	}
+	if err := SetupLog(&Config{LogFormat: "xml"}); err == nil {
+		t.Errorf("Expected: an error for an unknown format, but: was nil")
+	}
+
+	if err := SetupLog(new(Config)); err != nil || log.GetLevel() != log.InfoLevel {
+		t.Errorf("Expected: info level by default, but: was %v %v", log.GetLevel(), err)
+	}
+
+	dir, err := ioutil.TempDir("", "river_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/river.log"
+	if err = SetupLog(&Config{LogLevel: "warn", LogFormat: "json", LogFile: file}); err != nil {
+		t.Fatal(err)
+	}
+	log.Infof("insert row 1 to redis")
+	log.Warnf("sync err")
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err = json.Unmarshal(bytes.TrimSpace(data), &entry); err != nil || entry["msg"] != "sync err" || entry["level"] != "warning" {
+		t.Errorf("Expected: only the warning in JSON, but: was %s %v", data, err)
+	}
+}
+
+func TestStatWithoutCanal(t *testing.T) {
+	r := new(River)
+	r.c = new(Config)
+	r.st = newStat(r)
+
+	// the canal is read under canalLock, nil while restarted
+	var buf bytes.Buffer
+	if err := r.st.WriteTo(&buf); err == nil {
+		t.Errorf("Expected: an error without the canal, but: was nil")
+	}
+}
+
+func TestStatsdClient(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	read := func() string {
+		buf := make([]byte, 1024)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	rule := newDefaultRule("test", "t1")
+	c, err := newStatsdClient(pc.LocalAddr().String(), "river", []string{"env:test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Count("rows", 1, ruleTags(rule, "insert")...)
+	if v := read(); v != "river.rows:1|c|#env:test,schema:test,table:t1,action:insert" {
+		t.Errorf("Expected: the DogStatsD counter, but: was %s", v)
+	}
+
+	plain, err := newStatsdClient(pc.LocalAddr().String(), "river.", []string{"env:test"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Timing("latency", 1500*time.Microsecond, ruleTags(rule, "insert")...)
+	if v := read(); v != "river.latency:1.5|ms" {
+		t.Errorf("Expected: the StatsD timer without tags, but: was %s", v)
+	}
+
+	// a nil client sends nothing
+	var none *statsdClient
+	none.Gauge("lag", 1)
+	none.Close()
+}
+
+type testRowMapper struct{}
+
+func (m testRowMapper) Map(action string, rule *Rule, before, after []interface{}) ([]RedisOp, error) {
+	if action == "delete" {
+		return nil, ErrDefaultMapping
+	}
+	return []RedisOp{{Name: "SET", Args: []interface{}{fmt.Sprintf("%s:%v", rule.Table, after[0]), after[1]}}}, nil
+}
+
+func TestRowMapper(t *testing.T) {
+	r := new(River)
+	r.SetRowMapper(testRowMapper{})
+
+	rule := newDefaultRule("test", "test_river")
+
+	cmds, err := r.mapRow(rule, "insert", nil, []interface{}{1, "a"}, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fmt.Sprint(cmds); v != "[{SET [test_river:1 a]}]" {
+		t.Errorf("Expected: [{SET [test_river:1 a]}], but: was %s", v)
+	}
+
+	if _, err = r.mapRow(rule, "delete", []interface{}{1, "a"}, nil, "1"); err != ErrDefaultMapping {
+		t.Errorf("Expected: %v, but: was %v", ErrDefaultMapping, err)
+	}
+}
+
+type testRowVerifier struct{}
+
+func (v testRowVerifier) Verify(rule *Rule, key string, row []interface{}, redis RedisReader) ([]string, error) {
+	return nil, errors.Trace(ErrDefaultMapping)
+}
+
+func TestVerifyTracedDefaultMapping(t *testing.T) {
+	r := new(River)
+	r.SetRowMapper(testRowMapper{})
+	r.SetRowVerifier(testRowVerifier{})
+
+	rule := newDefaultRule("test", "test_river")
+	if _, err := r.verifyCustom(nil, rule, "test_river:1", nil); err != ErrDefaultMapping {
+		t.Errorf("Expected: %v, but: was %v", ErrDefaultMapping, err)
+	}
+}
+
+func TestSkipColumns(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "name_upper"}},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to load without the options
+	r := new(River)
+	r.st = &stat{}
+	if err := r.loadSkipColumns(rule); err != nil || rule.skipColumns != nil {
+		t.Errorf("Expected: no columns skipped, but: was %v %v", rule.skipColumns, err)
+	}
+
+	// the generated column is skipped, the values still line up
+	rule.skipColumns = map[string]bool{"name_upper": true}
+	if rule.CheckFilter("name_upper") || !rule.CheckFilter("name") {
+		t.Errorf("Expected: only name_upper filtered, but: was not")
+	}
+	values, _, err := r.makeRowValues(rule, nil, []interface{}{1, "a", "A"})
+	if err != nil || fmt.Sprint(values) != "map[id:1 name:a]" {
+		t.Errorf("Expected: map[id:1 name:a], but: was %v %v", values, err)
+	}
+
+	if err = checkRowColumns(rule, [][]interface{}{{1, "a", "A"}, {2, "b"}}); err == nil {
+		t.Errorf("Expected: an error for a row without the generated column, but: was nil")
+	}
+}
+
+func TestCheckAction(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	if !rule.CheckAction("delete") {
+		t.Error("Expected: all actions synced by default")
+	}
+
+	rule.Actions = []string{"insert", "update"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.CheckAction("update") || rule.CheckAction("delete") {
+		t.Errorf("Actions: %v, Expected: update synced and delete not", rule.Actions)
+	}
+
+	rule.Actions = []string{"upsert"}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: invalid action error, but: was nil")
+	}
+}
+
+func TestSoftDeleteColumn(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.SoftDeleteColumn = "deleted_at"
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "deleted_at"}},
+	}
+
+	tests := []struct {
+		Value  interface{}
+		Expect bool
+	}{
+		{nil, true},
+		{int8(0), true},
+		{int8(1), false},
+		{"", true},
+		{"0000-00-00 00:00:00", true},
+		{"2018-01-01 00:00:00", false},
+	}
+
+	for _, test := range tests {
+		if v := rule.MatchRow([]interface{}{1, test.Value}); v != test.Expect {
+			t.Errorf("Value: %v, Expected: is %t, but: was %t", test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestRuleDefaults(t *testing.T) {
+	c, err := NewConfig(`
+[rule_defaults]
+null_policy = "empty"
+purge_stale_fields = true
+exclude = ["password_hash"]
+
+[rule_defaults.field]
+name = "title"
+
+[[rule]]
+schema = "test"
+table = "t1"
+
+[[rule]]
+schema = "test"
+table = "t2"
+null_policy = "delete"
+purge_stale_fields = false
+exclude = ["ssn"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r1, r2 := c.Rules[0], c.Rules[1]
+	if r1.Table != "t1" || r1.NullPolicy != "empty" || !r1.PurgeStaleFields || !reflect.DeepEqual(r1.Exclude, []string{"password_hash"}) || r1.FieldName("name") != "title" {
+		t.Errorf("Expected: t1 inherits the defaults, but: was %+v", r1)
+	}
+	if r2.Table != "t2" || r2.NullPolicy != "delete" || r2.PurgeStaleFields || !reflect.DeepEqual(r2.Exclude, []string{"ssn"}) {
+		t.Errorf("Expected: t2 overrides the defaults, but: was %+v", r2)
+	}
+	if !reflect.DeepEqual(c.RuleDefaults.Exclude, []string{"password_hash"}) {
+		t.Errorf("Expected: defaults unchanged, but: was %v", c.RuleDefaults.Exclude)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "user_0012_03")
+	rule.KeyPrefix = "{schema}:shard_{1}:{2}"
+	rule.tableGroups = []string{"0012", "03"}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := r.getPKValue(rule, []interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "test:shard_0012:03:1" {
+		t.Errorf("Expected: test:shard_0012:03:1, but: was %s", key)
+	}
+}
+
+func TestOutputCmds(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.Outputs = []Output{
+		{Type: "set", Key: "{schema}:{table}:keys"},
+		{Type: "stream", Key: "changes", MaxLen: 100},
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	if rule.hasHashOutput() {
+		t.Error("Expected: no hash output")
+	}
+
+	cmds, err := r.outputCmds(rule, "insert", "test:test_river:1", []interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "[{SADD [test:test_river:keys test:test_river:1]} {XADD [changes MAXLEN ~ 100 * _action insert _key test:test_river:1 id 1]}]"
+	if v := fmt.Sprint(cmds); v != expect {
+		t.Errorf("Expected: %s, but: was %s", expect, v)
+	}
+
+	cmds, _ = r.outputCmds(rule, "delete", "test:test_river:1", nil)
+	expect = "[{SREM [test:test_river:keys test:test_river:1]} {XADD [changes MAXLEN ~ 100 * _action delete _key test:test_river:1]}]"
+	if v := fmt.Sprint(cmds); v != expect {
+		t.Errorf("Expected: %s, but: was %s", expect, v)
+	}
+
+	rule.Outputs = []Output{{Type: "set"}}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: set output without key error, but: was nil")
+	}
+}
+
+func TestComputedFields(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.Computed = map[string]string{
+		"display": "{{ .id }} - {{ .name }}",
+		"month":   "{{ yyyymm .created_at }}",
+		"total":   "{{ mul .price .qty }}",
+	}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "name", Type: schema.TYPE_STRING},
+			{Name: "created_at", Type: schema.TYPE_STRING},
+			{Name: "price", Type: schema.TYPE_STRING},
+			{Name: "qty", Type: schema.TYPE_NUMBER},
+		},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	row := []interface{}{int64(1), "a", "2018-03-04 05:06:07", "1.5", int64(3)}
+	values, _, err := r.makeRowValues(rule, nil, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["display"] != "1 - a" || values["month"] != "201803" || values["total"] != "4.5" {
+		t.Errorf("Expected: computed fields, but: was %v", values)
+	}
+
+	// nothing changed, nothing computed
+	values, _, _ = r.makeRowValues(rule, row, row)
+	if len(values) != 0 {
+		t.Errorf("Expected: no values, but: was %v", values)
+	}
+
+	if v := fmt.Sprint(deleteRowCmds(rule, "k")[0].Args); !strings.Contains(v, "month") {
+		t.Errorf("Expected: computed fields deleted, but: was %s", v)
+	}
+}
+
+func TestRuleConditions(t *testing.T) {
+	r := new(River)
+
+	c, err := NewConfig(`
+[[rule]]
+schema = "test"
+table = "test_river"
+ttl = "24h"
+
+[[rule.when]]
+condition = 'priority == "hot"'
+ttl = "1h"
+
+[[rule.when]]
+condition = 'priority == "archived"'
+key_prefix = "archive:{table}"
+ttl = "0s"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := c.Rules[0]
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "priority", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0},
+	}
+	if err = rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Priority string
+		Key      string
+		Expire   string
+	}{
+		{"hot", "test:test_river:1", "{EXPIRE [test:test_river:1 3600]}"},
+		{"normal", "test:test_river:1", "{EXPIRE [test:test_river:1 86400]}"},
+		{"archived", "archive:test_river:1", "{PERSIST [archive:test_river:1]}"},
+	}
+
+	for _, test := range tests {
+		row := []interface{}{int64(1), test.Priority}
+		key, _ := r.getPKValue(rule, row)
+		if key != test.Key {
+			t.Errorf("Priority: %s, Expected: %s, but: was %s", test.Priority, test.Key, key)
+		}
+
+		cmds, _ := r.upsertRowCmds(rule, key, row, row)
+		if v := fmt.Sprint(cmds[len(cmds)-1]); v != test.Expire {
+			t.Errorf("Priority: %s, Expected: %s, but: was %s", test.Priority, test.Expire, v)
+		}
+	}
+
+	rule.Conditions[0].TTL.Duration = 500 * time.Millisecond
+	if err = rule.prepare(new(Config)); err == nil {
+		t.Errorf("Expected: an error for ttl 500ms, but: was nil")
+	}
+}
+
+func TestMaskTransforms(t *testing.T) {
+	r := new(River)
+
+	rule := newDefaultRule("test", "test_river")
+	rule.MaskSalt = "salt"
+	rule.Transforms = map[string]string{
+		"email": "lower|hash",
+		"phone": "redact:4",
+		"ssn":   "drop",
+	}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "email", Type: schema.TYPE_STRING},
+			{Name: "phone", Type: schema.TYPE_STRING},
+			{Name: "ssn", Type: schema.TYPE_STRING},
+		},
+		PKColumns: []int{0},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	values, _, err := r.makeRowValues(rule, nil, []interface{}{int64(1), "A@b.c", "5551234", "123-45-6789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hmac.New(sha256.New, []byte("salt"))
+	h.Write([]byte("a@b.c"))
+	expect := map[string]interface{}{
+		"id":    int64(1),
+		"email": hex.EncodeToString(h.Sum(nil)),
+		"phone": "***1234",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, values)
+	}
+
+	rule.Transforms = map[string]string{"ssn": "trim|drop"}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: chained drop error, but: was nil")
+	}
+}
+
+func TestLimitValue(t *testing.T) {
+	r := new(River)
+	r.st = &stat{}
+
+	rule := newDefaultRule("test", "test_river")
+	rule.MaxFieldBytes = 4
+
+	tests := []struct {
+		Policy string
+		Value  interface{}
+		Expect interface{}
+		OK     bool
+		Err    bool
+	}{
+		{OversizePolicyTruncate, "abc", "abc", true, false},
+		{OversizePolicyTruncate, int64(123456), int64(123456), true, false},
+		{OversizePolicyTruncate, "abcdef", "abcd", true, false},
+		{OversizePolicyTruncate, "ab中文", "ab", true, false},
+		{OversizePolicyDropField, "abcdef", nil, false, false},
+		{OversizePolicyDropRow, "abcdef", nil, false, true},
+		{OversizePolicyDeadLetter, "abcdef", nil, false, true},
+	}
+
+	for _, test := range tests {
+		rule.OversizePolicy = test.Policy
+		v, ok, err := r.limitValue(rule, "title", test.Value)
+		if v != test.Expect || ok != test.OK || (err != nil) != test.Err {
+			t.Errorf("Policy: %s, Value: %v, Expected: %v %t %t, but: was %v %t %v", test.Policy, test.Value, test.Expect, test.OK, test.Err, v, ok, err)
+		}
+	}
+
+	if n := r.st.OversizeNum.Get(); n != 5 {
+		t.Errorf("Expected: 5 oversize values, but: was %d", n)
+	}
+}
+
+func TestCheckFilterRegex(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.FilterRegex = []string{"^meta_", "_id$"}
+	rule.ExcludeRegex = []string{"^meta_secret"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Field  string
+		Expect bool
+	}{
+		{"meta_title", true},
+		{"user_id", true},
+		{"title", false},
+		{"meta_secret_key", false},
+	}
+
+	for _, test := range tests {
+		if v := rule.CheckFilter(test.Field); v != test.Expect {
+			t.Errorf("Field: %s, Expected: is %t, but: was %t", test.Field, test.Expect, v)
+		}
+	}
+
+	rule.FilterRegex = []string{"("}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: invalid regexp error, but: was nil")
+	}
+}
+
+func TestSortRules(t *testing.T) {
+	wild1 := newDefaultRule("test", "test_river_0001")
+	wild1.wildcard = "test_river_[0-9]{4}"
+	exact := newDefaultRule("test", "test_river_0001")
+	wild2 := newDefaultRule("test", "test_river_0001")
+	wild2.wildcard = "test_river_.*"
+	wild2.Priority = 1
+
+	rules := []*Rule{wild1, exact, wild2}
+	sortRules(rules)
+
+	if rules[0] != wild2 || rules[1] != exact || rules[2] != wild1 {
+		t.Errorf("Expected: priority, then exact, then config order, but: was %v %v %v", rules[0].wildcard, rules[1].wildcard, rules[2].wildcard)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("RIVER_TEST_ADDR", "10.0.0.1:6379")
+	defer os.Unsetenv("RIVER_TEST_ADDR")
+
+	c, err := NewConfig(`
+redis_addr = "${RIVER_TEST_ADDR}"
+my_addr = "${RIVER_TEST_MISSING:-127.0.0.1:3306}"
+my_pass = "a$$b"
+# my_user = "${RIVER_TEST_MISSING}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RedisAddr != "10.0.0.1:6379" || c.MyAddr != "127.0.0.1:3306" || c.MyPassword != "a$b" {
+		t.Errorf("Expected: expanded config, but: was %s %s %s", c.RedisAddr, c.MyAddr, c.MyPassword)
+	}
+
+	if _, err = NewConfig(`redis_addr = "${RIVER_TEST_MISSING}"`); err == nil {
+		t.Error("Expected: missing environment variable error, but: was nil")
+	}
+
+	// the values are escaped for the string they are in
+	os.Setenv("RIVER_TEST_PASS", "a\"b\\c\nd")
+	defer os.Unsetenv("RIVER_TEST_PASS")
+	if c, err = NewConfig(`my_pass = "x${RIVER_TEST_PASS}"`); err != nil || c.MyPassword != "xa\"b\\c\nd" {
+		t.Errorf("Expected: escaped password, but: was %v %v", c, err)
+	}
+	if _, err = NewConfig(`my_pass = '${RIVER_TEST_PASS}'`); err == nil {
+		t.Error("Expected: a new line in a literal string error, but: was nil")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	yamlConfig := `
+my_addr: 127.0.0.1:3306
+server_id: 1001
+source:
+  - schema: test
+    tables: [test_river]
+rule:
+  - schema: test
+    table: test_river
+    ttl: 1h
+    field:
+      title: redis_title
+`
+	jsonConfig := `{
+	"my_addr": "127.0.0.1:3306",
+	"server_id": 1001,
+	"source": [{"schema": "test", "tables": ["test_river"]}],
+	"rule": [{"schema": "test", "table": "test_river", "ttl": "1h", "field": {"title": "redis_title"}}]
+}`
+
+	for format, data := range map[string]string{ConfigFormatYAML: yamlConfig, ConfigFormatJSON: jsonConfig} {
+		c, err := NewConfigWithFormat(data, format)
+		if err != nil {
+			t.Fatalf("Format: %s, err: %v", format, err)
+		}
+		if c.MyAddr != "127.0.0.1:3306" || c.ServerID != 1001 || len(c.Sources) != 1 || c.Sources[0].Tables[0] != "test_river" ||
+			len(c.Rules) != 1 || c.Rules[0].TTL.Duration != time.Hour || c.Rules[0].FieldName("title") != "redis_title" {
+			t.Errorf("Format: %s, Expected: decoded config, but: was %+v", format, c)
+		}
+	}
+
+	if configFormat("river.yml") != ConfigFormatYAML || configFormat("river.json") != ConfigFormatJSON || configFormat("river.toml") != ConfigFormatTOML {
+		t.Error("Expected: format by file extension")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c, err := NewConfig(`
+my_addr = "127.0.0.1:3306"
+redis_addr = "127.0.0.1:6379"
+redis_adr = "typo"
+check_master = "strict"
+server_id_min = 2000
+server_id_max = 1000
+
+[[source]]
+schema = "test"
+tables = ["test_river", "test_river_[0-9]{4}", "test_(river"]
+
+[[rule]]
+schema = "test"
+table = "test_river"
+key_prefix = "shared"
+
+[[rule]]
+schema = "test"
+table = "test_river_[0-9]{4}"
+key_prefix = "shared"
+
+[[rule]]
+schema = "test"
+table = "test_river_2024"
+
+[[rule]]
+schema = "test"
+table = "test_other"
+null_policy = "invalid"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected: ConfigErrors, but: was %v", err)
+	}
+
+	for _, expect := range []string{
+		"unknown config key redis_adr",
+		"invalid check_master strict",
+		"server_id_min 2000 must not be greater than server_id_max 1000",
+		"invalid table regexp test_(river",
+		"key_prefix shared is shared by all the wildcard tables",
+		"rule test.test_other: no source defines the table",
+		"invalid null_policy invalid",
+	} {
+		if !strings.Contains(errs.Error(), expect) {
+			t.Errorf("Expected: %s, but: was %v", expect, errs)
+		}
+	}
+	if strings.Contains(errs.Error(), "test.test_river_2024") {
+		t.Errorf("Expected: test_river_2024 defined by the wildcard source, but: was %v", errs)
+	}
+}
+
+func TestIncludeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(dir+"/rules", 0755)
+	ioutil.WriteFile(dir+"/rules/a.toml", []byte(`
+[[source]]
+schema = "test"
+tables = ["t1"]
+
+[[rule]]
+schema = "test"
+table = "t1"
+`), 0644)
+	ioutil.WriteFile(dir+"/river.toml", []byte(`
+include = ["rules/*.toml"]
+
+[rule_defaults]
+null_policy = "empty"
+
+[[source]]
+schema = "test"
+tables = ["t2"]
+`), 0644)
+
+	c, err := NewConfigWithFile(dir + "/river.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Sources) != 2 || len(c.Rules) != 1 || c.Rules[0].Table != "t1" || c.Rules[0].NullPolicy != "empty" {
+		t.Errorf("Expected: included source and rule with defaults, but: was %+v %+v", c.Sources, c.Rules)
+	}
+
+	ioutil.WriteFile(dir+"/rules/b.toml", []byte(`
+[[rule]]
+schema = "test"
+table = "t1"
+`), 0644)
+	if _, err = NewConfigWithFile(dir + "/river.toml"); err == nil || !strings.Contains(err.Error(), "duplicate rule test.t1") {
+		t.Errorf("Expected: duplicate rule error, but: was %v", err)
+	}
+}
+
+func TestConfigBuilder(t *testing.T) {
+	c, err := NewConfigBuilder().
+		MySQL("127.0.0.1:3306", "root", "").
+		Redis("127.0.0.1:6379").
+		ServerID(1001).
+		AddSource("test", "t1", "t2").
+		RuleDefaults(&Rule{NullPolicy: NullPolicyEmpty}).
+		AddTable("test", "t1").
+		AddTable("test", "t2", func(r *Rule) { r.NullPolicy = NullPolicyDelete }).
+		Set(func(c *Config) { c.StatAddr = "127.0.0.1:12800" }).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MyAddr != "127.0.0.1:3306" || c.ServerID != 1001 || c.StatAddr != "127.0.0.1:12800" || len(c.Sources) != 1 {
+		t.Errorf("Expected: built config, but: was %+v", c)
+	}
+	if len(c.Rules) != 2 || c.Rules[0].NullPolicy != NullPolicyEmpty || c.Rules[1].NullPolicy != NullPolicyDelete || c.Rules[1].Table != "t2" {
+		t.Errorf("Expected: rules with defaults, but: was %+v %+v", c.Rules[0], c.Rules[1])
+	}
+
+	if _, err = NewConfigBuilder().AddTable("test", "t1").Build(); err == nil {
+		t.Error("Expected: invalid config error, but: was nil")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	f, err := ioutil.TempFile("", "river_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("file-secret\n")
+	f.Close()
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/secret/data/river" || req.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"redis_password": "vault-secret"}}}`))
+	}))
+	defer vault.Close()
+
+	c := &Config{MyPasswordFile: f.Name(), RedisPasswordVault: "secret/data/river#redis_password", VaultAddr: vault.URL, VaultToken: "token"}
+	if err = c.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if c.MyPassword != "file-secret" || c.RedisPassword != "vault-secret" {
+		t.Errorf("Expected: secrets read, but: was %q %q", c.MyPassword, c.RedisPassword)
+	}
+
+	os.Setenv("RIVER_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("RIVER_TEST_SECRET")
+	c = &Config{MyPasswordEnv: "RIVER_TEST_SECRET", RedisPasswordEnv: "RIVER_TEST_UNSET"}
+	if err = c.ResolveSecrets(); err == nil {
+		t.Error("Expected: unset variable error, but: was nil")
+	}
+	if c.MyPassword != "env-secret" {
+		t.Errorf("Expected: env-secret, but: was %q", c.MyPassword)
+	}
+
+	c = &Config{MyAddr: "127.0.0.1:3306", RedisAddr: "127.0.0.1:6379", MyPasswordFile: f.Name(), MyPasswordEnv: "RIVER_TEST_SECRET"}
+	if err = c.Validate(); err == nil {
+		t.Error("Expected: more than one source error, but: was nil")
+	}
+}
+
+func TestManagerHTTP(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+
+	if err := m.Add("a/b", &Config{}); err == nil {
+		t.Error("Expected: invalid river name error, but: was nil")
+	}
+	if err := m.Remove("test"); err == nil {
+		t.Error("Expected: river not exist error, but: was nil")
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/stat", nil))
+	if !strings.HasPrefix(w.Body.String(), "river_num:0\n") {
+		t.Errorf("Expected: river_num:0, but: was %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/river/test/stat", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected: 404, but: was %d", w.Code)
+	}
+}
+
+func TestErrorCause(t *testing.T) {
+	rule := newDefaultRule("test", "t")
+	rule.TableInfo = &schema.Table{Columns: []schema.TableColumn{{Name: "id"}}}
+
+	err := errors.Trace(checkRowColumns(rule, [][]interface{}{{1, 2}}))
+	if errors.Cause(err) != ErrSchemaMismatch || ErrorCode(err) != "schema_mismatch" {
+		t.Errorf("Expected: schema_mismatch, but: was %v %q", errors.Cause(err), ErrorCode(err))
+	}
+	if !strings.Contains(err.Error(), "row has 2 values but table has 1 columns") {
+		t.Errorf("Expected: the message kept, but: was %v", err)
+	}
+
+	err = errors.Trace(redisError(redis.Error("READONLY You can't write against a read only replica.")))
+	if ErrorCode(err) != "redis_command" {
+		t.Errorf("Expected: redis_command, but: was %q", ErrorCode(err))
+	}
+	if err = redisError(io.EOF); !stderrors.Is(err, ErrRedisUnavailable) || !stderrors.Is(err, io.EOF) {
+		t.Errorf("Expected: Redis unavailable EOF, but: was %v", err)
+	}
+	if ErrorCode(io.EOF) != "" || redisError(nil) != nil {
+		t.Error("Expected: no code, but: was a code")
+	}
+}
+
+func TestRetryRedis(t *testing.T) {
+	for err, expect := range map[error]bool{
+		redis.Error("LOADING Redis is loading the dataset in memory"):                    true,
+		redis.Error("READONLY You can't write against a read only replica."):             true,
+		redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"): false,
+		errors.Trace(redisError(io.EOF)):                                                 true,
+		errors.Trace(redisError(syscall.ECONNRESET)):                                     true,
+		errors.New("invalid argument"):                                                   false,
+	} {
+		if isRetryableRedisError(err) != expect {
+			t.Errorf("Expected: retryable %v for %v, but: was not", expect, err)
+		}
+	}
+
+	r := new(River)
+	r.c = &Config{RedisMaxRetries: 2, RedisRetryBackoff: TomlDuration{time.Millisecond}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+
+	n := 0
+	err := r.retryRedis("HSET", func() error {
+		n++
+		return redisError(redis.Error("LOADING Redis is loading the dataset in memory"))
+	})
+	if ErrorCode(err) != "redis_command" || n != 3 || r.st.RedisRetryNum.Get() != 2 {
+		t.Errorf("Expected: 3 tries, but: was %d %v", n, err)
+	}
+
+	n = 0
+	err = r.retryRedis("HSET", func() error {
+		n++
+		if n == 1 {
+			return redisError(redis.Error("TRYAGAIN Multiple keys request during rehashing of slot"))
+		}
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("Expected: success on retry, but: was %d %v", n, err)
+	}
+
+	r.c.RedisMaxRetries = -1
+	n = 0
+	r.retryRedis("HSET", func() error {
+		n++
+		return redis.Error("LOADING Redis is loading the dataset in memory")
+	})
+	if n != 1 {
+		t.Errorf("Expected: no retry, but: was %d tries", n)
+	}
+}
+
+func TestRedisRedirect(t *testing.T) {
+	// a Sentinel replying to any command with the master address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1024))
+			conn.Write([]byte("*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6380\r\n"))
+			conn.Close()
+		}
+	}()
+
+	r := new(River)
+	r.c = &Config{RedisSentinelAddrs: []string{l.Addr().String()}, RedisSentinelMaster: "mymaster"}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+
+	addr, err := r.resolveRedis()
+	if err != nil || addr != "127.0.0.1:6380" {
+		t.Errorf("Expected: 127.0.0.1:6380, but: was %s %v", addr, err)
+	}
+
+	n := 0
+	err = r.retryRedis("HSET", func() error {
+		n++
+		if n == 1 {
+			return redisError(redis.Error("MOVED 3999 " + l.Addr().String()))
+		}
+		return nil
+	})
+	if err != nil || n != 2 || r.redisAddr != l.Addr().String() || r.st.RedisRetryNum.Get() != 0 {
+		t.Errorf("Expected: redirected to %s, but: was %s %d %v", l.Addr(), r.redisAddr, n, err)
+	}
+	r.redisConn.Close()
+}
+
+func TestRetryRedisMulti(t *testing.T) {
+	for _, test := range []struct {
+		Cmds   []redisCmd
+		Expect bool
+	}{
+		{[]redisCmd{newRedisCmd("HMSET", "k", "f", "v"), newRedisCmd("SADD", "s", "k")}, true},
+		{[]redisCmd{newRedisCmd("DEL", "k:f"), newRedisCmd("RPUSH", "k:f", "a"), newRedisCmd("RPUSH", "k:f", "b")}, true},
+		{[]redisCmd{newRedisCmd("HMSET", "k", "f", "v"), newRedisCmd("XADD", "stream", "*", "f", "v")}, false},
+		{[]redisCmd{newRedisCmd("RPUSH", "k:f", "a")}, false},
+		{[]redisCmd{newRedisCmd("hincrby", "sum", "f", 1)}, false},
+	} {
+		if v := isIdempotentCmds(test.Cmds); v != test.Expect {
+			t.Errorf("Cmds: %v, Expected: idempotent %v, but: was %v", test.Cmds, test.Expect, v)
+		}
+	}
+
+	// a Redis closing the connection on EXEC, so its result is unknown
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	execs := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if strings.Contains(string(buf[:n]), "EXEC") {
+						execs <- struct{}{}
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	r := new(River)
+	r.c = &Config{RedisAddr: l.Addr().String(), RedisMaxRetries: 1, RedisRetryBackoff: TomlDuration{time.Millisecond}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+	if err = r.dialRedis(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { r.redisConn.Close() }()
+
+	err = r.doRedisMulti([]redisCmd{newRedisCmd("HMSET", "k", "f", "v"), newRedisCmd("XADD", "stream", "*", "f", "v")})
+	if err == nil || ErrorCode(err) != "redis_unavailable" || len(execs) != 1 {
+		t.Errorf("Expected: no retry of XADD, but: was %d tries %v", len(execs), err)
+	}
+
+	for len(execs) > 0 {
+		<-execs
+	}
+	if err = r.dialRedis(); err != nil {
+		t.Fatal(err)
+	}
+	err = r.doRedisMulti([]redisCmd{newRedisCmd("HMSET", "k", "f", "v"), newRedisCmd("SADD", "s", "k")})
+	if err == nil || len(execs) != 2 {
+		t.Errorf("Expected: HMSET retried, but: was %d tries %v", len(execs), err)
+	}
+}
+
+type recordRowMapper struct {
+	rows [][]interface{}
+}
+
+func (m *recordRowMapper) Map(action string, rule *Rule, before, after []interface{}) ([]RedisOp, error) {
+	m.rows = append(m.rows, after)
+	return nil, nil
+}
+
+func TestHandleRowsError(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{
+		Schema:    "test",
+		Name:      "test_river",
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		PKColumns: []int{0},
+	}
+	rule.ErrorPolicy = ErrorPolicyDeadLetter
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Errorf("Expected: an error for dead_letter without a queue, but: was nil")
+	}
+
+	f, err := ioutil.TempFile("", "river_dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	r := new(River)
+	r.c = &Config{ErrorMaxConsecutive: 2, DeadLetterFile: f.Name()}
+	r.st = newStat(r)
+	if err = rule.prepare(r.c); err != nil {
+		t.Fatal(err)
+	}
+	if r.deadLetters, err = newDeadLetterQueue(r, f.Name(), ""); err != nil {
+		t.Fatal(err)
+	}
+	defer r.deadLetters.Close()
+
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: [][]interface{}{{1, "a"}}}
+	failed := errors.New("write failed")
+	if err = r.handleRowsError(rule, e, failed); err != nil {
+		t.Errorf("Expected: the event dead lettered, but: was %v", err)
+	}
+	var l deadLetter
+	data, _ := ioutil.ReadFile(f.Name())
+	if err = json.Unmarshal(data, &l); err != nil || l.Err != "write failed" || fmt.Sprint(l.Keys) != "[test:test_river:1]" {
+		t.Errorf("Expected: the dead letter of the event, but: was %s %v", data, err)
+	}
+
+	rule.ErrorPolicy = ErrorPolicySkip
+	if err = r.handleRowsError(rule, e, failed); err == nil {
+		t.Errorf("Expected: an error after 2 consecutive errors, but: was nil")
+	}
+	if r.st.SkipNum.Get() != 2 || r.st.DeadLetterNum.Get() != 1 {
+		t.Errorf("Expected: 2 skipped and 1 dead letter, but: was %d %d", r.st.SkipNum.Get(), r.st.DeadLetterNum.Get())
+	}
+
+	rule.ErrorPolicy = ErrorPolicyFail
+	r.consecutiveErrors = 0
+	if err = r.handleRowsError(rule, e, failed); err != failed {
+		t.Errorf("Expected: %v, but: was %v", failed, err)
+	}
+}
+
+func TestReplayDeadLetterFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "river_dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	lines := []string{
+		`{"schema": "test", "table": "test_river", "action": "insert", "rows": [[1, "a"]]}`,
+		`{"schema": "test", "table": "test_other", "action": "insert", "rows": [[2, "b"]]}`,
+		`{"schema": "test", "table": "test_river", "action": "insert", "rows": [[3, "c"]]}`,
+	}
+	f.WriteString(strings.Join(lines, "\n") + "\n")
+	f.Close()
+
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		PKColumns: []int{0},
+	}
+	if err = rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(recordRowMapper)
+	r := new(River)
+	r.c = new(Config)
+	r.st = newStat(r)
+	r.rules = map[string]*Rule{ruleKey("test", "test_river"): rule}
+	r.SetRowMapper(m)
+	if r.deadLetters, err = newDeadLetterQueue(r, f.Name(), ""); err != nil {
+		t.Fatal(err)
+	}
+	defer r.deadLetters.Close()
+
+	n, err := r.ReplayDeadLetters(context.Background())
+	if n != 1 || errors.Cause(err) != ErrRuleNotExist {
+		t.Errorf("Expected: 1 replayed and rule not exist, but: was %d %v", n, err)
+	}
+	if v := fmt.Sprint(m.rows); v != "[[1 a]]" {
+		t.Errorf("Expected: [[1 a]], but: was %s", v)
+	}
+	if _, ok := m.rows[0][0].(int64); !ok {
+		t.Errorf("Expected: int64 id, but: was %T", m.rows[0][0])
+	}
+
+	data, _ := ioutil.ReadFile(f.Name())
+	if string(data) != lines[1]+"\n"+lines[2]+"\n" {
+		t.Errorf("Expected: the events not replayed kept, but: was %s", data)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	r := new(River)
+	r.c = &Config{StartupWait: TomlDuration{100 * time.Millisecond}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	n := 0
+	err := r.waitFor("Redis", time.Now().Add(r.c.StartupWait.Duration), func() error {
+		n++
+		return io.EOF
+	})
+	if err == nil || n != 1 || !strings.Contains(err.Error(), "Redis is still unreachable after startup_wait 100ms") {
+		t.Errorf("Expected: unreachable after 1 try, but: was %d %v", n, err)
+	}
+
+	if err = r.waitFor("Redis", time.Now(), func() error { return nil }); err != nil {
+		t.Errorf("Expected: nil, but: was %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	for restarts, expect := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := restartBackoff(restarts); d != expect {
+			t.Errorf("Expected: %s, but: was %s", expect, d)
+		}
+	}
+	if d := restartBackoff(100); d != maxStartupBackoff {
+		t.Errorf("Expected: %s, but: was %s", maxStartupBackoff, d)
+	}
+
+	r := new(River)
+	r.c = &Config{MaxRestarts: 1}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if r.restart("canal", 1, io.EOF) {
+		t.Error("Expected: no restart after max_restarts, but: was restarted")
+	}
+	r.cancel()
+	if r.restart("canal", 0, io.EOF) {
+		t.Error("Expected: no restart after close, but: was restarted")
+	}
+}
+
+func TestRedisOOM(t *testing.T) {
+	used, max := parseRedisMemory("# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\nmaxmemory:2097152\r\n")
+	if used != 1048576 || max != 2097152 {
+		t.Errorf("Expected: 1048576 2097152, but: was %d %d", used, max)
+	}
+
+	r := new(River)
+	r.c = &Config{RedisOOMPolicy: RedisOOMPolicyDrop, RedisOOMMinPriority: 10}
+	r.st = newStat(r)
+
+	low, high := newDefaultRule("test", "t1"), newDefaultRule("test", "t2")
+	high.Priority = 10
+	if r.skipOOM(low) {
+		t.Error("Expected: no skip before out of memory, but: was skipped")
+	}
+
+	r.oom = true
+	r.oomCheckTime = time.Now()
+	if !r.skipOOM(low) || r.skipOOM(high) || r.st.RedisOOMDroppedNum.Get() != 1 {
+		t.Error("Expected: only the low priority rule skipped, but: was not")
+	}
+}
+
+func TestPoisonInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river_poison")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := loadPoisonInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 1234}
+	p.Failed(pos)
+	p.Failed(pos)
+
+	// the failures are kept across restarts
+	if p, err = loadPoisonInfo(dir); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := p.Failed(pos); n != 3 {
+		t.Errorf("Expected: 3 failures, but: was %d", n)
+	}
+	if n, _ := p.Failed(mysql.Position{Name: "mysql-bin.000001", Pos: 5678}); n != 1 {
+		t.Errorf("Expected: 1 failure at another position, but: was %d", n)
+	}
+
+	p.Reset()
+	if p, _ = loadPoisonInfo(dir); p.Failures != 0 {
+		t.Errorf("Expected: no failures after reset, but: was %d", p.Failures)
+	}
+}
+
+func TestTxnTimeout(t *testing.T) {
+	r := new(River)
+	r.c = &Config{TxnTimeout: TomlDuration{time.Millisecond}}
+	r.st = newStat(r)
+
+	rule := newDefaultRule("test", "t1")
+	e := &canal.RowsEvent{Action: canal.InsertAction, Header: &replication.EventHeader{LogPos: 1234}}
+
+	if err := r.checkTxnTimeout(rule, e); err != nil {
+		t.Fatalf("Expected: no error for the first rows event, but: was %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, ok := r.checkTxnTimeout(rule, e).(*txnTimeoutError); !ok {
+			t.Fatal("Expected: txn timeout error, but: was not")
+		}
+	}
+	if n := r.st.TxnTimeoutNum.Get(); n != 1 {
+		t.Errorf("Expected: 1 txn timeout, but: was %d", n)
+	}
+
+	// the next transaction has its own budget, the dump none
+	r.endTxn()
+	if err := r.checkTxnTimeout(rule, e); err != nil {
+		t.Errorf("Expected: no error after the transaction, but: was %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := r.checkTxnTimeout(rule, &canal.RowsEvent{Action: canal.InsertAction}); err != nil {
+		t.Errorf("Expected: no error for dump rows, but: was %v", err)
+	}
+
+	// the time paused does not count
+	r.endTxn()
+	r.c.TxnTimeout.Duration = 50 * time.Millisecond
+	r.checkTxnTimeout(rule, e)
+	r.waitedTxn(time.Now().Add(-time.Minute))
+	if err := r.checkTxnTimeout(rule, e); err != nil {
+		t.Errorf("Expected: no error after a pause, but: was %v", err)
+	}
+}
+
+func TestServerID(t *testing.T) {
+	for pid := 1; pid < 100; pid++ {
+		if id := hashServerID("host", pid, 1001, 1010); id < 1001 || id > 1010 {
+			t.Fatalf("Expected: server_id within 1001 and 1010, but: was %d", id)
+		}
+	}
+	if hashServerID("host1", 42, 1, 1<<20) == hashServerID("host2", 42, 1, 1<<20) {
+		t.Error("Expected: different server_id for different hosts, but: was the same")
+	}
+	if id := nextServerID(1010, 1001, 1010); id != 1001 {
+		t.Errorf("Expected: 1001 after the range, but: was %d", id)
+	}
+
+	err := errors.Trace(&mysql.MyError{
+		Code:    mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG,
+		Message: "A slave with the same server_uuid/server_id as this slave has connected to the master",
+	})
+	if !isDuplicateServerID(err) {
+		t.Errorf("Expected: duplicate server_id, but: was not for %v", err)
+	}
+	if isDuplicateServerID(errors.New("connection reset")) {
+		t.Error("Expected: not duplicate server_id, but: was")
+	}
+
+	r := new(River)
+	r.c = &Config{ServerID: 1010, ServerIDMin: 1001, ServerIDMax: 1010}
+	r.st = newStat(r)
+	if r.handleDuplicateServerID(err, 0) {
+		t.Error("Expected: no other server_id for a configured one, but: was")
+	}
+	r.autoServerID = true
+	if !r.handleDuplicateServerID(err, 0) || r.c.ServerID != 1001 {
+		t.Errorf("Expected: server_id 1001 selected, but: was %d", r.c.ServerID)
+	}
+	if r.handleDuplicateServerID(err, maxServerIDSelects) {
+		t.Error("Expected: no more server_id selected, but: was")
+	}
+}
+
+func TestBinlogPurged(t *testing.T) {
+	purgedErr := errors.Trace(&mysql.MyError{
+		Code:    mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG,
+		Message: "Could not find first log file name in binary log index file",
+	})
+	if !isBinlogPurged(purgedErr) {
+		t.Errorf("Expected: binlog purged, but: was not for %v", purgedErr)
+	}
+	if isBinlogPurged(errors.New("connection reset")) {
+		t.Error("Expected: not binlog purged, but: was")
+	}
+
+	dir, err := ioutil.TempDir("", "river_purged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := new(River)
+	r.c = &Config{DataDir: dir}
+	r.st = newStat(r)
+	if r.master, err = loadMasterInfo(dir); err != nil {
+		t.Fatal(err)
+	}
+	if r.poison, err = loadPoisonInfo(dir); err != nil {
+		t.Fatal(err)
+	}
+	r.master.Save(mysql.Position{Name: "mysql-bin.000001", Pos: 1234})
+
+	if r.handleBinlogPurged(purgedErr) {
+		t.Error("Expected: no dump for the fail policy, but: was")
+	}
+
+	r.c.BinlogPurgedPolicy = BinlogPurgedPolicyRedump
+	if !r.handleBinlogPurged(purgedErr) || r.st.RedumpNum.Get() != 1 {
+		t.Error("Expected: dump for the redump policy, but: was not")
+	}
+	if m, _ := loadMasterInfo(dir); len(m.Position().Name) > 0 {
+		t.Errorf("Expected: no saved position after reset, but: was %s", m.Position())
+	}
+}
+
+func TestLagAlert(t *testing.T) {
+	alerts := make(chan string, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msg map[string]string
+		json.NewDecoder(req.Body).Decode(&msg)
+		alerts <- msg["text"]
+	}))
+	defer webhook.Close()
+
+	r := new(River)
+	r.c = &Config{LagAlertThreshold: TomlDuration{30 * time.Second}}
+	r.st = newStat(r)
+	r.alert = newAlerter([]string{webhook.URL}, "")
+
+	// no event for a minute, like a stalled sync
+	r.updateLag(uint32(time.Now().Add(-time.Minute).Unix()))
+	r.checkLag()
+	r.checkLag()
+	if !r.st.lagAlerted {
+		t.Errorf("Expected: the lag alerted, but: was not")
+	}
+
+	r.updateLag(uint32(time.Now().Unix()))
+	r.checkLag()
+	if r.st.lagAlerted {
+		t.Errorf("Expected: the lag alert cleared, but: was not")
+	}
+
+	r.alert.Close()
+	close(alerts)
+	var texts []string
+	fired, cleared := 0, 0
+	for text := range alerts {
+		texts = append(texts, text)
+		if strings.Contains(text, "exceeds threshold 30s") {
+			fired++
+		}
+		if strings.Contains(text, "is back under threshold 30s") {
+			cleared++
+		}
+	}
+	if fired != 1 || cleared != 1 {
+		t.Errorf("Expected: the alert fired once then cleared, but: was %v", texts)
+	}
+}
+
+func TestReconnected(t *testing.T) {
+	alerts := make(chan string, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msg map[string]string
+		json.NewDecoder(req.Body).Decode(&msg)
+		alerts <- msg["text"]
+	}))
+	defer webhook.Close()
+
+	r := new(River)
+	r.c = &Config{}
+	r.st = newStat(r)
+	r.alert = newAlerter([]string{webhook.URL}, "")
+	r.redisState.name = "redis"
+
+	r.redisState.down(io.EOF)
+	r.redisState.down(syscall.ECONNREFUSED)
+	time.Sleep(time.Millisecond)
+	r.reconnected(&r.redisState)
+
+	if n := r.st.RedisReconnectNum.Get(); n != 1 {
+		t.Errorf("Expected: 1 reconnect, but: was %d", n)
+	}
+	samples := r.st.reconnects.Samples()
+	if len(samples) != 1 || samples[0].Err != io.EOF || samples[0].Duration <= 0 {
+		t.Errorf("Expected: reconnect after EOF with downtime, but: was %v", samples)
+	}
+	if !r.redisState.since.IsZero() || r.redisState.failures != 0 {
+		t.Error("Expected: connected state after reconnect, but: was not")
+	}
+
+	r.alert.Close()
+	select {
+	case text := <-alerts:
+		if !strings.HasPrefix(text, "reconnected redis after") || !strings.Contains(text, "2 failures since EOF") {
+			t.Errorf("Expected: reconnect alert, but: was %s", text)
+		}
+	default:
+		t.Error("Expected: reconnect alert, but: was none")
+	}
+}
+
+func TestDumpSSLOptions(t *testing.T) {
+	c := &Config{DumpSSLMode: "verify_identity", DumpSSLCA: "/ca.pem"}
+	expect := []string{"--ssl-mode=VERIFY_IDENTITY", "--ssl-ca=/ca.pem"}
+	if opts := c.dumpSSLOptions(); !reflect.DeepEqual(opts, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, opts)
+	}
+
+	c.Flavor = "mariadb"
+	expect = []string{"--ssl", "--ssl-verify-server-cert", "--ssl-ca=/ca.pem"}
+	if opts := c.dumpSSLOptions(); !reflect.DeepEqual(opts, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, opts)
+	}
+
+	if opts := new(Config).dumpSSLOptions(); len(opts) != 0 {
+		t.Errorf("Expected: no options, but: was %v", opts)
+	}
+
+	// mysqldump connects the tunnel on 127.0.0.1
+	c = &Config{MyAddr: "127.0.0.1:3306", RedisAddr: "127.0.0.1:6379", DumpSSLMode: "VERIFY_IDENTITY", DumpSSLCA: "/ca.pem",
+		DumpSSHAddr: "bastion:22", DumpSSHUser: "river", DumpSSHKeyFile: "/key"}
+	if err := c.validate(true); err == nil || !strings.Contains(err.Error(), "can not verify the host") {
+		t.Errorf("Expected: VERIFY_IDENTITY rejected with dump_ssh_addr, but: was %v", err)
+	}
+	c.DumpSSLMode = "VERIFY_CA"
+	if err := c.validate(true); err != nil && strings.Contains(err.Error(), "can not verify the host") {
+		t.Errorf("Expected: VERIFY_CA with dump_ssh_addr, but: was %v", err)
+	}
+}
+
+func TestEncryptTransform(t *testing.T) {
+	key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+	rule := newDefaultRule("test", "test_river")
+	rule.Transforms = map[string]string{"ssn": "trim|encrypt"}
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Error("Expected: encrypt_key error, but: was nil")
+	}
+
+	rule.EncryptKey = key
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := rule.transforms["ssn"](" 123-45-6789 ", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, _ := rule.transforms["ssn"]("123-45-6789", nil)
+	if v1 == v2 || strings.Contains(v1.(string), "6789") {
+		t.Errorf("Expected: different ciphertexts, but: was %v %v", v1, v2)
+	}
+
+	if plain, err := DecryptValue(key, v1.(string)); err != nil || plain != "123-45-6789" {
+		t.Errorf("Expected: 123-45-6789, but: was %s %v", plain, err)
+	}
+	if _, err := DecryptValue("YWJjZGVmZ2hpamtsbW5vcA==", v1.(string)); err == nil {
+		t.Error("Expected: decrypt error with another key, but: was nil")
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	f, err := ioutil.TempFile("", "river_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("old\n")
+	f.Close()
+
+	r := new(River)
+	r.c = &Config{RedisPasswordFile: f.Name(), MyPassword: "mysql"}
+	if err = r.ReloadSecrets(); err != nil || r.redisPassword() != "old" {
+		t.Fatalf("Expected: old, but: was %s %v", r.redisPassword(), err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("new\n"), 0600)
+	if err = r.ReloadSecrets(); err != nil || r.redisPassword() != "new" || r.mysqlPassword() != "mysql" {
+		t.Errorf("Expected: new and mysql, but: was %s %s %v", r.redisPassword(), r.mysqlPassword(), err)
+	}
+
+	// a secret which can not be read keeps the old password
+	os.Remove(f.Name())
+	r.reloadSecrets()
+	if r.redisPassword() != "new" {
+		t.Errorf("Expected: new, but: was %s", r.redisPassword())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	r := new(River)
+	r.c = &Config{DryRun: true}
+	r.st = newStat(r)
+
+	// no connection, so a command run would panic
+	if _, err := r.doRedis("HMSET", "test:1", "name", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.doRedisMulti([]redisCmd{newRedisCmd("DEL", "test:1"), newRedisCmd("EXPIRE", "test:1", 60)}); err != nil {
+		t.Fatal(err)
+	}
+	if r.dryRun("EXISTS", []interface{}{"test:1"}) {
+		t.Error("Expected: EXISTS run in dry run, but: was not")
+	}
+
+	expect := map[string]int64{"HMSET": 1, "DEL": 1, "EXPIRE": 1}
+	if !reflect.DeepEqual(r.st.dryRun, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, r.st.dryRun)
+	}
+	if samples := r.st.dryRunCmds.Samples(); len(samples) != 3 || samples[0].Key != "test:1" {
+		t.Errorf("Expected: 3 samples of test:1, but: was %v", samples)
+	}
+}
+
+func TestRequiredRedisACL(t *testing.T) {
+	r := new(River)
+	r.c = &Config{DeadLetterKey: "river:dead_letter"}
+
+	rule := newDefaultRule("test", "t1")
+	rule.Outputs = []Output{{Type: OutputSet, Key: "{table}:keys"}}
+	if err := rule.prepare(r.c); err != nil {
+		t.Fatal(err)
+	}
+	r.rules = map[string]*Rule{ruleKey("test", "t1"): rule}
+
+	acl := r.requiredRedisACL()
+	expect := "~river:dead_letter ~t1:keys +discard +exec +info +lindex +lpop +multi +ping +rpush +sadd +srem"
+	if s := acl.String(); s != expect || !acl.complete {
+		t.Errorf("Expected: %s, but: was %s", expect, s)
+	}
+
+	rule.Outputs = nil
+	rule.TTL = TomlDuration{time.Hour}
+	acl = r.requiredRedisACL()
+	for _, name := range []string{"DEL", "EXPIRE", "HDEL", "HMSET", "PERSIST"} {
+		if !strings.Contains(acl.String(), "+"+strings.ToLower(name)) {
+			t.Errorf("Expected: %s in %s, but: was not", name, acl)
+		}
+	}
+	if !strings.Contains(acl.String(), "~test:t1:*") {
+		t.Errorf("Expected: key pattern test:t1:*, but: was %s", acl)
+	}
+}
+
+func TestRedactRows(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.SensitiveColumns = []string{"salary"}
+	rule.Transforms = map[string]string{"email": "lower|hash", "name": "trim"}
+	if err := rule.prepare(&Config{}); err == nil || !strings.Contains(err.Error(), "mask_salt must be set") {
+		t.Errorf("Expected: mask_salt required for hash, but: was %v", err)
+	}
+	rule.MaskSalt = "salt"
+	if err := rule.prepare(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "email"}, {Name: "salary"}},
+		PKColumns: []int{0},
+	}
+
+	rows := [][]interface{}{{1, "a", "a@example.com", nil}, {2, "b", "b@example.com", 100}}
+	redacted, columns := redactRows(rule, rows)
+	expect := [][]interface{}{{1, "a", redactedValue, nil}, {2, "b", redactedValue, redactedValue}}
+	if !reflect.DeepEqual(redacted, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, redacted)
+	}
+	if !reflect.DeepEqual(columns, []string{"email", "salary"}) {
+		t.Errorf("Expected: [email salary], but: was %v", columns)
+	}
+	if rows[1][3] != 100 {
+		t.Errorf("Expected: the rows not changed, but: was %v", rows)
+	}
+
+	if v := rule.logValue("name", "a"); v != "a" {
+		t.Errorf("Expected: a, but: was %v", v)
+	}
+	if err := rule.redactError("email", errors.New("invalid a@example.com")); strings.Contains(err.Error(), "a@example.com") {
+		t.Errorf("Expected: the value redacted, but: was %v", err)
+	}
+
+	replay := rule.withoutColumns(columns)
+	if replay.CheckFilter("salary") || !replay.CheckFilter("name") || rule.skipColumns["salary"] {
+		t.Errorf("Expected: salary skipped on replay only, but: was not")
+	}
+}
+
+func TestStatAuth(t *testing.T) {
+	token := "secret"
+	h := statAuth{
+		h:     http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) }),
+		token: func() string { return token },
+	}
+
+	for auth, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/stat", nil)
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("Expected: %d for %q, but: was %d", code, auth, w.Code)
+		}
+	}
+
+	token = ""
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stat", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected: %d without stat_token, but: was %d", http.StatusOK, w.Code)
+	}
+
+	if cfg, err := (&Config{}).statTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("Expected: no TLS, but: was %v %v", cfg, err)
+	}
+	if _, err := (&Config{StatTLSCert: "/nonexistent.crt", StatTLSKey: "/nonexistent.key"}).statTLSConfig(); err == nil {
+		t.Errorf("Expected: load error, but: was nil")
+	}
+	c := &Config{MyAddr: "127.0.0.1:3306", RedisAddr: "127.0.0.1:6379", StatTLSClientCA: "/ca.crt"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "stat_tls_client_ca") {
+		t.Errorf("Expected: stat_tls_client_ca error, but: was %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	req := httptest.NewRequest("POST", "/river/pause", nil)
+	req.RemoteAddr = "10.0.0.1:53000"
+	req.Header.Set("Authorization", "Bearer secret")
+	source := HTTPAuditSource(req)
+	if source != "http 10.0.0.1 token:2bb80d53" {
+		t.Errorf("Expected: http 10.0.0.1 token:2bb80d53, but: was %s", source)
+	}
+
+	a := newAuditLog(&Config{AuditLog: dir + "/audit.log"})
+	a.Record("pause", source, map[string]interface{}{"river": "r1"})
+	a.Close()
+
+	data, err := ioutil.ReadFile(dir + "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"op":"pause"`, `"source":"http 10.0.0.1 token:2bb80d53"`, `"river":"r1"`, `"time":`} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("Expected: %s in %s, but: was not", s, data)
+		}
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Expected: no token in %s, but: was", data)
+	}
+
+	// nil-safe like the alerter
+	var none *auditLog
+	none.Record("pause", AuditSourceAPI, nil)
+}
+
+func TestBinaryValue(t *testing.T) {
+	r := new(River)
+	r.st = &stat{}
+
+	col := &schema.TableColumn{Name: "data", Type: schema.TYPE_STRING, RawType: "varbinary(16)"}
+	if !isBinaryColumn(col) || isBinaryColumn(&schema.TableColumn{Type: schema.TYPE_STRING, RawType: "varchar(16)"}) {
+		t.Errorf("Expected: only varbinary binary, but: was not")
+	}
+
+	rule := newDefaultRule("test", "test_river")
+	rule.Charset = "latin1"
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte{0xff, 0x00, 0xe9}
+	if v, ok := r.makeReqColumnData(rule, col, string(raw)).([]byte); !ok || !bytes.Equal(v, raw) {
+		t.Errorf("Expected: %v not decoded, but: was %v", raw, v)
+	}
+
+	tests := []struct {
+		Encoding string
+		Max      int
+		Expect   interface{}
+	}{
+		{BinaryEncodingBase64, 0, "/wDp"},
+		{BinaryEncodingHex, 0, "ff00e9"},
+		{BinaryEncodingHex, 2, "ff00"},
+	}
+	for _, test := range tests {
+		rule.BinaryEncoding = test.Encoding
+		rule.MaxBinaryBytes = test.Max
+		v, ok, err := r.binaryValue(rule, "data", raw)
+		if v != test.Expect || !ok || err != nil {
+			t.Errorf("Encoding: %s, Expected: %v, but: was %v %t %v", test.Encoding, test.Expect, v, ok, err)
+		}
+	}
+
+	rule.OversizePolicy = OversizePolicyDeadLetter
+	if _, ok, err := r.binaryValue(rule, "data", raw); ok || err == nil || !strings.Contains(err.Error(), "max_binary_bytes") {
+		t.Errorf("Expected: max_binary_bytes error, but: was %v", err)
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	// the SRID, then the little-endian WKB
+	wkb := func(srid uint32, parts ...interface{}) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, srid)
+		for _, p := range parts {
+			if b, ok := p.(byte); ok {
+				buf.WriteByte(b)
+			} else {
+				binary.Write(&buf, binary.LittleEndian, p)
+			}
+		}
+		return buf.Bytes()
+	}
+	point := wkb(4326, byte(1), uint32(1), 116.4, 39.9)
+	multiPoint := wkb(0, byte(1), uint32(4), uint32(2), byte(1), uint32(1), 1.0, 2.0, byte(1), uint32(1), 3.0, 4.0)
+	polygon := wkb(0, byte(1), uint32(3), uint32(1), uint32(4), 0.0, 0.0, 1.0, 0.0, 1.0, 1.0, 0.0, 0.0)
+
+	tests := []struct {
+		Data    []byte
+		WKT     string
+		GeoJSON string
+	}{
+		{point, "POINT(116.4 39.9)", `{"coordinates":[116.4,39.9],"type":"Point"}`},
+		{multiPoint, "MULTIPOINT((1 2),(3 4))", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{polygon, "POLYGON((0 0,1 0,1 1,0 0))", `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]]],"type":"Polygon"}`},
+	}
+	for _, test := range tests {
+		g, err := parseGeometry(test.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := g.WKT(); s != test.WKT {
+			t.Errorf("Expected: %s, but: was %s", test.WKT, s)
+		}
+		if s := g.GeoJSON(); s != test.GeoJSON {
+			t.Errorf("Expected: %s, but: was %s", test.GeoJSON, s)
+		}
+	}
+	if _, err := parseGeometry(point[:10]); err == nil {
+		t.Errorf("Expected: too short error, but: was nil")
+	}
+
+	rule := newDefaultRule("test", "shop")
+	rule.Outputs = []Output{{Type: OutputGeo, Key: "shops", Column: "location"}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "location", RawType: "point"}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	cmds, err := r.outputCmds(rule, canal.InsertAction, "test:shop:1", []interface{}{1, point})
+	if err != nil || len(cmds) != 1 || cmds[0].Name != "GEOADD" || !reflect.DeepEqual(cmds[0].Args, []interface{}{"shops", 116.4, 39.9, "test:shop:1"}) {
+		t.Errorf("Expected: GEOADD shops 116.4 39.9 test:shop:1, but: was %v %v", cmds, err)
+	}
+	cmds, err = r.outputCmds(rule, canal.UpdateAction, "test:shop:1", []interface{}{1, nil})
+	if err != nil || len(cmds) != 1 || cmds[0].Name != "ZREM" {
+		t.Errorf("Expected: ZREM for NULL, but: was %v %v", cmds, err)
+	}
+	// GEOADD rejects the latitudes out of the Web Mercator
+	cmds, err = r.outputCmds(rule, canal.UpdateAction, "test:shop:1", []interface{}{1, wkb(4326, byte(1), uint32(1), 116.4, 89.0)})
+	if err != nil || len(cmds) != 1 || cmds[0].Name != "ZREM" {
+		t.Errorf("Expected: ZREM for latitude 89, but: was %v %v", cmds, err)
+	}
+}
+
+func TestTimeColumns(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.TimeZone = "UTC"
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	if fsp := columnFsp(&schema.TableColumn{RawType: "datetime(3)"}); fsp != 3 {
+		t.Errorf("Expected: 3, but: was %d", fsp)
+	}
+	if v := formatTime(rule, "t", "2016-03-16 12:24:54.12", 3); v != "2016-03-16T12:24:54.120Z" {
+		t.Errorf("Expected: 2016-03-16T12:24:54.120Z, but: was %v", v)
+	}
+	rule.TimeFormat = TimeFormatUnixMicro
+	if v := formatTime(rule, "t", "2016-03-16 12:24:54.123456", 6); v != int64(1458131094123456) {
+		t.Errorf("Expected: 1458131094123456, but: was %v", v)
+	}
+
+	tests := []struct {
+		Format string
+		Value  string
+		Fsp    int
+		Expect interface{}
+	}{
+		{TimeColumnFormatRaw, "-838:59:59", 0, "-838:59:59"},
+		{TimeColumnFormatRaw, "12:34:56.5", 3, "12:34:56.500"},
+		{TimeColumnFormatRaw, "-00:00:00", 0, "00:00:00"},
+		{TimeColumnFormatSeconds, "-01:00:01", 0, int64(-3601)},
+		{TimeColumnFormatSeconds, "12:34:56.5", 1, "45296.5"},
+		{TimeColumnFormatISO8601, "12:34:56.5", 1, "PT12H34M56.5S"},
+		{TimeColumnFormatISO8601, "-838:59:59", 0, "-PT838H59M59S"},
+		{TimeColumnFormatRaw, "invalid", 0, "invalid"},
+	}
+	for _, test := range tests {
+		rule.TimeColumnFormat = test.Format
+		if v := formatTimeColumn(rule, "t", test.Value, test.Fsp); v != test.Expect {
+			t.Errorf("Format: %s, Value: %s, Expected: %#v, but: was %#v", test.Format, test.Value, test.Expect, v)
+		}
+	}
+
+	// the invalid value of a sensitive column is not logged
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	rule.sensitive = map[string]bool{"t": true}
+	formatTimeColumn(rule, "t", "secret", 0)
+	rule.sensitive = nil
+	log.SetOutput(os.Stderr)
+	if strings.Contains(buf.String(), "secret") || !strings.Contains(buf.String(), redactedValue) {
+		t.Errorf("Expected: the invalid time redacted, but: was %s", buf.String())
+	}
+
+	year := &schema.TableColumn{Type: schema.TYPE_NUMBER, RawType: "year(4)"}
+	r := new(River)
+	for _, value := range []interface{}{"2021", int64(2021)} {
+		if v := r.makeReqColumnData(rule, year, value); v != int64(2021) {
+			t.Errorf("Expected: 2021, but: was %#v", v)
+		}
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.SetFormat = SetFormatJSON
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	tags := schema.TableColumn{Name: "tags", Type: schema.TYPE_SET, SetValues: []string{"a", "b", "c"}}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, tags},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	for value, expect := range map[interface{}]string{int64(5): `["a","c"]`, "b": `["b"]`, "": `[]`} {
+		if v := r.makeReqColumnData(rule, &tags, value); v != expect {
+			t.Errorf("Value: %v, Expected: %s, but: was %v", value, expect, v)
+		}
+	}
+
+	rule.SetFormat = SetFormatRedisSet
+	values, _, err := r.makeRowValues(rule, nil, []interface{}{1, int64(3)})
+	if err != nil || len(values) != 1 {
+		t.Errorf("Expected: only the id field, but: was %v %v", values, err)
+	}
+
+	cmds, err := r.outputCmds(rule, canal.InsertAction, "test:t1:1", []interface{}{1, int64(3)})
+	expect := []redisCmd{newRedisCmd("DEL", "test:t1:1:tags"), newRedisCmd("SADD", "test:t1:1:tags", "a", "b")}
+	if err != nil || !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v %v", expect, cmds, err)
+	}
+	cmds, err = r.outputCmds(rule, canal.DeleteAction, "test:t1:1", nil)
+	if err != nil || !reflect.DeepEqual(cmds, expect[:1]) {
+		t.Errorf("Expected: %v, but: was %v %v", expect[:1], cmds, err)
+	}
+}
+
+func TestBitValue(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	bit1 := &schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(1)"}
+	bit12 := &schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(12)"}
+	bit64 := &schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(64)"}
+
+	tests := []struct {
+		Format string
+		Col    *schema.TableColumn
+		Value  interface{}
+		Expect interface{}
+	}{
+		{BitFormatInt, bit1, "\x01", int64(1)},
+		{BitFormatInt, bit1, "\x00", int64(0)},
+		{BitFormatInt, bit12, "\x0a\x05", int64(2565)},
+		{BitFormatInt, bit12, int64(2565), int64(2565)},
+		{BitFormatInt, bit12, "b'101'", int64(5)},
+		{BitFormatInt, bit64, int64(-1), uint64(math.MaxUint64)},
+		{BitFormatBitString, bit12, int64(5), "000000000101"},
+		{BitFormatBitString, bit1, "\x01", "1"},
+	}
+	r := new(River)
+	for _, test := range tests {
+		rule.BitFormat = test.Format
+		if v := r.makeReqColumnData(rule, test.Col, test.Value); v != test.Expect {
+			t.Errorf("Format: %s, Value: %q, Expected: %#v, but: was %#v", test.Format, test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestInvalidDatePolicy(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.TimeZone = "UTC"
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	created := schema.TableColumn{Name: "created", Type: schema.TYPE_DATETIME, RawType: "datetime"}
+	birthday := schema.TableColumn{Name: "birthday", Type: schema.TYPE_DATE, RawType: "date"}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, created, birthday},
+		PKColumns: []int{0},
+	}
+
+	if isInvalidDate(&created, "2016-03-16 12:24:54") || !isInvalidDate(&created, "0000-00-00 00:00:00") || !isInvalidDate(&birthday, "2020-02-30") {
+		t.Errorf("Expected: only the zero and invalid dates invalid, but: was not")
+	}
+
+	tests := []struct {
+		Policy string
+		Expect map[string]interface{}
+		Nulls  []string
+	}{
+		{InvalidDatePolicyRaw, map[string]interface{}{"id": 1, "created": "0000-00-00 00:00:00", "birthday": "0000-00-00"}, nil},
+		{InvalidDatePolicyEmpty, map[string]interface{}{"id": 1, "created": "", "birthday": ""}, nil},
+		{InvalidDatePolicyEpoch, map[string]interface{}{"id": 1, "created": "1970-01-01T00:00:00Z", "birthday": "1970-01-01"}, nil},
+		{InvalidDatePolicyNull, map[string]interface{}{"id": 1}, []string{"created", "birthday"}},
+	}
+	r := new(River)
+	r.st = &stat{}
+	for _, test := range tests {
+		rule.InvalidDatePolicy = test.Policy
+		values, nulls, err := r.makeRowValues(rule, nil, []interface{}{1, "0000-00-00 00:00:00", "0000-00-00"})
+		if err != nil || !reflect.DeepEqual(values, test.Expect) || !reflect.DeepEqual(nulls, test.Nulls) {
+			t.Errorf("Policy: %s, Expected: %v %v, but: was %v %v %v", test.Policy, test.Expect, test.Nulls, values, nulls, err)
+		}
+	}
+	if n := r.st.InvalidDateNum.Get(); n != 8 {
+		t.Errorf("Expected: 8 invalid dates, but: was %d", n)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	doc := schema.TableColumn{Name: "doc", Type: schema.TYPE_JSON, RawType: "json"}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, doc},
+		PKColumns: []int{0},
+	}
+
+	text := `{"b": "<x>", "a": 1.50}`
+	r := new(River)
+	r.st = &stat{}
+	for format, expect := range map[string]string{
+		JSONFormatRaw:       text,
+		JSONFormatNormalize: `{"a":1.50,"b":"<x>"}`,
+	} {
+		rule.JSONFormat = format
+		if v := r.makeReqColumnData(rule, &doc, text); v != expect {
+			t.Errorf("Format: %s, Expected: %s, but: was %v", format, expect, v)
+		}
+	}
+
+	rule.JSONFormat = JSONFormatFlatten
+	before := []interface{}{1, `{"addr": {"city": "Paris", "zip": "75001"}, "tags": ["a"]}`}
+	after := []interface{}{1, `{"addr": {"city": "Lyon"}, "tags": ["a", "b"], "none": null}`}
+	values, nulls, err := r.makeRowValues(rule, before, after)
+	expect := map[string]interface{}{"doc.addr.city": "Lyon", "doc.tags.0": "a", "doc.tags.1": "b"}
+	if err != nil || !reflect.DeepEqual(values, expect) || !reflect.DeepEqual(nulls, []string{"doc.addr.zip"}) {
+		t.Errorf("Expected: %v [doc.addr.zip], but: was %v %v %v", expect, values, nulls, err)
+	}
+}
+
+func TestNestedOutput(t *testing.T) {
+	rule := newDefaultRule("test", "item")
+	rule.Outputs = []Output{{Type: OutputNested, Key: "test:order:{order_id}", Field: "items"}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "order_id"}},
+		PKColumns: []int{0},
+	}
+	if rule.hasHashOutput() {
+		t.Errorf("Expected: no hash output, but: was %v", rule.Outputs)
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	cmds, err := r.nestedCmds(rule, canal.UpdateAction, "test:item:1", []interface{}{1, 7}, []interface{}{1, 8})
+	expect := []redisCmd{
+		nestedCmd("test:order:7", "items", "test:item:1", ""),
+		nestedCmd("test:order:8", "items", "test:item:1", `{"_key":"test:item:1","id":1,"order_id":8}`),
+	}
+	if err != nil || !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v %v", expect, cmds, err)
+	}
+
+	cmds, err = r.nestedCmds(rule, canal.DeleteAction, "test:item:1", nil, []interface{}{1, 8})
+	remove := []redisCmd{nestedCmd("test:order:8", "items", "test:item:1", "")}
+	if err != nil || !reflect.DeepEqual(cmds, remove) {
+		t.Errorf("Expected: %v, but: was %v %v", remove, cmds, err)
+	}
+
+	cmds, err = r.nestedCmds(rule, canal.InsertAction, "test:item:2", nil, []interface{}{2, nil})
+	if err != nil || len(cmds) != 0 {
+		t.Errorf("Expected: no parent for a NULL key, but: was %v %v", cmds, err)
+	}
+}
+
+func TestEpochColumns(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.TimeZone = "UTC"
+	rule.EpochColumns = []string{"created_at"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	created := schema.TableColumn{Name: "created_at", Type: schema.TYPE_NUMBER, RawType: "int(11)"}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, created},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	for value, expect := range map[interface{}]interface{}{
+		int32(1500000000): "2017-07-14T02:40:00Z",
+		"1500000000":      "2017-07-14T02:40:00Z",
+		"not a timestamp": "not a timestamp",
+	} {
+		if v := r.makeReqColumnData(rule, &created, value); v != expect {
+			t.Errorf("Value: %v, Expected: %v, but: was %v", value, expect, v)
+		}
+	}
+
+	rule.EpochUnit = EpochUnitMilli
+	if v := r.makeReqColumnData(rule, &created, int64(1500000000123)); v != "2017-07-14T02:40:00.123Z" {
+		t.Errorf("Expected: 2017-07-14T02:40:00.123Z, but: was %v", v)
+	}
+	rule.EpochLayout = "2006-01-02 15:04:05"
+	if v := r.makeReqColumnData(rule, &created, int64(1500000000123)); v != "2017-07-14 02:40:00" {
+		t.Errorf("Expected: 2017-07-14 02:40:00, but: was %v", v)
+	}
+
+	if types := typesValue(rule); types != `{"created_at":"datetime","id":"int"}` {
+		t.Errorf("Expected: created_at datetime, but: was %s", types)
+	}
+
+	if err := rule.checkEpochColumns(); err != nil {
+		t.Errorf("Expected: no error, but: was %v", err)
+	}
+	rule.TableInfo.Columns[1] = schema.TableColumn{Name: "created_at", Type: schema.TYPE_STRING, RawType: "varchar(16)"}
+	if err := rule.checkEpochColumns(); err == nil {
+		t.Errorf("Expected: an error for a varchar epoch column, but: was nil")
+	}
+	rule.EpochColumns = []string{"updated_at"}
+	if err := rule.checkEpochColumns(); err == nil {
+		t.Errorf("Expected: an error for an unknown epoch column, but: was nil")
+	}
+}
+
+func TestListColumns(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.ListColumns = []string{"tags"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	tags := schema.TableColumn{Name: "tags", Type: schema.TYPE_STRING, RawType: "varchar(255)"}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, tags},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	for value, expect := range map[string]string{"a, b,,c": `["a","b","c"]`, "a": `["a"]`, "": `[]`} {
+		if v := r.makeReqColumnData(rule, &tags, value); v != expect {
+			t.Errorf("Value: %v, Expected: %s, but: was %v", value, expect, v)
+		}
+	}
+	if v := r.makeReqColumnData(rule, &tags, []byte("x,y")); v != `["x","y"]` {
+		t.Errorf("Expected: [\"x\",\"y\"], but: was %v", v)
+	}
+
+	rule.ListFormat = ListFormatRedisSet
+	values, _, err := r.makeRowValues(rule, nil, []interface{}{1, "a,b"})
+	if err != nil || len(values) != 1 {
+		t.Errorf("Expected: only the id field, but: was %v %v", values, err)
+	}
+
+	cmds, err := r.outputCmds(rule, canal.InsertAction, "test:t1:1", []interface{}{1, "a, b"})
+	expect := []redisCmd{newRedisCmd("DEL", "test:t1:1:tags"), newRedisCmd("SADD", "test:t1:1:tags", "a", "b")}
+	if err != nil || !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v %v", expect, cmds, err)
+	}
+
+	if err := rule.checkListColumns(); err != nil {
+		t.Errorf("Expected: no error, but: was %v", err)
+	}
+	rule.TableInfo.Columns[1] = schema.TableColumn{Name: "tags", Type: schema.TYPE_NUMBER, RawType: "int(11)"}
+	if err := rule.checkListColumns(); err == nil {
+		t.Errorf("Expected: an error for an int list column, but: was nil")
+	}
+	rule.ListColumns = []string{"labels"}
+	if err := rule.checkListColumns(); err == nil {
+		t.Errorf("Expected: an error for an unknown list column, but: was nil")
+	}
+}
+
+func TestCheckCharset(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	name := schema.TableColumn{Name: "name", Type: schema.TYPE_STRING, RawType: "varchar(64)", Collation: "utf8mb4_general_ci"}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			name,
+			{Name: "title", Type: schema.TYPE_STRING, RawType: "varchar(64)", Collation: "utf8mb3_general_ci"},
+		},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	if v := r.makeReqColumnData(rule, &name, []byte("ok \xf0\x9f\x98\x80")); v != "ok 😀" {
+		t.Errorf("Expected: ok 😀, but: was %v", v)
+	}
+
+	if c := new(Config); c.myCharset() != "utf8mb4" {
+		t.Errorf("Expected: utf8mb4, but: was %s", c.myCharset())
+	}
+	if warnings := checkCharset(rule, "utf8mb4"); len(warnings) != 0 {
+		t.Errorf("Expected: no warnings, but: was %v", warnings)
+	}
+	if warnings := checkCharset(rule, "utf8"); len(warnings) != 1 || !strings.Contains(warnings[0], "column name is utf8mb4") {
+		t.Errorf("Expected: the utf8mb4 warning, but: was %v", warnings)
+	}
+
+	rule.Charset = "latin1"
+	if warnings := checkCharset(rule, "utf8mb4"); len(warnings) != 2 {
+		t.Errorf("Expected: 2 rule charset warnings, but: was %v", warnings)
+	}
+}
+
+func TestChunkOversize(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.MaxFieldBytes = 4
+	rule.OversizePolicy = OversizePolicyChunk
+	rule.ChunkBytes = 3
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "body", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	cmds, err := r.upsertRowCmds(rule, "test:t1:1", nil, []interface{}{1, "abcdefg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []redisCmd{
+		newRedisCmd("DEL", "{test:t1:1}:body:chunks"),
+		newRedisCmd("RPUSH", "{test:t1:1}:body:chunks", "abc"),
+		newRedisCmd("RPUSH", "{test:t1:1}:body:chunks", "def"),
+		newRedisCmd("RPUSH", "{test:t1:1}:body:chunks", "g"),
+	}
+	if len(cmds) != 5 || !reflect.DeepEqual(cmds[:4], expect) {
+		t.Fatalf("Expected: %v and HMSET, but: was %v", expect, cmds)
+	}
+	manifest := `{"key":"{test:t1:1}:body:chunks","chunks":3,"bytes":7}`
+	hmset := fmt.Sprint(cmds[4].Args)
+	if cmds[4].Name != "HMSET" || !strings.Contains(hmset, manifest) {
+		t.Errorf("Expected: HMSET with %s, but: was %s %s", manifest, cmds[4].Name, hmset)
+	}
+
+	// an unchunked value leaves the lists alone
+	cmds, err = r.upsertRowCmds(rule, "test:t1:1", nil, []interface{}{1, "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 1 || cmds[0].Name != "HMSET" {
+		t.Errorf("Expected: only HMSET, but: was %v", cmds)
+	}
+
+	cmds = deleteRowCmds(rule, "test:t1:1")
+	if len(cmds) != 2 || !reflect.DeepEqual(cmds[0], expect[0]) {
+		t.Errorf("Expected: %v and HDEL, but: was %v", expect[0], cmds)
+	}
+
+	if key := chunkKey("{user:1}:t1", "body"); key != "{user:1}:t1:body:chunks" {
+		t.Errorf("Expected: {user:1}:t1:body:chunks, but: was %s", key)
+	}
+	if !isChunkKey("{test:t1:1}:body:chunks", map[string]bool{"test:t1:1": true}) {
+		t.Errorf("Expected: {test:t1:1}:body:chunks a chunk key, but: was not")
+	}
+
+	// the stream has no lists to chunk to
+	rule.Outputs = []Output{{Type: OutputStream, Key: "test:t1:stream"}}
+	cmds, err = r.outputCmds(rule, canal.InsertAction, "test:t1:1", []interface{}{1, "abcdefg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xadd := fmt.Sprint(cmds[0].Args); !strings.Contains(xadd, "body abcd") || strings.Contains(xadd, "abcdefg") {
+		t.Errorf("Expected: XADD with body abcd, but: was %s", xadd)
+	}
+}
+
+func TestIndexColumns(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.IndexColumns = []string{"status"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "status", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	tests := []struct {
+		Action string
+		Before []interface{}
+		Row    []interface{}
+		Expect []redisCmd
+	}{
+		{canal.InsertAction, nil, []interface{}{1, "active"}, []redisCmd{
+			newRedisCmd("SADD", "idx:test_river:status:active", "1"),
+		}},
+		{canal.UpdateAction, []interface{}{1, "active"}, []interface{}{1, "closed"}, []redisCmd{
+			newRedisCmd("SREM", "idx:test_river:status:active", "1"),
+			newRedisCmd("SADD", "idx:test_river:status:closed", "1"),
+		}},
+		{canal.UpdateAction, []interface{}{1, "closed"}, []interface{}{1, nil}, []redisCmd{
+			newRedisCmd("SREM", "idx:test_river:status:closed", "1"),
+		}},
+		{canal.DeleteAction, nil, []interface{}{1, "closed"}, []redisCmd{
+			newRedisCmd("SREM", "idx:test_river:status:closed", "1"),
+		}},
+	}
+	for _, test := range tests {
+		if cmds := r.indexCmds(rule, test.Action, "test:test_river:1", test.Before, test.Row); !reflect.DeepEqual(cmds, test.Expect) {
+			t.Errorf("Action: %s, Expected: %v, but: was %v", test.Action, test.Expect, cmds)
+		}
+	}
+}
+
+func TestRangeIndexColumns(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.TimeZone = "UTC"
+	rule.RangeIndexColumns = []string{"created_at", "price"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "created_at", Type: schema.TYPE_DATETIME, RawType: "datetime(3)"},
+			{Name: "price", Type: schema.TYPE_DECIMAL},
+		},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	cmds := r.rangeIndexCmds(rule, canal.InsertAction, "test:test_river:1", []interface{}{1, "2017-07-14 02:40:00.500", "9.90"})
+	expect := []redisCmd{
+		newRedisCmd("ZADD", "idx:test_river:created_at", 1500000000.5, "1"),
+		newRedisCmd("ZADD", "idx:test_river:price", 9.9, "1"),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.rangeIndexCmds(rule, canal.UpdateAction, "test:test_river:1", []interface{}{1, nil, "9.90"})
+	if !reflect.DeepEqual(cmds[0], newRedisCmd("ZREM", "idx:test_river:created_at", "1")) {
+		t.Errorf("Expected: ZREM for NULL, but: was %v", cmds)
+	}
+
+	cmds = r.rangeIndexCmds(rule, canal.DeleteAction, "test:test_river:1", []interface{}{1, "2017-07-14 02:40:00", "9.90"})
+	if len(cmds) != 2 || cmds[1].Name != "ZREM" {
+		t.Errorf("Expected: ZREM from both, but: was %v", cmds)
+	}
+}
+
+func TestUniqueColumns(t *testing.T) {
+	rule := newDefaultRule("test", "user")
+	rule.UniqueColumns = []string{"email"}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "email", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	cmds := r.lookupCmds(rule, canal.UpdateAction, "test:user:1", []interface{}{1, "a@b.com"}, []interface{}{1, "c@d.com"})
+	expect := []redisCmd{
+		newRedisCmd("EVAL", lookupDeleteScript, 1, "lookup:user:email:a@b.com", "1"),
+		newRedisCmd("SET", "lookup:user:email:c@d.com", "1"),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.lookupCmds(rule, canal.UpdateAction, "test:user:1", []interface{}{1, "c@d.com"}, []interface{}{1, "c@d.com"})
+	if !reflect.DeepEqual(cmds, expect[1:]) {
+		t.Errorf("Expected: %v, but: was %v", expect[1:], cmds)
+	}
+
+	cmds = r.lookupCmds(rule, canal.DeleteAction, "test:user:1", nil, []interface{}{1, "c@d.com"})
+	remove := []redisCmd{newRedisCmd("EVAL", lookupDeleteScript, 1, "lookup:user:email:c@d.com", "1")}
+	if !reflect.DeepEqual(cmds, remove) {
+		t.Errorf("Expected: %v, but: was %v", remove, cmds)
+	}
+
+	rule.TTL.Duration = time.Hour
+	cmds = r.lookupCmds(rule, canal.InsertAction, "test:user:2", nil, []interface{}{2, "e@f.com"})
+	ttl := []redisCmd{newRedisCmd("SET", "lookup:user:email:e@f.com", "2", "PX", int64(3600000))}
+	if !reflect.DeepEqual(cmds, ttl) {
+		t.Errorf("Expected: %v, but: was %v", ttl, cmds)
+	}
+
+	// the lookup key would have the plain value
+	rule = newDefaultRule("test", "user")
+	rule.UniqueColumns = []string{"email"}
+	rule.Transforms = map[string]string{"email": "hash"}
+	rule.MaskSalt = "salt"
+	if err := rule.prepare(new(Config)); err == nil {
+		t.Errorf("Expected: an error for a hashed unique column, but: was nil")
+	}
+}
+
+func TestTrackRows(t *testing.T) {
+	rule := newDefaultRule("test", "test_river")
+	rule.TrackRows = true
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	for action, script := range map[string]string{canal.InsertAction: trackAddScript, canal.UpdateAction: trackAddScript, canal.DeleteAction: trackRemoveScript} {
+		cmds := r.rowIndexCmds(rule, action, "test:test_river:1", nil, []interface{}{1})
+		expect := []redisCmd{newRedisCmd("EVAL", script, 2, "test:test_river:__all", "test:test_river:__count", "1")}
+		if !reflect.DeepEqual(cmds, expect) {
+			t.Errorf("Action: %s, Expected: %v, but: was %v", action, expect, cmds)
+		}
+	}
+}
+
+func TestInvalidationKeys(t *testing.T) {
+	rule := newDefaultRule("test", "user")
+	rule.Invalidations = []Invalidation{
+		{Key: "session:{id}:*", Columns: []string{"password"}},
+		{Key: "team:{team_id}:members"},
+		{Set: "idx:order:user_id:{id}", SetKeyPrefix: "test:order"},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "team_id"}, {Name: "password"}},
+		PKColumns: []int{0},
+	}
+
+	keys, sets := invalidationKeys(rule, canal.UpdateAction, []interface{}{1, 7, "a"}, []interface{}{1, 8, "a"})
+	expect := []string{"team:7:members", "team:8:members"}
+	if !reflect.DeepEqual(keys, expect) || len(sets) != 1 || sets[0].Set != "idx:order:user_id:1" {
+		t.Errorf("Expected: %v and idx:order:user_id:1, but: was %v %v", expect, keys, sets)
+	}
+
+	keys, _ = invalidationKeys(rule, canal.DeleteAction, nil, []interface{}{1, nil, "a"})
+	if !reflect.DeepEqual(keys, []string{"session:1:*"}) || !isKeyPattern(keys[0]) {
+		t.Errorf("Expected: [session:1:*], but: was %v", keys)
+	}
+
+	rule.Invalidations[1].Set = ""
+	rule.Invalidations[1].Key = ""
+	if err := rule.Invalidations[1].prepare(rule); err == nil {
+		t.Errorf("Expected: an error without key and set, but: was nil")
+	}
+}
+
+func TestTopOutput(t *testing.T) {
+	rule := newDefaultRule("test", "comment")
+	rule.TimeZone = "UTC"
+	rule.Outputs = []Output{{Type: OutputTop, Key: "test:post:{post_id}:latest", Column: "created_at", MaxLen: 100}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "post_id", Type: schema.TYPE_NUMBER},
+			{Name: "created_at", Type: schema.TYPE_DATETIME},
+		},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	cmds := r.topCmds(rule, canal.UpdateAction, "test:comment:1", []interface{}{1, 7, "2017-07-14 02:40:00"}, []interface{}{1, 8, "2017-07-14 02:40:00"})
+	expect := []redisCmd{
+		newRedisCmd("ZREM", "test:post:7:latest", "test:comment:1"),
+		newRedisCmd("ZADD", "test:post:8:latest", float64(1500000000), "test:comment:1"),
+		newRedisCmd("ZREMRANGEBYRANK", "test:post:8:latest", 0, -101),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.topCmds(rule, canal.DeleteAction, "test:comment:1", nil, []interface{}{1, 8, "2017-07-14 02:40:00"})
+	remove := []redisCmd{newRedisCmd("ZREM", "test:post:8:latest", "test:comment:1")}
+	if !reflect.DeepEqual(cmds, remove) {
+		t.Errorf("Expected: %v, but: was %v", remove, cmds)
+	}
+
+	rule.Outputs[0].MaxLen = 0
+	if err := rule.Outputs[0].prepare(rule); err == nil {
+		t.Errorf("Expected: an error without max_len, but: was nil")
+	}
+}
+
+func TestRollup(t *testing.T) {
+	rule := newDefaultRule("test", "orders")
+	rule.TimeZone = "UTC"
+	rule.Rollups = []Rollup{{Key: "stats:orders:{bucket}", Column: "created_at", Count: "count", Sum: map[string]string{"revenue": "amount"}}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "created_at", Type: schema.TYPE_DATETIME},
+			{Name: "amount", Type: schema.TYPE_DECIMAL},
+		},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	cmds := r.rollupCmds(rule, canal.InsertAction, nil, []interface{}{1, "2024-06-01 10:00:00", "9.90"})
+	expect := []redisCmd{
+		newRedisCmd("HINCRBY", "stats:orders:2024-06-01", "count", 1),
+		newRedisCmd("HINCRBYFLOAT", "stats:orders:2024-06-01", "revenue", "9.9"),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.rollupCmds(rule, canal.UpdateAction, []interface{}{1, "2024-06-01 10:00:00", "9.90"}, []interface{}{1, "2024-06-02 10:00:00", "9.90"})
+	expect = []redisCmd{
+		newRedisCmd("HINCRBY", "stats:orders:2024-06-01", "count", -1),
+		newRedisCmd("HINCRBYFLOAT", "stats:orders:2024-06-01", "revenue", "-9.9"),
+		newRedisCmd("HINCRBY", "stats:orders:2024-06-02", "count", 1),
+		newRedisCmd("HINCRBYFLOAT", "stats:orders:2024-06-02", "revenue", "9.9"),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	// a rewrite of the row, like a repair, does not count it again
+	cmds, err := r.upsertRowAllCmds(rule, canal.InsertAction, "test:orders:1", nil, []interface{}{1, "2024-06-01 10:00:00", "9.90"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd.Name, "HINCRBY") {
+			t.Errorf("Expected: no rollup command on a rewrite, but: was %v", cmd)
+		}
+	}
+
+	rule.Rollups[0].TTL.Duration = 500 * time.Millisecond
+	if err := rule.Rollups[0].prepare(rule); err == nil {
+		t.Errorf("Expected: an error for ttl 500ms, but: was nil")
+	}
+	rule.Rollups[0].TTL.Duration = 0
+
+	rule.Rollups[0].Bucket = "week"
+	if err := rule.Rollups[0].prepare(rule); err == nil {
+		t.Errorf("Expected: an error for bucket week, but: was nil")
+	}
+}
+
+func TestJoinOutput(t *testing.T) {
+	rule := newDefaultRule("test", "post_tag")
+	rule.Outputs = []Output{
+		{Type: OutputJoin, Key: "post:{post_id}:tags", Column: "tag"},
+		{Type: OutputJoin, Key: "tag:{tag}:posts", Column: "post_id"},
+	}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "post_id", Type: schema.TYPE_NUMBER}, {Name: "tag", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0, 1},
+	}
+
+	r := new(River)
+	cmds := r.joinCmds(rule, canal.InsertAction, nil, []interface{}{1, "go"})
+	expect := []redisCmd{newRedisCmd("SADD", "post:1:tags", "go"), newRedisCmd("SADD", "tag:go:posts", "1")}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.joinCmds(rule, canal.UpdateAction, []interface{}{1, "go"}, []interface{}{1, "rust"})
+	expect = []redisCmd{
+		newRedisCmd("SREM", "post:1:tags", "go"),
+		newRedisCmd("SADD", "post:1:tags", "rust"),
+		newRedisCmd("SREM", "tag:go:posts", "1"),
+		newRedisCmd("SADD", "tag:rust:posts", "1"),
+	}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+
+	cmds = r.joinCmds(rule, canal.DeleteAction, nil, []interface{}{1, "rust"})
+	expect = []redisCmd{newRedisCmd("SREM", "post:1:tags", "rust"), newRedisCmd("SREM", "tag:rust:posts", "1")}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, cmds)
+	}
+}
+
+func TestVersionField(t *testing.T) {
+	if v := binlogVersion(mysql.Position{Name: "mysql-bin.000002", Pos: 120}); v != 2<<32|120 {
+		t.Errorf("Expected: %d, but: was %d", int64(2<<32|120), v)
+	}
+	if binlogVersion(mysql.Position{Name: "mysql-bin.000002", Pos: 4}) <= binlogVersion(mysql.Position{Name: "mysql-bin.000001", Pos: 1 << 30}) {
+		t.Errorf("Expected: the version to increase with the binlog file")
+	}
+
+	rule := newDefaultRule("test", "t1")
+	rule.VersionField = "_version"
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	r.version = 42
+	values, _, err := r.makeRowValues(rule, []interface{}{1, "a"}, []interface{}{1, "b"})
+	if err != nil || values["_version"] != int64(42) {
+		t.Errorf("Expected: _version 42, but: was %v %v", values, err)
+	}
+	values, _, _ = r.makeRowValues(rule, []interface{}{1, "b"}, []interface{}{1, "b"})
+	if len(values) != 0 {
+		t.Errorf("Expected: no values for an unchanged row, but: was %v", values)
+	}
+
+	// a repair without an event keeps the version
+	r.version = 0
+	values, _, _ = r.makeRowValues(rule, nil, []interface{}{1, "b"})
+	if _, ok := values["_version"]; ok || len(values) == 0 {
+		t.Errorf("Expected: no _version for a repair, but: was %v", values)
+	}
+}
+
+func TestAccountWrite(t *testing.T) {
+	cmds := []redisCmd{
+		newRedisCmd("HMSET", "test:t1:1", "name", "abc"),
+		newRedisCmd("EXPIRE", "test:t1:1", 60),
+	}
+	if n := cmdsSize(cmds); n != 27 {
+		t.Errorf("Expected: 27, but: was %d", n)
+	}
+
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	r.accountWrite(rule, cmds)
+	r.accountWrite(rule, cmds[:1])
+	if n := r.st.WrittenBytes.Get(); n != 43 {
+		t.Errorf("Expected: 43, but: was %d", n)
+	}
+	if n := r.st.Rule(rule).WrittenBytes.Get(); n != 43 {
+		t.Errorf("Expected: 43, but: was %d", n)
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "name", Type: schema.TYPE_STRING}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	r.st = &stat{}
+	row := []interface{}{int64(1), "a"}
+
+	m, err := r.checkHash(rule, "test:t1:1", row, map[string]string{"id": "1", "name": "a"})
+	if err != nil || m != nil {
+		t.Errorf("Expected: no mismatch, but: was %v %v", m, err)
+	}
+	m, _ = r.checkHash(rule, "test:t1:1", row, map[string]string{"id": "1", "name": "b"})
+	if m == nil || m.Kind != MismatchFields || len(m.Fields) != 1 || m.Fields[0] != "name" {
+		t.Errorf("Expected: name differs, but: was %v", m)
+	}
+	m, _ = r.checkHash(rule, "test:t1:1", row, nil)
+	if m == nil || m.Kind != MismatchMissing {
+		t.Errorf("Expected: missing, but: was %v", m)
+	}
+	m, _ = r.checkHash(rule, "test:t1:1", nil, map[string]string{"id": "1"})
+	if m == nil || m.Kind != MismatchExtra {
+		t.Errorf("Expected: extra, but: was %v", m)
+	}
+	m, _ = r.checkHash(rule, "test:t1:1", nil, map[string]string{"other": "1"})
+	if m != nil {
+		t.Errorf("Expected: no mismatch for the fields of others, but: was %v", m)
+	}
+
+	if pks, ok := keyPKValues(rule, "test:t1:1"); !ok || len(pks) != 1 || pks[0] != "1" {
+		t.Errorf("Expected: [1], but: was %v %v", pks, ok)
+	}
+	for _, test := range []struct {
+		Value  interface{}
+		Expect string
+	}{
+		{1e6, "1e+06"},
+		{1.5, "1.5"},
+		{float32(1e6), "1e+06"},
+		{strictValue(1e6), "1000000"},
+		{decimalValue(1e21), "1000000000000000000000"},
+		{true, "1"},
+		{nil, ""},
+	} {
+		if s := redisString(test.Value); s != test.Expect {
+			t.Errorf("Expected: %s, but: was %s", test.Expect, s)
+		}
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	r := new(River)
+	r.c = &Config{CheckRepairRate: 50}
+
+	p := r.newRepairer(nil)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("Expected: at least 40ms for 3 repairs at 50/s, but: was %s", d)
+	}
+
+	report := &CheckReport{max: 1, repair: p}
+	report.add(Mismatch{Rule: "test.t1", Key: "test:t1:1", Kind: MismatchMissing, Repaired: true})
+	report.add(Mismatch{Rule: "test.t1", Key: "test:t1:2", Kind: MismatchExtra})
+	if report.Missing != 1 || report.Extra != 1 || report.Repaired != 1 || len(report.Mismatches) != 1 {
+		t.Errorf("Expected: 1 missing, 1 extra, 1 repaired and 1 kept, but: was %+v", report)
+	}
+
+	var buf bytes.Buffer
+	report.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "test.t1 missing test:t1:1 repaired\n") || !strings.Contains(buf.String(), "repaired:1\n") {
+		t.Errorf("Expected: the repaired key in the report, but: was %s", buf.String())
+	}
+
+	// the repairs are written on the connection of Check, not of the sync
+	l := serveTestRedis(t, func() string { return "*1\r\n+OK" })
+	defer l.Close()
+	conn, err := redis.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p = r.newRepairer(conn)
+	if err = p.write([]redisCmd{newRedisCmd("HMSET", "test:t1:1", "id", 1), newRedisCmd("SADD", "test:t1", "1")}); err != nil {
+		t.Errorf("Expected: the repair written, but: was %v", err)
+	}
+}
+
+func TestCheckChecksum(t *testing.T) {
+	a := hashChecksum("test:t1:1", map[string]string{"id": "1", "name": "a"})
+	if b := hashChecksum("test:t1:1", map[string]string{"name": "a", "id": "1"}); a != b {
+		t.Errorf("Expected: %d, but: was %d", a, b)
+	}
+	if b := hashChecksum("test:t1:1", map[string]string{"id": "1", "name": "b"}); a == b {
+		t.Errorf("Expected: the checksum to change with a value")
+	}
+
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	if key := pkKey(rule, []interface{}{int64(1), "a"}); key != "test:t1:1:a" {
+		t.Errorf("Expected: test:t1:1:a, but: was %s", key)
+	}
+	if !rule.hasPKKeys() {
+		t.Errorf("Expected: the keys of the primary keys")
+	}
+
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info, err := loadCheckInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := checkChunkSum{Upper: "[1000]", MySQL: 1, Redis: 2}
+	name := chunkName(rule, nil)
+	info.verify(name, sum)
+	if err := info.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = loadCheckInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.unchanged(name, sum) {
+		t.Errorf("Expected: the chunk unchanged, but: was %v", info.Chunks)
+	}
+	sum.Redis = 3
+	if info.unchanged(name, sum) {
+		t.Errorf("Expected: the chunk changed in Redis")
+	}
+}
+
+func TestVerifyRing(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	v := newVerifyRing(4)
+	for i := 0; i < 6; i++ {
+		v.Add(verifyKey{rule: rule, key: fmt.Sprintf("test:t1:%d", i), pks: []interface{}{i}})
+	}
+
+	keys := v.Sample(3)
+	if len(keys) != 3 {
+		t.Fatalf("Expected: 3 keys, but: was %d", len(keys))
+	}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if k.key == "test:t1:0" || k.key == "test:t1:1" || seen[k.key] {
+			t.Errorf("Expected: distinct keys of the last 4, but: was %s", k.key)
+		}
+		seen[k.key] = true
+	}
+
+	if keys := v.Sample(3); len(keys) != 0 {
+		t.Errorf("Expected: no keys after a sample, but: was %d", len(keys))
+	}
+	v.Add(verifyKey{rule: rule, key: "test:t1:6"})
+	if keys := v.Sample(3); len(keys) != 1 || keys[0].key != "test:t1:6" {
+		t.Errorf("Expected: test:t1:6, but: was %v", keys)
+	}
+}
+
+func TestReapRowKey(t *testing.T) {
+	rule := newDefaultRule("test", "t1")
+	rule.OversizePolicy = OversizePolicyChunk
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "name"}},
+		PKColumns: []int{0},
+	}
+
+	for key, expected := range map[string]bool{
+		"test:t1:1":             true,
+		"test:t1:__all":         false,
+		"test:t1:__count":       false,
+		"test:t1:1:body:chunks": false,
+	} {
+		if ok := isRowKey(rule, key); ok != expected {
+			t.Errorf("Expected: %s row key %v, but: was %v", key, expected, ok)
+		}
+	}
+
+	if pks, ok := keyPKValues(rule, "test:t2:1"); ok {
+		t.Errorf("Expected: no PK values of another prefix, but: was %v", pks)
+	}
+	rule.KeyColumns = []string{"name"}
+	if rule.hasPKKeys() {
+		t.Errorf("Expected: no PK keys with key_columns")
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := &snapshot{
+		snapshotHeader: snapshotHeader{Rule: "test.t1", Time: time.Now()},
+		keys: map[string]map[string]string{
+			"test:t1:1": {"id": "1", "name": "a"},
+			"test:t1:2": {"id": "2", "name": "b"},
+		},
+	}
+	cur := &snapshot{
+		snapshotHeader: snapshotHeader{Rule: "test.t1", Time: time.Now()},
+		keys: map[string]map[string]string{
+			"test:t1:1": {"id": "1", "name": "c"},
+			"test:t1:3": {"id": "3", "name": "d"},
+		},
+	}
+	oldPath, curPath := dir+"/old.jsonl", dir+"/cur.jsonl"
+	if err := old.save(oldPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.save(curPath); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffSnapshotFiles(oldPath, curPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"test.t1 fields test:t1:1 name",
+		"test.t1 missing test:t1:2",
+		"test.t1 extra test:t1:3",
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("Expected: %v, but: was %v", expected, diff)
+	}
+	for i, m := range diff {
+		if m.String() != expected[i] {
+			t.Errorf("Expected: %s, but: was %s", expected[i], m)
+		}
+	}
+
+	if diff, err := DiffSnapshotFiles(oldPath, oldPath); err != nil || len(diff) != 0 {
+		t.Errorf("Expected: no differences, but: was %v %v", diff, err)
+	}
+}
+
+func TestLiveSnapshot(t *testing.T) {
+	// a Redis with no keys, the sync connection is not used
+	l := serveTestRedis(t, func() string { return "*2\r\n$1\r\n0\r\n*0" })
+	defer l.Close()
+
+	rule := newDefaultRule("test", "t1")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	r := new(River)
+	r.c = &Config{RedisAddr: l.Addr().String()}
+	r.rules = map[string]*Rule{ruleKey("test", "t1"): rule}
+
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if n, err := r.ExportSnapshot(context.Background(), "test.t1", dir+"/t1.jsonl"); err != nil || n != 0 {
+		t.Errorf("Expected: no keys exported, but: was %d %v", n, err)
+	}
+}
+
+func TestObserveProbe(t *testing.T) {
+	rule := newDefaultRule("test", "river_probe")
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = &schema.Table{
+		Columns:   []schema.TableColumn{{Name: "id"}, {Name: "ts"}},
+		PKColumns: []int{0},
+	}
+
+	r := new(River)
+	r.c = &Config{ServerID: 1001, ProbeTable: "test.river_probe"}
+	r.st = &stat{probeLatency: newHistogram(probeLatencyBuckets)}
+	r.probeRule = rule
+
+	ts := time.Now().Add(-2 * time.Second).UnixNano()
+	r.observeProbe(rule, []interface{}{int64(1002), ts})
+	if n := r.st.ProbeLatency.Get(); n != 0 {
+		t.Errorf("Expected: the probe of another river ignored, but: was %d", n)
+	}
+
+	r.observeProbe(rule, []interface{}{int64(1001), ts})
+	if n := r.st.ProbeLatency.Get(); n < 2000 || n > 10000 {
+		t.Errorf("Expected: about 2000ms, but: was %d", n)
+	}
+}
+
+type testRedisReader map[string]string
+
+func (m testRedisReader) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if v, ok := m[fmt.Sprint(args...)]; ok {
+		return []byte(v), nil
+	}
+	return nil, nil
+}
+
+func TestScriptVerify(t *testing.T) {
+	f, err := ioutil.TempFile("", "transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`
+function transform(action, schema, table, before, after, key)
+	return {{"SET", "user:" .. after.id, after.name}}
+end
+
+function verify(schema, table, row, key)
+	local name = redis_call("GET", "user:" .. key)
+	if row == nil then
+		if name ~= nil then
+			return {"user:" .. key}
+		end
+		return nil
+	end
+	if name ~= row.name then
+		return {"user:" .. key}
+	end
+	return nil
+end
+`)
+	f.Close()
+
+	s, err := newScript(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.canVerify() {
+		t.Fatal("Expected: the script to verify")
+	}
+
+	rd := testRedisReader{"user:1": "a"}
+	diffs, err := s.verify("test", "t1", map[string]interface{}{"id": "1", "name": "a"}, "1", rd)
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("Expected: no differences, but: was %v %v", diffs, err)
+	}
+	diffs, _ = s.verify("test", "t1", map[string]interface{}{"id": "1", "name": "b"}, "1", rd)
+	if len(diffs) != 1 || diffs[0] != "user:1" {
+		t.Errorf("Expected: [user:1], but: was %v", diffs)
+	}
+	diffs, _ = s.verify("test", "t1", nil, "1", rd)
+	if len(diffs) != 1 {
+		t.Errorf("Expected: [user:1] for a gone row, but: was %v", diffs)
+	}
+
+	ro := readOnlyRedis(func(cmd string, args ...interface{}) (interface{}, error) { return nil, nil })
+	if _, err := ro.Do("del", "user:1"); err == nil {
+		t.Errorf("Expected: DEL not allowed to verify")
+	}
+	if _, err := ro.Do("acl", "setuser", "river", "on"); err == nil {
+		t.Errorf("Expected: ACL not allowed to verify")
+	}
+	for _, cmd := range []string{"get", "zscore", "sismember", "hmget", "llen", "xlen"} {
+		if _, err := ro.Do(cmd, "user:1"); err != nil {
+			t.Errorf("Expected: %s allowed to verify, but: was %v", cmd, err)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river_pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := new(River)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = &stat{}
+	r.audit = newAuditLog(&Config{AuditLog: dir + "/audit.log"})
+
+	ctx := context.Background()
+	r.Pause(ctx, AuditSourceAPI)
+	r.Pause(ctx, AuditSourceAPI)
+	if st := r.Status(); !st.Paused || r.st.Paused.Get() != 1 {
+		t.Fatalf("Expected: paused, but: was %v", st.Paused)
+	}
+
+	done := make(chan bool)
+	go func() { done <- r.waitResume() }()
+	select {
+	case <-done:
+		t.Fatal("Expected: blocked while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.Resume(ctx, "http 10.0.0.1")
+	if ok := <-done; !ok {
+		t.Errorf("Expected: true after Resume, but: was %v", ok)
+	}
+	if r.Status().Paused {
+		t.Errorf("Expected: not paused after Resume")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := r.Pause(canceled, AuditSourceAPI); err == nil || r.Paused() {
+		t.Errorf("Expected: not paused with a done ctx, but: was %v", err)
+	}
+	r.Pause(ctx, AuditSourceSignal)
+	go func() { done <- r.waitResume() }()
+	r.cancel()
+	if ok := <-done; ok {
+		t.Errorf("Expected: false after close, but: was %v", ok)
+	}
+
+	r.audit.Close()
+	data, _ := ioutil.ReadFile(dir + "/audit.log")
+	if n := strings.Count(string(data), `"op":"pause"`); n != 2 || strings.Count(string(data), `"op":"resume"`) != 1 {
+		t.Errorf("Expected: 2 pauses and 1 resume audited, but: was %s", data)
+	}
+	if !strings.Contains(string(data), `"source":"http 10.0.0.1"`) || !strings.Contains(string(data), `"source":"signal"`) {
+		t.Errorf("Expected: the sources audited, but: was %s", data)
+	}
+
+	rule := &Rule{Schema: "test", Table: "t1"}
+	r.st.Rule(rule).InsertNum.Add(2)
+	if st := r.Status(); st.Rules["test.t1"].InsertNum != 2 {
+		t.Errorf("Expected: 2 inserts of test.t1, but: was %v", st.Rules)
+	}
+}
+
+func TestDeadLetterRows(t *testing.T) {
+	l := deadLetter{Rows: encodeDeadLetterRows([][]interface{}{{int64(1), []byte("blob\x00"), "text", 1.5, nil}})}
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d deadLetter
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if err = decodeDeadLetterRows(d.Rows); err != nil {
+		t.Fatal(err)
+	}
+	expect := []interface{}{int64(1), []byte("blob\x00"), "text", "1.5", nil}
+	if !reflect.DeepEqual(d.Rows[0], expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, d.Rows[0])
+	}
+
+	rule := &Rule{keyPrefix: "a"}
+	other := &Rule{keyPrefix: "b"}
+	rule.overlaps = []*Rule{other}
+	if r, ok := deadLetterRule(rule, &deadLetter{Rule: "b"}); !ok || r != other {
+		t.Errorf("Expected: the overlapping rule b, but: was %v %v", r, ok)
+	}
+	if r, ok := deadLetterRule(rule, &deadLetter{}); !ok || r != rule {
+		t.Errorf("Expected: the first rule without a rule, but: was %v %v", r, ok)
+	}
+	if _, ok := deadLetterRule(rule, &deadLetter{Rule: "c"}); ok {
+		t.Errorf("Expected: no rule c")
+	}
+
+	rule = &Rule{Schema: "test", Table: "t1", keyPrefix: "a"}
+	other = &Rule{Schema: "test", Table: "t2", keyPrefix: "a"}
+	riv := &River{rules: map[string]*Rule{ruleKey("test", "t1"): rule, ruleKey("test", "t2"): other}}
+	if r, err := riv.ruleOfDeadLetter(&deadLetter{Schema: "test", Table: "t1", Rule: "a", RuleName: "test.t2"}); err != nil || r != other {
+		t.Errorf("Expected: the rule test.t2, but: was %v %v", r, err)
+	}
+	if r, err := riv.ruleOfDeadLetter(&deadLetter{Schema: "test", Table: "t1", Rule: "a"}); err != nil || r != rule {
+		t.Errorf("Expected: the rule of the table without a rule name, but: was %v %v", r, err)
+	}
+	if _, err := riv.ruleOfDeadLetter(&deadLetter{Schema: "test", Table: "t1", Rule: "a", RuleName: "test.t3"}); errors.Cause(err) != ErrRuleNotExist {
+		t.Errorf("Expected: %v, but: was %v", ErrRuleNotExist, err)
+	}
+}
+
+// serveTestRedis serves the replies of reply to any command, closing the
+// connection on an empty reply.
+func serveTestRedis(t *testing.T, reply func() string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					if reply() == "" {
+						return
+					}
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					// skip the arguments, without new lines in the tests
+					n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+					for i := 0; i < 2*n; i++ {
+						rd.ReadString('\n')
+					}
+					conn.Write([]byte(reply() + "\r\n"))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestReplayGuard(t *testing.T) {
+	l := serveTestRedis(t, func() string {
+		return "*4\r\n$4\r\nname\r\n$16\r\nmysql-bin.000002\r\n$3\r\npos\r\n$3\r\n120"
+	})
+	defer l.Close()
+
+	var err error
+	r := new(River)
+	r.c = &Config{ServerID: 1001, RedisMaxRetries: -1}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+	if r.redisConn, err = redis.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.redisConn.Close()
+
+	if err = r.loadWatermark(); err != nil || len(r.watermark.Name) > 0 {
+		t.Errorf("Expected: no watermark without replay_guard, but: was %v %v", r.watermark, err)
+	}
+
+	r.c.ReplayGuard = true
+	if err = r.loadWatermark(); err != nil {
+		t.Fatal(err)
+	}
+	if r.c.ReplayGuardKey != "river:watermark:1001" || r.watermark != (mysql.Position{Name: "mysql-bin.000002", Pos: 120}) {
+		t.Errorf("Expected: the watermark in river:watermark:1001, but: was %v in %s", r.watermark, r.c.ReplayGuardKey)
+	}
+
+	// without a canal the events are of no binlog file, before the watermark
+	dump := &canal.RowsEvent{Action: canal.InsertAction}
+	binlog := &canal.RowsEvent{Action: canal.InsertAction, Header: &replication.EventHeader{LogPos: 100}}
+	if r.isReplayed(dump) {
+		t.Errorf("Expected: the dumped rows not replayed, but: were")
+	}
+	if !r.isReplayed(binlog) {
+		t.Errorf("Expected: the rows before the watermark replayed, but: were not")
+	}
+
+	// the selected server_id changes on restart
+	c := &Config{MyAddr: "127.0.0.1:3306", RedisAddr: "127.0.0.1:6379", ReplayGuard: true}
+	if err := c.validate(true); err == nil || !strings.Contains(err.Error(), "replay_guard_key must be set") {
+		t.Errorf("Expected: replay_guard_key required without server_id, but: was %v", err)
+	}
+	c.ReplayGuardKey = "river:watermark"
+	if err := c.validate(true); err != nil {
+		t.Errorf("Expected: no error, but: was %v", err)
+	}
+	c.ReplayGuardKey, c.ServerID = "", 1001
+	if err := c.validate(true); err != nil {
+		t.Errorf("Expected: no error, but: was %v", err)
+	}
+}
+
+func TestRedisCircuitBreaker(t *testing.T) {
+	// a Redis closing the connections while down, else replying OK
+	var up sync2.AtomicBool
+	l := serveTestRedis(t, func() string {
+		if !up.Get() {
+			return ""
+		}
+		return "+OK"
+	})
+	defer l.Close()
+
+	var err error
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}}, PKColumns: []int{0}}
+	if err = rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.ErrorPolicy = ErrorPolicySkip
+
+	r := new(River)
+	r.c = &Config{
+		RedisAddr:                 l.Addr().String(),
+		RedisMaxRetries:           -1,
+		RedisCircuitBreaker:       true,
+		RedisCircuitProbeInterval: TomlDuration{time.Millisecond},
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+	r.SetRowMapper(testRowMapper{})
+	if r.redisConn, err = redis.Dial("tcp", r.c.RedisAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rows are applied again once Redis is back
+	h := &eventHandler{r}
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: [][]interface{}{{1, "a"}}}
+	time.AfterFunc(20*time.Millisecond, func() { up.Set(true) })
+	if err = h.onRuleRows(rule, e); err != nil {
+		t.Fatal(err)
+	}
+	if r.st.InsertNum.Get() != 1 || r.st.RedisCircuitOpenNum.Get() != 1 || r.st.RedisCircuitOpen.Get() != 0 {
+		t.Errorf("Expected: 1 insert after the circuit closed, but: was %d", r.st.InsertNum.Get())
+	}
+	if r.st.WrittenBytes.Get() == 0 || r.st.Rule(rule).WrittenBytes.Get() == 0 {
+		t.Errorf("Expected: the mapped row written bytes, but: was %d", r.st.WrittenBytes.Get())
+	}
+
+	// closed while the circuit is open, the rows are neither applied nor skipped
+	up.Set(false)
+	r.redisConn.Close()
+	time.AfterFunc(20*time.Millisecond, r.cancel)
+	if err = h.onRuleRows(rule, e); err != context.Canceled {
+		t.Errorf("Expected: context canceled, but: was %v", err)
+	}
+	if n := r.st.SkipNum.Get(); n != 0 || r.st.InsertNum.Get() != 1 {
+		t.Errorf("Expected: no rows skipped, but: was %d skipped", n)
+	}
+}
+
+func TestRedisOOMClose(t *testing.T) {
+	l := serveTestRedis(t, func() string { return "-OOM command not allowed when used memory > 'maxmemory'." })
+	defer l.Close()
+
+	rule := newDefaultRule("test", "test_river")
+	rule.TableInfo = &schema.Table{Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}}, PKColumns: []int{0}}
+	if err := rule.prepare(new(Config)); err != nil {
+		t.Fatal(err)
+	}
+	rule.ErrorPolicy = ErrorPolicySkip
+
+	r := new(River)
+	r.c = &Config{
+		RedisAddr:                 l.Addr().String(),
+		RedisOOMPolicy:            RedisOOMPolicyPause,
+		RedisCircuitProbeInterval: TomlDuration{time.Millisecond},
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.st = newStat(r)
+	r.SetRowMapper(testRowMapper{})
+	var err error
+	if r.redisConn, err = redis.Dial("tcp", r.c.RedisAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed while paused for memory, the rows are neither applied nor skipped
+	time.AfterFunc(20*time.Millisecond, r.cancel)
+	h := &eventHandler{r}
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: [][]interface{}{{1, "a"}}}
+	if err = h.onRuleRows(rule, e); err != context.Canceled {
+		t.Errorf("Expected: context canceled, but: was %v", err)
+	}
+	if n := r.st.SkipNum.Get(); n != 0 || r.st.RedisOOMNum.Get() != 1 {
+		t.Errorf("Expected: no rows skipped, but: was %d skipped", n)
+	}
+}
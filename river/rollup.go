@@ -0,0 +1,146 @@
+package river
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// Buckets of the rollups.
+const (
+	RollupBucketHour  = "hour"
+	RollupBucketDay   = "day"
+	RollupBucketMonth = "month"
+)
+
+var rollupLayouts = map[string]string{
+	RollupBucketHour:  "2006-01-02T15",
+	RollupBucketDay:   "2006-01-02",
+	RollupBucketMonth: "2006-01",
+}
+
+// Rollup aggregates the rows into the hashes of time buckets, like the
+// number and the revenue of the orders of each day in stats:orders:<day>.
+// Inserted rows are added, deleted rows are subtracted, and updated rows
+// are subtracted before and added after the change. The increments are not
+// idempotent, so a repair or a rewrite of the skip write_policy leaves the
+// buckets alone, but an event applied again, like a replayed dead letter or
+// the events after a restart from an older position, is counted twice.
+type Rollup struct {
+	// Key is the hash of the bucket, {bucket} is replaced by the bucket of
+	// the time column like 2024-06-01, and {column} by the row values.
+	Key string `toml:"key"`
+
+	// Column is the DATETIME, TIMESTAMP, DATE or epoch column of the time
+	// of the rows, Bucket is hour, day or month.
+	Column string `toml:"column"`
+	Bucket string `toml:"bucket"`
+
+	// Count is the field counting the rows, none if empty.
+	Count string `toml:"count"`
+
+	// Sum maps the fields to the number columns they sum, like revenue = "amount".
+	Sum map[string]string `toml:"sum"`
+
+	// TTL expires the buckets after the duration since their last change,
+	// default never.
+	TTL TomlDuration `toml:"ttl"`
+}
+
+func (ro *Rollup) prepare(r *Rule) error {
+	if len(ro.Key) == 0 || len(ro.Column) == 0 {
+		return errors.Errorf("%s.%s key and column must be set for rollup", r.Schema, r.Table)
+	}
+	if !strings.Contains(ro.Key, "{bucket}") {
+		return errors.Errorf("%s.%s rollup key %s must contain {bucket}", r.Schema, r.Table, ro.Key)
+	}
+	switch ro.Bucket {
+	case "":
+		ro.Bucket = RollupBucketDay
+	case RollupBucketHour, RollupBucketDay, RollupBucketMonth:
+	default:
+		return errors.Errorf("%s.%s invalid rollup bucket %s, must be hour, day or month", r.Schema, r.Table, ro.Bucket)
+	}
+	if len(ro.Count) == 0 && len(ro.Sum) == 0 {
+		return errors.Errorf("%s.%s count or sum must be set for rollup", r.Schema, r.Table)
+	}
+	if ro.TTL.Duration > 0 && ro.TTL.Duration < time.Second {
+		return errors.Errorf("%s.%s rollup ttl %s must be at least 1s", r.Schema, r.Table, ro.TTL.Duration)
+	}
+	ro.Key = r.replaceKey(ro.Key)
+	return nil
+}
+
+// bucketKey returns the hash of the bucket of the row, empty for a row
+// without time or a NULL key column.
+func (ro *Rollup) bucketKey(rule *Rule, row []interface{}) string {
+	i := rule.TableInfo.FindColumn(ro.Column)
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	t, ok := columnTime(rule, &rule.TableInfo.Columns[i], row[i])
+	if !ok {
+		return ""
+	}
+	key := strings.Replace(ro.Key, "{bucket}", t.Format(rollupLayouts[ro.Bucket]), -1)
+	return columnKey(rule, key, row)
+}
+
+// rollupCmds returns the commands to add the row to the buckets of the
+// rollups, or subtract it for delete, before is the row before an update
+// subtracted first, nil if unknown.
+func (r *River) rollupCmds(rule *Rule, action string, before []interface{}, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	for i := range rule.Rollups {
+		ro := &rule.Rollups[i]
+		if action == canal.DeleteAction {
+			cmds = append(cmds, r.rollupRowCmds(rule, ro, row, -1)...)
+			continue
+		}
+		if before != nil {
+			cmds = append(cmds, r.rollupRowCmds(rule, ro, before, -1)...)
+		}
+		cmds = append(cmds, r.rollupRowCmds(rule, ro, row, 1)...)
+	}
+	return cmds
+}
+
+// rollupRowCmds returns the commands to add the row times the sign to its
+// bucket of the rollup.
+func (r *River) rollupRowCmds(rule *Rule, ro *Rollup, row []interface{}, sign int) []redisCmd {
+	key := ro.bucketKey(rule, row)
+	if len(key) == 0 {
+		return nil
+	}
+
+	var cmds []redisCmd
+	if len(ro.Count) > 0 {
+		cmds = append(cmds, newRedisCmd("HINCRBY", key, ro.Count, sign))
+	}
+
+	fields := make([]string, 0, len(ro.Sum))
+	for field := range ro.Sum {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		i := rule.TableInfo.FindColumn(ro.Sum[field])
+		if i < 0 || i >= len(row) || row[i] == nil {
+			continue
+		}
+		f, err := strconv.ParseFloat(transformString(r.makeReqColumnData(rule, &rule.TableInfo.Columns[i], row[i])), 64)
+		if err != nil || f == 0 {
+			continue
+		}
+		cmds = append(cmds, newRedisCmd("HINCRBYFLOAT", key, field, strconv.FormatFloat(float64(sign)*f, 'f', -1, 64)))
+	}
+
+	if ro.TTL.Duration > 0 && len(cmds) > 0 {
+		cmds = append(cmds, newRedisCmd("EXPIRE", key, int64(ro.TTL.Duration/time.Second)))
+	}
+	return cmds
+}
@@ -0,0 +1,63 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadSecrets reads the MySQL and Redis passwords and the stat_token again from their
+// files, environment variables or Vault, like on SIGHUP after a scheduled
+// rotation. The connections keep working and use the new passwords when
+// they reconnect, which also reads them again.
+func (r *River) ReloadSecrets() error {
+	r.secretsLock.Lock()
+	defer r.secretsLock.Unlock()
+
+	for _, s := range []struct {
+		source secretSource
+		value  *string
+	}{
+		{secretSource{name: "my_password", file: r.c.MyPasswordFile, env: r.c.MyPasswordEnv, vault: r.c.MyPasswordVault}, &r.c.MyPassword},
+		{secretSource{name: "redis_password", file: r.c.RedisPasswordFile, env: r.c.RedisPasswordEnv, vault: r.c.RedisPasswordVault}, &r.c.RedisPassword},
+		{r.c.statTokenSource(), &r.c.StatToken},
+	} {
+		// a failed read keeps the old password
+		value := *s.value
+		if err := r.c.resolveSecret(s.source, &value); err != nil {
+			return errors.Trace(err)
+		}
+		if value != *s.value {
+			log.Infof("%s is rotated, used from the next connection", s.source.name)
+			*s.value = value
+		}
+	}
+	return nil
+}
+
+// reloadSecrets reads the passwords again before a reconnect, the old
+// ones are kept if they can not be read.
+func (r *River) reloadSecrets() {
+	if err := r.ReloadSecrets(); err != nil {
+		log.Warnf("read the rotated passwords err %v, use the old ones", err)
+	}
+}
+
+// mysqlPassword and redisPassword return the passwords for a new connection,
+// statToken the token of the status endpoints.
+func (r *River) mysqlPassword() string {
+	r.secretsLock.Lock()
+	defer r.secretsLock.Unlock()
+	return r.c.MyPassword
+}
+
+func (r *River) redisPassword() string {
+	r.secretsLock.Lock()
+	defer r.secretsLock.Unlock()
+	return r.c.RedisPassword
+}
+
+func (r *River) statToken() string {
+	r.secretsLock.Lock()
+	defer r.secretsLock.Unlock()
+	return r.c.StatToken
+}
@@ -1,9 +1,157 @@
 package river
 
 import (
+	"crypto/cipher"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/schema"
 )
 
+// NULL policies for how a NULL column value is written to Redis.
+const (
+	// NullPolicyDelete deletes the field from the hash, the default.
+	NullPolicyDelete = "delete"
+	// NullPolicyEmpty writes an empty string.
+	NullPolicyEmpty = "empty"
+	// NullPolicySentinel writes NullSentinel.
+	NullPolicySentinel = "sentinel"
+)
+
+const defaultTypesField = "_types"
+
+// Strategies for a table without a primary key and key_columns.
+const (
+	// NoPKStrategyError fails to start, the default.
+	NoPKStrategyError = "error"
+	// NoPKStrategySkip ignores the table with a warning.
+	NoPKStrategySkip = "skip"
+	// NoPKStrategyHash keys the rows by the hash of all columns,
+	// so an update moves the row to a new key and equal rows share one key.
+	NoPKStrategyHash = "hash"
+)
+
+// Policies for an invalid ENUM index or SET bitmask from binlog.
+const (
+	// InvalidEnumPolicyEmpty writes an empty string, the default.
+	InvalidEnumPolicyEmpty = "empty"
+	// InvalidEnumPolicyRaw writes the numeric value.
+	InvalidEnumPolicyRaw = "raw"
+	// InvalidEnumPolicySkip does not write the field.
+	InvalidEnumPolicySkip = "skip"
+	// InvalidEnumPolicyError fails the rows event.
+	InvalidEnumPolicyError = "error"
+)
+
+// Policies for a zero or invalid DATE, DATETIME or TIMESTAMP value, like
+// 0000-00-00 00:00:00.
+const (
+	// InvalidDatePolicyRaw writes the MySQL string, the default.
+	InvalidDatePolicyRaw = "raw"
+	// InvalidDatePolicyNull handles the value like NULL by the null_policy.
+	InvalidDatePolicyNull = "null"
+	// InvalidDatePolicyEmpty writes an empty string.
+	InvalidDatePolicyEmpty = "empty"
+	// InvalidDatePolicyEpoch writes the unix epoch in the time_format.
+	InvalidDatePolicyEpoch = "epoch"
+)
+
+// Error policies for a rows event that fails to be written.
+const (
+	// ErrorPolicyFail stops the sync, the default.
+	ErrorPolicyFail = "fail"
+	// ErrorPolicySkip logs and skips the event.
+	ErrorPolicySkip = "skip"
+	// ErrorPolicyDeadLetter writes the event to the dead-letter queue and skips it.
+	ErrorPolicyDeadLetter = "dead_letter"
+)
+
+// Policies for a value larger than max_field_bytes.
+const (
+	// OversizePolicyTruncate cuts the value to max_field_bytes, the default.
+	OversizePolicyTruncate = "truncate"
+	// OversizePolicyDropField does not write the field.
+	OversizePolicyDropField = "drop_field"
+	// OversizePolicyDropRow does not write the row.
+	OversizePolicyDropRow = "drop_row"
+	// OversizePolicyDeadLetter writes the rows event to the dead-letter queue.
+	OversizePolicyDeadLetter = "dead_letter"
+	// OversizePolicyChunk writes the value to the list <row key>:<field>:chunks
+	// in chunks of chunk_bytes, and its JSON manifest to the field.
+	OversizePolicyChunk = "chunk"
+)
+
+// Time formats for DATETIME and TIMESTAMP columns.
+const (
+	// TimeFormatRFC3339 is like 2006-01-02T15:04:05+08:00, the default.
+	TimeFormatRFC3339 = "rfc3339"
+	// TimeFormatUnix is unix seconds.
+	TimeFormatUnix = "unix"
+	// TimeFormatUnixMilli is unix milliseconds.
+	TimeFormatUnixMilli = "unix_ms"
+	// TimeFormatUnixMicro is unix microseconds, for DATETIME(6).
+	TimeFormatUnixMicro = "unix_us"
+	// TimeFormatRaw keeps the MySQL string.
+	TimeFormatRaw = "raw"
+)
+
+// Units of the unix timestamps in epoch_columns.
+const (
+	// EpochUnitSeconds is unix seconds, the default.
+	EpochUnitSeconds = "s"
+	// EpochUnitMilli is unix milliseconds.
+	EpochUnitMilli = "ms"
+)
+
+// Formats for BIT(n) columns.
+const (
+	// BitFormatInt is the unsigned integer, the default.
+	BitFormatInt = "int"
+	// BitFormatBitString is the n binary digits, like 00101 for BIT(5).
+	BitFormatBitString = "bitstring"
+)
+
+// Formats for TIME columns, which may be negative or over 24 hours.
+const (
+	// TimeColumnFormatRaw is like -838:59:59 or 12:34:56.500, the default.
+	TimeColumnFormatRaw = "raw"
+	// TimeColumnFormatSeconds is the signed number of seconds, like 45296.5.
+	TimeColumnFormatSeconds = "seconds"
+	// TimeColumnFormatISO8601 is the ISO 8601 duration like PT12H34M56.5S.
+	TimeColumnFormatISO8601 = "iso8601"
+)
+
+// Write policies for how a row is written to an existing hash key.
+const (
+	// WritePolicyMerge sets the changed fields and keeps the others, the default.
+	WritePolicyMerge = "merge"
+	// WritePolicyOverwrite deletes the key before writing the full row,
+	// purging the fields not written by the river.
+	WritePolicyOverwrite = "overwrite"
+	// WritePolicySkip only writes the row if the key does not exist.
+	WritePolicySkip = "skip"
+)
+
+// RuleCondition overrides the rule options for the rows matching the
+// condition expression, like priority == "hot".
+type RuleCondition struct {
+	Condition string `toml:"condition"`
+
+	// TTL overrides the rule ttl, 0 for no TTL.
+	TTL *TomlDuration `toml:"ttl"`
+
+	// KeyPrefix overrides the rule key_prefix.
+	KeyPrefix string `toml:"key_prefix"`
+
+	expr      expr
+	keyPrefix string
+}
+
 // Rule is the rule for how to sync data from MySQL to Redis.
 // If you want to sync MySQL data into elasticsearch, you must set a rule to let us know how to do it.
 // The mapping rule may this: schema + table <-> index + document type.
@@ -11,13 +159,228 @@ import (
 type Rule struct {
 	Schema string   `toml:"schema"`
 	Table  string   `toml:"table"`
-	// PK     []string `toml:"pk"`
+
+	// Priority decides the rule applied to a table matched by more rules,
+	// the higher first, default 0.
+	Priority int `toml:"priority"`
+
+	// KeyColumns are the columns to build the key from instead of the PK,
+	// like a unique key for a table without a primary key.
+	KeyColumns []string `toml:"key_columns"`
+
+	// NoPKStrategy is used when the table has no primary key and no key_columns,
+	// error, skip or hash, default skip if skip_no_pk_table is set, or error.
+	NoPKStrategy string `toml:"no_pk_strategy"`
 
 	// MySQL table information
 	TableInfo *schema.Table
 
 	//only MySQL fields in filter will be synced , default sync all fields
 	Filter []string `toml:"filter"`
+
+	// Exclude are the MySQL fields not to be synced, even if they are in filter.
+	Exclude []string `toml:"exclude"`
+
+	// FilterRegex and ExcludeRegex are like Filter and Exclude for the
+	// fields matching any of the regexps, like ^meta_ or _id$.
+	FilterRegex  []string `toml:"filter_regex"`
+	ExcludeRegex []string `toml:"exclude_regex"`
+
+	// FieldMapping maps MySQL column names to Redis hash field names,
+	// the columns not in it keep their names.
+	FieldMapping map[string]string `toml:"field"`
+
+	// Actions are the row actions to sync, insert, update or delete, default all.
+	Actions []string `toml:"actions"`
+
+	// NullPolicy is how NULL column values are written, delete, empty or sentinel.
+	NullPolicy   string `toml:"null_policy"`
+	NullSentinel string `toml:"null_sentinel"`
+
+	// WritePolicy is how a row is written to an existing key, merge, overwrite or skip.
+	WritePolicy string `toml:"write_policy"`
+
+	// PurgeStaleFields deletes the key before a full-row write, so fields no
+	// longer in the filter are removed, the overwrite policy always does.
+	PurgeStaleFields bool `toml:"purge_stale_fields"`
+
+	// StrictTypes encodes numbers canonically and writes a JSON object of
+	// column types to TypesField, so consumers can round-trip the values.
+	StrictTypes bool   `toml:"strict_types"`
+	TypesField  string `toml:"types_field"`
+
+	// VersionField is the field of the version of the last change of the
+	// row, increasing with the binlog position, none if empty.
+	VersionField string `toml:"version_field"`
+
+	// TimeZone is the zone DATETIME and TIMESTAMP values are in, like UTC or
+	// Asia/Shanghai, default the time_zone in config, or local.
+	TimeZone   string `toml:"time_zone"`
+	TimeFormat string `toml:"time_format"`
+
+	// TimeColumnFormat is how TIME columns are written, raw, seconds or iso8601.
+	TimeColumnFormat string `toml:"time_column_format"`
+
+	// Charset overrides the column charsets to decode string columns to UTF-8,
+	// like latin1 or gbk, default the charset of each column collation.
+	Charset string `toml:"charset"`
+
+	// BinaryEncoding is how BINARY, VARBINARY and BLOB columns are written,
+	// raw, base64 or hex, MaxBinaryBytes limits their size before encoding,
+	// 0 for no limit, the larger ones are handled by the oversize_policy.
+	BinaryEncoding string `toml:"binary_encoding"`
+	MaxBinaryBytes int    `toml:"max_binary_bytes"`
+
+	// GeometryFormat is how the spatial columns are written, wkt or geojson.
+	GeometryFormat string `toml:"geometry_format"`
+
+	// SetFormat is how SET columns are written, string, json or redis_set.
+	SetFormat string `toml:"set_format"`
+
+	// ListColumns are the string columns of items separated by
+	// ListSeparator, default ",", written by ListFormat as a JSON array,
+	// json, or to the Redis set <row key>:<field>, redis_set.
+	ListColumns   []string `toml:"list_columns"`
+	ListSeparator string   `toml:"list_separator"`
+	ListFormat    string   `toml:"list_format"`
+
+	// BitFormat is how BIT(n) columns are written, int or bitstring.
+	BitFormat string `toml:"bit_format"`
+
+	// EpochColumns are the integer columns of unix timestamps in EpochUnit,
+	// s or ms, written as datetimes in the time_format, or in EpochLayout,
+	// a Go time layout like "2006-01-02 15:04:05", in the rule time zone.
+	EpochColumns []string `toml:"epoch_columns"`
+	EpochUnit    string   `toml:"epoch_unit"`
+	EpochLayout  string   `toml:"epoch_layout"`
+
+	// JSONFormat is how JSON columns are written, decode, raw, normalize or flatten.
+	JSONFormat string `toml:"json_format"`
+
+	// InvalidEnumPolicy is how invalid ENUM and SET values are written, empty, raw, skip or error.
+	InvalidEnumPolicy string `toml:"invalid_enum_policy"`
+
+	// InvalidDatePolicy is how zero and invalid dates are written, raw, null, empty or epoch.
+	InvalidDatePolicy string `toml:"invalid_date_policy"`
+
+	// ErrorPolicy is what to do when a rows event fails, fail, skip or dead_letter,
+	// default the error_policy in config.
+	ErrorPolicy string `toml:"error_policy"`
+
+	// SkipGeneratedColumns and SkipInvisibleColumns exclude the generated
+	// and invisible columns, which are synced by default.
+	SkipGeneratedColumns bool `toml:"skip_generated_columns"`
+	SkipInvisibleColumns bool `toml:"skip_invisible_columns"`
+
+	// RowFilter is an expression to sync only the matching rows, like
+	// status == "active" && deleted_at == nil. A row updated to not match
+	// any more is deleted from Redis.
+	RowFilter string `toml:"row_filter"`
+
+	// Transforms are the column value transforms, like lower, trim|upper,
+	// rfc3339, split or template:{{ .title }} - {{ .content }}.
+	Transforms map[string]string `toml:"transform"`
+
+	// MaxFieldBytes limits the size of the written values, 0 for no limit,
+	// OversizePolicy is truncate, drop_field, drop_row, dead_letter or chunk,
+	// ChunkBytes is the chunk size of chunk, default 1MB.
+	MaxFieldBytes  int    `toml:"max_field_bytes"`
+	OversizePolicy string `toml:"oversize_policy"`
+	ChunkBytes     int    `toml:"chunk_bytes"`
+
+	// MaskSalt is the HMAC key of the hash transform, keep it secret so the
+	// hashed values can not be looked up.
+	MaskSalt string `toml:"mask_salt"`
+
+	// EncryptKey is the base64 AES key of the encrypt transform, or it is
+	// read from EncryptKeyFile, EncryptKeyEnv or EncryptKeyVault.
+	EncryptKey      string `toml:"encrypt_key"`
+	EncryptKeyFile  string `toml:"encrypt_key_file"`
+	EncryptKeyEnv   string `toml:"encrypt_key_env"`
+	EncryptKeyVault string `toml:"encrypt_key_vault"`
+
+	// SensitiveColumns are never logged or written to the dead letters,
+	// with the columns of the hash, redact, drop and encrypt transforms.
+	SensitiveColumns []string `toml:"sensitive_columns"`
+
+	// Computed are the fields computed from the row columns by templates,
+	// like "{{ .first_name }} {{ .last_name }}" or "{{ yyyymm .created_at }}",
+	// written like the column fields.
+	Computed map[string]string `toml:"computed"`
+
+	// TransformScript is the path of a Lua script to map the rows to Redis
+	// commands instead of the rule options, see script for the function.
+	TransformScript string `toml:"transform_script"`
+
+	// SoftDeleteColumn marks the rows deleted when it is not NULL or zero,
+	// like deleted_at or is_deleted, so they are deleted from Redis, and
+	// written again when it is reset.
+	SoftDeleteColumn string `toml:"soft_delete_column"`
+
+	// KeyPrefix is the prefix of the row keys, default {schema}:{table}.
+	// For a wildcard table rule, {1}, {2}... are the capture groups of the
+	// table regexp, like shard_{1} for table user_([0-9]+).
+	KeyPrefix string `toml:"key_prefix"`
+
+	// TTL expires the row keys after the duration since the last write, default never.
+	TTL TomlDuration `toml:"ttl"`
+
+	// Conditions override the ttl and key_prefix for the rows matching
+	// them, the first matching one is used.
+	Conditions []RuleCondition `toml:"when"`
+
+	// IndexColumns are the columns whose values index the rows by the
+	// sets <index_prefix>:<column>:<value> of their PKs, IndexPrefix is
+	// default idx:{table}.
+	IndexColumns []string `toml:"index_columns"`
+	IndexPrefix  string   `toml:"index_prefix"`
+
+	// RangeIndexColumns are the number and date columns indexing the rows
+	// by the sorted sets <index_prefix>:<column> of their PKs scored by the
+	// values, the dates by unix seconds.
+	RangeIndexColumns []string `toml:"range_index_columns"`
+
+	// UniqueColumns are the unique columns with the keys
+	// <lookup_prefix>:<column>:<value> to the PKs of the rows, LookupPrefix
+	// is default lookup:{table}.
+	UniqueColumns []string `toml:"unique_columns"`
+	LookupPrefix  string   `toml:"lookup_prefix"`
+
+	// TrackRows keeps the PKs of the rows in the set <key_prefix>:__all and
+	// their number in <key_prefix>:__count.
+	TrackRows bool `toml:"track_rows"`
+
+	// Outputs are the Redis data structures to write the rows to, default a hash.
+	Outputs []Output `toml:"output"`
+
+	// Invalidations delete the keys derived from the rows of other tables
+	// when the rows change.
+	Invalidations []Invalidation `toml:"invalidate"`
+
+	// Rollups aggregate the rows into the hashes of time buckets.
+	Rollups []Rollup `toml:"rollup"`
+
+	location     *time.Location
+	indexPrefix  string
+	lookupPrefix string
+	keyPrefix    string
+	tableGroups  []string
+	skipColumns  map[string]bool
+	filterRegex  []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+	dropColumns  map[string]bool
+	rowFilter    expr
+	transforms   map[string]transform
+	computed     map[string]transform
+	encrypter    cipher.AEAD
+	sensitive    map[string]bool
+	epoch        map[string]bool
+	list         map[string]bool
+	script       *script
+	// wildcard is the wildcard table of the rule the table rule is from
+	wildcard string
+	// overlaps are the lower priority rules of the table applied with rule_overlap all
+	overlaps []*Rule
 }
 
 func newDefaultRule(schema string, table string) *Rule {
@@ -29,9 +392,390 @@ func newDefaultRule(schema string, table string) *Rule {
 	return r
 }
 
+// clone returns a copy of the rule options, with the slices and maps
+// copied so decoding into the copy does not change the rule.
+func (r *Rule) clone() *Rule {
+	c := new(Rule)
+	src, dst := reflect.ValueOf(r).Elem(), reflect.ValueOf(c).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).PkgPath != "" {
+			// unexported fields are set by prepare
+			continue
+		}
+
+		f := src.Field(i)
+		switch f.Kind() {
+		case reflect.Slice:
+			if !f.IsNil() {
+				s := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+				reflect.Copy(s, f)
+				f = s
+			}
+		case reflect.Map:
+			if !f.IsNil() {
+				m := reflect.MakeMap(f.Type())
+				for _, k := range f.MapKeys() {
+					m.SetMapIndex(k, f.MapIndex(k))
+				}
+				f = m
+			}
+		}
+		dst.Field(i).Set(f)
+	}
+	return c
+}
+
+// prepare fills the defaults from the config and checks the rule options.
+func (r *Rule) prepare(c *Config) error {
+	switch r.NullPolicy {
+	case "":
+		r.NullPolicy = NullPolicyDelete
+	case NullPolicyDelete, NullPolicyEmpty:
+	case NullPolicySentinel:
+		if len(r.NullSentinel) == 0 {
+			return errors.Errorf("%s.%s null_sentinel must be set for null_policy sentinel", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("%s.%s invalid null_policy %s", r.Schema, r.Table, r.NullPolicy)
+	}
+
+	switch r.WritePolicy {
+	case "":
+		r.WritePolicy = WritePolicyMerge
+	case WritePolicyMerge, WritePolicyOverwrite, WritePolicySkip:
+	default:
+		return errors.Errorf("%s.%s invalid write_policy %s", r.Schema, r.Table, r.WritePolicy)
+	}
+
+	if r.StrictTypes && len(r.TypesField) == 0 {
+		r.TypesField = defaultTypesField
+	}
+
+	switch r.NoPKStrategy {
+	case "":
+		r.NoPKStrategy = NoPKStrategyError
+		if c.SkipNoPkTable {
+			r.NoPKStrategy = NoPKStrategySkip
+		}
+	case NoPKStrategyError, NoPKStrategySkip, NoPKStrategyHash:
+	default:
+		return errors.Errorf("%s.%s invalid no_pk_strategy %s", r.Schema, r.Table, r.NoPKStrategy)
+	}
+
+	switch r.InvalidEnumPolicy {
+	case "":
+		r.InvalidEnumPolicy = InvalidEnumPolicyEmpty
+	case InvalidEnumPolicyEmpty, InvalidEnumPolicyRaw, InvalidEnumPolicySkip, InvalidEnumPolicyError:
+	default:
+		return errors.Errorf("%s.%s invalid invalid_enum_policy %s", r.Schema, r.Table, r.InvalidEnumPolicy)
+	}
+
+	switch r.InvalidDatePolicy {
+	case "":
+		r.InvalidDatePolicy = InvalidDatePolicyRaw
+	case InvalidDatePolicyRaw, InvalidDatePolicyNull, InvalidDatePolicyEmpty, InvalidDatePolicyEpoch:
+	default:
+		return errors.Errorf("%s.%s invalid invalid_date_policy %s", r.Schema, r.Table, r.InvalidDatePolicy)
+	}
+
+	if len(r.ErrorPolicy) == 0 {
+		r.ErrorPolicy = c.ErrorPolicy
+	}
+	switch r.ErrorPolicy {
+	case "":
+		r.ErrorPolicy = ErrorPolicyFail
+	case ErrorPolicyFail, ErrorPolicySkip:
+	case ErrorPolicyDeadLetter:
+		if len(c.DeadLetterFile) == 0 && len(c.DeadLetterKey) == 0 {
+			return errors.Errorf("%s.%s dead_letter_file or dead_letter_key must be set for error_policy dead_letter", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("%s.%s invalid error_policy %s", r.Schema, r.Table, r.ErrorPolicy)
+	}
+
+	prefix := r.KeyPrefix
+	if len(prefix) == 0 {
+		prefix = "{schema}:{table}"
+	}
+	r.keyPrefix = r.replaceKey(prefix)
+
+	prefix = r.IndexPrefix
+	if len(prefix) == 0 {
+		prefix = "idx:{table}"
+	}
+	r.indexPrefix = r.replaceKey(prefix)
+
+	prefix = r.LookupPrefix
+	if len(prefix) == 0 {
+		prefix = "lookup:{table}"
+	}
+	r.lookupPrefix = r.replaceKey(prefix)
+
+	// EXPIRE has whole seconds, 0 would delete the key
+	if r.TTL.Duration > 0 && r.TTL.Duration < time.Second {
+		return errors.Errorf("%s.%s ttl %s must be at least 1s", r.Schema, r.Table, r.TTL.Duration)
+	}
+	for i := range r.Conditions {
+		c := &r.Conditions[i]
+		e, err := parseExpr(c.Condition)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid condition %s", r.Schema, r.Table, c.Condition)
+		}
+		if c.TTL != nil && c.TTL.Duration > 0 && c.TTL.Duration < time.Second {
+			return errors.Errorf("%s.%s ttl %s of condition %s must be at least 1s", r.Schema, r.Table, c.TTL.Duration, c.Condition)
+		}
+		c.expr = e
+		if len(c.KeyPrefix) > 0 {
+			c.keyPrefix = r.replaceKey(c.KeyPrefix)
+		}
+	}
+
+	for i := range r.Rollups {
+		if err := r.Rollups[i].prepare(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for i := range r.Invalidations {
+		if err := r.Invalidations[i].prepare(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for i := range r.Outputs {
+		if err := r.Outputs[i].prepare(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	var err error
+	if r.filterRegex, err = compileRegexps(r.FilterRegex); err != nil {
+		return errors.Annotatef(err, "%s.%s invalid filter_regex", r.Schema, r.Table)
+	}
+	if r.excludeRegex, err = compileRegexps(r.ExcludeRegex); err != nil {
+		return errors.Annotatef(err, "%s.%s invalid exclude_regex", r.Schema, r.Table)
+	}
+
+	for _, action := range r.Actions {
+		switch action {
+		case canal.InsertAction, canal.UpdateAction, canal.DeleteAction:
+		default:
+			return errors.Errorf("%s.%s invalid action %s", r.Schema, r.Table, action)
+		}
+	}
+
+	fields := make(map[string]string, len(r.FieldMapping))
+	for column, field := range r.FieldMapping {
+		if len(field) == 0 {
+			return errors.Errorf("%s.%s empty field name for column %s", r.Schema, r.Table, column)
+		}
+		if other, ok := fields[field]; ok {
+			return errors.Errorf("%s.%s columns %s and %s are both mapped to field %s", r.Schema, r.Table, other, column, field)
+		}
+		fields[field] = column
+	}
+
+	switch r.OversizePolicy {
+	case "":
+		r.OversizePolicy = OversizePolicyTruncate
+	case OversizePolicyTruncate, OversizePolicyDropField, OversizePolicyDropRow:
+	case OversizePolicyChunk:
+		if r.ChunkBytes <= 0 {
+			r.ChunkBytes = defaultChunkBytes
+		}
+	case OversizePolicyDeadLetter:
+		if len(c.DeadLetterFile) == 0 && len(c.DeadLetterKey) == 0 {
+			return errors.Errorf("%s.%s dead_letter_file or dead_letter_key must be set for oversize_policy dead_letter", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("%s.%s invalid oversize_policy %s", r.Schema, r.Table, r.OversizePolicy)
+	}
+
+	if len(r.RowFilter) > 0 {
+		e, err := parseExpr(r.RowFilter)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid row_filter", r.Schema, r.Table)
+		}
+		r.rowFilter = e
+	}
+
+	if len(r.Charset) > 0 && !isValidCharset(r.Charset) {
+		return errors.Errorf("%s.%s invalid charset %s", r.Schema, r.Table, r.Charset)
+	}
+
+	if len(r.TimeZone) == 0 {
+		r.TimeZone = c.TimeZone
+	}
+	if len(r.TimeZone) == 0 {
+		r.location = time.Local
+	} else {
+		loc, err := time.LoadLocation(r.TimeZone)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid time_zone %s", r.Schema, r.Table, r.TimeZone)
+		}
+		r.location = loc
+	}
+
+	switch r.TimeFormat {
+	case "":
+		r.TimeFormat = TimeFormatRFC3339
+	case TimeFormatRFC3339, TimeFormatUnix, TimeFormatUnixMilli, TimeFormatUnixMicro, TimeFormatRaw:
+	default:
+		return errors.Errorf("%s.%s invalid time_format %s", r.Schema, r.Table, r.TimeFormat)
+	}
+
+	switch r.TimeColumnFormat {
+	case "":
+		r.TimeColumnFormat = TimeColumnFormatRaw
+	case TimeColumnFormatRaw, TimeColumnFormatSeconds, TimeColumnFormatISO8601:
+	default:
+		return errors.Errorf("%s.%s invalid time_column_format %s", r.Schema, r.Table, r.TimeColumnFormat)
+	}
+
+	switch r.BinaryEncoding {
+	case "":
+		r.BinaryEncoding = BinaryEncodingRaw
+	case BinaryEncodingRaw, BinaryEncodingBase64, BinaryEncodingHex:
+	default:
+		return errors.Errorf("%s.%s invalid binary_encoding %s, must be raw, base64 or hex", r.Schema, r.Table, r.BinaryEncoding)
+	}
+
+	switch r.GeometryFormat {
+	case "":
+		r.GeometryFormat = GeometryFormatWKT
+	case GeometryFormatWKT, GeometryFormatGeoJSON:
+	default:
+		return errors.Errorf("%s.%s invalid geometry_format %s, must be wkt or geojson", r.Schema, r.Table, r.GeometryFormat)
+	}
+
+	switch r.SetFormat {
+	case "":
+		r.SetFormat = SetFormatString
+	case SetFormatString, SetFormatJSON, SetFormatRedisSet:
+	default:
+		return errors.Errorf("%s.%s invalid set_format %s, must be string, json or redis_set", r.Schema, r.Table, r.SetFormat)
+	}
+
+	switch r.BitFormat {
+	case "":
+		r.BitFormat = BitFormatInt
+	case BitFormatInt, BitFormatBitString:
+	default:
+		return errors.Errorf("%s.%s invalid bit_format %s, must be int or bitstring", r.Schema, r.Table, r.BitFormat)
+	}
+
+	switch r.ListFormat {
+	case "":
+		r.ListFormat = ListFormatJSON
+	case ListFormatJSON, ListFormatRedisSet:
+	default:
+		return errors.Errorf("%s.%s invalid list_format %s, must be json or redis_set", r.Schema, r.Table, r.ListFormat)
+	}
+	if len(r.ListSeparator) == 0 {
+		r.ListSeparator = ","
+	}
+	r.list = make(map[string]bool, len(r.ListColumns))
+	for _, column := range r.ListColumns {
+		r.list[column] = true
+	}
+
+	switch r.EpochUnit {
+	case "":
+		r.EpochUnit = EpochUnitSeconds
+	case EpochUnitSeconds, EpochUnitMilli:
+	default:
+		return errors.Errorf("%s.%s invalid epoch_unit %s, must be s or ms", r.Schema, r.Table, r.EpochUnit)
+	}
+	r.epoch = make(map[string]bool, len(r.EpochColumns))
+	for _, column := range r.EpochColumns {
+		r.epoch[column] = true
+	}
+
+	switch r.JSONFormat {
+	case "":
+		r.JSONFormat = JSONFormatDecode
+	case JSONFormatDecode, JSONFormatRaw, JSONFormatNormalize, JSONFormatFlatten:
+	default:
+		return errors.Errorf("%s.%s invalid json_format %s, must be decode, raw, normalize or flatten", r.Schema, r.Table, r.JSONFormat)
+	}
+
+	if len(r.EncryptKey) > 0 {
+		if r.encrypter, err = newEncrypter(r.EncryptKey); err != nil {
+			return errors.Annotatef(err, "%s.%s", r.Schema, r.Table)
+		}
+	}
+
+	r.transforms = make(map[string]transform, len(r.Transforms))
+	r.dropColumns = make(map[string]bool)
+	for column, s := range r.Transforms {
+		if strings.TrimSpace(s) == dropTransform {
+			r.dropColumns[column] = true
+			continue
+		}
+
+		t, err := parseTransform(r, s)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid transform for column %s", r.Schema, r.Table, column)
+		}
+		r.transforms[column] = t
+	}
+	r.prepareSensitive()
+	// the index keys and scores are the plain values
+	for _, columns := range [][]string{r.IndexColumns, r.RangeIndexColumns, r.UniqueColumns} {
+		for _, column := range columns {
+			if r.isMasked(column) {
+				return errors.Errorf("%s.%s index column %s can not have a hash, redact, drop or encrypt transform", r.Schema, r.Table, column)
+			}
+		}
+	}
+
+	r.computed = make(map[string]transform, len(r.Computed))
+	for field, s := range r.Computed {
+		t, err := parseTransform(r, templateTransformPrefix+s)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid computed field %s", r.Schema, r.Table, field)
+		}
+		r.computed[field] = t
+	}
+
+	if len(r.TransformScript) > 0 {
+		s, err := newScript(r.TransformScript)
+		if err != nil {
+			return errors.Annotatef(err, "%s.%s invalid transform_script", r.Schema, r.Table)
+		}
+		r.script = s
+	}
+
+	return nil
+}
+
+// replaceKey replaces {schema}, {table} and the wildcard table capture groups {1}, {2}... in the key.
+func (r *Rule) replaceKey(key string) string {
+	oldnew := []string{"{schema}", r.Schema, "{table}", r.Table}
+	for i, g := range r.tableGroups {
+		oldnew = append(oldnew, fmt.Sprintf("{%d}", i+1), g)
+	}
+	return strings.NewReplacer(oldnew...).Replace(key)
+}
+
 // CheckFilter checkers whether the field needs to be filtered.
 func (r *Rule) CheckFilter(field string) bool {
-	if r.Filter == nil {
+	if r.skipColumns[field] || r.dropColumns[field] {
+		return false
+	}
+
+	for _, f := range r.Exclude {
+		if f == field {
+			return false
+		}
+	}
+	for _, re := range r.excludeRegex {
+		if re.MatchString(field) {
+			return false
+		}
+	}
+
+	if r.Filter == nil && r.filterRegex == nil {
 		return true
 	}
 
@@ -40,5 +784,136 @@ func (r *Rule) CheckFilter(field string) bool {
 			return true
 		}
 	}
+	for _, re := range r.filterRegex {
+		if re.MatchString(field) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, s := range exprs {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// FieldName returns the Redis hash field name for the column.
+func (r *Rule) FieldName(column string) string {
+	if field, ok := r.FieldMapping[column]; ok {
+		return field
+	}
+	return column
+}
+
+// CheckAction checks whether the rows of the action are synced.
+func (r *Rule) CheckAction(action string) bool {
+	if r.Actions == nil {
+		return true
+	}
+
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRow checks whether the row matches the row filter and is not soft
+// deleted, all rows match without them.
+func (r *Rule) MatchRow(row []interface{}) bool {
+	if r.isSoftDeleted(row) {
+		return false
+	}
+
+	if r.rowFilter == nil {
+		return true
+	}
+
+	return isTrue(r.rowFilter.eval(r.exprValues(row)))
+}
+
+// exprValues returns the row values by column name for the expressions.
+func (r *Rule) exprValues(row []interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(row))
+	for i, c := range r.TableInfo.Columns {
+		if i < len(row) {
+			values[c.Name] = row[i]
+		}
+	}
+	return values
+}
+
+// matchCondition returns the first condition the row matches, or nil.
+func (r *Rule) matchCondition(row []interface{}) *RuleCondition {
+	if len(r.Conditions) == 0 {
+		return nil
+	}
+
+	values := r.exprValues(row)
+	for i := range r.Conditions {
+		if isTrue(r.Conditions[i].expr.eval(values)) {
+			return &r.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// rowKeyPrefix returns the key prefix of the row.
+func (r *Rule) rowKeyPrefix(row []interface{}) string {
+	if c := r.matchCondition(row); c != nil && len(c.keyPrefix) > 0 {
+		return c.keyPrefix
+	}
+	return r.keyPrefix
+}
+
+// rowTTL returns the TTL of the row key, 0 for no TTL.
+func (r *Rule) rowTTL(row []interface{}) time.Duration {
+	if c := r.matchCondition(row); c != nil && c.TTL != nil {
+		return c.TTL.Duration
+	}
+	return r.TTL.Duration
+}
+
+// hasTTL checks whether any row key of the rule may have a TTL.
+func (r *Rule) hasTTL() bool {
+	if r.TTL.Duration > 0 {
+		return true
+	}
+	for _, c := range r.Conditions {
+		if c.TTL != nil && c.TTL.Duration > 0 {
+			return true
+		}
+	}
 	return false
 }
+
+func (r *Rule) isSoftDeleted(row []interface{}) bool {
+	if len(r.SoftDeleteColumn) == 0 {
+		return false
+	}
+
+	i := r.TableInfo.FindColumn(r.SoftDeleteColumn)
+	if i < 0 || i >= len(row) {
+		return false
+	}
+
+	switch v := normalizeExprValue(row[i]).(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return len(v) > 0 && v != "0" && !strings.HasPrefix(v, "0000-00-00")
+	}
+	return true
+}
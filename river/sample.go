@@ -0,0 +1,89 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const defaultSampleSize = 100
+
+// sample is one applied event or error kept for the status API.
+type sample struct {
+	Time   time.Time
+	Action string
+	Key    string
+	Pos    mysql.Position
+	Err    error
+	// Duration is the downtime of a reconnect
+	Duration time.Duration
+}
+
+func (s sample) String() string {
+	str := fmt.Sprintf("%s %s %s %s", s.Time.Format(time.RFC3339), s.Action, s.Key, s.Pos)
+	if s.Duration > 0 {
+		str = fmt.Sprintf("%s after %s", str, s.Duration)
+	}
+	if s.Err != nil {
+		str = fmt.Sprintf("%s err %v", str, s.Err)
+	}
+	return str
+}
+
+// sampleRing keeps the last N samples in memory.
+type sampleRing struct {
+	sync.Mutex
+
+	samples []sample
+	next    int
+	full    bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	if size <= 0 {
+		size = defaultSampleSize
+	}
+
+	return &sampleRing{samples: make([]sample, size)}
+}
+
+// Add adds the sample, overwriting the oldest one if the ring is full.
+func (r *sampleRing) Add(s sample) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Samples returns the kept samples, oldest first.
+func (r *sampleRing) Samples() []sample {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.full {
+		return append([]sample(nil), r.samples[:r.next]...)
+	}
+
+	samples := make([]sample, 0, len(r.samples))
+	samples = append(samples, r.samples[r.next:]...)
+	return append(samples, r.samples[:r.next]...)
+}
+
+func (r *sampleRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+
+	for _, s := range r.Samples() {
+		buf.WriteString(s.String())
+		buf.WriteByte('\n')
+	}
+
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,206 @@
+package river
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const scriptFunction = "transform"
+
+// scriptVerifyFunction is the optional function of the script to verify
+// the rows for -check and verify_sample.
+const scriptVerifyFunction = "verify"
+
+// script is the Lua transform script of a rule. The script defines
+//
+//	function transform(action, schema, table, before, after, key)
+//
+// before and after are tables of column name to value, NULL columns are
+// absent, before is nil for insert and after is nil for delete. key is the
+// key of the row built by the rule. It returns a list of Redis commands
+// like {{"HSET", key, "title", after.title}}, which are applied in a
+// transaction, or nil to write nothing.
+//
+// The script may also define
+//
+//	function verify(schema, table, row, key)
+//
+// row is the table of the row, nil if it is gone. It reads what transform
+// wrote by redis_call(cmd, args...), which runs the read-only commands, and
+// returns a list of the differences found, or nil if none.
+type script struct {
+	sync.Mutex
+
+	path     string
+	l        *lua.LState
+	fn       lua.LValue
+	verifyFn lua.LValue
+}
+
+func newScript(path string) (*script, error) {
+	l := lua.NewState()
+	if err := l.DoFile(path); err != nil {
+		l.Close()
+		return nil, errors.Annotatef(err, "load script %s", path)
+	}
+
+	fn := l.GetGlobal(scriptFunction)
+	if fn.Type() != lua.LTFunction {
+		l.Close()
+		return nil, errors.Errorf("script %s must define function %s", path, scriptFunction)
+	}
+
+	s := &script{path: path, l: l, fn: fn}
+	if fn := l.GetGlobal(scriptVerifyFunction); fn.Type() == lua.LTFunction {
+		s.verifyFn = fn
+	}
+	return s, nil
+}
+
+// canVerify returns true if the script defines the verify function.
+func (s *script) canVerify() bool {
+	return s.verifyFn != nil
+}
+
+// verify runs the verify function with redis_call reading by rd, and
+// returns the differences.
+func (s *script) verify(schema, table string, row map[string]interface{}, key string, rd RedisReader) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.l.SetGlobal("redis_call", s.l.NewFunction(func(l *lua.LState) int {
+		args := make([]interface{}, 0, l.GetTop())
+		for i := 2; i <= l.GetTop(); i++ {
+			args = append(args, l.Get(i).String())
+		}
+		reply, err := rd.Do(l.CheckString(1), args...)
+		if err != nil {
+			l.RaiseError("%v", err)
+			return 0
+		}
+		l.Push(s.value(reply))
+		return 1
+	}))
+	defer s.l.SetGlobal("redis_call", lua.LNil)
+
+	err := s.l.CallByParam(lua.P{Fn: s.verifyFn, NRet: 1, Protect: true},
+		lua.LString(schema), lua.LString(table), s.table(row), lua.LString(key))
+	if err != nil {
+		return nil, errors.Annotatef(err, "call script %s verify", s.path)
+	}
+
+	ret := s.l.Get(-1)
+	s.l.Pop(1)
+
+	if ret == lua.LNil {
+		return nil, nil
+	}
+	list, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, errors.Errorf("script %s verify returns %s, must be a list of differences", s.path, ret.Type())
+	}
+
+	diffs := make([]string, 0, list.Len())
+	for i := 1; i <= list.Len(); i++ {
+		diffs = append(diffs, list.RawGetInt(i).String())
+	}
+	return diffs, nil
+}
+
+// value converts the Redis reply to Lua, nil for a missing key, a list
+// for an array.
+func (s *script) value(reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LNil
+	case int64:
+		return lua.LNumber(v)
+	case []interface{}:
+		t := s.l.NewTable()
+		for _, item := range v {
+			t.Append(s.value(item))
+		}
+		return t
+	}
+	return lua.LString(transformString(reply))
+}
+
+// call runs the transform function and returns the Redis commands.
+func (s *script) call(action, schema, table string, before, after map[string]interface{}, key string) ([]redisCmd, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.l.CallByParam(lua.P{Fn: s.fn, NRet: 1, Protect: true},
+		lua.LString(action), lua.LString(schema), lua.LString(table),
+		s.table(before), s.table(after), lua.LString(key))
+	if err != nil {
+		return nil, errors.Annotatef(err, "call script %s", s.path)
+	}
+
+	ret := s.l.Get(-1)
+	s.l.Pop(1)
+
+	if ret == lua.LNil {
+		return nil, nil
+	}
+	list, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, errors.Errorf("script %s returns %s, must be a list of commands", s.path, ret.Type())
+	}
+
+	var cmds []redisCmd
+	for i := 1; i <= list.Len(); i++ {
+		t, ok := list.RawGetInt(i).(*lua.LTable)
+		if !ok || t.Len() == 0 {
+			return nil, errors.Errorf("script %s command %d must be a non-empty list", s.path, i)
+		}
+
+		args := make([]interface{}, 0, t.Len()-1)
+		for j := 2; j <= t.Len(); j++ {
+			args = append(args, t.RawGetInt(j).String())
+		}
+		cmds = append(cmds, newRedisCmd(t.RawGetInt(1).String(), args...))
+	}
+	return cmds, nil
+}
+
+// table converts the row to a Lua table, the values are strings so that
+// large integers keep their precision, Lua converts them for arithmetic.
+func (s *script) table(row map[string]interface{}) lua.LValue {
+	if row == nil {
+		return lua.LNil
+	}
+
+	t := s.l.NewTable()
+	for name, value := range row {
+		if value == nil {
+			continue
+		}
+		t.RawSetString(name, lua.LString(transformString(value)))
+	}
+	return t
+}
+
+func (s *script) Close() {
+	s.Lock()
+	s.l.Close()
+	s.Unlock()
+}
+
+// makeScriptRow returns the converted values of the row columns by
+// column name, keeping NULL as nil.
+func (r *River) makeScriptRow(rule *Rule, row []interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+
+	data := r.makeRowData(rule, row)
+	for i, c := range rule.TableInfo.Columns {
+		if i < len(row) && row[i] == nil {
+			data[c.Name] = nil
+		}
+	}
+	return data
+}
@@ -0,0 +1,153 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// secretSource is where one credential is read from, at most one is set.
+type secretSource struct {
+	name  string
+	file  string
+	env   string
+	vault string
+}
+
+// ResolveSecrets reads the passwords set by my_password_file,
+// my_password_env, my_password_vault and the redis_password ones,
+// replacing my_pass and redis_pass, the stat_token and the encrypt_key
+// of the rules.
+// It is called by NewRiver, so a rotated secret is read again when the
+// river is created again.
+func (c *Config) ResolveSecrets() error {
+	my := secretSource{name: "my_password", file: c.MyPasswordFile, env: c.MyPasswordEnv, vault: c.MyPasswordVault}
+	if err := c.resolveSecret(my, &c.MyPassword); err != nil {
+		return errors.Trace(err)
+	}
+
+	redis := secretSource{name: "redis_password", file: c.RedisPasswordFile, env: c.RedisPasswordEnv, vault: c.RedisPasswordVault}
+	if err := c.resolveSecret(redis, &c.RedisPassword); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := c.resolveSecret(c.statTokenSource(), &c.StatToken); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, rule := range c.Rules {
+		if err := c.resolveSecret(rule.encryptKeySource(), &rule.EncryptKey); err != nil {
+			return errors.Annotatef(err, "rule %s.%s", rule.Schema, rule.Table)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) encryptKeySource() secretSource {
+	return secretSource{name: "encrypt_key", file: r.EncryptKeyFile, env: r.EncryptKeyEnv, vault: r.EncryptKeyVault}
+}
+
+func (c *Config) resolveSecret(s secretSource, value *string) error {
+	switch {
+	case len(s.file) > 0:
+		b, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			return errors.Annotatef(err, "read %s_file", s.name)
+		}
+		// files written by editors or secret mounts often end with a newline
+		*value = strings.TrimRight(string(b), "\r\n")
+	case len(s.env) > 0:
+		v, ok := os.LookupEnv(s.env)
+		if !ok {
+			return errors.Errorf("environment variable %s of %s_env is not set", s.env, s.name)
+		}
+		*value = v
+	case len(s.vault) > 0:
+		v, err := c.readVault(s.vault)
+		if err != nil {
+			return errors.Annotatef(err, "read %s_vault %s", s.name, s.vault)
+		}
+		*value = v
+	}
+	return nil
+}
+
+// check checks at most one source is set for the secret.
+func (s secretSource) check() error {
+	n := 0
+	for _, v := range []string{s.file, s.env, s.vault} {
+		if len(v) > 0 {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.Errorf("only one of %s_file, %s_env and %s_vault can be set", s.name, s.name, s.name)
+	}
+	if len(s.vault) > 0 && !strings.Contains(s.vault, "#") {
+		return errors.Errorf("invalid %s_vault %s, must be like secret/data/river#password", s.name, s.vault)
+	}
+	return nil
+}
+
+// readVault reads the field of a Vault KV secret, the path is like
+// "secret/data/river#password". Both the KV version 1 and 2 are supported.
+func (c *Config) readVault(path string) (string, error) {
+	addr := c.VaultAddr
+	if len(addr) == 0 {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	token := c.VaultToken
+	if len(token) == 0 {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if len(addr) == 0 || len(token) == 0 {
+		return "", errors.New("vault_addr and vault_token or VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	seps := strings.SplitN(path, "#", 2)
+	if len(seps) != 2 {
+		return "", errors.Errorf("no field in %s", path)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s", strings.TrimRight(addr, "/"), strings.TrimLeft(seps[0], "/")), nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault status %s", resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	data := secret.Data
+	// KV version 2 nests the fields in data.data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+
+	v, ok := data[seps[1]].(string)
+	if !ok {
+		return "", errors.Errorf("no string field %s in %s", seps[1], seps[0])
+	}
+	return v, nil
+}
@@ -0,0 +1,137 @@
+package river
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// The default range of the server_id selected automatically.
+const (
+	defaultServerIDMin = 1001
+	defaultServerIDMax = 65535
+)
+
+// maxServerIDSelects is how many times another server_id is selected
+// after the master disconnected the river for a duplicate one.
+const maxServerIDSelects = 10
+
+// isDuplicateServerID returns true if the master disconnected the river
+// as another replica connected with the same server_id.
+func isDuplicateServerID(err error) bool {
+	if err == nil {
+		return false
+	}
+	if myErr, ok := errors.Cause(err).(*mysql.MyError); ok && myErr.Code != mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG {
+		return false
+	}
+	// "A slave with the same server_uuid/server_id as this slave has
+	// connected to the master", replica and source since MySQL 8.0.26
+	msg := err.Error()
+	return strings.Contains(msg, "with the same server_uuid/server_id") ||
+		strings.Contains(msg, "with the same server_id")
+}
+
+// serverIDRange returns the range of the server_id selected automatically.
+func (c *Config) serverIDRange() (uint32, uint32) {
+	min, max := c.ServerIDMin, c.ServerIDMax
+	if min == 0 {
+		min = defaultServerIDMin
+	}
+	if max == 0 {
+		max = defaultServerIDMax
+	}
+	return min, max
+}
+
+// hashServerID derives the server_id of the hostname and pid within the
+// range, so rivers on different hosts or processes rarely pick the same.
+func hashServerID(hostname string, pid int, min uint32, max uint32) uint32 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", hostname, pid)
+	return min + h.Sum32()%(max-min+1)
+}
+
+// nextServerID returns the server_id after id within the range.
+func nextServerID(id uint32, min uint32, max uint32) uint32 {
+	if id >= max || id < min {
+		return min
+	}
+	return id + 1
+}
+
+// selectServerID sets server_id if not set: from the hash of the hostname
+// and pid within server_id_min and server_id_max, skipping the server_id
+// of MySQL and of its replicas if it can list them.
+func (c *Config) selectServerID() {
+	if c.ServerID != 0 {
+		return
+	}
+
+	min, max := c.serverIDRange()
+	hostname, _ := os.Hostname()
+	id := hashServerID(hostname, os.Getpid(), min, max)
+
+	used, err := c.usedServerIDs()
+	if err != nil {
+		log.Warnf("list the server_id used by MySQL err %v, select server_id without", err)
+	}
+	for i := uint32(0); i < max-min && used[id]; i++ {
+		id = nextServerID(id, min, max)
+	}
+
+	c.ServerID = id
+	log.Infof("select server_id %d", id)
+}
+
+// usedServerIDs returns the server_id of MySQL and of its replicas.
+func (c *Config) usedServerIDs() (map[uint32]bool, error) {
+	conn, err := client.Connect(c.MyAddr, c.MyUser, c.MyPassword, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	used := make(map[uint32]bool)
+
+	res, err := conn.Execute("SELECT @@server_id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	id, _ := res.Resultset.GetUint(0, 0)
+	used[uint32(id)] = true
+
+	if res, err = conn.Execute("SHOW SLAVE HOSTS"); err != nil {
+		return used, errors.Trace(err)
+	}
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		id, _ := res.Resultset.GetUint(i, 0)
+		used[uint32(id)] = true
+	}
+	return used, nil
+}
+
+// handleDuplicateServerID reports the master disconnected the river for
+// a duplicate server_id, and selects the next one if it was selected
+// automatically. It returns true to restart the canal with it.
+func (r *River) handleDuplicateServerID(err error, selects int) bool {
+	r.st.DuplicateServerIDNum.Add(1)
+
+	if !r.autoServerID || selects >= maxServerIDSelects {
+		log.Errorf("server_id %d is used by another replica of MySQL, set a unique server_id or leave it unset to select one: %v", r.c.ServerID, err)
+		return false
+	}
+
+	min, max := r.c.serverIDRange()
+	id := nextServerID(r.c.ServerID, min, max)
+	log.Warnf("server_id %d is used by another replica of MySQL, select server_id %d", r.c.ServerID, id)
+	r.alert.Alertf("server_id %d is used by another replica of MySQL, switched to server_id %d", r.c.ServerID, id)
+	r.c.ServerID = id
+	return true
+}
@@ -0,0 +1,147 @@
+package river
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// Formats of the SET columns.
+const (
+	// SetFormatString writes the comma-joined members, the default.
+	SetFormatString = "string"
+	// SetFormatJSON writes the JSON array of the members.
+	SetFormatJSON = "json"
+	// SetFormatRedisSet writes the members to the Redis set
+	// <row key>:<field> instead of a hash field.
+	SetFormatRedisSet = "redis_set"
+)
+
+// Formats of the list_columns.
+const (
+	// ListFormatJSON writes the JSON array of the items, the default.
+	ListFormatJSON = "json"
+	// ListFormatRedisSet writes the items to the Redis set
+	// <row key>:<field> instead of a hash field.
+	ListFormatRedisSet = "redis_set"
+)
+
+// setValue returns the comma-joined SET members in the rule set_format.
+func setValue(rule *Rule, value string) interface{} {
+	if rule.SetFormat != SetFormatJSON {
+		return value
+	}
+
+	members := setMembers(value)
+	data, err := json.Marshal(members)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+func setMembers(value string) []string {
+	if len(value) == 0 {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// checkListColumns returns an error for a column of list_columns not in
+// the table or not a text string, which would be written as it is.
+func (r *Rule) checkListColumns() error {
+	for _, name := range r.ListColumns {
+		i := r.TableInfo.FindColumn(name)
+		if i == -1 {
+			return errors.Errorf("%s.%s list column %s not found", r.Schema, r.Table, name)
+		}
+		if col := &r.TableInfo.Columns[i]; !r.isListColumn(col) {
+			return errors.Errorf("%s.%s list column %s must be a text string, but is %s", r.Schema, r.Table, name, col.RawType)
+		}
+	}
+	return nil
+}
+
+// isListColumn returns true for a string column of separated items listed
+// in the rule list_columns.
+func (r *Rule) isListColumn(col *schema.TableColumn) bool {
+	return r.list[col.Name] && col.Type == schema.TYPE_STRING && !isBinaryColumn(col)
+}
+
+// listItems splits the list column value by the rule list_separator,
+// trimming the spaces around the items and dropping the empty ones.
+func listItems(rule *Rule, value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, rule.ListSeparator) {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listValue returns the JSON array of the list column items.
+func listValue(rule *Rule, value string) interface{} {
+	data, err := json.Marshal(listItems(rule, value))
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+// isRedisSetColumn returns true for a SET or list column written to its
+// own Redis set by the rule.
+func (r *Rule) isRedisSetColumn(col *schema.TableColumn) bool {
+	if r.isListColumn(col) {
+		return r.ListFormat == ListFormatRedisSet
+	}
+	return r.SetFormat == SetFormatRedisSet && col.Type == schema.TYPE_SET
+}
+
+// setKey returns the Redis set of the SET column field of the row key.
+func setKey(key string, field string) string {
+	return key + ":" + field
+}
+
+// redisSetCmds returns the commands to replace the Redis sets of the SET
+// and list columns of the row with the key, row is nil for delete.
+func (r *River) redisSetCmds(rule *Rule, key string, row []interface{}) []redisCmd {
+	if rule.SetFormat != SetFormatRedisSet && rule.ListFormat != ListFormatRedisSet {
+		return nil
+	}
+
+	var cmds []redisCmd
+	for i, c := range rule.TableInfo.Columns {
+		if !rule.isRedisSetColumn(&c) || !rule.CheckFilter(c.Name) {
+			continue
+		}
+
+		k := setKey(key, rule.FieldName(c.Name))
+		cmds = append(cmds, newRedisCmd("DEL", k))
+		if row == nil || i >= len(row) || row[i] == nil {
+			continue
+		}
+
+		value := transformString(r.makeReqColumnData(rule, &c, row[i]))
+		members := setMembers(value)
+		if rule.isListColumn(&c) {
+			members = listItems(rule, value)
+		}
+		if len(members) == 0 {
+			continue
+		}
+		args := make([]interface{}, 0, len(members)+1)
+		args = append(args, k)
+		for _, m := range members {
+			args = append(args, m)
+		}
+		cmds = append(cmds, newRedisCmd("SADD", args...))
+		if ttl := rule.rowTTL(row); ttl > 0 {
+			cmds = append(cmds, newRedisCmd("EXPIRE", k, int64(ttl/time.Second)))
+		}
+	}
+	return cmds
+}
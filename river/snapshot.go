@@ -0,0 +1,249 @@
+package river
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+)
+
+// snapshotHeader is the first line of a snapshot file.
+type snapshotHeader struct {
+	Rule string    `json:"rule"`
+	Time time.Time `json:"time"`
+}
+
+// snapshotEntry is a line of a snapshot file after the header, a row key
+// with its hash.
+type snapshotEntry struct {
+	Key    string            `json:"key"`
+	Fields map[string]string `json:"fields"`
+}
+
+// snapshot is the row keys of a rule with their hashes at a time, saved as
+// JSON lines sorted by key to audit them or diff them later.
+type snapshot struct {
+	snapshotHeader
+	keys map[string]map[string]string
+}
+
+// ruleByName returns the rule of the schema.table name.
+func (r *River) ruleByName(name string) (*Rule, error) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return nil, errors.Errorf("invalid rule %s, must be schema.table", name)
+	}
+	rule, ok := r.rules[ruleKey(name[:i], name[i+1:])]
+	if !ok {
+		return nil, errors.Errorf("rule %s not found", name)
+	}
+	return rule, nil
+}
+
+// liveSnapshot reads the row hash keys of the rule from Redis by SCAN, on
+// a connection of its own as it may run along the sync.
+func (r *River) liveSnapshot(ctx context.Context, rule *Rule) (*snapshot, error) {
+	s := &snapshot{
+		snapshotHeader: snapshotHeader{Rule: rule.Schema + "." + rule.Table, Time: time.Now()},
+		keys:           make(map[string]map[string]string),
+	}
+
+	addr, err := r.resolveRedisMaster()
+	if err != nil {
+		return nil, errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+	conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+	if err != nil {
+		return nil, errors.Trace(wrapError(err, ErrRedisUnavailable))
+	}
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", rule.keyPrefix+":*", "COUNT", 1000))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return nil, errors.Errorf("invalid SCAN reply %v", reply)
+		}
+
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if !isRowKey(rule, key) {
+				continue
+			}
+			if typ, err := redis.String(conn.Do("TYPE", key)); err != nil {
+				return nil, errors.Trace(err)
+			} else if typ != "hash" {
+				continue
+			}
+
+			hash, err := redis.StringMap(conn.Do("HGETALL", key))
+			if err != nil && err != redis.ErrNil {
+				return nil, errors.Trace(err)
+			}
+			if len(hash) > 0 {
+				s.keys[key] = hash
+			}
+		}
+
+		if cursor == "0" {
+			return s, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
+
+func (s *snapshot) save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(s.snapshotHeader); err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range s.sortedKeys() {
+		if err := enc.Encode(snapshotEntry{Key: key, Fields: s.keys[key]}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	s := &snapshot{keys: make(map[string]map[string]string)}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err := dec.Decode(&s.snapshotHeader); err != nil {
+		return nil, errors.Annotatef(err, "invalid snapshot %s", path)
+	}
+	for dec.More() {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, errors.Annotatef(err, "invalid snapshot %s", path)
+		}
+		s.keys[e.Key] = e.Fields
+	}
+	return s, nil
+}
+
+func (s *snapshot) sortedKeys() []string {
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffSnapshots returns the keys of the old snapshot missing in the
+// current one, the keys only in the current one as extra, and the keys
+// with differing fields, sorted by key.
+func diffSnapshots(old *snapshot, cur *snapshot) []Mismatch {
+	var diff []Mismatch
+	for _, key := range old.sortedKeys() {
+		hash, ok := cur.keys[key]
+		if !ok {
+			diff = append(diff, Mismatch{Rule: old.Rule, Key: key, Kind: MismatchMissing})
+			continue
+		}
+
+		var fields []string
+		for field, value := range old.keys[key] {
+			if v, ok := hash[field]; !ok || v != value {
+				fields = append(fields, field)
+			}
+		}
+		for field := range hash {
+			if _, ok := old.keys[key][field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) > 0 {
+			sort.Strings(fields)
+			diff = append(diff, Mismatch{Rule: old.Rule, Key: key, Kind: MismatchFields, Fields: fields})
+		}
+	}
+
+	var extra []Mismatch
+	for _, key := range cur.sortedKeys() {
+		if _, ok := old.keys[key]; !ok {
+			extra = append(extra, Mismatch{Rule: cur.Rule, Key: key, Kind: MismatchExtra})
+		}
+	}
+	diff = append(diff, extra...)
+	sort.SliceStable(diff, func(i, j int) bool { return diff[i].Key < diff[j].Key })
+	return diff
+}
+
+// ExportSnapshot writes the row hash keys of the rule, schema.table, in
+// Redis to the file, and returns the number of keys. Only the hash keys
+// under the rule key_prefix are exported.
+func (r *River) ExportSnapshot(ctx context.Context, rule string, path string) (int, error) {
+	rl, err := r.ruleByName(rule)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	s, err := r.liveSnapshot(ctx, rl)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(s.keys), errors.Trace(s.save(path))
+}
+
+// DiffLiveSnapshot returns the differences of the keys in Redis from the
+// snapshot file of ExportSnapshot.
+func (r *River) DiffLiveSnapshot(ctx context.Context, path string) ([]Mismatch, error) {
+	old, err := loadSnapshot(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rule, err := r.ruleByName(old.Rule)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s, err := r.liveSnapshot(ctx, rule)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return diffSnapshots(old, s), nil
+}
+
+// DiffSnapshotFiles returns the differences of the new snapshot file from
+// the old one, both of ExportSnapshot for the same rule.
+func DiffSnapshotFiles(oldPath string, newPath string) ([]Mismatch, error) {
+	old, err := loadSnapshot(oldPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s, err := loadSnapshot(newPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if old.Rule != s.Rule {
+		return nil, errors.Errorf("snapshots of different rules %s and %s", old.Rule, s.Rule)
+	}
+	return diffSnapshots(old, s), nil
+}
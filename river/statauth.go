@@ -0,0 +1,92 @@
+package river
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+func (c *Config) statTokenSource() secretSource {
+	return secretSource{name: "stat_token", file: c.StatTokenFile, env: c.StatTokenEnv, vault: c.StatTokenVault}
+}
+
+// statTLSConfig returns the TLS config of the status http server, nil if
+// stat_tls_cert is not set. The clients must have a certificate signed by
+// stat_tls_client_ca if it is set.
+func (c *Config) statTLSConfig() (*tls.Config, error) {
+	if len(c.StatTLSCert) == 0 {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.StatTLSCert, c.StatTLSKey)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load stat_tls_cert and stat_tls_key")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(c.StatTLSClientCA) > 0 {
+		pem, err := ioutil.ReadFile(c.StatTLSClientCA)
+		if err != nil {
+			return nil, errors.Annotatef(err, "read stat_tls_client_ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate in stat_tls_client_ca %s", c.StatTLSClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// listenStat listens on the status address, with TLS if it is set.
+func (c *Config) listenStat(addr string) (net.Listener, error) {
+	cfg, err := c.statTLSConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "listen stat addr %s", addr)
+	}
+	if cfg != nil {
+		l = tls.NewListener(l, cfg)
+	}
+	return l, nil
+}
+
+// statAuth requires "Authorization: Bearer <stat_token>" for the status
+// endpoints if the token is set.
+type statAuth struct {
+	h http.Handler
+	// token returns the current token, which may be rotated
+	token func() string
+	// audit records the unauthorized requests, may be nil
+	audit *auditLog
+}
+
+func (a statAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := a.token()
+	if len(token) > 0 {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			a.audit.Record("stat_unauthorized", HTTPAuditSource(req), map[string]interface{}{"path": req.URL.Path})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="river"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	a.h.ServeHTTP(w, req)
+}
@@ -0,0 +1,88 @@
+package river
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsdClient pushes metrics to StatsD over UDP.
+// With datadog enabled, tags are sent in the DogStatsD format, plain StatsD drops them.
+// All methods are no-ops on a nil client.
+type statsdClient struct {
+	conn net.Conn
+
+	prefix  string
+	tags    []string
+	datadog bool
+}
+
+func newStatsdClient(addr string, prefix string, tags []string, datadog bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return &statsdClient{
+		conn:    conn,
+		prefix:  prefix,
+		tags:    tags,
+		datadog: datadog,
+	}, nil
+}
+
+// Count adds value to the counter name.
+func (c *statsdClient) Count(name string, value int64, tags ...string) {
+	c.send(name, fmt.Sprintf("%d", value), "c", tags)
+}
+
+// Gauge sets the gauge name to value.
+func (c *statsdClient) Gauge(name string, value float64, tags ...string) {
+	c.send(name, fmt.Sprintf("%g", value), "g", tags)
+}
+
+// Timing records d in milliseconds for the timer name.
+func (c *statsdClient) Timing(name string, d time.Duration, tags ...string) {
+	c.send(name, fmt.Sprintf("%g", float64(d)/float64(time.Millisecond)), "ms", tags)
+}
+
+func (c *statsdClient) send(name string, value string, typ string, tags []string) {
+	if c == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s%s:%s|%s", c.prefix, name, value, typ)
+	if c.datadog && len(c.tags)+len(tags) > 0 {
+		line = fmt.Sprintf("%s|#%s", line, strings.Join(append(append([]string(nil), c.tags...), tags...), ","))
+	}
+
+	// UDP is fire and forget, a lost metric must not break syncing
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		log.Debugf("send statsd metric %s err %v", name, err)
+	}
+}
+
+// Close closes the UDP connection.
+func (c *statsdClient) Close() {
+	if c == nil {
+		return
+	}
+
+	c.conn.Close()
+}
+
+func ruleTags(rule *Rule, action string) []string {
+	return []string{
+		"schema:" + rule.Schema,
+		"table:" + rule.Table,
+		"action:" + action,
+	}
+}
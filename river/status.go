@@ -6,9 +6,12 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/siddontang/go/sync2"
-	"gopkg.in/birkirb/loggers.v1/log"
+	log "github.com/sirupsen/logrus"
 )
 
 type stat struct {
@@ -19,22 +22,321 @@ type stat struct {
 	InsertNum sync2.AtomicInt64
 	UpdateNum sync2.AtomicInt64
 	DeleteNum sync2.AtomicInt64
+
+	// SkipNum is the number of failed rows events skipped by the error policy.
+	SkipNum       sync2.AtomicInt64
+	DeadLetterNum sync2.AtomicInt64
+
+	// FilteredNum is the number of rows not matching the rule row_filter or actions.
+	FilteredNum sync2.AtomicInt64
+
+	// InvalidEnumNum is the number of invalid ENUM and SET values.
+	InvalidEnumNum sync2.AtomicInt64
+	// InvalidDateNum is the number of zero and invalid dates.
+	InvalidDateNum sync2.AtomicInt64
+
+	// OversizeNum is the number of values larger than max_field_bytes.
+	OversizeNum sync2.AtomicInt64
+
+	// InvalidatedNum is the number of keys deleted by the invalidate rules.
+	InvalidatedNum sync2.AtomicInt64
+
+	// LastVersion is the version of the last rows event of a rule with version_field.
+	LastVersion sync2.AtomicInt64
+
+	// WrittenBytes is the approximate number of bytes written to Redis.
+	WrittenBytes sync2.AtomicInt64
+
+	// VerifiedNum is the number of keys sampled by verify_sample and
+	// DivergedNum the number of them differing from their rows.
+	VerifiedNum sync2.AtomicInt64
+	DivergedNum sync2.AtomicInt64
+
+	// ReapedNum is the number of keys deleted by reap_interval as their
+	// rows were gone for longer than reap_window.
+	ReapedNum sync2.AtomicInt64
+
+	// ProbeLatency is the last end to end latency in milliseconds of the
+	// probe_table row from MySQL to Redis.
+	ProbeLatency sync2.AtomicInt64
+
+	// OrphanNum is the number of old keys left by moved rows across cluster slots,
+	// OrphanCleanupNum is the number of new keys rolled back.
+	OrphanNum        sync2.AtomicInt64
+	OrphanCleanupNum sync2.AtomicInt64
+
+	// RedisRetryNum is the number of Redis commands retried on transient errors.
+	RedisRetryNum sync2.AtomicInt64
+
+	// RedisCircuitOpen is 1 while the sync is paused as Redis is unavailable,
+	// RedisCircuitOpenNum is the number of times it was paused.
+	RedisCircuitOpen    sync2.AtomicInt64
+	RedisCircuitOpenNum sync2.AtomicInt64
+
+	// Paused is 1 between Pause and Resume.
+	Paused sync2.AtomicInt64
+
+	// RedisOOMNum is the number of writes refused for Redis maxmemory,
+	// RedisOOMDroppedNum is the number of rows events skipped by the drop policy.
+	RedisOOMNum        sync2.AtomicInt64
+	RedisOOMDroppedNum sync2.AtomicInt64
+
+	// RedisUsedMemory and RedisMaxMemory are used_memory and maxmemory of Redis INFO.
+	RedisUsedMemory sync2.AtomicInt64
+	RedisMaxMemory  sync2.AtomicInt64
+
+	// QuarantinedNum is the number of poison rows events quarantined.
+	QuarantinedNum sync2.AtomicInt64
+
+	// TxnTimeoutNum is the number of transactions exceeding txn_timeout.
+	TxnTimeoutNum sync2.AtomicInt64
+
+	// DuplicateServerIDNum is the number of times the master disconnected
+	// the river for another replica with the same server_id.
+	DuplicateServerIDNum sync2.AtomicInt64
+
+	// BinlogPurgedNum is the number of times the saved binlog position
+	// was not on MySQL any more, RedumpNum is the number of dumps it started.
+	BinlogPurgedNum sync2.AtomicInt64
+	RedumpNum       sync2.AtomicInt64
+
+	// MySQLReconnectNum and RedisReconnectNum are the number of reconnects
+	// after the connection failed.
+	MySQLReconnectNum sync2.AtomicInt64
+	RedisReconnectNum sync2.AtomicInt64
+
+	// PanicNum is the number of panics recovered, RestartNum is the number
+	// of restarts after an error or a panic.
+	PanicNum   sync2.AtomicInt64
+	RestartNum sync2.AtomicInt64
+
+	// ReplayedNum is the number of rows events skipped by the replay guard.
+	ReplayedNum sync2.AtomicInt64
+
+	// LastEventTime is the timestamp (unix seconds) of the last applied binlog event.
+	LastEventTime sync2.AtomicInt64
+
+	lagAlerted bool
+
+	rulesLock sync.RWMutex
+	rules     map[string]*ruleStat
+
+	dryRunLock sync.Mutex
+	// the write commands not run in dry run, by command
+	dryRun map[string]int64
+
+	latencyLock sync.RWMutex
+	// Redis command latency in milliseconds, by command
+	latency map[string]*histogram
+
+	// number of rows in one rows event
+	batchSize *histogram
+
+	// end to end latency in milliseconds of the probe_table rows, nil if not set
+	probeLatency *histogram
+
+	// optional push sink, nil if statsd_addr is not set
+	statsd *statsdClient
+
+	// the last N applied events, errors, reconnects and commands not run in dry run
+	events     *sampleRing
+	errors     *sampleRing
+	reconnects *sampleRing
+	dryRunCmds *sampleRing
+}
+
+func newStat(r *River) *stat {
+	s := &stat{r: r}
+	s.batchSize = newHistogram(batchSizeBuckets)
+	if len(r.c.ProbeTable) > 0 {
+		s.probeLatency = newHistogram(probeLatencyBuckets)
+	}
+	s.events = newSampleRing(r.c.StatSampleSize)
+	s.errors = newSampleRing(r.c.StatSampleSize)
+	s.reconnects = newSampleRing(r.c.StatSampleSize)
+	s.dryRunCmds = newSampleRing(r.c.StatSampleSize)
+	return s
+}
+
+// ruleStat is the statistics for one schema.table.
+type ruleStat struct {
+	InsertNum sync2.AtomicInt64
+	UpdateNum sync2.AtomicInt64
+	DeleteNum sync2.AtomicInt64
+	ErrorNum  sync2.AtomicInt64
+	SkipNum   sync2.AtomicInt64
+
+	InvalidEnumNum sync2.AtomicInt64
+	InvalidDateNum sync2.AtomicInt64
+	OversizeNum    sync2.AtomicInt64
+	InvalidatedNum sync2.AtomicInt64
+
+	// WrittenBytes is the approximate number of bytes written, LiveKeys and
+	// MemoryBytes are the keys and their estimated memory by keyspace_interval.
+	WrittenBytes sync2.AtomicInt64
+	LiveKeys     sync2.AtomicInt64
+	MemoryBytes  sync2.AtomicInt64
+
+	VerifiedNum sync2.AtomicInt64
+	DivergedNum sync2.AtomicInt64
+	ReapedNum   sync2.AtomicInt64
+
+	// LastAppliedTime is the time (unix seconds) the last rows event was applied.
+	LastAppliedTime sync2.AtomicInt64
+}
+
+// Rule returns the statistics for the rule, creating them if needed.
+func (s *stat) Rule(rule *Rule) *ruleStat {
+	name := fmt.Sprintf("%s.%s", rule.Schema, rule.Table)
+
+	s.rulesLock.RLock()
+	rs, ok := s.rules[name]
+	s.rulesLock.RUnlock()
+	if ok {
+		return rs
+	}
+
+	s.rulesLock.Lock()
+	defer s.rulesLock.Unlock()
+
+	if s.rules == nil {
+		s.rules = make(map[string]*ruleStat)
+	}
+	if rs, ok = s.rules[name]; !ok {
+		rs = new(ruleStat)
+		s.rules[name] = rs
+	}
+	return rs
+}
+
+// ObserveLatency adds the latency of one Redis command.
+func (s *stat) ObserveLatency(cmd string, d time.Duration) {
+	s.latencyLock.RLock()
+	h, ok := s.latency[cmd]
+	s.latencyLock.RUnlock()
+
+	if !ok {
+		s.latencyLock.Lock()
+		if s.latency == nil {
+			s.latency = make(map[string]*histogram)
+		}
+		if h, ok = s.latency[cmd]; !ok {
+			h = newHistogram(latencyBuckets)
+			s.latency[cmd] = h
+		}
+		s.latencyLock.Unlock()
+	}
+
+	h.Observe(float64(d) / float64(time.Millisecond))
+	s.statsd.Timing("redis.latency", d, "cmd:"+cmd)
+}
+
+// Lag returns how far behind MySQL the last applied binlog event is.
+func (s *stat) Lag() time.Duration {
+	ts := s.LastEventTime.Get()
+	if ts == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(ts, 0))
+}
+
+// Status is a snapshot of the state and the statistics of a River.
+type Status struct {
+	// Position is the binlog position read up to, empty before the canal
+	// reads any binlog.
+	Position string
+	// Paused is true between Pause and Resume, CircuitOpen while the sync
+	// is paused as Redis is unavailable.
+	Paused      bool
+	CircuitOpen bool
+	// Lag is how far behind MySQL the last applied binlog event is.
+	Lag time.Duration
+
+	InsertNum    int64
+	UpdateNum    int64
+	DeleteNum    int64
+	SkipNum      int64
+	WrittenBytes int64
+
+	// Rules is the statistics by schema.table.
+	Rules map[string]RuleStatus
+}
+
+// RuleStatus is the statistics of a rule in Status.
+type RuleStatus struct {
+	InsertNum    int64
+	UpdateNum    int64
+	DeleteNum    int64
+	ErrorNum     int64
+	SkipNum      int64
+	WrittenBytes int64
+
+	// LastApplied is the time the last rows event was applied, zero if none.
+	LastApplied time.Time
+}
+
+// Status returns the state and the statistics of the River, without
+// querying MySQL or Redis.
+func (r *River) Status() Status {
+	s := r.st
+	st := Status{
+		Paused:       r.Paused(),
+		CircuitOpen:  s.RedisCircuitOpen.Get() == 1,
+		Lag:          s.Lag(),
+		InsertNum:    s.InsertNum.Get(),
+		UpdateNum:    s.UpdateNum.Get(),
+		DeleteNum:    s.DeleteNum.Get(),
+		SkipNum:      s.SkipNum.Get(),
+		WrittenBytes: s.WrittenBytes.Get(),
+		Rules:        make(map[string]RuleStatus),
+	}
+	if pos := r.syncedPosition(); len(pos.Name) > 0 {
+		st.Position = pos.String()
+	}
+
+	s.rulesLock.RLock()
+	defer s.rulesLock.RUnlock()
+	for name, rs := range s.rules {
+		rst := RuleStatus{
+			InsertNum:    rs.InsertNum.Get(),
+			UpdateNum:    rs.UpdateNum.Get(),
+			DeleteNum:    rs.DeleteNum.Get(),
+			ErrorNum:     rs.ErrorNum.Get(),
+			SkipNum:      rs.SkipNum.Get(),
+			WrittenBytes: rs.WrittenBytes.Get(),
+		}
+		if ts := rs.LastAppliedTime.Get(); ts > 0 {
+			rst.LastApplied = time.Unix(ts, 0)
+		}
+		st.Rules[name] = rst
+	}
+	return st
 }
 
 func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 
-	rr, err := s.r.canal.Execute("SHOW MASTER STATUS")
-	if err != nil {
+	if err := s.WriteTo(&buf); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("execute sql error %v", err)))
+		w.Write([]byte(err.Error()))
 		return
 	}
 
+	w.Write(buf.Bytes())
+}
+
+// WriteTo writes the statistics in the /stat format.
+func (s *stat) WriteTo(buf *bytes.Buffer) error {
+	rr, err := s.r.executeCanal("SHOW MASTER STATUS")
+	if err != nil {
+		return fmt.Errorf("execute sql error %v", err)
+	}
+
 	binName, _ := rr.GetString(0, 0)
 	binPos, _ := rr.GetUint(0, 1)
 
-	pos := s.r.canal.SyncedPosition()
+	pos := s.r.syncedPosition()
 
 	buf.WriteString(fmt.Sprintf("server_current_binlog:(%s, %d)\n", binName, binPos))
 	buf.WriteString(fmt.Sprintf("read_binlog:%s\n", pos))
@@ -42,8 +344,102 @@ func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	buf.WriteString(fmt.Sprintf("insert_num:%d\n", s.InsertNum.Get()))
 	buf.WriteString(fmt.Sprintf("update_num:%d\n", s.UpdateNum.Get()))
 	buf.WriteString(fmt.Sprintf("delete_num:%d\n", s.DeleteNum.Get()))
+	buf.WriteString(fmt.Sprintf("skip_num:%d\n", s.SkipNum.Get()))
+	buf.WriteString(fmt.Sprintf("dead_letter_num:%d\n", s.DeadLetterNum.Get()))
+	buf.WriteString(fmt.Sprintf("replayed_num:%d\n", s.ReplayedNum.Get()))
+	buf.WriteString(fmt.Sprintf("filtered_num:%d\n", s.FilteredNum.Get()))
+	buf.WriteString(fmt.Sprintf("invalid_enum_num:%d\n", s.InvalidEnumNum.Get()))
+	buf.WriteString(fmt.Sprintf("invalid_date_num:%d\n", s.InvalidDateNum.Get()))
+	buf.WriteString(fmt.Sprintf("oversize_num:%d\n", s.OversizeNum.Get()))
+	buf.WriteString(fmt.Sprintf("invalidated_num:%d\n", s.InvalidatedNum.Get()))
+	buf.WriteString(fmt.Sprintf("last_version:%d\n", s.LastVersion.Get()))
+	buf.WriteString(fmt.Sprintf("written_bytes:%d\n", s.WrittenBytes.Get()))
+	buf.WriteString(fmt.Sprintf("verified_num:%d\n", s.VerifiedNum.Get()))
+	buf.WriteString(fmt.Sprintf("diverged_num:%d\n", s.DivergedNum.Get()))
+	buf.WriteString(fmt.Sprintf("reaped_num:%d\n", s.ReapedNum.Get()))
+	buf.WriteString(fmt.Sprintf("probe_latency_ms:%d\n", s.ProbeLatency.Get()))
+	buf.WriteString(fmt.Sprintf("orphan_num:%d\n", s.OrphanNum.Get()))
+	buf.WriteString(fmt.Sprintf("orphan_cleanup_num:%d\n", s.OrphanCleanupNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_retry_num:%d\n", s.RedisRetryNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_oom_num:%d\n", s.RedisOOMNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_oom_dropped_num:%d\n", s.RedisOOMDroppedNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_used_memory:%d\n", s.RedisUsedMemory.Get()))
+	buf.WriteString(fmt.Sprintf("redis_maxmemory:%d\n", s.RedisMaxMemory.Get()))
+	buf.WriteString(fmt.Sprintf("quarantined_num:%d\n", s.QuarantinedNum.Get()))
+	buf.WriteString(fmt.Sprintf("txn_timeout_num:%d\n", s.TxnTimeoutNum.Get()))
+	buf.WriteString(fmt.Sprintf("duplicate_server_id_num:%d\n", s.DuplicateServerIDNum.Get()))
+	buf.WriteString(fmt.Sprintf("binlog_purged_num:%d\n", s.BinlogPurgedNum.Get()))
+	buf.WriteString(fmt.Sprintf("redump_num:%d\n", s.RedumpNum.Get()))
+	buf.WriteString(fmt.Sprintf("mysql_reconnect_num:%d\n", s.MySQLReconnectNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_reconnect_num:%d\n", s.RedisReconnectNum.Get()))
+	buf.WriteString(fmt.Sprintf("panic_num:%d\n", s.PanicNum.Get()))
+	buf.WriteString(fmt.Sprintf("restart_num:%d\n", s.RestartNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_circuit_open:%d\n", s.RedisCircuitOpen.Get()))
+	buf.WriteString(fmt.Sprintf("redis_circuit_open_num:%d\n", s.RedisCircuitOpenNum.Get()))
+	buf.WriteString(fmt.Sprintf("paused:%d\n", s.Paused.Get()))
 
-	w.Write(buf.Bytes())
+	buf.WriteString(fmt.Sprintf("last_event_time:%d\n", s.LastEventTime.Get()))
+	buf.WriteString(fmt.Sprintf("replication_lag:%d\n", int64(s.Lag().Seconds())))
+
+	s.rulesLock.RLock()
+	names := make([]string, 0, len(s.rules))
+	for name := range s.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rs := s.rules[name]
+		buf.WriteString(fmt.Sprintf("\n[%s]\n", name))
+		buf.WriteString(fmt.Sprintf("insert_num:%d\n", rs.InsertNum.Get()))
+		buf.WriteString(fmt.Sprintf("update_num:%d\n", rs.UpdateNum.Get()))
+		buf.WriteString(fmt.Sprintf("delete_num:%d\n", rs.DeleteNum.Get()))
+		buf.WriteString(fmt.Sprintf("error_num:%d\n", rs.ErrorNum.Get()))
+		buf.WriteString(fmt.Sprintf("skip_num:%d\n", rs.SkipNum.Get()))
+		buf.WriteString(fmt.Sprintf("invalid_enum_num:%d\n", rs.InvalidEnumNum.Get()))
+		buf.WriteString(fmt.Sprintf("invalid_date_num:%d\n", rs.InvalidDateNum.Get()))
+		buf.WriteString(fmt.Sprintf("oversize_num:%d\n", rs.OversizeNum.Get()))
+		buf.WriteString(fmt.Sprintf("invalidated_num:%d\n", rs.InvalidatedNum.Get()))
+		buf.WriteString(fmt.Sprintf("written_bytes:%d\n", rs.WrittenBytes.Get()))
+		buf.WriteString(fmt.Sprintf("live_keys:%d\n", rs.LiveKeys.Get()))
+		buf.WriteString(fmt.Sprintf("memory_bytes:%d\n", rs.MemoryBytes.Get()))
+		buf.WriteString(fmt.Sprintf("verified_num:%d\n", rs.VerifiedNum.Get()))
+		buf.WriteString(fmt.Sprintf("diverged_num:%d\n", rs.DivergedNum.Get()))
+		buf.WriteString(fmt.Sprintf("reaped_num:%d\n", rs.ReapedNum.Get()))
+		buf.WriteString(fmt.Sprintf("last_applied_time:%d\n", rs.LastAppliedTime.Get()))
+	}
+	s.rulesLock.RUnlock()
+
+	s.latencyLock.RLock()
+	cmds := make([]string, 0, len(s.latency))
+	for cmd := range s.latency {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	for _, cmd := range cmds {
+		s.latency[cmd].WriteTo(buf, fmt.Sprintf("redis_latency_ms %s", cmd))
+	}
+	s.latencyLock.RUnlock()
+
+	s.batchSize.WriteTo(buf, "batch_size")
+	if s.probeLatency != nil {
+		s.probeLatency.WriteTo(buf, "probe_latency_ms")
+	}
+
+	s.dryRunLock.Lock()
+	cmds = cmds[:0]
+	for cmd := range s.dryRun {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	for _, cmd := range cmds {
+		buf.WriteString(fmt.Sprintf("dry_run_cmd_num %s:%d\n", cmd, s.dryRun[cmd]))
+	}
+	s.dryRunLock.Unlock()
+
+	return nil
 }
 
 func (s *stat) Run(addr string) {
@@ -52,7 +448,7 @@ func (s *stat) Run(addr string) {
 	}
 	log.Infof("run status http server %s", addr)
 	var err error
-	s.l, err = net.Listen("tcp", addr)
+	s.l, err = s.r.c.listenStat(addr)
 	if err != nil {
 		log.Errorf("listen stat addr %s err %v", addr, err)
 		return
@@ -61,8 +457,13 @@ func (s *stat) Run(addr string) {
 	srv := http.Server{}
 	mux := http.NewServeMux()
 	mux.Handle("/stat", s)
+	mux.Handle("/stat/events", s.events)
+	mux.Handle("/stat/errors", s.errors)
+	mux.Handle("/stat/reconnects", s.reconnects)
+	mux.Handle("/stat/dry_run", s.dryRunCmds)
+	mux.Handle("/stat/redis_acl", redisACLHandler{s.r})
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
-	srv.Handler = mux
+	srv.Handler = statAuth{h: mux, token: s.r.statToken, audit: s.r.audit}
 
 	srv.Serve(s.l)
 }
@@ -71,4 +472,6 @@ func (s *stat) Close() {
 	if s.l != nil {
 		s.l.Close()
 	}
+
+	s.statsd.Close()
 }
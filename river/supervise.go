@@ -0,0 +1,81 @@
+package river
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// panicError is a recovered panic.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// recoverPanic recovers a panic of the named goroutine or handler,
+// reports it and sets it as the error. It must be deferred.
+func (r *River) recoverPanic(name string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	perr := &panicError{value: v, stack: debug.Stack()}
+	log.WithField("stack", string(perr.stack)).Errorf("%s %v", name, perr)
+	r.st.PanicNum.Add(1)
+	r.recordError(name, "", perr)
+	*err = perr
+}
+
+// restartBackoff returns how long to wait before the restart.
+func restartBackoff(restarts int) time.Duration {
+	d := time.Second << uint(restarts)
+	if d > maxStartupBackoff || d <= 0 {
+		d = maxStartupBackoff
+	}
+	return d
+}
+
+// restart waits before a restart, it returns false if the restarts are
+// used up or the river is closed.
+func (r *River) restart(name string, restarts int, err error) bool {
+	if r.ctx.Err() != nil || restarts >= r.c.MaxRestarts {
+		return false
+	}
+
+	wait := restartBackoff(restarts)
+	log.Errorf("%s stopped err %v, restart %d/%d in %s from binlog %s", name, err, restarts+1, r.c.MaxRestarts, wait, r.master.Position())
+	r.alert.Alertf("%s stopped err %v, restarting from binlog %s", name, err, r.master.Position())
+	r.st.RestartNum.Add(1)
+
+	select {
+	case <-time.After(wait):
+		return r.ctx.Err() == nil
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// restartCanal creates the canal again, to sync from the saved position,
+// with the MySQL password read again as it may be rotated.
+func (r *River) restartCanal() error {
+	// not along a query of another goroutine
+	r.canalLock.Lock()
+	r.canal.Close()
+	r.canalLock.Unlock()
+	r.reloadSecrets()
+	// the canal starts again from the saved position, before the transaction
+	r.endTxn()
+
+	if err := r.newCanal(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(r.prepareCanal())
+}
@@ -2,7 +2,8 @@ package river
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"strings"
@@ -13,10 +14,13 @@ import (
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	"github.com/siddontang/go-mysql/schema"
-	"gopkg.in/birkirb/loggers.v1/log"
+	log "github.com/sirupsen/logrus"
 	"github.com/gomodule/redigo/redis"
 )
 
+// lagInterval is the interval the replication lag is checked at.
+const lagInterval = time.Second
+
 type posSaver struct {
 	pos   mysql.Position
 	force bool
@@ -49,17 +53,35 @@ func (h *eventHandler) OnTableChanged(schema, table string) error {
 
 func (h *eventHandler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
 	log.Debugf("OnDDL scheduled, log name %s, pos %d", nextPos.Name, nextPos.Pos)
+	h.r.endTxn()
 	h.r.syncCh <- posSaver{nextPos, true}
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnXID(nextPos mysql.Position) error {
 	log.Debugf("OnXID scheduled, log name %s, pos %d", nextPos.Name, nextPos.Pos)
+	h.r.endTxn()
 	h.r.syncCh <- posSaver{nextPos, false}
 	return h.r.ctx.Err()
 }
 
-func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
+func (h *eventHandler) OnRow(e *canal.RowsEvent) (err error) {
+	// a panic stops the canal, which is restarted by max_restarts,
+	// unless the event is quarantined
+	defer func() {
+		if _, ok := err.(*panicError); !ok {
+			return
+		}
+		if rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]; ok && h.r.quarantine(rule, e, err) {
+			err = nil
+		}
+	}()
+	defer h.r.recoverPanic("OnRow", &err)
+
+	if !h.r.waitResume() {
+		return h.r.ctx.Err()
+	}
+
 	// log.Infof("OnRow scheduled, database name %s, table name %s", e.Table.Schema, e.Table.Name)
 	rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]
 	if !ok {
@@ -67,26 +89,127 @@ func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
 		return nil
 	}
 
-	var err error
-	switch e.Action {
-	case canal.InsertAction:
-		err = h.r.insertRows(rule, e.Rows)
-	case canal.DeleteAction:
-		err = h.r.deleteRows(rule, e.Rows)
-	case canal.UpdateAction:
-		err = h.r.updateRows(rule, e.Rows)
-	default:
-		err = errors.Errorf("invalid rows action %s", e.Action)
+	if h.r.isReplayed(e) {
+		log.Debugf("skip replayed %s %s.%s", e.Action, rule.Schema, rule.Table)
+		h.r.st.ReplayedNum.Add(1)
+		return h.r.ctx.Err()
+	}
+
+	h.r.st.batchSize.Observe(float64(len(e.Rows)))
+
+	// with rule_overlap all, the other rules of the table apply the rows too
+	for _, rule := range append([]*Rule{rule}, rule.overlaps...) {
+		if err := h.onRuleRows(rule, e); err != nil {
+			return err
+		}
+	}
+
+	return h.r.ctx.Err() // FIXME
+}
+
+// onRuleRows applies the rows event with the rule, it only returns an
+// error to stop the sync.
+func (h *eventHandler) onRuleRows(rule *Rule, e *canal.RowsEvent) error {
+	if !rule.CheckAction(e.Action) {
+		n := len(e.Rows)
+		if e.Action == canal.UpdateAction {
+			n /= 2
+		}
+		h.r.st.FilteredNum.Add(int64(n))
+		return nil
+	}
+
+	if h.r.skipOOM(rule) {
+		return nil
+	}
+
+	err := h.r.checkTxnTimeout(rule, e)
+	if err == nil {
+		err = h.applyRuleRows(rule, e)
+	}
+	for err != nil {
+		oomPolicy := h.r.c.RedisOOMPolicy
+		if h.r.c.RedisCircuitBreaker && errors.Cause(err) == ErrRedisUnavailable {
+			// with the circuit breaker, wait for Redis and apply the rows again
+			if !h.r.waitRedis(err) {
+				if h.r.ctx.Err() != nil {
+					// closed, the rows are applied again after restart
+					return h.r.ctx.Err()
+				}
+				break
+			}
+		} else if isRedisReply(err, "OOM") && len(oomPolicy) > 0 && oomPolicy != RedisOOMPolicyFail {
+			skip, retry := h.r.handleOOM(rule, err)
+			if skip {
+				return nil
+			} else if !retry {
+				// closed while waiting, the rows are applied again after restart
+				return h.r.ctx.Err()
+			}
+		} else {
+			break
+		}
+		err = h.applyRuleRows(rule, e)
 	}
 
 	if err != nil {
-		h.r.cancel()
-		log.Errorf("sync err %v after binlog %s, close sync", err, h.r.canal.SyncedPosition())
-		return errors.Errorf("%s redis err %v, close sync", e.Action, err)
+		h.r.st.Rule(rule).ErrorNum.Add(1)
+		h.r.recordError(e.Action, ruleKey(rule.Schema, rule.Table), err)
+		h.r.st.statsd.Count("errors", 1, ruleTags(rule, e.Action)...)
+
+		if err = h.r.handleRowsError(rule, e, err); err != nil {
+			if h.r.quarantine(rule, e, err) {
+				return nil
+			}
+
+			h.r.cancel()
+			log.Errorf("sync err %v after binlog %s, close sync", err, h.r.syncedPosition())
+			h.r.alert.Alertf("sync stopped, %s %s.%s err %v after binlog %s", e.Action, rule.Schema, rule.Table, err, h.r.syncedPosition())
+			return errors.Errorf("%s redis err %v, close sync", e.Action, err)
+		}
+
+		return nil
 	}
 
+	h.r.consecutiveErrors = 0
 
-	return h.r.ctx.Err() // FIXME
+	h.r.st.Rule(rule).LastAppliedTime.Set(time.Now().Unix())
+
+	// rows from mysqldump have no binlog header
+	if e.Header != nil {
+		h.r.updateLag(e.Header.Timestamp)
+	}
+
+	return nil
+}
+
+// applyRuleRows writes the rows event to Redis with the rule.
+func (h *eventHandler) applyRuleRows(rule *Rule, e *canal.RowsEvent) error {
+	if len(rule.VersionField) > 0 {
+		h.r.version = h.r.eventVersion(e)
+		h.r.st.LastVersion.Set(h.r.version)
+	}
+
+	err := checkRowColumns(rule, e.Rows)
+	if err == nil && (h.r.mapper != nil || rule.script != nil) {
+		err = h.r.mapRows(rule, e.Action, e.Rows)
+	} else if err == nil {
+		switch e.Action {
+		case canal.InsertAction:
+			err = h.r.insertRows(rule, e.Rows)
+		case canal.DeleteAction:
+			err = h.r.deleteRows(rule, e.Rows)
+		case canal.UpdateAction:
+			err = h.r.updateRows(rule, e.Rows)
+		default:
+			err = errors.Errorf("invalid rows action %s", e.Action)
+		}
+	}
+
+	if err == nil {
+		err = h.r.saveWatermark(e)
+	}
+	return err
 }
 
 func (h *eventHandler) OnGTID(gtid mysql.GTIDSet) error {
@@ -102,9 +225,28 @@ func (h *eventHandler) String() string {
 }
 
 func (r *River) syncLoop() {
-
 	defer r.wg.Done()
 
+	for restarts := 0; ; restarts++ {
+		err := r.runSyncLoop()
+		if err == nil {
+			return
+		}
+
+		if !r.restart("sync loop", restarts, err) {
+			log.Errorf("sync loop err %v, close sync", err)
+			r.alert.Alertf("sync stopped, sync loop err %v", err)
+			r.cancel()
+			return
+		}
+	}
+}
+
+// runSyncLoop saves the positions until the river is closed, it only
+// returns an error on a panic.
+func (r *River) runSyncLoop() (err error) {
+	defer r.recoverPanic("sync loop", &err)
+
 	lastSavedTime := time.Now()
 
 	var pos mysql.Position
@@ -126,19 +268,121 @@ func (r *River) syncLoop() {
 				log.Errorf("invalid event type")
 			}
 		case <-r.ctx.Done():
-			return
+			return nil
 		}
 
 		if needSavePos {
 			if err := r.master.Save(pos); err != nil {
 				log.Errorf("save sync position %s err %v, close sync", pos, err)
+				r.recordError("save", "", err)
+				r.alert.Alertf("sync stopped, save sync position %s err %v", pos, err)
 				r.cancel()
-				return
+				return nil
 			}
 		}
 	}
 }
 
+// handleRowsError applies the rule error policy to the failed rows event,
+// it returns an error if the sync must stop.
+func (r *River) handleRowsError(rule *Rule, e *canal.RowsEvent, err error) error {
+	policy := rule.ErrorPolicy
+	if _, ok := errors.Cause(err).(*oversizeError); ok {
+		policy = ErrorPolicyDeadLetter
+	}
+
+	switch policy {
+	case ErrorPolicySkip:
+		log.Errorf("skip %s %s.%s err %v after binlog %s", e.Action, rule.Schema, rule.Table, err, r.syncedPosition())
+	case ErrorPolicyDeadLetter:
+		if derr := r.deadLetters.Put(rule, e, err); derr != nil {
+			return errors.Annotatef(err, "put dead letter err %v", derr)
+		}
+		r.st.DeadLetterNum.Add(1)
+		log.Errorf("dead letter %s %s.%s err %v after binlog %s", e.Action, rule.Schema, rule.Table, err, r.syncedPosition())
+	default:
+		return err
+	}
+
+	r.st.SkipNum.Add(1)
+	r.st.Rule(rule).SkipNum.Add(1)
+
+	r.consecutiveErrors++
+	if max := r.c.ErrorMaxConsecutive; max > 0 && r.consecutiveErrors >= max {
+		return errors.Annotatef(err, "%d consecutive errors", r.consecutiveErrors)
+	}
+
+	return nil
+}
+
+func (r *River) recordEvent(action string, key string) {
+	r.st.events.Add(sample{
+		Time:   time.Now(),
+		Action: action,
+		Key:    key,
+		Pos:    r.syncedPosition(),
+	})
+}
+
+func (r *River) recordError(action string, key string, err error) {
+	r.st.errors.Add(sample{
+		Time:   time.Now(),
+		Action: action,
+		Key:    key,
+		Pos:    r.syncedPosition(),
+		Err:    err,
+	})
+}
+
+// updateLag records the timestamp of the last applied binlog event, the
+// lag is checked by lagLoop.
+func (r *River) updateLag(timestamp uint32) {
+	r.st.LastEventTime.Set(int64(timestamp))
+}
+
+// lagLoop checks the replication lag every lagInterval, also while no
+// binlog event arrives, as the sync may be stalled.
+func (r *River) lagLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		r.checkLag()
+	}
+}
+
+// checkLag sends the replication lag to StatsD, and logs an error once it
+// exceeds lag_alert_threshold and once it is back under.
+func (r *River) checkLag() {
+	r.st.statsd.Gauge("replication_lag", r.st.Lag().Seconds())
+
+	threshold := r.c.LagAlertThreshold.Duration
+	if threshold <= 0 {
+		return
+	}
+
+	lag := r.st.Lag()
+	if lag > threshold {
+		if !r.st.lagAlerted {
+			log.Errorf("replication lag %s exceeds threshold %s, binlog %s", lag, threshold, r.syncedPosition())
+			r.alert.Alertf("replication lag %s exceeds threshold %s", lag, threshold)
+			r.st.lagAlerted = true
+		}
+	} else if r.st.lagAlerted {
+		log.Infof("replication lag %s is back under threshold %s", lag, threshold)
+		r.alert.Alertf("replication lag %s is back under threshold %s", lag, threshold)
+		r.st.lagAlerted = false
+	}
+}
+
 func (r *River) insertRows(rule *Rule, rows [][]interface{}) error {
 	for _, row := range rows {
 		if err := r.insertRow(rule, row); err != nil {
@@ -149,66 +393,354 @@ func (r *River) insertRows(rule *Rule, rows [][]interface{}) error {
 }
 
 func (r *River) insertRow(rule *Rule, row []interface{}) error {
+	if !rule.MatchRow(row) {
+		r.st.FilteredNum.Add(1)
+		return nil
+	}
+
+	return r.upsertRow(rule, canal.InsertAction, nil, row)
+}
+
+func (r *River) updateRow(rule *Rule, beforeValues []interface{}, afterValues []interface{}) error {
+	return r.upsertRow(rule, canal.UpdateAction, beforeValues, afterValues)
+}
+
+// upsertRow writes the row to its hash key following the rule write policy.
+// For update, before is the row before the change, for insert it is nil.
+func (r *River) upsertRow(rule *Rule, action string, before []interface{}, row []interface{}) error {
 	// 获取主键
 	pk, err := r.getPKValue(rule, row)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	// 获取需要同步的字段value
-	values := make(map[string]interface{}, len(row))
-	for i, c := range rule.TableInfo.Columns {
-		if !rule.CheckFilter(c.Name) {
-			continue
+	// the rollups apply the change of the event, not the rewrite below
+	changed := before
+	if rule.WritePolicy == WritePolicySkip {
+		exists, err := redis.Bool(r.doRedis("EXISTS", pk))
+		if err != nil {
+			log.Errorf("sync err %v after binlog %s", err, r.syncedPosition())
+			return errors.Trace(err)
+		}
+		if exists {
+			log.WithField("key", pk).Debugf("skip %s row, key exists", action)
+			return nil
 		}
-		values[c.Name] = r.makeReqColumnData(&c, row[i])
+		// the key is missing, so write the full row
+		before = nil
 	}
 
 	// 写入哈希表
-	if _, err := r.redisConn.Do("HMSET", redis.Args{}.Add(pk).AddFlat(values)...); err != nil {
-		log.Errorf("sync err %v after binlog %s", err, r.canal.SyncedPosition())
+	cmds, err := r.upsertRowAllCmds(rule, action, pk, before, row)
+	if errors.Cause(err) == errDropRow {
+		log.WithField("key", pk).Warnf("drop oversize %s row", action)
+		return nil
+	} else if err != nil {
 		return errors.Trace(err)
 	}
+	cmds = append(cmds, r.rollupCmds(rule, action, changed, row)...)
 
-	// 更新统计信息
-	r.st.InsertNum.Add(1)
+	if err := r.writeRow(cmds); err != nil {
+		return errors.Trace(err)
+	}
+	r.accountWrite(rule, cmds)
+	if err := r.invalidate(rule, action, before, row); err != nil {
+		return errors.Trace(err)
+	}
 
-	log.Infof("insert row %s to redis", pk)
+	// 更新统计信息
+	r.rowApplied(rule, action, pk)
+	r.recordVerify(rule, pk, row)
+	r.observeProbe(rule, row)
 	return nil
 }
 
-func (r *River) updateRow(rule *Rule, beforeValues []interface{}, afterValues []interface{}) error {
-	// 获取主键
-	pk, err := r.getPKValue(rule, beforeValues)
+// makeRowValues returns the field values to set and the fields to delete
+// for the row, applying the rule filter and NULL policy.
+// If before is not nil, only the changed columns are returned.
+func (r *River) makeRowValues(rule *Rule, before []interface{}, row []interface{}) (map[string]interface{}, []string, error) {
+	values, nulls, err := r.makeRowFields(rule, before, row)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
+	// no event is applied for a repair, so its version is unknown
+	if len(rule.VersionField) > 0 && r.version > 0 && (len(values) > 0 || len(nulls) > 0) {
+		values[rule.VersionField] = r.version
+	}
+	return values, nulls, nil
+}
+
+// makeRowFields is makeRowValues without the version field, it does not
+// read the canal goroutine state, so the background tasks can use it.
+func (r *River) makeRowFields(rule *Rule, before []interface{}, row []interface{}) (map[string]interface{}, []string, error) {
+	values := make(map[string]interface{}, len(row))
+	var nulls []string
+	// the converted row for the transforms, made on demand
+	var data map[string]interface{}
 
-	// 获取需要同步的字段value
-	values := make(map[string]interface{}, len(beforeValues))
 	for i, c := range rule.TableInfo.Columns {
-		if !rule.CheckFilter(c.Name) {
+		if !rule.CheckFilter(c.Name) || rule.isRedisSetColumn(&c) {
 			continue
 		}
-		if reflect.DeepEqual(beforeValues[i], afterValues[i]) {
+		field := rule.FieldName(c.Name)
+		// a template may use other columns, so it is always rendered
+		isTemplate := isTemplateTransform(rule.Transforms[c.Name])
+		if before != nil && reflect.DeepEqual(before[i], row[i]) && !isTemplate {
 			//nothing changed
 			continue
 		}
 
-		values[c.Name] = r.makeReqColumnData(&c, afterValues[i])
+		invalidDate := row[i] != nil && isInvalidDate(&c, row[i])
+		if invalidDate {
+			r.st.InvalidDateNum.Add(1)
+			r.st.Rule(rule).InvalidDateNum.Add(1)
+		}
+
+		if rule.isFlattenJSON(&c) {
+			flatValues, flatNulls := r.flattenJSONValues(rule, &c, field, before, row, i)
+			for k, v := range flatValues {
+				values[k] = v
+			}
+			nulls = append(nulls, flatNulls...)
+			continue
+		}
+
+		if (row[i] == nil || invalidDate && rule.InvalidDatePolicy == InvalidDatePolicyNull) && !isTemplate {
+			switch rule.NullPolicy {
+			case NullPolicyEmpty:
+				values[field] = ""
+			case NullPolicySentinel:
+				values[field] = rule.NullSentinel
+			default:
+				nulls = append(nulls, field)
+			}
+			continue
+		}
+
+		if isInvalidEnumSet(&c, row[i]) {
+			r.st.InvalidEnumNum.Add(1)
+			r.st.Rule(rule).InvalidEnumNum.Add(1)
+
+			switch rule.InvalidEnumPolicy {
+			case InvalidEnumPolicyRaw:
+				values[field] = row[i]
+			case InvalidEnumPolicySkip:
+			case InvalidEnumPolicyError:
+				return nil, nil, errors.Errorf("%s.%s invalid %s value %v for column %s", rule.Schema, rule.Table, c.RawType, rule.logValue(c.Name, row[i]), c.Name)
+			default:
+				values[field] = ""
+			}
+			continue
+		}
+
+		var value interface{}
+		if row[i] != nil {
+			value = r.makeReqColumnData(rule, &c, row[i])
+		}
+		if b, ok := value.([]byte); ok && isBinaryColumn(&c) {
+			v, ok, err := r.binaryValue(rule, field, b)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			} else if !ok {
+				continue
+			}
+			value = v
+		}
+		if t, ok := rule.transforms[c.Name]; ok {
+			if data == nil {
+				data = r.makeRowData(rule, row)
+			}
+			v, err := t(value, data)
+			if err != nil {
+				return nil, nil, errors.Annotatef(rule.redactError(c.Name, err), "%s.%s transform column %s", rule.Schema, rule.Table, c.Name)
+			}
+			value = v
+		}
+		if rule.StrictTypes {
+			value = strictValue(value)
+		}
+		value, ok, err := r.limitValue(rule, field, value)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		} else if !ok {
+			continue
+		}
+		values[field] = value
+	}
+
+	// the computed fields may use any column, so they are written on any change
+	if len(rule.computed) > 0 && (len(values) > 0 || len(nulls) > 0) {
+		if data == nil {
+			data = r.makeRowData(rule, row)
+		}
+		for field, t := range rule.computed {
+			v, err := t(nil, data)
+			if err != nil {
+				return nil, nil, errors.Annotatef(rule.redactError("", err), "%s.%s computed field %s", rule.Schema, rule.Table, field)
+			}
+			v, ok, err := r.limitValue(rule, field, v)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			} else if !ok {
+				continue
+			}
+			values[field] = v
+		}
 	}
-	// 写入哈希表
-	if _, err := r.redisConn.Do("HMSET", redis.Args{}.Add(pk).AddFlat(values)...); err != nil {
-		log.Errorf("sync err %v after binlog %s", err, r.canal.SyncedPosition())
-		return errors.Trace(err)
+
+	if rule.StrictTypes && (len(values) > 0 || len(nulls) > 0) {
+		values[rule.TypesField] = typesValue(rule)
 	}
 
-	// 更新统计信息
-	r.st.UpdateNum.Add(1)
-	log.Infof("update row %s to redis", pk)
+	return values, nulls, nil
+}
+
+// makeRowData returns the converted values of all the row columns by
+// column name, NULL as an empty string.
+func (r *River) makeRowData(rule *Rule, row []interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(row))
+	for i, c := range rule.TableInfo.Columns {
+		if i >= len(row) {
+			break
+		}
+		if row[i] == nil {
+			data[c.Name] = ""
+			continue
+		}
+		data[c.Name] = r.makeReqColumnData(rule, &rule.TableInfo.Columns[i], row[i])
+	}
+	return data
+}
+
+// upsertRowAllCmds returns the commands to write the row to the hash key and the other outputs
+// but the rollups, so it also rewrites a row, like a repair, without counting it again.
+func (r *River) upsertRowAllCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) ([]redisCmd, error) {
+	var cmds []redisCmd
+	if rule.hasHashOutput() {
+		var err error
+		if cmds, err = r.upsertRowCmds(rule, key, before, row); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	outputCmds, err := r.outputCmds(rule, action, key, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	nestedCmds, err := r.nestedCmds(rule, action, key, before, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cmds = append(cmds, outputCmds...)
+	cmds = append(cmds, nestedCmds...)
+	return append(cmds, r.rowIndexCmds(rule, action, key, before, row)...), nil
+}
+
+// upsertRowCmds returns the commands to write the row to the hash key.
+// With the overwrite policy, or purge_stale_fields on a full-row write, the key
+// is deleted first and the full row is written, otherwise only the columns
+// changed from before are merged into the key. Then the TTL of the row is set.
+func (r *River) upsertRowCmds(rule *Rule, key string, before []interface{}, row []interface{}) ([]redisCmd, error) {
+	purge := rule.WritePolicy == WritePolicyOverwrite || (before == nil && rule.PurgeStaleFields)
+
+	var cmds []redisCmd
+	if purge {
+		cmds = append(cmds, newRedisCmd("DEL", key))
+		before = nil
+	}
+
+	values, nulls, err := r.makeRowValues(rule, before, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if purge {
+		// no field is left to delete after DEL
+		nulls = nil
+	}
+
+	ttl := rule.rowTTL(row)
+	cmds = append(cmds, chunkCmds(rule, key, values, ttl)...)
+	cmds = append(cmds, writeRowCmds(key, values, nulls)...)
+
+	if ttl > 0 {
+		cmds = append(cmds, newRedisCmd("EXPIRE", key, int64(ttl/time.Second)))
+	} else if rule.hasTTL() && !purge {
+		// the row may have had a TTL by another condition
+		cmds = append(cmds, newRedisCmd("PERSIST", key))
+	}
+
+	return cmds, nil
+}
+
+// writeRowCmds returns the commands to set the values and delete the
+// null fields in the hash key.
+func writeRowCmds(key string, values map[string]interface{}, nulls []string) []redisCmd {
+	var cmds []redisCmd
+	if len(values) > 0 {
+		cmds = append(cmds, newRedisCmd("HMSET", redis.Args{}.Add(key).AddFlat(values)...))
+	}
+	if len(nulls) > 0 {
+		cmds = append(cmds, newRedisCmd("HDEL", redis.Args{}.Add(key).AddFlat(nulls)...))
+	}
+	return cmds
+}
+
+// deleteRowCmds returns the commands to delete the row in the hash key.
+// With the overwrite policy the whole key is deleted, otherwise only the
+// row fields are, keeping the fields written by others.
+func deleteRowCmds(rule *Rule, key string) []redisCmd {
+	cmds := chunkDeleteCmds(rule, key, chunkFields(rule))
+	if rule.WritePolicy == WritePolicyOverwrite {
+		return append(cmds, newRedisCmd("DEL", key))
+	}
+
+	args := redis.Args{}.Add(key)
+	for _, c := range rule.TableInfo.Columns {
+		args = args.Add(rule.FieldName(c.Name))
+	}
+	for field := range rule.Computed {
+		args = args.Add(field)
+	}
+	return append(cmds, newRedisCmd("HDEL", args...))
+}
+
+// writeRow runs the commands for one row, in a transaction if there are
+// more than one, so the key is never seen deleted or half written.
+func (r *River) writeRow(cmds []redisCmd) error {
+	var err error
+	if len(cmds) > 1 {
+		err = r.doRedisMulti(cmds)
+	} else {
+		err = r.doRedisCmds(cmds)
+	}
+
+	if err != nil {
+		log.Errorf("sync err %v after binlog %s", err, r.syncedPosition())
+		return errors.Trace(err)
+	}
 	return nil
 }
 
+// rowApplied updates the statistics after the row is written to Redis.
+func (r *River) rowApplied(rule *Rule, action string, key string) {
+	switch action {
+	case canal.InsertAction:
+		r.st.InsertNum.Add(1)
+		r.st.Rule(rule).InsertNum.Add(1)
+	case canal.UpdateAction:
+		r.st.UpdateNum.Add(1)
+		r.st.Rule(rule).UpdateNum.Add(1)
+	case canal.DeleteAction:
+		r.st.DeleteNum.Add(1)
+		r.st.Rule(rule).DeleteNum.Add(1)
+	}
+
+	r.recordEvent(action, key)
+	r.st.statsd.Count("rows", 1, ruleTags(rule, action)...)
+
+	log.WithField("key", key).Debugf("%s row to redis", action)
+}
+
 func (r *River) deleteRows(rule *Rule, rows [][]interface{}) error {
 	for _, row := range rows {
 		if err := r.deleteRow(rule, row); err != nil {
@@ -226,18 +758,36 @@ func (r *River) deleteRow(rule *Rule, row []interface{}) error {
 		return errors.Trace(err)
 	}
 
-	// 遍历哈希表中key的所有字段，逐个删除
-	for _, c := range rule.TableInfo.Columns {
-		// FIXME:字段不存在，是否返回错误
-		if _, err := r.redisConn.Do("HDEL", pk, c.Name); err != nil {
-			log.Errorf("sync err %v after binlog %s", err, r.canal.SyncedPosition())
-			return errors.Trace(err)
-		}
+	// 删除哈希表中key的所有字段
+	var cmds []redisCmd
+	if rule.hasHashOutput() {
+		cmds = deleteRowCmds(rule, pk)
+	}
+
+	outputCmds, err := r.outputCmds(rule, canal.DeleteAction, pk, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	nestedCmds, err := r.nestedCmds(rule, canal.DeleteAction, pk, nil, row)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cmds = append(cmds, outputCmds...)
+	cmds = append(cmds, nestedCmds...)
+	cmds = append(cmds, r.rowIndexCmds(rule, canal.DeleteAction, pk, nil, row)...)
+	cmds = append(cmds, r.rollupCmds(rule, canal.DeleteAction, nil, row)...)
+
+	if err := r.writeRow(cmds); err != nil {
+		return errors.Trace(err)
+	}
+	r.accountWrite(rule, cmds)
+	if err := r.invalidate(rule, canal.DeleteAction, nil, row); err != nil {
+		return errors.Trace(err)
 	}
 
 	// 更新统计信息
-	r.st.DeleteNum.Add(1)
-	log.Infof("delete row %s from redis", pk)
+	r.rowApplied(rule, canal.DeleteAction, pk)
+	r.recordVerify(rule, pk, row)
 
 	return nil
 }
@@ -248,6 +798,25 @@ func (r *River) updateRows(rule *Rule, rows [][]interface{}) error {
 	}
 
 	for i := 0; i < len(rows); i += 2 {
+		beforeMatch, afterMatch := rule.MatchRow(rows[i]), rule.MatchRow(rows[i+1])
+		switch {
+		case !beforeMatch && !afterMatch:
+			r.st.FilteredNum.Add(1)
+			continue
+		case beforeMatch && !afterMatch:
+			// the row leaves the row_filter, remove it from Redis
+			if err := r.deleteRow(rule, rows[i]); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		case !beforeMatch && afterMatch:
+			// the row enters the row_filter, it is not in Redis yet
+			if err := r.insertRow(rule, rows[i+1]); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
 		beforePK, err := r.getPKValue(rule, rows[i])
 		if err != nil {
 			return errors.Trace(err)
@@ -260,27 +829,106 @@ func (r *River) updateRows(rule *Rule, rows [][]interface{}) error {
 		}
 
 		if beforePK != afterPK {
-			// 删除旧记录
-			if err := r.deleteRow(rule, rows[i]); err != nil {
+			// 删除旧记录并插入新记录
+			if err := r.moveRow(rule, beforePK, afterPK, rows[i], rows[i+1]); err != nil {
 				return errors.Trace(err)
 			}
+		} else if err := r.updateRow(rule, rows[i], rows[i+1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
-			// 插入新记录
-			if err := r.insertRow(rule, rows[i+1]); err != nil {
-				return errors.Trace(err)
-			}
-		} else {
-			r.updateRow(rule, rows[i], rows[i+1])
+	return nil
+}
 
+// moveRow deletes the row under the old key and writes it under the new key
+// in one transaction, so a PK change never leaves both keys or neither.
+// In Redis Cluster with the keys in different slots, it falls back to moveRowOrdered.
+func (r *River) moveRow(rule *Rule, oldKey string, newKey string, before []interface{}, row []interface{}) error {
+	write := true
+	if rule.WritePolicy == WritePolicySkip {
+		exists, err := redis.Bool(r.doRedis("EXISTS", newKey))
+		if err != nil {
+			log.Errorf("sync err %v after binlog %s", err, r.syncedPosition())
+			return errors.Trace(err)
 		}
+		write = !exists
+	}
 
+	var deleteCmds, writeCmds []redisCmd
+	if rule.hasHashOutput() {
+		deleteCmds = deleteRowCmds(rule, oldKey)
+	}
+	outputCmds, err := r.outputCmds(rule, canal.DeleteAction, oldKey, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	deleteCmds = append(deleteCmds, outputCmds...)
+	nestedCmds, err := r.nestedCmds(rule, canal.DeleteAction, oldKey, nil, before)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	deleteCmds = append(deleteCmds, nestedCmds...)
+	deleteCmds = append(deleteCmds, r.rowIndexCmds(rule, canal.DeleteAction, oldKey, nil, before)...)
+	deleteCmds = append(deleteCmds, r.rollupCmds(rule, canal.DeleteAction, nil, before)...)
+
+	if write {
+		writeCmds, err = r.upsertRowAllCmds(rule, canal.InsertAction, newKey, nil, row)
+		if errors.Cause(err) == errDropRow {
+			// only delete the old key
+			log.WithField("key", newKey).Warnf("drop oversize moved row")
+			write = false
+		} else if err != nil {
+			return errors.Trace(err)
+		} else {
+			writeCmds = append(writeCmds, r.rollupCmds(rule, canal.InsertAction, nil, row)...)
+		}
+	}
+
+	if r.c.RedisCluster && keySlot(oldKey) != keySlot(newKey) {
+		err = r.moveRowOrdered(rule, oldKey, newKey, deleteCmds, writeCmds)
+	} else {
+		err = r.doRedisMulti(append(deleteCmds, writeCmds...))
+	}
+	if err != nil {
+		log.Errorf("sync err %v after binlog %s", err, r.syncedPosition())
+		return errors.Trace(err)
+	}
+	r.accountWrite(rule, deleteCmds)
+	r.accountWrite(rule, writeCmds)
+	if err = r.invalidate(rule, canal.UpdateAction, before, row); err != nil {
+		return errors.Trace(err)
 	}
 
+	r.rowApplied(rule, canal.DeleteAction, oldKey)
+	r.recordVerify(rule, oldKey, before)
+	if write {
+		r.rowApplied(rule, canal.InsertAction, newKey)
+		r.recordVerify(rule, newKey, row)
+	}
 	return nil
 }
 
-func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) interface{} {
+func (r *River) makeReqColumnData(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	if isGeometryColumn(col) {
+		return geometryValue(rule, col, value)
+	}
+
 	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		if rule.isEpochColumn(col) {
+			if col.IsUnsigned {
+				value = unsignedValue(col, value)
+			}
+			return epochValue(rule, value)
+		}
+		if isYearColumn(col) {
+			return yearValue(value)
+		}
+		if col.IsUnsigned {
+			// binlog decodes integers as signed, so large unsigned values are negative
+			return unsignedValue(col, value)
+		}
 	case schema.TYPE_ENUM:
 		switch value := value.(type) {
 		case int64:
@@ -305,41 +953,50 @@ func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) in
 					sets = append(sets, s)
 				}
 			}
-			return strings.Join(sets, ",")
-		}
-	case schema.TYPE_BIT:
-		switch value := value.(type) {
+			return setValue(rule, strings.Join(sets, ","))
 		case string:
-			// for binlog, BIT is int64, but for dump, BIT is string
-			// for dump 0x01 is for 1, \0 is for 0
-			if value == "\x01" {
-				return int64(1)
-			}
-
-			return int64(0)
+			return setValue(rule, value)
 		}
+	case schema.TYPE_BIT:
+		// for binlog, BIT is int64, but for dump, BIT is string
+		return bitValue(rule, col, value)
 	case schema.TYPE_STRING:
+		if isBinaryColumn(col) {
+			return binaryBytes(value)
+		}
+		var s string
 		switch value := value.(type) {
 		case []byte:
-			return string(value[:])
+			s = decodeString(rule, col, value)
+		case string:
+			s = decodeString(rule, col, []byte(value))
+		default:
+			return value
+		}
+		if rule.isListColumn(col) && rule.ListFormat == ListFormatJSON {
+			return listValue(rule, s)
 		}
+		return s
 	case schema.TYPE_JSON:
-		var f interface{}
-		var err error
+		return jsonValue(rule, value)
+	case schema.TYPE_DECIMAL:
+		return decimalValue(value)
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		if isInvalidDate(col, value) {
+			return invalidDateValue(rule, col, value)
+		}
 		switch v := value.(type) {
 		case string:
-			err = json.Unmarshal([]byte(v), &f)
-		case []byte:
-			err = json.Unmarshal(v, &f)
+			return formatTime(rule, col.Name, v, columnFsp(col))
 		}
-		if err == nil && f != nil {
-			return f
+	case schema.TYPE_DATE:
+		if isInvalidDate(col, value) {
+			return invalidDateValue(rule, col, value)
 		}
-	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+	case schema.TYPE_TIME:
 		switch v := value.(type) {
 		case string:
-			vt, _ := time.ParseInLocation(mysql.TimeFormat, string(v), time.Local)
-			return vt.Format(time.RFC3339)
+			return formatTimeColumn(rule, col.Name, v, columnFsp(col))
 		}
 	}
 
@@ -365,27 +1022,35 @@ func (r *River) getFieldParts(k string, v string) (string, string, string) {
 }
 */
 
-// If id in toml file is none, get primary keys in one row and format them into a string, and PK must not be nil
-// Else get the ID's column in one row and format them into a string
+// If key_columns in toml file is none, get primary keys in one row and format them into a string, and PK must not be nil
+// Else get the key columns in one row and format them into a string
+// For a table without PK and the hash no_pk_strategy, use the hash of all columns
 func (r *River) getPKValue(rule *Rule, row []interface{}) (string, error) {
 	var (
 		pks []interface{}
 		err error
 	)
 
-	pks, err = rule.TableInfo.GetPKValues(row)
+	switch {
+	case len(rule.KeyColumns) > 0:
+		pks, err = getKeyColumnValues(rule, row)
+	case len(rule.TableInfo.PKColumns) == 0 && rule.NoPKStrategy == NoPKStrategyHash:
+		pks = []interface{}{hashRow(row)}
+	default:
+		pks, err = rule.TableInfo.GetPKValues(row)
+	}
 	if err != nil {
-		return "", err
+		return "", wrapError(err, ErrPKMissing)
 	}
 
 	var buf bytes.Buffer
 
 	sep := ":"
-	buf.WriteString(fmt.Sprintf("%s%s%s", rule.Schema, sep, rule.Table))
+	buf.WriteString(rule.rowKeyPrefix(row))
 
 	for i, value := range pks {
 		if value == nil {
-			return "", errors.Errorf("The %ds id or PK value is nil", i)
+			return "", wrapError(errors.Errorf("The %ds id or PK value is nil", i), ErrPKMissing)
 		}
 
 		buf.WriteString(fmt.Sprintf("%s%v", sep, value))
@@ -394,6 +1059,27 @@ func (r *River) getPKValue(rule *Rule, row []interface{}) (string, error) {
 	return buf.String(), nil
 }
 
+func getKeyColumnValues(rule *Rule, row []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(rule.KeyColumns))
+	for _, name := range rule.KeyColumns {
+		i := rule.TableInfo.FindColumn(name)
+		if i == -1 || i >= len(row) {
+			return nil, errors.Errorf("%s.%s key column %s not found", rule.Schema, rule.Table, name)
+		}
+		values = append(values, row[i])
+	}
+	return values, nil
+}
+
+// hashRow returns the SHA1 hex of all the column values.
+func hashRow(row []interface{}) string {
+	h := sha1.New()
+	for _, value := range row {
+		fmt.Fprintf(h, "%v\x00", value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 /**
 func (r *River) doBulk(reqs []*elastic.BulkRequest) error {
 	if len(reqs) == 0 {
@@ -401,7 +1087,7 @@ func (r *River) doBulk(reqs []*elastic.BulkRequest) error {
 	}
 
 	if resp, err := r.es.Bulk(reqs); err != nil {
-		log.Errorf("sync docs err %v after binlog %s", err, r.canal.SyncedPosition())
+		log.Errorf("sync docs err %v after binlog %s", err, r.syncedPosition())
 		return errors.Trace(err)
 	} else if resp.Code/100 == 2 || resp.Errors {
 		for i := 0; i < len(resp.Items); i++ {
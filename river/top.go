@@ -0,0 +1,44 @@
+package river
+
+import (
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// topCmds returns the commands to keep the row with the key in the sorted
+// sets of its group by the top outputs, the key with {column} replaced by
+// the row values, scored by the column and trimmed to max_len. before is
+// the row before an update, nil if unknown, and row is the deleted row for
+// delete. A row moved to another group is removed from the old one, and a
+// row without group or score is removed.
+func (r *River) topCmds(rule *Rule, action string, key string, before []interface{}, row []interface{}) []redisCmd {
+	var cmds []redisCmd
+	for _, o := range rule.Outputs {
+		if o.Type != OutputTop {
+			continue
+		}
+
+		group := columnKey(rule, o.Key, row)
+		if before != nil {
+			if old := columnKey(rule, o.Key, before); len(old) > 0 && old != group {
+				cmds = append(cmds, newRedisCmd("ZREM", old, key))
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+
+		i := rule.TableInfo.FindColumn(o.Column)
+		if i < 0 || i >= len(row) {
+			continue
+		}
+		score, ok := r.rangeScore(rule, &rule.TableInfo.Columns[i], row[i])
+		if action == canal.DeleteAction || !ok {
+			cmds = append(cmds, newRedisCmd("ZREM", group, key))
+			continue
+		}
+		cmds = append(cmds, newRedisCmd("ZADD", group, score, key))
+		// keep the max_len highest scores
+		cmds = append(cmds, newRedisCmd("ZREMRANGEBYRANK", group, 0, -o.MaxLen-1))
+	}
+	return cmds
+}
@@ -0,0 +1,233 @@
+package river
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const (
+	templateTransformPrefix = "template:"
+	dropTransform           = "drop"
+)
+
+// transform converts the column value, row is the converted values of all
+// the row columns by name, used by templates.
+type transform func(value interface{}, row map[string]interface{}) (interface{}, error)
+
+// parseTransform compiles the transform of a column, which is either a
+// template like "template:{{ .title }} - {{ .content }}", or functions
+// chained by "|" like "trim|lower":
+//
+//	lower, upper, trim      change the string value
+//	hash                    HMAC-SHA256 hex with the rule mask_salt
+//	redact or redact:<n>    masks all but the last 4 or n characters
+//	drop                    never writes the column, can not be chained
+//	encrypt                 AES-GCM with the rule encrypt_key, see DecryptValue
+//	rfc3339                 converts unix seconds to RFC3339 in the rule time zone
+//	split or split:<sep>    splits the string by "," or sep to a JSON array
+func parseTransform(rule *Rule, s string) (transform, error) {
+	if strings.HasPrefix(s, templateTransformPrefix) {
+		t, err := template.New("transform").Option("missingkey=error").Funcs(templateFuncs).Parse(s[len(templateTransformPrefix):])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, row); err != nil {
+				return nil, errors.Trace(err)
+			}
+			return buf.String(), nil
+		}, nil
+	}
+
+	var fns []transform
+	for _, name := range strings.Split(s, "|") {
+		name = strings.TrimSpace(name)
+		var fn transform
+		switch {
+		case name == "lower":
+			fn = stringTransform(strings.ToLower)
+		case name == "upper":
+			fn = stringTransform(strings.ToUpper)
+		case name == "trim":
+			fn = stringTransform(strings.TrimSpace)
+		case name == "hash":
+			if len(rule.MaskSalt) == 0 {
+				// an unkeyed hash of a known value is looked up by hashing it
+				return nil, errors.Errorf("mask_salt must be set for transform hash")
+			}
+			fn = hashTransform(rule.MaskSalt)
+		case name == "redact":
+			fn = redactTransform(4)
+		case strings.HasPrefix(name, "redact:"):
+			n, err := strconv.Atoi(name[len("redact:"):])
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("invalid transform %s", name)
+			}
+			fn = redactTransform(n)
+		case name == "encrypt":
+			if !rule.hasEncryptKey() {
+				return nil, errors.Errorf("encrypt_key must be set for transform encrypt")
+			}
+			fn = encryptTransform(rule)
+		case name == "drop":
+			return nil, errors.Errorf("transform drop can not be chained")
+		case name == "rfc3339":
+			fn = epochTransform(rule.location)
+		case name == "split":
+			fn = splitTransform(",")
+		case strings.HasPrefix(name, "split:"):
+			fn = splitTransform(name[len("split:"):])
+		default:
+			return nil, errors.Errorf("unknown transform %s", name)
+		}
+		fns = append(fns, fn)
+	}
+
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		var err error
+		for _, fn := range fns {
+			if value, err = fn(value, row); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return value, nil
+	}, nil
+}
+
+// templateFuncs are the functions for the transform templates, the values
+// are numbers or time strings of the row, like {{ mul .price .qty }} or
+// {{ yyyymm .created_at }}.
+var templateFuncs = template.FuncMap{
+	"add": func(x, y interface{}) (string, error) {
+		return arithmetic(x, y, func(a, b float64) float64 { return a + b })
+	},
+	"sub": func(x, y interface{}) (string, error) {
+		return arithmetic(x, y, func(a, b float64) float64 { return a - b })
+	},
+	"mul": func(x, y interface{}) (string, error) {
+		return arithmetic(x, y, func(a, b float64) float64 { return a * b })
+	},
+	"div": func(x, y interface{}) (string, error) {
+		if f, ok := toFloat(normalizeExprValue(y)); ok && f == 0 {
+			return "", errors.Errorf("division by zero")
+		}
+		return arithmetic(x, y, func(a, b float64) float64 { return a / b })
+	},
+	"date": func(layout string, value interface{}) (string, error) {
+		t, err := toTime(value)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return t.Format(layout), nil
+	},
+	"yyyymm": func(value interface{}) (string, error) {
+		t, err := toTime(value)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return t.Format("200601"), nil
+	},
+}
+
+func arithmetic(x, y interface{}, fn func(a, b float64) float64) (string, error) {
+	a, ok := toFloat(normalizeExprValue(x))
+	if !ok {
+		return "", errors.Errorf("invalid number %v", x)
+	}
+	b, ok := toFloat(normalizeExprValue(y))
+	if !ok {
+		return "", errors.Errorf("invalid number %v", y)
+	}
+	return strconv.FormatFloat(fn(a, b), 'f', -1, 64), nil
+}
+
+// toTime parses the unix seconds in UTC or the time string of a column.
+func toTime(value interface{}) (time.Time, error) {
+	s := transformString(value)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
+	}
+
+	for _, layout := range []string{mysql.TimeFormat, time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid time %s", s)
+}
+
+func isTemplateTransform(s string) bool {
+	return strings.HasPrefix(s, templateTransformPrefix)
+}
+
+func transformString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+func stringTransform(fn func(string) string) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		return fn(transformString(value)), nil
+	}
+}
+
+func hashTransform(salt string) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		h := hmac.New(sha256.New, []byte(salt))
+		h.Write([]byte(transformString(value)))
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+func redactTransform(keep int) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		rs := []rune(transformString(value))
+		for i := 0; i < len(rs)-keep; i++ {
+			rs[i] = '*'
+		}
+		return string(rs), nil
+	}
+}
+
+func epochTransform(loc *time.Location) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		n, err := strconv.ParseInt(transformString(value), 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid unix time %v", value)
+		}
+		return time.Unix(n, 0).In(loc).Format(time.RFC3339), nil
+	}
+}
+
+func splitTransform(sep string) transform {
+	return func(value interface{}, row map[string]interface{}) (interface{}, error) {
+		items := []string{}
+		if s := transformString(value); len(s) > 0 {
+			items = strings.Split(s, sep)
+		}
+		data, err := json.Marshal(items)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return string(data), nil
+	}
+}
@@ -0,0 +1,68 @@
+package river
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	log "github.com/sirupsen/logrus"
+)
+
+// txnTimeoutError is the error of the rows events of a transaction
+// applied after it exceeded txn_timeout.
+type txnTimeoutError struct {
+	elapsed time.Duration
+	timeout time.Duration
+}
+
+func (e *txnTimeoutError) Error() string {
+	return fmt.Sprintf("transaction applied for %s exceeds txn_timeout %s", e.elapsed, e.timeout)
+}
+
+// checkTxnTimeout returns an error if the transaction of the rows event
+// already spent more than txn_timeout applying to Redis, so the error
+// policy applies to the rest of it. The first time, it alerts. The time
+// paused or waiting for Redis does not count.
+func (r *River) checkTxnTimeout(rule *Rule, e *canal.RowsEvent) error {
+	timeout := r.c.TxnTimeout.Duration
+	// rows from mysqldump have no binlog header nor transaction
+	if timeout <= 0 || e.Header == nil {
+		return nil
+	}
+
+	if r.txnStart.IsZero() {
+		r.txnStart = time.Now()
+		return nil
+	}
+
+	elapsed := time.Since(r.txnStart) - r.txnWaited
+	if elapsed < timeout {
+		return nil
+	}
+
+	if !r.txnTimedOut {
+		r.txnTimedOut = true
+		r.st.TxnTimeoutNum.Add(1)
+		log.Errorf("transaction applied for %s exceeds txn_timeout %s at %s %s.%s binlog pos %d",
+			elapsed, timeout, e.Action, rule.Schema, rule.Table, e.Header.LogPos)
+		r.alert.Alertf("transaction applied for %s exceeds txn_timeout %s at binlog pos %d, the error policy applies to the rest of it",
+			elapsed, timeout, e.Header.LogPos)
+	}
+
+	return &txnTimeoutError{elapsed: elapsed, timeout: timeout}
+}
+
+// waitedTxn stops the clock of the transaction for the wait since start,
+// while paused or waiting for Redis.
+func (r *River) waitedTxn(start time.Time) {
+	if !r.txnStart.IsZero() {
+		r.txnWaited += time.Since(start)
+	}
+}
+
+// endTxn starts the budget of the next transaction.
+func (r *River) endTxn() {
+	r.txnStart = time.Time{}
+	r.txnWaited = 0
+	r.txnTimedOut = false
+}
@@ -0,0 +1,443 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// columnTypeName returns the type name stored in the types field for strict_types.
+func columnTypeName(col *schema.TableColumn) string {
+	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		if col.IsUnsigned {
+			return "uint"
+		}
+		return "int"
+	case schema.TYPE_FLOAT:
+		return "float"
+	case schema.TYPE_DECIMAL:
+		return "decimal"
+	case schema.TYPE_ENUM:
+		return "enum"
+	case schema.TYPE_SET:
+		return "set"
+	case schema.TYPE_BIT:
+		return "bit"
+	case schema.TYPE_JSON:
+		return "json"
+	case schema.TYPE_DATETIME:
+		return "datetime"
+	case schema.TYPE_TIMESTAMP:
+		return "timestamp"
+	case schema.TYPE_DATE:
+		return "date"
+	case schema.TYPE_TIME:
+		return "time"
+	default:
+		if isBinaryColumn(col) {
+			return "binary"
+		}
+		if isGeometryColumn(col) {
+			return "geometry"
+		}
+		return "string"
+	}
+}
+
+// strictValue encodes numbers without exponent or rounding and
+// JSON values as JSON, instead of leaving them to redigo formatting.
+func strictValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return value
+		}
+		return string(data)
+	}
+	return value
+}
+
+// typesValue returns the JSON object of field name to type name
+// for the columns synced by the rule.
+func typesValue(rule *Rule) string {
+	types := make(map[string]string, len(rule.TableInfo.Columns))
+	for i, c := range rule.TableInfo.Columns {
+		if !rule.CheckFilter(c.Name) {
+			continue
+		}
+		if rule.isEpochColumn(&c) {
+			types[rule.FieldName(c.Name)] = "datetime"
+			continue
+		}
+		if rule.isListColumn(&c) {
+			types[rule.FieldName(c.Name)] = "list"
+			continue
+		}
+		types[rule.FieldName(c.Name)] = columnTypeName(&rule.TableInfo.Columns[i])
+	}
+
+	data, _ := json.Marshal(types)
+	return string(data)
+}
+
+// formatTime converts the DATETIME or TIMESTAMP string of the column in the
+// rule time zone to the rule time format, with the fsp digits of fractional
+// seconds.
+func formatTime(rule *Rule, column string, value string, fsp int) interface{} {
+	if rule.TimeFormat == TimeFormatRaw {
+		return value
+	}
+
+	t, err := time.ParseInLocation(mysql.TimeFormat, value, rule.location)
+	if err != nil {
+		log.Warnf("invalid time %v for %s.%s column %s, keep it raw", rule.logValue(column, value), rule.Schema, rule.Table, column)
+		return value
+	}
+	return formatTimeValue(rule, t, fsp)
+}
+
+// formatTimeValue converts the time to the rule time format.
+func formatTimeValue(rule *Rule, t time.Time, fsp int) interface{} {
+	switch rule.TimeFormat {
+	case TimeFormatRaw:
+		return t.Format(mysql.TimeFormat)
+	case TimeFormatUnix:
+		return t.Unix()
+	case TimeFormatUnixMilli:
+		return t.UnixNano() / int64(time.Millisecond)
+	case TimeFormatUnixMicro:
+		return t.UnixNano() / int64(time.Microsecond)
+	default:
+		if fsp > 0 {
+			return t.Format("2006-01-02T15:04:05." + strings.Repeat("0", fsp) + "Z07:00")
+		}
+		return t.Format(time.RFC3339)
+	}
+}
+
+// checkEpochColumns returns an error for a column of epoch_columns not in
+// the table or not an integer, which would be written as it is.
+func (r *Rule) checkEpochColumns() error {
+	for _, name := range r.EpochColumns {
+		i := r.TableInfo.FindColumn(name)
+		if i == -1 {
+			return errors.Errorf("%s.%s epoch column %s not found", r.Schema, r.Table, name)
+		}
+		if col := &r.TableInfo.Columns[i]; !r.isEpochColumn(col) {
+			return errors.Errorf("%s.%s epoch column %s must be an integer, but is %s", r.Schema, r.Table, name, col.RawType)
+		}
+	}
+	return nil
+}
+
+// isEpochColumn returns true for an integer column of unix timestamps
+// listed in the rule epoch_columns.
+func (r *Rule) isEpochColumn(col *schema.TableColumn) bool {
+	return r.epoch[col.Name] && (col.Type == schema.TYPE_NUMBER || col.Type == schema.TYPE_MEDIUM_INT)
+}
+
+// epochValue converts the unix timestamp in the rule epoch_unit to the
+// epoch_layout, or the time_format, in the rule time zone. Values which
+// are not integers are kept.
+func epochValue(rule *Rule, value interface{}) interface{} {
+	var n int64
+	switch v := value.(type) {
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case int:
+		n = int64(v)
+	case uint32:
+		n = int64(v)
+	case uint64:
+		n = int64(v)
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return value
+		}
+		n = i
+	default:
+		return value
+	}
+
+	var t time.Time
+	fsp := 0
+	if rule.EpochUnit == EpochUnitMilli {
+		t = time.Unix(n/1000, n%1000*int64(time.Millisecond))
+		fsp = 3
+	} else {
+		t = time.Unix(n, 0)
+	}
+	t = t.In(rule.location)
+	if len(rule.EpochLayout) > 0 {
+		return t.Format(rule.EpochLayout)
+	}
+	if rule.TimeFormat == TimeFormatRaw && fsp > 0 {
+		return t.Format(mysql.TimeFormat + ".000")
+	}
+	return formatTimeValue(rule, t, fsp)
+}
+
+// columnFsp returns the fractional seconds precision of the TIME, DATETIME
+// or TIMESTAMP column, like 3 for datetime(3).
+func columnFsp(col *schema.TableColumn) int {
+	if fsp := columnLength(col); fsp <= 6 {
+		return fsp
+	}
+	return 0
+}
+
+// columnLength returns the length of the column type, like 5 for bit(5),
+// 0 if it has none.
+func columnLength(col *schema.TableColumn) int {
+	i := strings.Index(col.RawType, "(")
+	j := strings.Index(col.RawType, ")")
+	if i < 0 || j < i {
+		return 0
+	}
+	n, err := strconv.Atoi(col.RawType[i+1 : j])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// bitValue returns the BIT(n) value, an int64 from binlog, or big-endian
+// bytes or a b'0101' literal from the dump, as an integer or a bitstring
+// of n digits by the rule bit_format.
+func bitValue(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	var v uint64
+	switch value := value.(type) {
+	case int64:
+		v = uint64(value)
+	case string:
+		if strings.HasPrefix(value, "b'") && strings.HasSuffix(value, "'") {
+			n, err := strconv.ParseUint(value[2:len(value)-1], 2, 64)
+			if err != nil {
+				return value
+			}
+			v = n
+			break
+		}
+		for i := 0; i < len(value); i++ {
+			v = v<<8 | uint64(value[i])
+		}
+	case []byte:
+		for _, b := range value {
+			v = v<<8 | uint64(b)
+		}
+	default:
+		return value
+	}
+
+	if rule.BitFormat == BitFormatBitString {
+		n := columnLength(col)
+		s := strconv.FormatUint(v, 2)
+		if len(s) < n {
+			s = strings.Repeat("0", n-len(s)) + s
+		}
+		return s
+	}
+	if v > math.MaxInt64 {
+		return v
+	}
+	return int64(v)
+}
+
+// isYearColumn returns true for YEAR, which go-mysql reads as a number.
+func isYearColumn(col *schema.TableColumn) bool {
+	return strings.HasPrefix(strings.ToLower(col.RawType), "year")
+}
+
+// yearValue returns the YEAR as an integer, it is a string in the dump,
+// 0 for 0000.
+func yearValue(value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+// formatTimeColumn converts the TIME string of the column, like -838:59:59 or
+// 12:34:56.5, to the rule time_column_format with the fsp digits of
+// fractional seconds.
+func formatTimeColumn(rule *Rule, column string, value string, fsp int) interface{} {
+	sign := ""
+	s := value
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	frac := ""
+	if i := strings.Index(s, "."); i >= 0 {
+		s, frac = s[:i], s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		log.Warnf("invalid time %v for %s.%s column %s, keep it raw", rule.logValue(column, value), rule.Schema, rule.Table, column)
+		return value
+	}
+	var hms [3]int64
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			log.Warnf("invalid time %v for %s.%s column %s, keep it raw", rule.logValue(column, value), rule.Schema, rule.Table, column)
+			return value
+		}
+		hms[i] = n
+	}
+
+	// the fraction is padded or cut to the column precision
+	if len(frac) < fsp {
+		frac += strings.Repeat("0", fsp-len(frac))
+	}
+	frac = frac[:fsp]
+	if fsp > 0 {
+		frac = "." + frac
+	}
+	if sign == "-" && hms[0] == 0 && hms[1] == 0 && hms[2] == 0 && strings.Trim(frac, ".0") == "" {
+		sign = ""
+	}
+
+	switch rule.TimeColumnFormat {
+	case TimeColumnFormatSeconds:
+		seconds := hms[0]*3600 + hms[1]*60 + hms[2]
+		if fsp == 0 {
+			if sign == "-" {
+				return -seconds
+			}
+			return seconds
+		}
+		return fmt.Sprintf("%s%d%s", sign, seconds, frac)
+	case TimeColumnFormatISO8601:
+		return fmt.Sprintf("%sPT%dH%dM%d%sS", sign, hms[0], hms[1], hms[2], frac)
+	default:
+		return fmt.Sprintf("%s%02d:%02d:%02d%s", sign, hms[0], hms[1], hms[2], frac)
+	}
+}
+
+// unsignedValue converts the signed integer decoded from binlog for the
+// unsigned column to its unsigned value.
+func unsignedValue(col *schema.TableColumn, value interface{}) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return uint8(v)
+	case int16:
+		return uint16(v)
+	case int32:
+		if col.Type == schema.TYPE_MEDIUM_INT || strings.HasPrefix(col.RawType, "mediumint") {
+			// MEDIUMINT is 24 bits, sign extended to int32
+			return uint32(v) & 0xFFFFFF
+		}
+		return uint32(v)
+	case int64:
+		return uint64(v)
+	case int:
+		if v < 0 {
+			return uint64(v)
+		}
+	}
+	return value
+}
+
+// decimalValue returns the DECIMAL value as an exact decimal string.
+func decimalValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case fmt.Stringer:
+		// decimal.Decimal from binlog with UseDecimal
+		return v.String()
+	case []byte:
+		return string(v)
+	case float64:
+		// already rounded, but at least never in exponent form
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return value
+}
+
+// unmarshalJSON decodes numbers as json.Number, so they keep their precision.
+func unmarshalJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// isInvalidEnumSet returns whether the binlog ENUM index or SET bitmask is out
+// of the column values, as MySQL stores invalid values in non-strict sql_mode.
+func isInvalidEnumSet(col *schema.TableColumn, value interface{}) bool {
+	v, ok := value.(int64)
+	if !ok {
+		// dump values are strings
+		return false
+	}
+
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		return v < 1 || v > int64(len(col.EnumValues))
+	case schema.TYPE_SET:
+		return len(col.SetValues) < 64 && uint64(v)>>uint(len(col.SetValues)) != 0
+	}
+	return false
+}
+
+// isInvalidDate returns true for a zero or invalid DATE, DATETIME or
+// TIMESTAMP value, like 0000-00-00 or 2020-02-30 00:00:00.
+func isInvalidDate(col *schema.TableColumn, value interface{}) bool {
+	layout := mysql.TimeFormat
+	switch col.Type {
+	case schema.TYPE_DATE:
+		layout = "2006-01-02"
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+	default:
+		return false
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return false
+	}
+	_, err := time.Parse(layout, s)
+	return err != nil
+}
+
+// invalidDateValue returns the zero or invalid date value by the rule
+// invalid_date_policy, NULL is written as an empty string.
+func invalidDateValue(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	switch rule.InvalidDatePolicy {
+	case InvalidDatePolicyNull, InvalidDatePolicyEmpty:
+		return ""
+	case InvalidDatePolicyEpoch:
+		if col.Type == schema.TYPE_DATE {
+			return "1970-01-01"
+		}
+		return formatTimeValue(rule, time.Unix(0, 0).In(rule.location), columnFsp(col))
+	}
+	return value
+}
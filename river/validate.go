@@ -0,0 +1,353 @@
+package river
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigErrors are all the problems found in a config.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the config without connecting to MySQL or Redis,
+// it returns ConfigErrors with all the problems found.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate checks the config, the unknown keys are only logged if not strict.
+func (c *Config) validate(strict bool) error {
+	var errs ConfigErrors
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, errors.Errorf(format, args...))
+	}
+
+	for _, key := range c.undecoded {
+		if strict {
+			add("unknown config key %s", key)
+		} else {
+			log.Warnf("ignore unknown config key %s", key)
+		}
+	}
+
+	if len(c.MyAddr) == 0 {
+		add("my_addr must be set")
+	}
+	if len(c.RedisAddr) == 0 && len(c.RedisSentinelMaster) == 0 {
+		add("redis_addr or redis_sentinel_master must be set")
+	}
+	if len(c.RedisSentinelMaster) > 0 && len(c.RedisSentinelAddrs) == 0 {
+		add("redis_sentinel_addrs must be set for redis_sentinel_master")
+	}
+	for _, s := range []secretSource{
+		{name: "my_password", file: c.MyPasswordFile, env: c.MyPasswordEnv, vault: c.MyPasswordVault},
+		{name: "redis_password", file: c.RedisPasswordFile, env: c.RedisPasswordEnv, vault: c.RedisPasswordVault},
+		c.statTokenSource(),
+	} {
+		if err := s.check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if (len(c.StatTLSCert) > 0) != (len(c.StatTLSKey) > 0) {
+		add("stat_tls_cert and stat_tls_key must be set together")
+	}
+	if len(c.StatTLSClientCA) > 0 && len(c.StatTLSCert) == 0 {
+		add("stat_tls_cert must be set for stat_tls_client_ca")
+	}
+	if min, max := c.serverIDRange(); min > max {
+		add("server_id_min %d must not be greater than server_id_max %d", min, max)
+	}
+	// the selected server_id changes on restart, and so would the key
+	if c.ReplayGuard && c.ServerID == 0 && len(c.ReplayGuardKey) == 0 {
+		add("replay_guard_key must be set for replay_guard without server_id")
+	}
+	switch c.Flavor {
+	case "", "mysql", "mariadb":
+	default:
+		add("invalid flavor %s, must be mysql or mariadb", c.Flavor)
+	}
+	switch c.CheckMaster {
+	case "", CheckMasterOff, CheckMasterWarn, CheckMasterError:
+	default:
+		add("invalid check_master %s, must be off, warn or error", c.CheckMaster)
+	}
+	switch c.CheckRedisACL {
+	case "", CheckRedisACLOff, CheckRedisACLWarn, CheckRedisACLError:
+	default:
+		add("invalid check_redis_acl %s, must be off, warn or error", c.CheckRedisACL)
+	}
+	if c.PoisonThreshold > 0 && len(c.DeadLetterFile) == 0 && len(c.DeadLetterKey) == 0 {
+		add("dead_letter_file or dead_letter_key must be set for poison_threshold")
+	}
+	switch c.RedisOOMPolicy {
+	case "", RedisOOMPolicyFail, RedisOOMPolicyPause, RedisOOMPolicyDrop:
+	case RedisOOMPolicyTTL:
+		if c.RedisOOMTTL.Duration <= 0 {
+			add("redis_oom_ttl must be set for redis_oom_policy ttl")
+		}
+	default:
+		add("invalid redis_oom_policy %s, must be fail, pause, drop or ttl", c.RedisOOMPolicy)
+	}
+	switch strings.ToUpper(c.DumpSSLMode) {
+	case "", DumpSSLModeDisabled, DumpSSLModePreferred, DumpSSLModeRequired:
+	case DumpSSLModeVerifyCA, DumpSSLModeVerifyIdentity:
+		if len(c.DumpSSLCA) == 0 {
+			add("dump_ssl_ca must be set for dump_ssl_mode %s", c.DumpSSLMode)
+		}
+	default:
+		add("invalid dump_ssl_mode %s, must be DISABLED, PREFERRED, REQUIRED, VERIFY_CA or VERIFY_IDENTITY", c.DumpSSLMode)
+	}
+	if len(c.DumpSSHAddr) > 0 && (len(c.DumpSSHUser) == 0 || len(c.DumpSSHKeyFile) == 0) {
+		add("dump_ssh_user and dump_ssh_key_file must be set for dump_ssh_addr")
+	}
+	// mysqldump connects the tunnel on 127.0.0.1, not the host of the
+	// certificate, and MariaDB has no verification of the CA only
+	if mode := strings.ToUpper(c.DumpSSLMode); len(c.DumpSSHAddr) > 0 && (mode == DumpSSLModeVerifyIdentity || mode == DumpSSLModeVerifyCA && c.Flavor == "mariadb") {
+		add("dump_ssl_mode %s can not verify the host through dump_ssh_addr, use VERIFY_CA with MySQL", c.DumpSSLMode)
+	}
+	switch c.BinlogPurgedPolicy {
+	case "", BinlogPurgedPolicyFail:
+	case BinlogPurgedPolicyRedump:
+		if len(c.DumpExec) == 0 {
+			add("mysqldump must be set for binlog_purged_policy redump")
+		}
+	default:
+		add("invalid binlog_purged_policy %s, must be fail or redump", c.BinlogPurgedPolicy)
+	}
+	switch c.DeadLetterType {
+	case "", DeadLetterTypeList, DeadLetterTypeStream:
+	default:
+		add("invalid dead_letter_type %s, must be list or stream", c.DeadLetterType)
+	}
+	if len(c.ProbeTable) > 0 && strings.Count(c.ProbeTable, ".") != 1 {
+		add("invalid probe_table %s, must be schema.table", c.ProbeTable)
+	}
+	switch c.RuleOverlap {
+	case "", RuleOverlapPriority, RuleOverlapAll:
+	default:
+		add("invalid rule_overlap %s", c.RuleOverlap)
+	}
+
+	sources := make(map[string]bool)
+	// the wildcard source tables by schema, matched like RLIKE by parseSource
+	wildSources := make(map[string][]*regexp.Regexp)
+	for _, s := range c.Sources {
+		if len(s.Schema) == 0 {
+			add("empty schema not allowed for source")
+		}
+		if !isValidTables(s.Tables) {
+			add("source %s: wildcard * is not allowed for multiple tables", s.Schema)
+		}
+		for _, table := range s.Tables {
+			sources[ruleKey(s.Schema, table)] = true
+			if regexp.QuoteMeta(table) == table {
+				continue
+			}
+			re, err := regexp.Compile(buildTable(table))
+			if err != nil {
+				add("source %s: invalid table regexp %s: %v", s.Schema, table, err)
+				continue
+			}
+			schema := strings.ToLower(s.Schema)
+			wildSources[schema] = append(wildSources[schema], re)
+		}
+	}
+	// sourced returns true if a source defines the rule table, a wildcard
+	// rule needs the same wildcard source table
+	sourced := func(rule *Rule) bool {
+		if sources[ruleKey(rule.Schema, rule.Table)] {
+			return true
+		}
+		if regexp.QuoteMeta(rule.Table) != rule.Table {
+			return false
+		}
+		for _, re := range wildSources[strings.ToLower(rule.Schema)] {
+			if re.MatchString(rule.Table) {
+				return true
+			}
+		}
+		return false
+	}
+
+	prefixes := make(map[string]string)
+	for _, rule := range c.Rules {
+		name := rule.Schema + "." + rule.Table
+		if len(rule.Schema) == 0 {
+			add("empty schema not allowed for rule %s", name)
+		}
+		if !sourced(rule) {
+			add("rule %s: no source defines the table", name)
+		}
+
+		wildcard := regexp.QuoteMeta(rule.Table) != rule.Table
+		if wildcard && len(rule.KeyPrefix) > 0 && !strings.Contains(rule.KeyPrefix, "{table}") && !strings.Contains(rule.KeyPrefix, "{1}") {
+			add("rule %s: key_prefix %s is shared by all the wildcard tables, use {table} or {1}", name, rule.KeyPrefix)
+		}
+		if !wildcard && len(rule.KeyPrefix) > 0 {
+			prefix := rule.replaceKey(rule.KeyPrefix)
+			if other, ok := prefixes[prefix]; ok {
+				add("rule %s: key_prefix %s conflicts with rule %s", name, prefix, other)
+			}
+			prefixes[prefix] = name
+		}
+
+		if err := rule.encryptKeySource().check(); err != nil {
+			add("rule %s: %v", name, err)
+		}
+
+		// check the rule options on a copy, the rule is prepared by the river
+		r := rule.clone()
+		if err := r.prepare(c); err != nil {
+			errs = append(errs, err)
+		}
+		if r.script != nil {
+			r.script.Close()
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// How the MySQL settings are checked on startup.
+const (
+	CheckMasterOff   = "off"
+	CheckMasterWarn  = "warn"
+	CheckMasterError = "error"
+)
+
+// CheckMaster checks the MySQL settings the river requires, the binlog
+// in ROW format with the FULL row image, a server_id not used by MySQL or
+// its other replicas, my_charset and flavor supported by the server,
+// it returns ConfigErrors with all the problems found. If flavor is not
+// set, it is set to the flavor of the server. It returns the error of
+// ctx if ctx is done first.
+func CheckMaster(ctx context.Context, c *Config) error {
+	type result struct {
+		flavor string
+		err    error
+	}
+
+	// the client can not be cancelled, so the check works on a copy
+	ch := make(chan result, 1)
+	cc := *c
+	go func() {
+		flavor, err := queryMaster(&cc)
+		ch <- result{flavor, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if len(c.Flavor) == 0 {
+			c.Flavor = res.flavor
+		}
+		return res.err
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// queryMaster checks the MySQL settings, it returns the flavor of the server.
+func queryMaster(c *Config) (string, error) {
+	conn, err := client.Connect(c.MyAddr, c.MyUser, c.MyPassword, "")
+	if err != nil {
+		return "", errors.Annotatef(wrapError(err, ErrMySQLUnavailable), "connect MySQL %s", c.MyAddr)
+	}
+	defer conn.Close()
+
+	var errs ConfigErrors
+	for name, expect := range map[string]string{"binlog_format": "ROW", "binlog_row_image": "FULL"} {
+		res, err := conn.Execute("SHOW GLOBAL VARIABLES LIKE ?", name)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		if res.Resultset.RowNumber() == 0 {
+			// old servers without binlog_row_image always log full rows
+			if name == "binlog_row_image" {
+				continue
+			}
+			errs = append(errs, errors.Errorf("MySQL %s is not set, must be %s", name, expect))
+			continue
+		}
+
+		value, _ := res.Resultset.GetString(0, 1)
+		if !strings.EqualFold(value, expect) {
+			errs = append(errs, errors.Errorf("MySQL %s is %q, must be %s, like SET GLOBAL %s = '%s'", name, value, expect, name, expect))
+		}
+	}
+
+	res, err := conn.Execute("SELECT @@server_id, VERSION()")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if id, _ := res.Resultset.GetUint(0, 0); id == uint64(c.ServerID) {
+		errs = append(errs, errors.Errorf("server_id %d is the server_id of MySQL itself, set another one", c.ServerID))
+	}
+
+	flavor := "mysql"
+	if version, _ := res.Resultset.GetString(0, 1); strings.Contains(strings.ToLower(version), "mariadb") {
+		flavor = "mariadb"
+	}
+	if len(c.Flavor) > 0 && c.Flavor != flavor {
+		errs = append(errs, errors.Errorf("flavor is %s, but MySQL is %s", c.Flavor, flavor))
+	}
+
+	// SHOW SLAVE HOSTS requires REPLICATION SLAVE, which the river has already
+	if res, err = conn.Execute("SHOW SLAVE HOSTS"); err == nil {
+		for i := 0; i < res.Resultset.RowNumber(); i++ {
+			if id, _ := res.Resultset.GetUint(i, 0); id == uint64(c.ServerID) {
+				host, _ := res.Resultset.GetString(i, 1)
+				errs = append(errs, errors.Errorf("server_id %d is used by the replica %s, two replicas with one server_id disconnect each other", c.ServerID, host))
+			}
+		}
+	}
+
+	if len(c.MyCharset) > 0 {
+		if res, err = conn.Execute("SHOW CHARACTER SET LIKE ?", c.MyCharset); err != nil {
+			return "", errors.Trace(err)
+		}
+		if res.Resultset.RowNumber() == 0 {
+			errs = append(errs, errors.Errorf("my_charset %s is not supported by MySQL, see SHOW CHARACTER SET", c.MyCharset))
+		}
+	}
+
+	if len(errs) == 0 {
+		return flavor, nil
+	}
+	return flavor, errs
+}
+
+// checkMaster checks the MySQL settings on startup by check_master, it
+// only logs the problems for warn.
+func (c *Config) checkMaster(ctx context.Context) error {
+	switch c.CheckMaster {
+	case "", CheckMasterOff:
+		return nil
+	case CheckMasterWarn:
+		err := CheckMaster(ctx, c)
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, err := range errs {
+				log.Warnf("check MySQL: %v", err)
+			}
+			return nil
+		}
+		return errors.Trace(err)
+	default:
+		return errors.Trace(CheckMaster(ctx, c))
+	}
+}
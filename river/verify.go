@@ -0,0 +1,168 @@
+package river
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// verifyInterval is the interval verify_sample keys are verified at.
+const verifyInterval = time.Minute
+
+// verifyRecentFactor is the number of recently synced keys kept for each
+// key of verify_sample to sample them from.
+const verifyRecentFactor = 10
+
+// verifyKey is a key synced for a row with the primary key values.
+type verifyKey struct {
+	rule *Rule
+	key  string
+	pks  []interface{}
+}
+
+// verifyRing keeps the last keys synced since the last sample.
+type verifyRing struct {
+	sync.Mutex
+
+	keys []verifyKey
+	next int
+	full bool
+}
+
+func newVerifyRing(size int) *verifyRing {
+	return &verifyRing{keys: make([]verifyKey, size)}
+}
+
+// Add adds the key, overwriting the oldest one if the ring is full.
+func (v *verifyRing) Add(k verifyKey) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.keys[v.next] = k
+	v.next = (v.next + 1) % len(v.keys)
+	if v.next == 0 {
+		v.full = true
+	}
+}
+
+// Sample returns n random keys of the ring and empties it.
+func (v *verifyRing) Sample(n int) []verifyKey {
+	v.Lock()
+	defer v.Unlock()
+
+	size := v.next
+	if v.full {
+		size = len(v.keys)
+	}
+	if n > size {
+		n = size
+	}
+
+	keys := make([]verifyKey, 0, n)
+	for _, i := range rand.Perm(size)[:n] {
+		keys = append(keys, v.keys[i])
+	}
+
+	v.next, v.full = 0, false
+	for i := range v.keys {
+		v.keys[i] = verifyKey{}
+	}
+	return keys
+}
+
+// recordVerify keeps the key synced for the row to be sampled by
+// verifyLoop, row is the deleted row for delete.
+func (r *River) recordVerify(rule *Rule, key string, row []interface{}) {
+	if r.verifyKeys == nil || len(r.checkSkipReason(rule)) > 0 {
+		return
+	}
+
+	pks, err := rule.TableInfo.GetPKValues(row)
+	if err != nil {
+		return
+	}
+	r.verifyKeys.Add(verifyKey{rule: rule, key: key, pks: pks})
+}
+
+// verifyLoop compares verify_sample keys synced in the last minute with
+// their rows read again from MySQL every minute, and counts the keys
+// diverged in the statistics, with its own MySQL and Redis connections.
+func (r *River) verifyLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		keys := r.verifyKeys.Sample(r.c.VerifySample)
+		if len(keys) == 0 {
+			continue
+		}
+
+		addr, err := r.resolveRedisMaster()
+		if err != nil {
+			continue
+		}
+		my, err := r.dialMySQL()
+		if err != nil {
+			log.Warnf("verify err %v", err)
+			continue
+		}
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+		if err != nil {
+			my.Close()
+			continue
+		}
+
+		for _, k := range keys {
+			m, err := r.verifyKey(my, conn, k)
+			if err != nil {
+				log.Warnf("verify %s err %v", k.key, err)
+				break
+			}
+
+			r.st.VerifiedNum.Add(1)
+			r.st.Rule(k.rule).VerifiedNum.Add(1)
+			if m != nil {
+				r.st.DivergedNum.Add(1)
+				r.st.Rule(k.rule).DivergedNum.Add(1)
+				r.st.statsd.Count("diverged", 1, "schema:"+k.rule.Schema, "table:"+k.rule.Table, "kind:"+m.Kind)
+				log.WithField("key", k.key).Warnf("key diverged from MySQL: %s", m)
+			}
+		}
+		conn.Close()
+		my.Close()
+	}
+}
+
+// verifyKey compares the key with its row read again from MySQL, and once
+// more after checkRecheckDelay on a mismatch, as the row may have changed
+// but not been synced yet. It returns the mismatch, nil if none.
+func (r *River) verifyKey(my mysqlExecutor, conn redis.Conn, k verifyKey) (*Mismatch, error) {
+	for i := 0; ; i++ {
+		row, err := selectRow(my, k.rule, k.pks)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		m, err := r.compareKey(readOnlyRedis(conn.Do), k.rule, k.key, row)
+		if err != nil || m == nil || i > 0 {
+			return m, errors.Trace(err)
+		}
+
+		select {
+		case <-time.After(checkRecheckDelay):
+		case <-r.ctx.Done():
+			return nil, errors.Trace(r.ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package river
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// binlogVersion returns the version of the binlog position, the number of
+// the binlog file in the high 32 bits and the position in the low ones, so
+// it increases along the binlog of the server until RESET MASTER.
+func binlogVersion(pos mysql.Position) int64 {
+	var n int64
+	if i := strings.LastIndex(pos.Name, "."); i >= 0 {
+		n, _ = strconv.ParseInt(pos.Name[i+1:], 10, 64)
+	}
+	return n<<32 | int64(pos.Pos)
+}
+
+// eventVersion returns the version of the rows event by its binlog position,
+// or the position the dump was taken at for the rows of mysqldump.
+func (r *River) eventVersion(e *canal.RowsEvent) int64 {
+	if pos, ok := r.eventPosition(e); ok {
+		return binlogVersion(pos)
+	}
+	return binlogVersion(r.syncedPosition())
+}
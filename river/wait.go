@@ -0,0 +1,78 @@
+package river
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxStartupBackoff = 30 * time.Second
+
+// waitDependencies waits up to startup_wait for MySQL and Redis to be
+// reachable, as they may start after the river.
+func (r *River) waitDependencies() error {
+	max := r.c.StartupWait.Duration
+	if max <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(max)
+
+	err := r.waitFor("MySQL", deadline, func() error {
+		conn, err := client.Connect(r.c.MyAddr, r.c.MyUser, r.mysqlPassword(), "")
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	if err != nil {
+		return errors.Trace(wrapError(err, ErrMySQLUnavailable))
+	}
+
+	err = r.waitFor("Redis", deadline, func() error {
+		addr, err := r.resolveRedis()
+		if err != nil {
+			return err
+		}
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(r.redisPassword()))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// a Redis loading the dataset replies an error
+		_, err = conn.Do("PING")
+		return err
+	})
+	return errors.Trace(wrapError(err, ErrRedisUnavailable))
+}
+
+// waitFor calls check with exponential backoff until it succeeds, or
+// returns its error if the next try would be after the deadline.
+func (r *River) waitFor(name string, deadline time.Time, check func() error) error {
+	backoff := time.Second
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return errors.Annotatef(err, "%s is still unreachable after startup_wait %s", name, r.c.StartupWait.Duration)
+		}
+
+		log.Warnf("%s is unreachable err %v, wait %s", name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return errors.Trace(r.ctx.Err())
+		}
+
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
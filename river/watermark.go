@@ -0,0 +1,95 @@
+package river
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// The replay guard keeps the binlog position of the last applied rows event
+// in Redis. The position in master.info is saved at most every few seconds,
+// so after a crash the rows events up to the watermark are replayed, and
+// applying them again may resurrect deleted keys.
+
+// loadWatermark reads the applied watermark from Redis.
+func (r *River) loadWatermark() error {
+	if !r.c.ReplayGuard {
+		return nil
+	}
+
+	if len(r.c.ReplayGuardKey) == 0 {
+		r.c.ReplayGuardKey = fmt.Sprintf("river:watermark:%d", r.c.ServerID)
+	}
+
+	v, err := redis.StringMap(r.doRedis("HGETALL", r.c.ReplayGuardKey))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(v["name"]) == 0 {
+		return nil
+	}
+
+	pos, err := strconv.ParseUint(v["pos"], 10, 32)
+	if err != nil {
+		return errors.Annotatef(err, "invalid watermark %v in %s", v, r.c.ReplayGuardKey)
+	}
+
+	r.watermark = mysql.Position{Name: v["name"], Pos: uint32(pos)}
+	log.Infof("replay guard skips rows events at or before %s", r.watermark)
+	return nil
+}
+
+// eventPosition returns the binlog position of the rows event,
+// rows from mysqldump have no position.
+func (r *River) eventPosition(e *canal.RowsEvent) (mysql.Position, bool) {
+	if e.Header == nil {
+		return mysql.Position{}, false
+	}
+
+	return mysql.Position{
+		Name: r.syncedPosition().Name,
+		Pos:  e.Header.LogPos,
+	}, true
+}
+
+// isReplayed returns whether the rows event was applied before the restart.
+func (r *River) isReplayed(e *canal.RowsEvent) bool {
+	if len(r.watermark.Name) == 0 {
+		return false
+	}
+
+	pos, ok := r.eventPosition(e)
+	if !ok {
+		return false
+	}
+
+	if pos.Compare(r.watermark) <= 0 {
+		return true
+	}
+
+	// passed the watermark, no more replayed events
+	log.Infof("replay guard passed watermark %s", r.watermark)
+	r.watermark = mysql.Position{}
+	return false
+}
+
+// saveWatermark saves the position of the applied rows event to Redis.
+func (r *River) saveWatermark(e *canal.RowsEvent) error {
+	if !r.c.ReplayGuard {
+		return nil
+	}
+
+	pos, ok := r.eventPosition(e)
+	if !ok {
+		return nil
+	}
+
+	_, err := r.doRedis("HMSET", r.c.ReplayGuardKey, "name", pos.Name, "pos", pos.Pos)
+	return errors.Trace(err)
+}